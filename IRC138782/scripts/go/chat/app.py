@@ -0,0 +1,634 @@
+# Stub chat server (FastAPI), served by setup_local_chat_openshift.go.
+#
+# This file is a Go text/template: the deployer renders it (see
+# renderApp) into the <name>-app ConfigMap, which pods mount at /app.
+# Runtime settings come from the environment (the <name>-config
+# ConfigMap), but for the system prompt: that's a file from the same
+# ConfigMap (SYSTEM_PROMPT_FILE), re-read when it changes, so editing it
+# needs no new pods. (The kubelet takes a minute or two to update the
+# file; POST /admin/reload then re-reads it at once.)
+#
+# With BACKEND_URL set, /chat is a thin gateway to an OpenAI-compatible
+# server (llama.cpp, vLLM, ...); without it, it echoes the prompt.
+# BACKENDS (JSON, {"model": "url"}) adds more: a request's "model" picks
+# one (by default MODEL_NAME, at BACKEND_URL), and GET /models lists them.
+# /healthz says the app runs; /readyz, also that the backend answers.
+#
+# Prompts over MAX_PROMPT_CHARS get 413. A backend that doesn't answer
+# within BACKEND_TIMEOUT seconds, and a /chat answer not ready within
+# REQUEST_TIMEOUT (the router's timeout), get 504 from the app, with the
+# reason, rather than the router's bare one.
+#
+# With BLOCKLIST (regexes, one a line) or MODERATION_URL (an OpenAI-style
+# moderations endpoint) set, prompts and answers are checked: what fails
+# is answered with REFUSAL and a "refusal" object saying why.
+#
+# With HSTS_MAX_AGE set (--hsts-max-age, with --tls=edge), HTTPS answers
+# tell browsers to use only HTTPS for this host for that many seconds.
+#
+# With REDIS_URL set (--enable-sessions), a request's session_id keys a
+# Redis list of the conversation so far, sent along with each prompt.
+#
+# Each client gets RATE_LIMIT_RPM requests a minute (in bursts of up to
+# RATE_LIMIT_BURST); more get 429 with Retry-After.
+#
+# With API_KEY set (from the <name>-api-key Secret, unless deployed with
+# --no-auth), /chat and /chat/stream want it in an X-API-Key header.
+#
+# /ws is /chat/stream over a WebSocket, for any number of prompts.
+#
+# With QDRANT_URL set (--with-rag), the RAG_TOP_K chunks of RAG_COLLECTION
+# closest to the prompt go to the model along with the system prompt (see
+# rag.py, next to this file).
+#
+# With TRANSCRIPTS_DIR set (--transcripts, a PVC), every prompt and its
+# answer (or error) is appended there as a JSON line, one file per pod and
+# day; the transcripts command reads them back.
+from fastapi import Depends, FastAPI, Header, HTTPException, Request, WebSocket, WebSocketDisconnect
+from fastapi.responses import JSONResponse, StreamingResponse
+from pydantic import BaseModel
+from rag import QDRANT_URL, retrieve
+from starlette.concurrency import run_in_threadpool
+from datetime import datetime, timezone
+from typing import Optional
+import hmac
+import asyncio
+import json
+import math
+import os
+import re
+import socket
+import threading
+import time
+import urllib.error
+import urllib.request
+
+app = FastAPI()
+
+# The router gives up after REQUEST_TIMEOUT seconds; /chat answers 504
+# itself a little before. BACKEND_TIMEOUT is shorter still, so a slow
+# backend is named in the error.
+REQUEST_TIMEOUT = float(os.environ.get("REQUEST_TIMEOUT") or 120)
+REQUEST_DEADLINE = REQUEST_TIMEOUT - min(5, REQUEST_TIMEOUT / 10)
+BACKEND_TIMEOUT = float(os.environ.get("BACKEND_TIMEOUT") or 110)
+# 0 = any length. Bodies are turned away unread past what could hold such
+# a prompt (JSON escapes a character in up to 6 bytes).
+MAX_PROMPT_CHARS = int(os.environ.get("MAX_PROMPT_CHARS") or 0)
+MAX_BODY_BYTES = 6 * MAX_PROMPT_CHARS + 4096 if MAX_PROMPT_CHARS else 0
+# Under the readiness probe's 5s timeout.
+READY_TIMEOUT = 3
+
+# Sessions keep the last SESSION_TURNS exchanges, for SESSION_TTL seconds
+# after the last one.
+SESSION_TURNS = int(os.environ.get("SESSION_TURNS") or 10)
+SESSION_TTL = int(os.environ.get("SESSION_TTL") or 86400)
+SESSION_ID = re.compile(r"^[A-Za-z0-9_.-]{1,128}$")
+
+API_KEY = os.environ.get("API_KEY", "").strip()
+
+# Moderation. Streamed answers are checked as they come, every
+# MODERATION_STRIDE characters with the service (every piece with just the
+# blocklist): pieces wait until the text they end has passed. If the
+# service can't be asked, requests fail (503) rather than go unchecked.
+MODERATION_URL = os.environ.get("MODERATION_URL", "")
+MODERATION_TIMEOUT = 10
+MODERATION_STRIDE = 200
+# (line number, pattern); blank lines and # comments skipped.
+BLOCKLIST = [(n, re.compile(line.strip(), re.IGNORECASE))
+             for n, line in enumerate((os.environ.get("BLOCKLIST") or "").splitlines(), 1)
+             if line.strip() and not line.lstrip().startswith("#")]
+REFUSAL = "Sorry, I can't help with that."
+
+# Without the file (an older deployment), SYSTEM_PROMPT from the environment.
+SYSTEM_PROMPT_FILE = os.environ.get("SYSTEM_PROMPT_FILE", "")
+_system = {"mtime": None, "text": os.environ.get("SYSTEM_PROMPT", "")}
+
+# 0 turns rate limiting off. Limits are per pod.
+RATE_LIMIT_RPM = float(os.environ.get("RATE_LIMIT_RPM") or 0)
+RATE_LIMIT_BURST = int(os.environ.get("RATE_LIMIT_BURST") or 1)
+
+HSTS_MAX_AGE = int(os.environ.get("HSTS_MAX_AGE") or 0)
+
+TRANSCRIPTS_DIR = os.environ.get("TRANSCRIPTS_DIR", "")
+
+# model -> backend URL ("" = echo). MODEL_NAME is the default.
+BACKENDS = {k: v.rstrip("/") for k, v in json.loads(os.environ.get("BACKENDS") or "{}").items()}
+BACKENDS.setdefault(os.environ.get("MODEL_NAME", "unknown-model"), os.environ.get("BACKEND_URL", ""))
+
+class ChatReq(BaseModel):
+    prompt: str
+    session_id: Optional[str] = None
+    model: Optional[str] = None
+
+# client -> (tokens, when counted): a token bucket per client.
+_buckets = {}
+
+def take_token(client, now):
+    """Spends one of client's tokens. Returns 0, or (with none left) the
+    seconds until there is one again."""
+    rate = RATE_LIMIT_RPM / 60
+    if len(_buckets) > 10000:
+        # Forget clients whose buckets have refilled anyway.
+        for c, (tokens, last) in list(_buckets.items()):
+            if tokens + (now - last) * rate >= RATE_LIMIT_BURST:
+                del _buckets[c]
+    tokens, last = _buckets.get(client, (RATE_LIMIT_BURST, now))
+    tokens = min(RATE_LIMIT_BURST, tokens + (now - last) * rate)
+    if tokens < 1:
+        _buckets[client] = (tokens, now)
+        return (1 - tokens) / rate
+    _buckets[client] = (tokens - 1, now)
+    return 0
+
+def client_address(conn):
+    """Who sent a request (or opened a WebSocket), for rate limiting."""
+    # The router appends the address it saw to X-Forwarded-For; earlier
+    # entries come from the client and can be made up.
+    client = conn.headers.get("x-forwarded-for", "").split(",")[-1].strip()
+    if not client and conn.client:
+        client = conn.client.host
+    return client
+
+@app.middleware("http")
+async def limit_body(request: Request, call_next):
+    if MAX_BODY_BYTES and int(request.headers.get("content-length") or 0) > MAX_BODY_BYTES:
+        return JSONResponse({"detail": f"request body over {MAX_BODY_BYTES} bytes "
+                                       f"(prompts may have {MAX_PROMPT_CHARS} characters)"}, status_code=413)
+    return await call_next(request)
+
+@app.middleware("http")
+async def rate_limit(request: Request, call_next):
+    if RATE_LIMIT_RPM <= 0 or request.url.path in ("/healthz", "/readyz"):
+        return await call_next(request)
+    wait = take_token(client_address(request), time.monotonic())
+    if wait:
+        return JSONResponse({"detail": f"rate limit: {RATE_LIMIT_RPM:g} requests a minute"},
+                            status_code=429, headers={"Retry-After": str(math.ceil(wait))})
+    return await call_next(request)
+
+# Added after rate_limit, so it wraps it: 429s get the header too.
+@app.middleware("http")
+async def hsts(request: Request, call_next):
+    response = await call_next(request)
+    # The router terminates TLS and says so in X-Forwarded-Proto; browsers
+    # ignore the header over plain HTTP anyway.
+    if HSTS_MAX_AGE > 0 and request.headers.get("x-forwarded-proto") == "https":
+        response.headers["Strict-Transport-Security"] = f"max-age={HSTS_MAX_AGE}; includeSubDomains"
+    return response
+
+def require_key(x_api_key: Optional[str] = Header(None)):
+    if API_KEY and not hmac.compare_digest((x_api_key or "").encode(), API_KEY.encode()):
+        raise HTTPException(401, "missing or wrong X-API-Key", headers={"WWW-Authenticate": "ApiKey"})
+
+_transcript_lock = threading.Lock()
+
+def log_transcript(endpoint, req, started, **fields):
+    """Appends req (and what became of it: model and output, or status and
+    error) to this pod's transcript for today. started is when it came in
+    (time.time()). A full or missing volume only costs the record."""
+    if not TRANSCRIPTS_DIR:
+        return
+    when = datetime.fromtimestamp(started, timezone.utc)
+    pod = os.environ.get("HOSTNAME", "app")
+    record = {"ts": when.isoformat(timespec="milliseconds").replace("+00:00", "Z"), "pod": pod,
+              "endpoint": endpoint, "session_id": req.session_id,
+              # The system prompt too, for comparing answers across prompt changes.
+              "system": system_prompt(), "prompt": req.prompt,
+              "ms": round((time.time() - started) * 1000), **fields}
+    path = os.path.join(TRANSCRIPTS_DIR, f"{when:%Y-%m-%d}.{pod}.jsonl")
+    try:
+        with _transcript_lock, open(path, "a", encoding="utf-8") as f:
+            f.write(json.dumps(record, ensure_ascii=False) + "\n")
+    except OSError as e:
+        print(f"transcript {path}: {e}", flush=True)
+
+def system_prompt(force=False):
+    """The system prompt, re-read when its file changes (the kubelet swaps
+    in a new one) or with force. If the file can't be read, the last one
+    stays."""
+    if not SYSTEM_PROMPT_FILE:
+        return _system["text"]
+    try:
+        mtime = os.stat(SYSTEM_PROMPT_FILE).st_mtime_ns
+        if force or mtime != _system["mtime"]:
+            with open(SYSTEM_PROMPT_FILE, encoding="utf-8") as f:
+                text = f.read()
+            if _system["mtime"] is not None and text != _system["text"]:
+                print(f"system prompt reloaded: {text!r}", flush=True)
+            _system.update(mtime=mtime, text=text)
+    except OSError as e:
+        print(f"system prompt {SYSTEM_PROMPT_FILE}: {e}; keeping the last one", flush=True)
+    return _system["text"]
+
+@app.post("/admin/reload", dependencies=[Depends(require_key)])
+def admin_reload():
+    """Re-reads the system prompt now. Which pod answered is in served_by;
+    each has its own copy."""
+    before = _system["text"]
+    text = system_prompt(force=True)
+    return {"system": text, "changed": text != before, "served_by": os.environ.get("HOSTNAME", "")}
+
+class Refused(Exception):
+    """Moderation turned text down; info is the "refusal" object."""
+    def __init__(self, info):
+        super().__init__(info["reason"])
+        self.info = info
+
+def moderate(stage, text):
+    """Raises Refused if text (the "prompt", or the "response" so far)
+    matches the blocklist or the moderation service flags it, and
+    HTTPException(503) if the service can't say."""
+    for n, rx in BLOCKLIST:
+        if rx.search(text):
+            raise Refused({"stage": stage, "source": "blocklist", "rule": n,
+                           "reason": f"matches blocklist rule {n}"})
+    if not MODERATION_URL:
+        return
+    req = urllib.request.Request(MODERATION_URL, json.dumps({"input": text}).encode(),
+                                 {"Content-Type": "application/json"})
+    try:
+        with urllib.request.urlopen(req, timeout=MODERATION_TIMEOUT) as resp:
+            result = json.load(resp)["results"][0]
+    except (OSError, ValueError, KeyError, IndexError, TypeError) as e:
+        raise HTTPException(503, f"moderation: {e}")
+    if result.get("flagged"):
+        categories = sorted(c for c, on in (result.get("categories") or {}).items() if on)
+        raise Refused({"stage": stage, "source": "moderation", "categories": categories,
+                       "reason": "flagged" + (": " + ", ".join(categories) if categories else "")})
+
+def moderated(pieces):
+    """Yields pieces once the answer up to them passes moderate()."""
+    if not (BLOCKLIST or MODERATION_URL):
+        yield from pieces
+        return
+    stride = MODERATION_STRIDE if MODERATION_URL else 1
+    held, text, checked = [], "", 0
+    for piece in pieces:
+        held.append(piece)
+        text += piece
+        if len(text) - checked >= stride:
+            moderate("response", text)
+            checked = len(text)
+            yield from held
+            held = []
+    if held:
+        moderate("response", text)
+        yield from held
+
+@app.get("/healthz")
+def healthz():
+    return {"ok": True}
+
+def check_prompt(prompt):
+    if MAX_PROMPT_CHARS and len(prompt) > MAX_PROMPT_CHARS:
+        raise HTTPException(413, f"prompt has {len(prompt)} characters; at most {MAX_PROMPT_CHARS}")
+
+def backend_error(backend, e):
+    """The HTTPException for a failed backend request: 504 if it timed
+    out (urllib wraps a connect timeout in URLError), else 502."""
+    if isinstance(getattr(e, "reason", e), (socket.timeout, TimeoutError)):
+        return HTTPException(504, f"backend {backend}: no answer within {BACKEND_TIMEOUT:g}s")
+    return HTTPException(502, f"backend {backend}: {e}")
+
+def route(model):
+    """(model, backend URL) for a request's model; None is the default."""
+    model = model or os.environ.get("MODEL_NAME", "unknown-model")
+    if model not in BACKENDS:
+        raise HTTPException(404, f"unknown model {model!r}; GET /models lists them")
+    return model, BACKENDS[model]
+
+def ping_backend(url):
+    """Asks the backend at url for its models, a request that costs it
+    next to nothing. Returns None if it answered, else what went wrong."""
+    headers = {}
+    if os.environ.get("BACKEND_API_KEY"):
+        headers["Authorization"] = "Bearer " + os.environ["BACKEND_API_KEY"]
+    try:
+        with urllib.request.urlopen(urllib.request.Request(url + "/models", headers=headers),
+                                    timeout=READY_TIMEOUT) as resp:
+            json.load(resp)
+    except urllib.error.HTTPError as e:
+        return f"answered {e.code}"
+    except (OSError, ValueError) as e:
+        return str(e)
+    return None
+
+@app.get("/readyz")
+def readyz():
+    """The readiness probe: ready when the default model's backend (if
+    any) answers; 503 otherwise, so the router sends no one to a pod that
+    could only answer 502. (Only the default's: another being down
+    shouldn't take them all away.)"""
+    backend = route(None)[1]
+    if not backend:
+        return {"ok": True, "backend": None}
+    started = time.monotonic()
+    err = ping_backend(backend)
+    if err:
+        return JSONResponse({"ok": False, "backend": err}, status_code=503)
+    return {"ok": True, "backend": "ok", "ms": round((time.monotonic() - started) * 1000)}
+
+@app.get("/models", dependencies=[Depends(require_key)])
+def models():
+    """The models a request may ask for, OpenAI style."""
+    default = route(None)[0]
+    return {"object": "list", "default": default,
+            "data": [{"id": m, "object": "model", "owned_by": "backend" if u else "echo", "default": m == default}
+                     for m, u in sorted(BACKENDS.items())]}
+
+_redis = None
+
+def sessions():
+    """The Redis client, or None when sessions are off. (redis is only
+    imported then, so images without it still serve stateless chat.)"""
+    global _redis
+    if _redis is None and os.environ.get("REDIS_URL"):
+        import redis
+        _redis = redis.Redis.from_url(os.environ["REDIS_URL"],
+                                      password=os.environ.get("REDIS_PASSWORD") or None,
+                                      socket_timeout=5, socket_connect_timeout=5)
+    return _redis
+
+def check_session(session_id):
+    if session_id is None:
+        return
+    if not os.environ.get("REDIS_URL"):
+        raise HTTPException(400, "session_id given, but sessions are off (deploy with --enable-sessions)")
+    if not SESSION_ID.match(session_id):
+        raise HTTPException(400, "session_id must be 1-128 letters, digits, '_', '.' or '-'")
+
+def load_history(session_id):
+    """The session's earlier messages, oldest first."""
+    if session_id is None:
+        return []
+    return [json.loads(m) for m in sessions().lrange("session:" + session_id, 0, -1)]
+
+def save_turn(session_id, prompt, answer):
+    """Appends an exchange and drops the ones beyond SESSION_TURNS."""
+    if session_id is None:
+        return
+    key = "session:" + session_id
+    p = sessions().pipeline()
+    p.rpush(key, json.dumps({"role": "user", "content": prompt}),
+            json.dumps({"role": "assistant", "content": answer}))
+    p.ltrim(key, -2 * SESSION_TURNS, -1)
+    p.expire(key, SESSION_TTL)
+    p.execute()
+
+def rag_context(prompt):
+    try:
+        return retrieve(prompt)
+    except urllib.error.HTTPError as e:
+        raise HTTPException(503, f"vector db answered {e.code}: {e.read().decode(errors='replace')[:300]}")
+    except (OSError, ValueError, KeyError) as e:
+        raise HTTPException(503, f"vector db: {e}")
+
+def with_context(system, chunks):
+    """The system prompt, plus the retrieved chunks (numbered, to cite)."""
+    if not chunks:
+        return system
+    context = "\n\n".join(f"[{i + 1}] ({c['source']})\n{c['text']}" for i, c in enumerate(chunks))
+    return (system + "\n\n" if system else "") + \
+        "Answer from the following context where it helps, citing it as [n].\n\n" + context
+
+def rag_info(chunks):
+    return {"chunks": len(chunks), "sources": list(dict.fromkeys(c["source"] for c in chunks))}
+
+def build_messages(system, history, prompt):
+    messages = [{"role": "system", "content": system}] if system else []
+    return messages + history + [{"role": "user", "content": prompt}]
+
+def backend_request(url, model, messages, stream=False):
+    """Builds the chat completion request for the backend."""
+    headers = {"Content-Type": "application/json"}
+    if os.environ.get("BACKEND_API_KEY"):
+        headers["Authorization"] = "Bearer " + os.environ["BACKEND_API_KEY"]
+    body = json.dumps({"model": model, "messages": messages, "stream": stream}).encode()
+    return urllib.request.Request(url + "/chat/completions", body, headers)
+
+def ask_backend(url, model, messages):
+    """POSTs one chat completion to the backend and returns (model, answer)."""
+    req = backend_request(url, model, messages)
+    with urllib.request.urlopen(req, timeout=BACKEND_TIMEOUT) as resp:
+        out = json.load(resp)
+    return out.get("model", model), out["choices"][0]["message"]["content"]
+
+def stream_backend(url, model, messages):
+    """Yields the answer's pieces as the backend streams them."""
+    req = backend_request(url, model, messages, stream=True)
+    with urllib.request.urlopen(req, timeout=BACKEND_TIMEOUT) as resp:
+        for line in resp:
+            line = line.decode().strip()
+            if not line.startswith("data:"):
+                continue
+            data = line[5:].strip()
+            if data == "[DONE]":
+                return
+            for choice in json.loads(data).get("choices", []):
+                piece = (choice.get("delta") or {}).get("content")
+                if piece:
+                    yield piece
+
+def sse(event):
+    return "data: " + json.dumps(event) + "\n\n"
+
+@app.post("/chat", dependencies=[Depends(require_key)])
+async def chat(req: ChatReq):
+    started = time.time()
+    try:
+        try:
+            out = await asyncio.wait_for(chat_answer(req), REQUEST_DEADLINE)
+        except asyncio.TimeoutError:
+            raise HTTPException(504, f"no answer within {REQUEST_DEADLINE:g}s")
+    except HTTPException as e:
+        log_transcript("/chat", req, started, status=e.status_code, error=e.detail)
+        raise
+    log_transcript("/chat", req, started, status=200, model=out["model"], output=out["output"],
+                   **{k: out[k] for k in ("rag", "refusal") if k in out})
+    return out
+
+async def chat_answer(req):
+    """/chat's answer to req."""
+    check_prompt(req.prompt)
+    model, backend = route(req.model)
+    system = system_prompt()
+    check_session(req.session_id)
+    refusal = None
+    try:
+        await run_in_threadpool(moderate, "prompt", req.prompt)
+    except Refused as r:
+        refusal = r.info
+    history = await run_in_threadpool(session_history, req.session_id)
+    chunks = await run_in_threadpool(rag_context, req.prompt)
+    if refusal:
+        text = REFUSAL
+    elif not backend:
+        text = f"I ({model}) received: {req.prompt.strip()}"
+    else:
+        try:
+            model, text = await run_in_threadpool(
+                ask_backend, backend, model, build_messages(with_context(system, chunks), history, req.prompt))
+        except urllib.error.HTTPError as e:
+            detail = e.read().decode(errors="replace")[:500]
+            raise HTTPException(502, f"backend answered {e.code}: {detail}")
+        except (OSError, ValueError, KeyError, IndexError) as e:
+            raise backend_error(backend, e)
+    if not refusal:
+        try:
+            await run_in_threadpool(moderate, "response", text)
+        except Refused as r:
+            refusal, text = r.info, REFUSAL
+    # served_by (the pod) shows which replica answered.
+    out = {"model": model, "output": text, "system": system, "version": "{{.Version}}",
+           "served_by": os.environ.get("HOSTNAME", "")}
+    if refusal:
+        out["refusal"] = refusal
+    if req.session_id is not None:
+        # A refused exchange isn't kept as context.
+        if not refusal:
+            await run_in_threadpool(session_save, req.session_id, req.prompt, text)
+        out.update(session_id=req.session_id, turns=len(history) // 2)
+    if QDRANT_URL:
+        out["rag"] = rag_info(chunks)
+    return out
+
+def session_history(session_id):
+    try:
+        return load_history(session_id)
+    except Exception as e:  # redis.RedisError, without importing redis here
+        raise HTTPException(503, f"session store: {e}")
+
+def session_save(session_id, prompt, answer):
+    try:
+        save_turn(session_id, prompt, answer)
+    except Exception as e:
+        raise HTTPException(503, f"session store: {e}")
+
+def answer_events(req, history, chunks, endpoint, started):
+    """The answer as events: {"index": i, "delta": ...} per piece, then
+    {"index": n, "done": true} (or "error" if something fails). The last
+    one goes to the transcript, with the answer so far."""
+    answer = []
+    for ev in stream_answer(req, history, chunks, answer):
+        if "done" in ev:
+            log_transcript(endpoint, req, started, status=200, model=ev["model"], output="".join(answer),
+                           **{k: ev[k] for k in ("rag", "refusal") if k in ev})
+        elif "error" in ev:
+            # Mid-stream: the status (200) was sent long ago.
+            log_transcript(endpoint, req, started, error=ev["error"], output="".join(answer),
+                           **({"refusal": ev["refusal"]} if "refusal" in ev else {}))
+        yield ev
+
+def stream_answer(req, history, chunks, answer):
+    """answer_events without the transcript; the pieces also go to answer."""
+    model, backend = route(req.model)
+    system = system_prompt()
+    done = {"done": True, "model": model, "version": "{{.Version}}"}
+    try:
+        moderate("prompt", req.prompt)
+    except Refused as r:
+        answer.append(REFUSAL)
+        yield {"index": 0, "delta": REFUSAL}
+        yield {"index": 1, **done, "refusal": r.info}
+        return
+    except HTTPException as e:
+        yield {"index": 0, "error": e.detail}
+        return
+    i = 0
+    try:
+        if backend:
+            pieces = stream_backend(backend, model, build_messages(with_context(system, chunks), history, req.prompt))
+        else:
+            # Word by word, paced like a model, so clients see streaming.
+            text = f"I ({model}) received: {req.prompt.strip()}"
+            pieces = (w if n == 0 else " " + w for n, w in enumerate(text.split()))
+        for piece in moderated(pieces):
+            yield {"index": i, "delta": piece}
+            answer.append(piece)
+            i += 1
+            if not backend:
+                time.sleep(0.05)
+    except Refused as r:
+        # What was sent had passed; the rest isn't.
+        yield {"index": i, "error": f"answer withheld: {r.info['reason']}", "refusal": r.info}
+        return
+    except HTTPException as e:
+        yield {"index": i, "error": e.detail}
+        return
+    except urllib.error.HTTPError as e:
+        yield {"index": i, "error": f"backend answered {e.code}"}
+        return
+    except (OSError, ValueError) as e:
+        yield {"index": i, "error": backend_error(backend, e).detail}
+        return
+    try:
+        save_turn(req.session_id, req.prompt, "".join(answer))
+    except Exception as e:
+        yield {"index": i, "error": f"session store: {e}"}
+        return
+    done = {"index": i, **done}
+    if QDRANT_URL:
+        done["rag"] = rag_info(chunks)
+    yield done
+
+@app.post("/chat/stream", dependencies=[Depends(require_key)])
+def chat_stream(req: ChatReq):
+    """/chat as server-sent events (see answer_events)."""
+    started = time.time()
+    try:
+        check_prompt(req.prompt)
+        route(req.model)
+        check_session(req.session_id)
+        history = session_history(req.session_id)
+        chunks = rag_context(req.prompt)
+    except HTTPException as e:
+        log_transcript("/chat/stream", req, started, status=e.status_code, error=e.detail)
+        raise
+    events = (sse(ev) for ev in answer_events(req, history, chunks, "/chat/stream", started))
+    # X-Accel-Buffering: proxies that honor it pass each event on at once.
+    return StreamingResponse(events, media_type="text/event-stream",
+                             headers={"Cache-Control": "no-cache", "X-Accel-Buffering": "no"})
+
+@app.websocket("/ws")
+async def chat_ws(ws: WebSocket):
+    """Each {"prompt": ..., "session_id": ...} message sent gets its answer
+    back as /chat/stream's events, one message each. The API key goes in
+    X-API-Key or, as browsers can't set headers here, ?api_key=."""
+    try:
+        require_key(ws.headers.get("x-api-key") or ws.query_params.get("api_key"))
+    except HTTPException:
+        await ws.close(code=1008)  # Policy violation; before accept, a 403
+        return
+    await ws.accept()
+    client = client_address(ws)
+    try:
+        while True:
+            text = await ws.receive_text()
+            # The HTTP middleware doesn't see these; count each prompt.
+            wait = take_token(client, time.monotonic()) if RATE_LIMIT_RPM > 0 else 0
+            if wait:
+                await ws.send_json({"index": 0, "error": f"rate limit: {RATE_LIMIT_RPM:g} requests a minute",
+                                    "retry_after": math.ceil(wait)})
+                continue
+            started = time.time()
+            try:
+                req = ChatReq(**json.loads(text))
+            except (TypeError, ValueError) as e:
+                await ws.send_json({"index": 0, "error": f"want a JSON object with a prompt: {e}"})
+                continue
+            try:
+                check_prompt(req.prompt)
+                route(req.model)
+                check_session(req.session_id)
+                history = await run_in_threadpool(session_history, req.session_id)
+                chunks = await run_in_threadpool(rag_context, req.prompt)
+            except HTTPException as e:
+                log_transcript("/ws", req, started, status=e.status_code, error=e.detail)
+                await ws.send_json({"index": 0, "error": e.detail})
+                continue
+            events = answer_events(req, history, chunks, "/ws", started)
+            # The events block (backend, pacing), so fetch them off the loop.
+            while (ev := await run_in_threadpool(next, events, None)) is not None:
+                await ws.send_json(ev)
+    except WebSocketDisconnect:
+        pass
@@ -0,0 +1,162 @@
+# Retrieval for the stub chat server (--with-rag): embeddings, Qdrant, and
+# chunking documents, shared by app.py and the ingest Job.
+#
+# Standard library only, so the ingest Job runs it with a plain Python
+# image:
+#
+#   python rag.py /docs [--chunk-size N] [--chunk-overlap N]
+#
+# indexes the text files under /docs into RAG_COLLECTION (replacing what
+# was there) and prints a JSON summary as its last line.
+#
+# Settings come from the environment, as for app.py.
+import argparse
+import hashlib
+import json
+import math
+import os
+import re
+import sys
+import urllib.error
+import urllib.request
+import uuid
+
+QDRANT_URL = os.environ.get("QDRANT_URL", "")
+RAG_COLLECTION = os.environ.get("RAG_COLLECTION") or "docs"
+RAG_TOP_K = int(os.environ.get("RAG_TOP_K") or 4)
+# Embeddings come from EMBED_URL (an OpenAI-compatible API) or, without
+# it, from hashing words into HASH_DIM buckets: crude, but needs no model.
+EMBED_URL = os.environ.get("EMBED_URL", "").rstrip("/")
+EMBED_MODEL = os.environ.get("EMBED_MODEL", "")
+EMBED_TIMEOUT = 110
+HASH_DIM = 512
+
+def hash_embed(text):
+    v = [0.0] * HASH_DIM
+    for word in re.findall(r"\w+", text.lower()):
+        h = int.from_bytes(hashlib.blake2b(word.encode(), digest_size=8).digest(), "little")
+        v[h % HASH_DIM] += 1.0 if h >> 63 else -1.0
+    norm = math.sqrt(sum(x * x for x in v)) or 1.0
+    return [x / norm for x in v]
+
+def embed(texts):
+    """One vector per text in texts."""
+    if not EMBED_URL:
+        return [hash_embed(t) for t in texts]
+    headers = {"Content-Type": "application/json"}
+    if os.environ.get("BACKEND_API_KEY"):
+        headers["Authorization"] = "Bearer " + os.environ["BACKEND_API_KEY"]
+    body = json.dumps({"model": EMBED_MODEL, "input": texts}).encode()
+    req = urllib.request.Request(EMBED_URL + "/embeddings", body, headers)
+    with urllib.request.urlopen(req, timeout=EMBED_TIMEOUT) as resp:
+        data = json.load(resp)["data"]
+    return [d["embedding"] for d in sorted(data, key=lambda d: d["index"])]
+
+def qdrant(method, path, body=None):
+    """Calls Qdrant's REST API and returns the reply's "result"."""
+    headers = {"Content-Type": "application/json"}
+    if os.environ.get("QDRANT_API_KEY"):
+        headers["api-key"] = os.environ["QDRANT_API_KEY"]
+    data = json.dumps(body).encode() if body is not None else None
+    req = urllib.request.Request(QDRANT_URL + path, data, headers, method=method)
+    with urllib.request.urlopen(req, timeout=30) as resp:
+        return json.load(resp)["result"]
+
+def retrieve(prompt):
+    """The chunks closest to prompt: [{"source", "text", "score"}]. No
+    collection yet (nothing ingested) just means none."""
+    if not QDRANT_URL:
+        return []
+    try:
+        hits = qdrant("POST", f"/collections/{RAG_COLLECTION}/points/search",
+                      {"vector": embed([prompt])[0], "limit": RAG_TOP_K, "with_payload": True})
+    except urllib.error.HTTPError as e:
+        if e.code == 404:
+            return []
+        raise
+    return [{"source": h["payload"].get("source", "?"), "text": h["payload"].get("text", ""),
+             "score": h["score"]} for h in hits]
+
+def chunk_text(text, size, overlap):
+    """Splits text into pieces of at most size characters, each starting
+    overlap characters before the last one ended. Pieces end at a
+    paragraph, else a sentence, else a word, when one is near the limit."""
+    text = re.sub(r"\n{3,}", "\n\n", text).strip()
+    chunks, start = [], 0
+    while start < len(text):
+        end = min(len(text), start + size)
+        if end < len(text):
+            for sep in ("\n\n", ". ", " "):
+                cut = text.rfind(sep, start + size // 2, end)
+                if cut > 0:
+                    end = cut + len(sep)
+                    break
+        chunks.append(text[start:end].strip())
+        if end >= len(text):
+            break
+        start = max(end - overlap, start + 1)
+    return [c for c in chunks if c]
+
+def index_docs(root, size, overlap, batch=64):
+    """Replaces RAG_COLLECTION with the chunks of the text files under
+    root. Files that aren't UTF-8 text are skipped."""
+    files, skipped, points = 0, [], []
+    for dirpath, dirnames, filenames in os.walk(root):
+        dirnames[:] = sorted(d for d in dirnames if not d.startswith("."))
+        for fn in sorted(filenames):
+            if fn.startswith("."):
+                continue
+            path = os.path.join(dirpath, fn)
+            source = os.path.relpath(path, root)
+            try:
+                with open(path, encoding="utf-8") as f:
+                    text = f.read()
+            except (UnicodeDecodeError, OSError) as e:
+                skipped.append(f"{source}: {e.__class__.__name__}")
+                continue
+            chunks = chunk_text(text, size, overlap)
+            if not chunks:
+                skipped.append(f"{source}: empty")
+                continue
+            files += 1
+            for i, chunk in enumerate(chunks):
+                # Stable IDs: the same chunk of the same file keeps its point.
+                pid = str(uuid.uuid5(uuid.NAMESPACE_URL, f"{source}#{i}"))
+                points.append({"id": pid, "payload": {"source": source, "chunk": i, "text": chunk}})
+            print(f"{source}: {len(chunks)} chunks", flush=True)
+
+    if points:
+        # Embed everything first: if the embedder fails, the old
+        # collection is still there.
+        for n in range(0, len(points), batch):
+            part = points[n:n + batch]
+            for p, v in zip(part, embed([p["payload"]["text"] for p in part])):
+                p["vector"] = v
+            print(f"embedded {n + len(part)}/{len(points)} chunks", flush=True)
+        try:
+            qdrant("DELETE", f"/collections/{RAG_COLLECTION}")
+        except urllib.error.HTTPError as e:
+            if e.code != 404:
+                raise
+        # The embedder decides the size.
+        qdrant("PUT", f"/collections/{RAG_COLLECTION}",
+               {"vectors": {"size": len(points[0]["vector"]), "distance": "Cosine"}})
+        for n in range(0, len(points), batch):
+            qdrant("PUT", f"/collections/{RAG_COLLECTION}/points?wait=true", {"points": points[n:n + batch]})
+    return {"collection": RAG_COLLECTION, "files": files, "chunks": len(points), "skipped": skipped}
+
+if __name__ == "__main__":
+    ap = argparse.ArgumentParser(description="Index text files into Qdrant.")
+    ap.add_argument("root")
+    ap.add_argument("--chunk-size", type=int, default=800)
+    ap.add_argument("--chunk-overlap", type=int, default=100)
+    args = ap.parse_args()
+    if not QDRANT_URL:
+        sys.exit("QDRANT_URL is not set (deploy with --with-rag)")
+    try:
+        summary = index_docs(args.root, args.chunk_size, args.chunk_overlap)
+    except urllib.error.HTTPError as e:
+        sys.exit(f"{e.url}: {e.code} {e.read().decode(errors='replace')[:500]}")
+    except (OSError, ValueError, KeyError) as e:
+        sys.exit(f"index: {e}")
+    print(json.dumps(summary))
@@ -6,21 +6,204 @@
 //
 // (1) Connect to the cluster (via your kubeconfig).
 // (2) Ensure a target Namespace exists.
-// (3) Create/Update a ConfigMap containing model settings.
+// (3) Create/Update a ConfigMap containing model settings, a Secret
+//     holding the endpoint's API key (generated unless --api-key is
+//     given) and, with --hf-token, one holding the Hugging Face token.
 // (4) Create/Update a PersistentVolumeClaim (PVC) to persist
-//     /models across pod restarts (so we don't re-download).
+//     /models across pod restarts (so we don't re-download). With
+//     --model-hostpath=DIR (single-node CRC), a hostPath
+//     PersistentVolume on the node's DIR/<model-name> backs it, so a
+//     model staged there, or downloaded by an earlier deployment in any
+//     namespace, is reused.
 // (5) Create/Update a Deployment that has:
 //     - An initContainer ("fetch-model") that downloads the GGUF
-//       model into /models with curl (robust retries).
+//       model into /models with curl (robust retries, resumable,
+//       renamed into place only once complete), verifying it
+//       against --model-sha256 when given (--downloader=aria2 uses
+//       aria2c, in parallel segments). With --model-oci-ref
+//       it pulls the GGUF from an OCI registry with oras instead;
+//       with --model-from-pvc a Job copies it from an existing PVC
+//       beforehand and the initContainer only checks it.
 //     - The main llama.cpp server container using the official
 //       image. We DO NOT override command; we configure it via
 //       LLAMA_ARG_* environment variables (the image reads these).
+//       It only turns Ready once /health says the model is loaded
+//       (with --inference-probe, once it has generated a token: a model
+//       that loads but fails on inference never gets traffic).
 //     - A pod-level FSGroup so the mounted volume is writable by
 //       OpenShift's random non-root UID under the restricted SCC.
-// (6) Create/Update a ClusterIP Service.
-// (7) Create/Update an Ingress (OpenShift router exposes it).
-// (8) Wait for readiness and then send a real OpenAI-style
-//     /v1/chat/completions request to verify it works.
+//     - The official multi-arch server image, or with --cpu-variant
+//       a variant of it (avx512, avx2, noavx or arm64), since the
+//       official image dies with "illegal instruction" on CPUs
+//       without AVX2. --cpu-variant=auto picks the one the nodes'
+//       CPUs can run (from Node Feature Discovery labels, else a short
+//       Job reading /proc/cpuinfo); --cpu-variant-images maps them to
+//       images.
+//     - All pods pinned to one CPU architecture (kubernetes.io/arch),
+//       amd64 or arm64, that of the nodes unless --arch says otherwise,
+//       with the images' builds for it (CRC on Apple Silicon is arm64).
+//     - With --rpc-workers=N (experimental): N llama.cpp rpc-server pods
+//       (a StatefulSet, spread over the nodes, reachable only from the
+//       server) that the server offloads the model's layers to, so a
+//       model bigger than one node's memory can still be tried out.
+//       Needs an image with RPC support (--rpc-image, or
+//       --build-from-source, which then turns it on).
+//     - With --build-from-source: a llama-server image built in the
+//       cluster (BuildConfig + ImageStream) from --llama-cpp-ref with
+//       --cmake-flags, e.g. without AVX512 or with OpenBLAS, instead of
+//       the official one.
+//     - With --gpu=N: the CUDA server image, N nvidia.com/gpu,
+//       all layers offloaded, and the NVIDIA runtime class/toleration.
+//     - With --draft-model-url: a second initContainer fetching a
+//       small draft GGUF, which the server uses for speculative
+//       decoding.
+//     - With --mmproj-url: an initContainer fetching the multimodal
+//       projector of a LLaVA-style model, so it accepts images; step
+//       (8) then also asks it to describe a small test image.
+//     - With --lora-url (repeatable): one more initContainer per LoRA
+//       adapter, which the server applies on top of the model.
+//     - With --chat-template: one of the server's built-in chat
+//       templates instead of the one in the GGUF's metadata.
+//     - With --server-env NAME=VALUE / --server-arg (repeatable): any
+//       other llama.cpp option (LLAMA_ARG_* or a command-line flag),
+//       so new server features need no new deployer flag.
+//     - With --prompt-cache: the server's slots (the KV cache of the
+//       prompts it processed, long system prompts included) saved to
+//       /models/prompt-cache by a small sidecar every few minutes and
+//       when the pod stops, and restored when it starts again; the
+//       oldest files go beyond --prompt-cache-size.
+//     - With --cache-ttl or --rate-limit-mode=sidecar: a proxy sidecar
+//       answering repeated identical requests from a cache and/or
+//       limiting each client's request rate (counters on /metrics); the
+//       Service sends traffic through it. With --usage-log it also
+//       appends each request's token counts and latency to JSON lines
+//       files on a small PVC (<name>-usage-pvc; ReadWriteMany unless
+//       --model-volume=rwo, as every replica mounts it).
+// (6) Create/Update a ClusterIP Service (also serving /metrics; with
+//     --service-monitor, a ServiceMonitor has Prometheus scrape it, or
+//     with --observability a PodMonitor plus a Grafana dashboard
+//     ConfigMap of token throughput, slot use and per-token latency).
+// (7) Create/Update an Ingress (OpenShift router exposes it), or with
+//     --tls=edge a Route that terminates TLS and redirects plain HTTP.
+// (8) Wait for readiness (streaming the model download's progress)
+//     and then send a real OpenAI-style /v1/chat/completions request
+//     to verify it works (and, with an API key, that the same request
+//     without it gets 401).
+// (9) With --bundle-file and/or --bundle-namespace, hand the endpoint
+//     to its clients: base URL, model name, API key (or, with
+//     --bundle-key-ref, where to find it) and the router's CA with
+//     --tls, as a dotenv or JSON file and/or a Secret in the consuming
+//     app's namespace.
+//
+// With --backend=vllm, step (5) runs the vLLM OpenAI server instead
+// (GPU, Hugging Face cache on the PVC, no init container); the
+// Service, Ingress and verification are the same. --backend=tgi is
+// the same idea with Text Generation Inference (sharded over the
+// GPUs, optionally --tgi-quantize'd, prompts capped at --ctx minus
+// one token, which step (8) checks). --backend=ollama runs the
+// Ollama server and, after (7), an "ollama pull" Job.
+//
+// --replicas runs several server pods per model and --hpa-max adds a
+// HorizontalPodAutoscaler on CPU. --model-volume picks how they get
+// the model: one RWO PVC (single node), one RWX PVC, or per-replica
+// emptyDirs that each pod downloads into.
+//
+// --scale-to-zero adds a KEDA scaler (HTTP add-on or Prometheus
+// trigger) so idle servers scale to zero; step (8) then retries the
+// chat request until a replica has woken up instead of waiting.
+//
+// --integrity-schedule adds a CronJob that re-hashes the GGUF on the
+// PVC (against --model-sha256, else the hash it saw first), since disks
+// do rot. A mismatch raises a Warning Event on the Deployment and fails
+// the server's liveness probe; deleting the pods then downloads the
+// model again.
+//
+// --verify-stream makes step (8) use stream:true and check the reply
+// arrives as several server-sent events, ending with [DONE].
+// --parallel/--cont-batching/--batch-size tune how llama.cpp batches
+// requests; --verify-parallel then checks --parallel concurrent
+// requests really are decoded together.
+// --n-predict caps the tokens a llama.cpp request may generate (clients'
+// max_tokens included), so a runaway generation can't hold a slot for
+// minutes; step (8) then asks for more and checks, counting with
+// /tokenize when the reply has no usage, that the cap holds.
+// --cache-type-k/--cache-type-v store the KV cache quantized (e.g.
+// q8_0), roughly halving it, and before deploying the expected memory
+// use (weights + KV cache, from the GGUF header) is printed.
+// Above --memory-limit it's a warning, or with --fit-ctx=adjust the
+// context is lowered to the largest that fits.
+// --verify-prompt adds a question asked at temperature 0, whose answer
+// must match --verify-expect-regex: a wrong chat template or a broken
+// quantization still says hello, but rarely gets the answer right.
+// --verify-json-schema adds a request constrained with response_format
+// to a JSON schema, and checks the reply parses and matches it.
+//
+// A model split into "-00001-of-0000N.gguf" shards is given as any
+// one shard's URL (or the full list, comma-separated or as urls:); the
+// initContainer downloads every shard and llama.cpp loads the first.
+//
+// The "set-model" command rotates a deployed model in place: a Job
+// downloads the new GGUF under its own name next to the old one, the
+// ConfigMap and Deployment switch to it, and after verification the
+// old files are pruned.
+//
+// The "upload-model" command deploys a GGUF from this machine (--file),
+// for clusters that can't download it: before step (5) a helper pod on
+// the models PVC receives it through the API server's pod proxy, and the
+// initContainer only checks it.
+//
+// The "quantize" command deploys from a full-precision GGUF
+// (--source-url): before step (5) a Job downloads it into the PVC and
+// converts it with llama-quantize (--quant, default Q4_K_M), and the
+// initContainer only checks the result.
+//
+// The "compare" command is quantize twice (two --quant types of one
+// --source-url, as <name>-<quant> stacks), followed by the benchmark on
+// both, their server memory (from the metrics API), and the replies
+// both give to the same prompts at temperature 0, side by side; the
+// slower one is then removed (--keep-both keeps it).
+//
+// The "swap" command is a blue-green model upgrade: the new model gets a
+// Deployment of its own (<name>-green, or <name>-blue when green is live)
+// with its own PVC, which is verified through a temporary Service and
+// host (<name>-green.<namespace>.apps-crc.testing); only then does the
+// main Service's selector move to it, in one update, and the previous
+// Deployment is scaled to zero (its PVC stays, so swapping back is fast).
+// A plain deploy takes the Service back to the <name> Deployment and,
+// once that is verified, removes the <name>-green and <name>-blue
+// stacks (Deployment, PVC and the rest) left from earlier swaps.
+//
+// The "gateway" command puts one hostname in front of models that are
+// already deployed (same --name/--models-file flags): a small reverse
+// proxy routes each /v1/* request to a model's Service by its "model"
+// field, and each model is verified through it.
+//
+// The "canary" command deploys a second model next to a running one
+// (objects named <name>-canary, with their own host for the check in
+// step (8)) and then has the main Route send --weight percent of the
+// requests to it; without --tls the Ingress becomes a Route for this,
+// since only Routes split traffic by weight. "promote" (same model flags)
+// moves all traffic to the canary, switches the main stack to its model,
+// verifies it through its Service (via the API server's service proxy)
+// and only then moves the traffic back and removes the canary; "abort"
+// removes it and restores the main Route or Ingress.
+//
+// The "benchmark" command skips (2)-(8) and load-tests models that are
+// already deployed (same --name/--models-file flags), reporting
+// tokens/sec, time to first token and latency percentiles.
+//
+// The "usage" command reads the --usage-log records back (a Job mounts
+// the PVC and prints them) and totals requests, tokens and latency per
+// API key, client, model or day, for lightweight chargeback.
+//
+// The "batch" command runs a file of prompts through models that are
+// already deployed, for offline evaluation: a Job sends each prompt
+// (from a ConfigMap made of --prompts-file, or a pvc:// path) to the
+// model's Service and writes the replies as JSON lines into a PVC
+// (--batch-output=pvc://<claim>/<dir>/).
+//
+// With --models-file, steps (3)-(8) run once per listed model
+// (objects named <name>-<model>), followed by a combined summary.
 //
 // --------------------------------------------------------------
 // HOW TO RUN (example):
@@ -43,11 +226,236 @@
 //     --ctx=2048 \
 //     --threads=4
 //
+//   # Or let a preset pick a known-good model and sizing
+//   go run setup_local_llamacpp_openshift.go --preset=qwen2.5-0.5b
+//
+//   # Same model on a GPU node (NVIDIA GPU Operator installed)
+//   go run setup_local_llamacpp_openshift.go \
+//     --model-url="https://.../model.gguf" \
+//     --gpu=1
+//
+//   # A gated model (e.g. Llama 3): the token goes into a Secret and is
+//   # sent as "Authorization: Bearer", never into the URL or ConfigMap
+//   go run setup_local_llamacpp_openshift.go \
+//     --model-url="https://huggingface.co/meta-llama/.../resolve/main/model.gguf" \
+//     --hf-token="$HF_TOKEN"
+//
+//   # A model mirrored as an OCI artifact (oras push ... model.gguf)
+//   go run setup_local_llamacpp_openshift.go \
+//     --model-oci-ref=registry.internal/models/tinyllama:q4 \
+//     --oci-pull-secret=internal-registry-creds
+//
+//   # A bigger model needs a bigger PVC (checked against its size)
+//   go run setup_local_llamacpp_openshift.go --preset=mistral-7b-q4 \
+//     --model-storage-size=10Gi --model-storage-class=lvms-vg1
+//
+//   # Reuse a model another deployment already downloaded (fast on CRC)
+//   go run setup_local_llamacpp_openshift.go --name=llama-test \
+//     --model-from-pvc=llama-chat-models-pvc
+//
+//   # vLLM instead of llama.cpp (GPU node; serves a Hugging Face repo)
+//   go run setup_local_llamacpp_openshift.go --backend=vllm \
+//     --model-name=qwen2.5-0.5b --hf-model=Qwen/Qwen2.5-0.5B-Instruct
+//
+//   # Text Generation Inference, 4-bit, sharded over two GPUs
+//   go run setup_local_llamacpp_openshift.go --backend=tgi --gpu=2 \
+//     --model-name=qwen2-5-7b --hf-model=Qwen/Qwen2.5-7B-Instruct \
+//     --tgi-quantize=bitsandbytes-nf4
+//
+//   # Ollama (model pulled by a Job, served as --model-name; it has
+//   # no API key support, hence --no-auth)
+//   go run setup_local_llamacpp_openshift.go --backend=ollama \
+//     --model-name=llama3-2-1b --ollama-model=llama3.2:1b --no-auth
+//
+//   # Autoscale 1-4 replicas sharing an RWX volume
+//   go run setup_local_llamacpp_openshift.go --preset=qwen2.5-0.5b --cpu-limit=4 \
+//     --hpa-max=4 --hpa-cpu-target=70 --model-volume=rwx
+//
+//   # Scale to zero after 15 idle minutes; a request wakes it (KEDA +
+//   # HTTP add-on installed; the router must allow ExternalName Services)
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama \
+//     --scale-to-zero=http --scale-to-zero-idle=15m --timeout=30m
+//
+//   # HTTPS only, with our own certificate (plain HTTP is redirected)
+//   oc create secret tls llama-chat-tls -n testing --cert=tls.crt --key=tls.key
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama \
+//     --tls=edge --tls-secret=llama-chat-tls
+//
+//   # A split GGUF: any shard's URL pulls all of them (size the PVC to fit)
+//   go run setup_local_llamacpp_openshift.go --model-name=qwen2.5-14b \
+//     --model-url="https://huggingface.co/Qwen/Qwen2.5-14B-Instruct-GGUF/resolve/main/qwen2.5-14b-instruct-q4_k_m-00001-of-00003.gguf?download=true" \
+//     --ctx=4096 --threads=8 --memory-limit=12Gi --model-storage-size=15Gi
+//
+//   # Speculative decoding: a small draft model from the same family
+//   go run setup_local_llamacpp_openshift.go --preset=qwen2.5-0.5b \
+//     --draft-model-url="https://huggingface.co/Qwen/Qwen2.5-0.5B-Instruct-GGUF/resolve/main/qwen2.5-0.5b-instruct-q2_k.gguf?download=true" \
+//     --draft-max=8
+//
+//   # Fail the deploy unless the model gets a known answer right
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama \
+//     --verify-prompt="What is the capital of France? Answer in one word." \
+//     --verify-expect-regex="(?i)paris"
+//
+//   # Keep a model that loads but can't generate (bad quant) out of the
+//   # Service: pods only turn Ready after producing a token
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama --inference-probe
+//
+//   # Also check structured output (response_format with a JSON schema)
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama \
+//     --verify-json-schema=person.schema.json
+//
+//   # Four parallel slots (8192 tokens of context each), checked under load
+//   go run setup_local_llamacpp_openshift.go --preset=qwen2.5-0.5b \
+//     --ctx=32768 --parallel=4 --verify-parallel
+//
+//   # One CPU slot: no request may generate more than 512 tokens
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama --n-predict=512
+//
+//   # A vision model: the LLM plus its multimodal projector
+//   go run setup_local_llamacpp_openshift.go --model-name=llava-7b \
+//     --model-url="https://huggingface.co/.../llava-v1.5-7b-Q4_K_M.gguf" \
+//     --mmproj-url="https://huggingface.co/.../mmproj-model-f16.gguf" \
+//     --memory-limit=8Gi --model-storage-size=10Gi
+//
+//   # A fine-tuned variant: base model plus a LoRA adapter (no merging)
+//   go run setup_local_llamacpp_openshift.go --preset=qwen2.5-0.5b \
+//     --lora-url="https://mirror.internal/adapters/qwen2.5-0.5b-hpc-support-lora.gguf"
+//
+//   # A llama.cpp option without a flag of its own (env replaces ours of the
+//   # same name; command-line args win over LLAMA_ARG_* env in llama.cpp)
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama \
+//     --server-env=LLAMA_ARG_DEFRAG_THOLD=0.1 --server-arg=--no-warmup
+//
+//   # A long system prompt that survives restarts already processed
+//   go run setup_local_llamacpp_openshift.go --preset=qwen2.5-0.5b --parallel=2 \
+//     --prompt-cache --prompt-cache-size=2Gi --model-storage-size=5Gi
+//
+//   # A demo hammered with the same prompts: cache replies for 10 minutes
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama \
+//     --cache-ttl=10m --cache-max-entries=500
+//
+//   # At most 2 requests/s per client: 429s from a sidecar (the default,
+//   # router, has the OpenShift router drop the excess instead)
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama \
+//     --rate-limit=2 --rate-limit-mode=sidecar
+//
+//   # A multi-GB model over 16 connections (aria2c) instead of one curl,
+//   # from an image you vetted (it is handed HF_TOKEN)
+//   go run setup_local_llamacpp_openshift.go --preset=qwen2.5-0.5b \
+//     --downloader=aria2 --aria2-image=registry.internal/tools/aria2:1.37 \
+//     --aria2-split=16 --aria2-connections=16
+//
+//   # Re-check the model for bit-rot every week
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama --integrity-schedule=@weekly
+//   oc get events -n testing --field-selector reason=ModelCorrupted
+//
+//   # Our own llama-server build: a pinned release, OpenBLAS, no AVX512
+//   # (older nodes); rebuilt only when the ref or the flags change
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama --timeout=45m \
+//     --build-from-source --llama-cpp-ref=b4000 \
+//     --cmake-flags="-DGGML_NATIVE=OFF -DGGML_AVX512=OFF -DGGML_BLAS=ON -DGGML_BLAS_VENDOR=OpenBLAS"
+//   oc logs -f bc/llama-chat-llama-server -n testing
+//
+//   # Experimental: spread a 7B model's layers over 3 RPC workers of 4Gi each
+//   go run setup_local_llamacpp_openshift.go --preset=mistral-7b-q4 --timeout=45m \
+//     --build-from-source --llama-cpp-ref=b4000 \
+//     --rpc-workers=3 --rpc-worker-memory=4Gi
+//
+//   # Older nodes without AVX2: serve a no-AVX build from an internal registry
+//   # (--cpu-variant=auto detects it instead, on mixed clusters)
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama --cpu-variant=noavx \
+//     --cpu-variant-images=noavx=registry.internal/llama.cpp:server-noavx
+//
+//   # CRC on Apple Silicon (detected anyway; --arch skips listing the nodes)
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama --arch=arm64
+//
+//   # Only on the GPU pool (its taint tolerated), fetch initContainer included
+//   go run setup_local_llamacpp_openshift.go --preset=mistral-7b-q4 --gpu=1 \
+//     --node-selector=nvidia.com/gpu.present=true \
+//     --tolerations=nvidia.com/gpu:NoSchedule,dedicated=gpu:NoSchedule
+//
+//   # Keep models on the CRC VM itself, shared by every namespace (needs
+//   # cluster-admin for the PersistentVolume; the directory must exist and
+//   # be writable by the pods' random UID). Files a pod downloads carry its
+//   # namespace's SELinux categories; re-run the chcon to share them.
+//   oc debug node/crc -- chroot /host sh -c 'mkdir -p /var/models/tinyllama-1.1b &&
+//     chmod 0777 /var/models/tinyllama-1.1b && chcon -R -t container_file_t -l s0 /var/models'
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama --model-hostpath=/var/models
+//
+//   # A longer context in the same memory: 8-bit KV cache
+//   go run setup_local_llamacpp_openshift.go --preset=phi-3-mini \
+//     --ctx=8192 --cache-type-k=q8_0 --cache-type-v=q8_0
+//
+//   # The largest context that fits in 4Gi, instead of an OOM-killed pod
+//   go run setup_local_llamacpp_openshift.go --preset=phi-3-mini \
+//     --ctx=32768 --memory-limit=4Gi --fit-ctx=adjust
+//
+//   # Swap a running deployment to another model, then prune the old GGUF
+//   go run setup_local_llamacpp_openshift.go set-model --name=llama-chat \
+//     --model-name=qwen2.5-0.5b \
+//     --model-url="https://huggingface.co/Qwen/Qwen2.5-0.5B-Instruct-GGUF/resolve/main/qwen2.5-0.5b-instruct-q4_k_m.gguf?download=true"
+//
+//   # Air-gapped: stream a GGUF from this machine into the cluster and serve it
+//   go run setup_local_llamacpp_openshift.go upload-model --model-name=tinyllama-1.1b \
+//     --file=./tinyllama-1.1b-chat-v1.0.Q4_K_M.gguf --timeout=30m
+//
+//   # Quantize an internally mirrored F16 GGUF in the cluster and serve it
+//   go run setup_local_llamacpp_openshift.go quantize --model-name=qwen2.5-0.5b \
+//     --source-url="https://mirror.internal/models/qwen2.5-0.5b-instruct-f16.gguf" \
+//     --quant=Q4_K_M --timeout=30m
+//
+//   # Same source, Q4_K_M against Q5_K_M: report, then keep the faster
+//   go run setup_local_llamacpp_openshift.go compare --model-name=qwen2.5-0.5b \
+//     --source-url="https://mirror.internal/models/qwen2.5-0.5b-instruct-f16.gguf" \
+//     --quant=Q4_K_M --quant=Q5_K_M --timeout=45m
+//
+//   # Metrics scraped per pod, and a dashboard the OpenShift console shows
+//   # under Observe > Dashboards (that namespace needs cluster-admin; a
+//   # Grafana with a dashboard sidecar picks it up from any namespace)
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama \
+//     --observability --dashboard-namespace=openshift-config-managed
+//
+//   # Upgrade without downtime: verify the new model, then switch over
+//   go run setup_local_llamacpp_openshift.go swap --preset=qwen2.5-0.5b
+//
+//   # Send 10% of the requests to a new model, then promote it (or abort)
+//   go run setup_local_llamacpp_openshift.go canary --preset=qwen2.5-0.5b --weight=10
+//   go run setup_local_llamacpp_openshift.go promote --preset=qwen2.5-0.5b
+//   go run setup_local_llamacpp_openshift.go abort
+//
+//   # One OpenAI endpoint for the whole zoo, routed by "model"
+//   go run setup_local_llamacpp_openshift.go gateway --models-file=models.yaml
+//
+//   # Benchmark a deployed model: 50 requests, 8 at a time, as JSON
+//   go run setup_local_llamacpp_openshift.go benchmark --name=llama-chat \
+//     --bench-requests=50 --bench-concurrency=8 --bench-format=json
+//
+//   # Record usage, then summarize the last week per API key
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama --usage-log
+//   go run setup_local_llamacpp_openshift.go usage --usage-since=168h
+//
+//   # Offline evaluation: answer every prompt, results into a PVC
+//   # (one {"id": ..., "prompt": "..."} or {"id": ..., "messages": [...]} per line)
+//   go run setup_local_llamacpp_openshift.go batch --name=llama-chat \
+//     --prompts-file=prompts.jsonl --batch-output=pvc://eval-results/run1/ --batch-concurrency=4
+//
+//   # Hand the endpoint to an app in another namespace (env vars from a
+//   # Secret) and to this machine (source it, or pass it to docker --env-file)
+//   go run setup_local_llamacpp_openshift.go --preset=tinyllama --tls=edge \
+//     --bundle-namespace=my-app --bundle-file=llama-chat.env
+//   oc set env deployment/my-app -n my-app --from=secret/llama-chat-client
+//
+//   # A whole model zoo from one file (see modelsFile for the format)
+//   go run setup_local_llamacpp_openshift.go --models-file=models.yaml
+//
 // After success, the API should be at:
 //   http://<name>.<namespace>.apps-crc.testing/v1/chat/completions
+// (https:// with --tls=edge; plain HTTP requests are redirected).
 //
-// Example curl:
+// Example curl (the API key is in the <name>-api-key Secret):
+//   API_KEY=$(oc get secret llama-chat-api-key -n testing -o jsonpath='{.data.api-key}' | base64 -d)
 //   curl -s -X POST "http://llama-chat.testing.apps-crc.testing/v1/chat/completions" \
+//     -H "Authorization: Bearer $API_KEY" \
 //     -H "Content-Type: application/json" \
 //     -d '{"model":"tinyllama-1.1b","messages":[{"role":"system","content":"You are a helpful LANL HPC assistant."},{"role":"user","content":"Say hello in one short sentence."}]}' | jq .
 //
@@ -57,39 +465,76 @@ package main
 
 // Standard library imports. We explain briefly what each is used for.
 import (
-	"context"   // Propagates timeouts/cancellation through API calls
-	"crypto/tls" // Allows skipping TLS verification for local dev (CRC)
-	"encoding/json" // JSON encode/decode for request/response bodies
-	"flag"          // Command-line flags (e.g., --namespace=testing)
-	"fmt"           // Printing/logging
-	"io"            // Reading HTTP response bodies
-	"net/http"      // Sending the verification POST request
-	"os"            // OS utilities (stderr, exit codes, environment)
-	"path/filepath" // Build default kubeconfig path
-	"strings"       // Small helpers for strings
-	"time"          // Durations, timeouts
+	"bufio"           // Splitting streamed container logs into lines
+	"bytes"           // Reading the gzipped usage records
+	"compress/gzip"   // Decompressing them
+	"context"         // Propagates timeouts/cancellation through API calls
+	"crypto/rand"     // Generating the API key when --api-key is empty
+	"crypto/sha256"   // Naming rotated model files after their source
+	"crypto/tls"      // Allows skipping TLS verification for local dev (CRC)
+	"encoding/base64" // Inlining the vision test image
+	"encoding/binary" // Reading GGUF headers for the memory estimate
+	"encoding/hex"    // Validating --model-sha256
+	"encoding/json"   // JSON encode/decode for request/response bodies
+	"flag"            // Command-line flags (e.g., --namespace=testing)
+	"fmt"             // Printing/logging
+	"image"           // Drawing the vision test image
+	"image/color"     // Its colour
+	"image/png"       // Encoding it
+	"io"              // Reading HTTP response bodies
+	"math"            // Rounding the router's rate limit
+	"net/http"        // Sending the verification POST request
+	"os"              // OS utilities (stderr, exit codes, environment)
+	"path/filepath"   // Build default kubeconfig path
+	"regexp"          // Recognising split-GGUF shard names
+	"sort"            // Stable listing of model presets
+	"strconv"         // Parsing shard counts
+	"strings"         // Small helpers for strings
+	"text/tabwriter"  // Aligned summary table for multi-model runs
+	"time"            // Durations, timeouts
 )
 
 // Kubernetes API types we will create/apply.
 import (
-	appsv1 "k8s.io/api/apps/v1" // Deployment API
-	corev1 "k8s.io/api/core/v1" // Core types: Namespace, Service, ConfigMap, PVC, Pod
-	netv1 "k8s.io/api/networking/v1" // Ingress API
+	appsv1 "k8s.io/api/apps/v1"               // Deployment and StatefulSet (RPC workers) API
+	autoscalingv2 "k8s.io/api/autoscaling/v2" // HorizontalPodAutoscaler API
+	batchv1 "k8s.io/api/batch/v1"             // Job/CronJob API (model clone, quantize, integrity)
+	corev1 "k8s.io/api/core/v1"               // Core types: Namespace, Service, ConfigMap, PVC, Pod
+	netv1 "k8s.io/api/networking/v1"          // Ingress and NetworkPolicy API
+	rbacv1 "k8s.io/api/rbac/v1"               // Role for the integrity CronJob's Events
 )
 
 // Kubernetes helper packages.
 import (
-	kerrors "k8s.io/apimachinery/pkg/api/errors" // For IsNotFound checks
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1" // Object metadata types
-	"k8s.io/apimachinery/pkg/api/resource"        // For PVC sizes like "5Gi"
-	"k8s.io/apimachinery/pkg/util/intstr"         // IntOrString (ports in probes/services)
-	waitutil "k8s.io/apimachinery/pkg/util/wait"  // Poll/wait utilities
+	kerrors "k8s.io/apimachinery/pkg/api/errors"        // For IsNotFound checks
+	"k8s.io/apimachinery/pkg/api/meta"                  // NoMatch errors for missing CRDs
+	"k8s.io/apimachinery/pkg/api/resource"              // For PVC sizes like "5Gi"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"       // Object metadata types
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured" // KEDA objects without their Go types
+	"k8s.io/apimachinery/pkg/labels"                    // Node selector for --cpu-variant detection
+	"k8s.io/apimachinery/pkg/runtime/schema"            // Group/version/resource of KEDA objects
+	"k8s.io/apimachinery/pkg/types"                     // Merge patches of Deployment annotations
+	"k8s.io/apimachinery/pkg/util/intstr"               // IntOrString (ports in probes/services)
+	"k8s.io/apimachinery/pkg/util/validation"           // DNS label checks for model names
+	waitutil "k8s.io/apimachinery/pkg/util/wait"        // Poll/wait utilities
 )
 
 // Kubernetes client-go: the typed client and kubeconfig loader.
 import (
-	"k8s.io/client-go/kubernetes"           // The "clientset" for Kubernetes
-	"k8s.io/client-go/tools/clientcmd"      // Loads kubeconfig like kubectl does
+	"k8s.io/client-go/dynamic"         // Client for custom resources (KEDA)
+	"k8s.io/client-go/kubernetes"      // The "clientset" for Kubernetes
+	"k8s.io/client-go/rest"            // Requests through the API server's pod proxy (upload-model)
+	"k8s.io/client-go/tools/clientcmd" // Loads kubeconfig like kubectl does
+)
+
+// YAML support for --models-file.
+import (
+	"sigs.k8s.io/yaml" // Converts YAML to JSON first, so json struct tags apply
+)
+
+// OpenShift helpers shared with the chat setup (../ocphelpers).
+import (
+	"ocphelpers" // Image builds (--build-from-source), the service proxy (promote)
 )
 
 // ---------- Small helper functions ----------
@@ -97,9 +542,31 @@ import (
 // int32p returns a pointer to an int32 literal. Go doesn't allow &int32(1) directly.
 func int32p(i int32) *int32 { return &i }
 
+// int64p returns a pointer to an int64 literal.
+func int64p(i int64) *int64 { return &i }
+
 // boolp returns a pointer to a bool literal.
 func boolp(b bool) *bool { return &b }
 
+// truncate shortens s to at most n runes, marking the cut with "...".
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "..."
+}
+
+// stringList is a repeatable string flag.
+type stringList []string
+
+func (l *stringList) String() string { return strings.Join(*l, ",") }
+
+func (l *stringList) Set(v string) error {
+	*l = append(*l, v)
+	return nil
+}
+
 // cfgKey is a convenience to pull an environment variable from a ConfigMap key.
 // It builds the { ValueFrom: { ConfigMapKeyRef: ... } } boilerplate for you.
 func cfgKey(cmName, key string) *corev1.EnvVarSource {
@@ -118,6 +585,27 @@ type chatReq struct {
 	Model    string        `json:"model"`
 	Messages []chatMessage `json:"messages"`
 	Stream   bool          `json:"stream"`
+	// MaxTokens caps the reply length; omitted when 0.
+	MaxTokens int `json:"max_tokens,omitempty"`
+	// Temperature, when set, overrides the server's sampling temperature
+	// (0 = greedy, for answers that can be checked).
+	Temperature *float64 `json:"temperature,omitempty"`
+	// ResponseFormat constrains the reply (structured output); optional.
+	ResponseFormat *responseFormat `json:"response_format,omitempty"`
+}
+
+// responseFormat asks for JSON matching a schema. llama.cpp and vLLM take
+// OpenAI's {"type":"json_schema","json_schema":{...}}; TGI takes
+// {"type":"json_object","value":<schema>}.
+type responseFormat struct {
+	Type       string          `json:"type"`
+	JSONSchema *jsonSchemaSpec `json:"json_schema,omitempty"`
+	Value      json.RawMessage `json:"value,omitempty"`
+}
+type jsonSchemaSpec struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+	Strict bool            `json:"strict"`
 }
 type chatMessage struct {
 	Role    string `json:"role"`
@@ -132,6 +620,516 @@ type chatResp struct {
 	} `json:"choices"`
 }
 
+// chatChunk is one server-sent event of a streamed (stream:true) reply.
+// Servers that report usage put it in the last chunk.
+type chatChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content string `json:"content"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *struct {
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// ---------- Model specs ----------
+
+// modelSpec describes one model server. A single-model run builds one from
+// the --model-* flags; --models-file lists several (YAML or JSON, same keys).
+// Zero values fall back to the corresponding command-line flag.
+type modelSpec struct {
+	Name    string `json:"name"`               // Logical model name used by clients (also suffixes object names)
+	URL     string `json:"url,omitempty"`      // Direct URL to a GGUF model file (or to one shard of a split model)
+	OCIRef  string `json:"oci_ref,omitempty"`  // Or: OCI artifact holding the GGUF (pulled with oras)
+	FromPVC string `json:"from_pvc,omitempty"` // Or: existing PVC to copy the GGUF from (path inside: FromPVCPath)
+	Preset  string `json:"preset,omitempty"`   // Start from a modelPresets entry; other fields override it
+	// FromPVCPath is the GGUF's path inside FromPVC (default model.gguf,
+	// i.e. another llama-chat deployment's models PVC).
+	FromPVCPath string `json:"from_pvc_path,omitempty"`
+	Backend     string `json:"backend,omitempty"`      // Serving stack: llamacpp (default), vllm, ollama or tgi
+	HFModel     string `json:"hf_model,omitempty"`     // Hugging Face repo id served by vllm/tgi, e.g. Qwen/Qwen2.5-0.5B-Instruct
+	Quantize    string `json:"quantize,omitempty"`     // TGI --quantize method, e.g. awq or bitsandbytes-nf4
+	OllamaModel string `json:"ollama_model,omitempty"` // Ollama library model pulled by ollama, e.g. llama3.2:1b
+	Ctx         int    `json:"ctx,omitempty"`          // Context window tokens
+	Threads     int    `json:"threads,omitempty"`      // CPU threads
+	CPU         string `json:"cpu,omitempty"`          // Optional CPU limit, e.g. "4"
+	Memory      string `json:"memory,omitempty"`       // Optional memory limit, e.g. "8Gi"
+	GPU         int    `json:"gpu,omitempty"`          // NVIDIA GPUs (0 = CPU-only)
+	SHA256      string `json:"sha256,omitempty"`       // Expected checksum of the GGUF file (hex)
+	Storage     string `json:"storage,omitempty"`      // Models PVC size, e.g. "20Gi"
+	// URLs lists every shard of a split GGUF, in order (instead of URL).
+	URLs []string `json:"urls,omitempty"`
+	// DraftURL is a small GGUF sharing the model's vocabulary, used as the
+	// draft model for speculative decoding (llamacpp only).
+	DraftURL string `json:"draft_url,omitempty"`
+	// ChatTemplate overrides the template in the GGUF's metadata with one
+	// of llamaChatTemplates (llamacpp only).
+	ChatTemplate string `json:"chat_template,omitempty"`
+	// LoRAURLs are GGUF LoRA adapters applied on top of the model
+	// (llamacpp only); they must be made for this base model.
+	LoRAURLs []string `json:"lora_urls,omitempty"`
+	// MMProjURL is the multimodal projector of a vision (LLaVA-style)
+	// model (llamacpp only).
+	MMProjURL string `json:"mmproj_url,omitempty"`
+	// SourceURL is the quantize command's full-precision GGUF, which a Job
+	// converts to the Quant type (e.g. Q4_K_M); not a --models-file key.
+	SourceURL string `json:"-"`
+	Quant     string `json:"-"`
+	// LocalFile is the upload-model command's GGUF on this machine, which
+	// is streamed into the PVC; not a --models-file key either.
+	LocalFile string `json:"-"`
+}
+
+// modelPresets are known-good small models for a first deployment: a direct
+// GGUF link plus ctx/threads/memory that fit a default CRC VM (9-16 GiB).
+// A preset without a pinned SHA256 is checked against the one Hugging
+// Face publishes for the file (see hubSHA256), and isn't downloaded
+// when there's none; --model-sha256 overrides both.
+var modelPresets = map[string]modelSpec{
+	"tinyllama": {
+		Name:    "tinyllama-1.1b",
+		URL:     "https://huggingface.co/TheBloke/TinyLlama-1.1B-Chat-v1.0-GGUF/resolve/main/tinyllama-1.1b-chat-v1.0.Q4_K_M.gguf?download=true",
+		Ctx:     2048,
+		Threads: 4,
+		Memory:  "2Gi",
+	},
+	"phi-3-mini": {
+		Name:    "phi-3-mini",
+		URL:     "https://huggingface.co/microsoft/Phi-3-mini-4k-instruct-gguf/resolve/main/Phi-3-mini-4k-instruct-q4.gguf?download=true",
+		Ctx:     4096,
+		Threads: 4,
+		Memory:  "5Gi",
+	},
+	"qwen2.5-0.5b": {
+		Name:    "qwen2.5-0.5b",
+		URL:     "https://huggingface.co/Qwen/Qwen2.5-0.5B-Instruct-GGUF/resolve/main/qwen2.5-0.5b-instruct-q4_k_m.gguf?download=true",
+		Ctx:     4096,
+		Threads: 2,
+		Memory:  "1Gi",
+	},
+	"mistral-7b-q4": {
+		Name:    "mistral-7b-instruct",
+		URL:     "https://huggingface.co/TheBloke/Mistral-7B-Instruct-v0.2-GGUF/resolve/main/mistral-7b-instruct-v0.2.Q4_K_M.gguf?download=true",
+		Ctx:     4096,
+		Threads: 4,
+		Memory:  "8Gi",
+		Storage: "8Gi",
+	},
+}
+
+// presetNames lists modelPresets keys for flag help and error messages.
+func presetNames() string {
+	var names []string
+	for k := range modelPresets {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return strings.Join(names, "|")
+}
+
+// applyPreset fills the fields m leaves unset from the named preset.
+func (m *modelSpec) applyPreset(name string) error {
+	p, ok := modelPresets[name]
+	if !ok {
+		return fmt.Errorf("unknown preset %q (have: %s)", name, presetNames())
+	}
+	if m.Name == "" {
+		m.Name = p.Name
+	}
+	if m.URL == "" && m.OCIRef == "" && m.FromPVC == "" && m.HFModel == "" && m.OllamaModel == "" {
+		m.URL = p.URL
+		if m.SHA256 == "" {
+			m.SHA256 = p.SHA256
+		}
+	}
+	m.Preset = name
+	if m.Ctx == 0 {
+		m.Ctx = p.Ctx
+	}
+	if m.Threads == 0 {
+		m.Threads = p.Threads
+	}
+	if m.Memory == "" {
+		m.Memory = p.Memory
+	}
+	if m.Storage == "" {
+		m.Storage = p.Storage
+	}
+	return nil
+}
+
+// modelsFile is the top-level shape of --models-file, e.g.:
+//
+//	models:
+//	  - name: tinyllama-1.1b
+//	    url: https://huggingface.co/.../tinyllama-1.1b-chat-v1.0.Q4_K_M.gguf
+//	  - name: phi-3-mini
+//	    url: https://huggingface.co/.../Phi-3-mini-4k-instruct-q4.gguf
+//	    ctx: 4096
+//	    threads: 8
+//	    memory: 6Gi
+//	  - name: mistral-7b
+//	    oci_ref: registry.internal/models/mistral-7b:q4_k_m
+//	    chat_template: mistral-v1
+//	    lora_urls:
+//	      - https://mirror.internal/adapters/mistral-7b-hpc-lora.gguf
+//	  - name: qwen
+//	    preset: qwen2.5-0.5b
+//	  - name: qwen-14b
+//	    urls:
+//	      - https://huggingface.co/.../qwen2.5-14b-instruct-q4_k_m-00001-of-00002.gguf
+//	      - https://huggingface.co/.../qwen2.5-14b-instruct-q4_k_m-00002-of-00002.gguf
+type modelsFile struct {
+	Models []modelSpec `json:"models"`
+}
+
+// readModelsFile loads --models-file and fills unset fields from defaults.
+// Names become part of Kubernetes object names, so they must be DNS labels.
+func readModelsFile(path string, defaults modelSpec) ([]modelSpec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f modelsFile
+	// sigs.k8s.io/yaml converts YAML to JSON first, so the json tags apply
+	// and plain JSON files work too.
+	if err := yaml.UnmarshalStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(f.Models) == 0 {
+		return nil, fmt.Errorf("%s: no models listed", path)
+	}
+	seen := map[string]bool{}
+	for i := range f.Models {
+		m := &f.Models[i]
+		if m.Preset != "" {
+			if m.Name == "" {
+				return nil, fmt.Errorf("%s: model %d: name is required (preset names aren't valid object names)", path, i+1)
+			}
+			if err := m.applyPreset(m.Preset); err != nil {
+				return nil, fmt.Errorf("%s: model %q: %v", path, m.Name, err)
+			}
+		}
+		if errs := validation.IsDNS1123Label(m.Name); len(errs) > 0 {
+			return nil, fmt.Errorf("%s: model %d: name %q: %s", path, i+1, m.Name, strings.Join(errs, "; "))
+		}
+		if seen[m.Name] {
+			return nil, fmt.Errorf("%s: model %q listed twice", path, m.Name)
+		}
+		seen[m.Name] = true
+		if m.Ctx == 0 {
+			m.Ctx = defaults.Ctx
+		}
+		if m.Threads == 0 {
+			m.Threads = defaults.Threads
+		}
+		if m.CPU == "" {
+			m.CPU = defaults.CPU
+		}
+		if m.Memory == "" {
+			m.Memory = defaults.Memory
+		}
+		if m.Storage == "" {
+			m.Storage = defaults.Storage
+		}
+		if m.GPU == 0 {
+			m.GPU = defaults.GPU
+		}
+		if m.Backend == "" {
+			m.Backend = defaults.Backend
+		}
+		if m.Quantize == "" && m.Backend == "tgi" {
+			m.Quantize = defaults.Quantize
+		}
+		if (m.Backend == "vllm" || m.Backend == "tgi") && m.GPU == 0 {
+			m.GPU = 1
+		}
+		// A checksum belongs to one file, so it is never inherited, and
+		// neither is the other kind of source.
+		if m.URL == "" && len(m.URLs) == 0 && m.OCIRef == "" && m.FromPVC == "" && m.HFModel == "" && m.OllamaModel == "" {
+			m.URL, m.OCIRef, m.FromPVC = defaults.URL, defaults.OCIRef, defaults.FromPVC
+			m.HFModel, m.OllamaModel = defaults.HFModel, defaults.OllamaModel
+		}
+		if m.FromPVC != "" && m.FromPVCPath == "" {
+			m.FromPVCPath = defaults.FromPVCPath
+		}
+	}
+	return f.Models, nil
+}
+
+// validate checks what the API server would otherwise reject mid-deploy.
+func (m modelSpec) validate() error {
+	if m.ChatTemplate != "" && m.Backend != "llamacpp" {
+		return fmt.Errorf("model %q: chat_template (--chat-template) applies to the llamacpp backend only", m.Name)
+	}
+	if m.MMProjURL != "" && m.Backend != "llamacpp" {
+		return fmt.Errorf("model %q: mmproj_url (--mmproj-url) applies to the llamacpp backend only", m.Name)
+	}
+	if len(m.LoRAURLs) > 0 && m.Backend != "llamacpp" {
+		return fmt.Errorf("model %q: lora_urls (--lora-url) apply to the llamacpp backend only", m.Name)
+	}
+	switch m.Backend {
+	case "llamacpp":
+		if m.HFModel != "" || m.OllamaModel != "" || m.Quantize != "" {
+			return fmt.Errorf("model %q: hf_model/ollama_model/quantize belong to other backends; llama.cpp serves GGUF files", m.Name)
+		}
+		if err := checkChatTemplate(m.ChatTemplate); err != nil {
+			return fmt.Errorf("model %q: %v", m.Name, err)
+		}
+	case "ollama":
+		// Ollama pulls from its own library by name.
+		if m.OllamaModel == "" || m.URL != "" || m.OCIRef != "" || m.FromPVC != "" || m.HFModel != "" || m.Quantize != "" {
+			return fmt.Errorf("model %q: the ollama backend takes ollama_model (--ollama-model) instead of a GGUF source", m.Name)
+		}
+		if m.GPU < 0 {
+			return fmt.Errorf("model %q: gpu must be >= 0", m.Name)
+		}
+		return m.validateResources()
+	case "vllm", "tgi":
+		// vLLM and TGI download Hugging Face repos themselves; there's no GGUF to fetch.
+		if m.HFModel == "" || m.URL != "" || m.OCIRef != "" || m.FromPVC != "" || m.OllamaModel != "" {
+			return fmt.Errorf("model %q: the %s backend takes hf_model (--hf-model) instead of a GGUF source", m.Name, m.Backend)
+		}
+		if m.GPU < 1 {
+			return fmt.Errorf("model %q: the %s backend needs at least one GPU", m.Name, m.Backend)
+		}
+		if m.Quantize != "" && m.Backend != "tgi" {
+			return fmt.Errorf("model %q: quantize (--tgi-quantize) applies to the tgi backend only", m.Name)
+		}
+		if m.Backend == "tgi" && m.Ctx < 2 {
+			return fmt.Errorf("model %q: the tgi backend needs ctx >= 2 (the prompt gets ctx-1 tokens)", m.Name)
+		}
+		return m.validateResources()
+	default:
+		return fmt.Errorf("model %q: unknown backend %q (llamacpp, vllm, ollama or tgi)", m.Name, m.Backend)
+	}
+	sources := 0
+	for _, src := range []string{m.URL, m.OCIRef, m.FromPVC, m.SourceURL, m.LocalFile} {
+		if src != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("model %q: set exactly one of url (--model-url), oci_ref (--model-oci-ref) or from_pvc (--model-from-pvc)", m.Name)
+	}
+	if m.SourceURL != "" && m.Quant == "" {
+		return fmt.Errorf("model %q: --quant is required with --source-url", m.Name)
+	}
+	if m.Ctx < 1 || m.Threads < 1 {
+		return fmt.Errorf("model %q: ctx and threads must be >= 1", m.Name)
+	}
+	if m.GPU < 0 {
+		return fmt.Errorf("model %q: gpu must be >= 0", m.Name)
+	}
+	if m.SHA256 != "" {
+		if _, err := hex.DecodeString(m.SHA256); err != nil || len(m.SHA256) != 64 {
+			return fmt.Errorf("model %q: sha256 must be 64 hex characters", m.Name)
+		}
+		if len(m.URLs) > 1 {
+			return fmt.Errorf("model %q: sha256 covers one file, so it can't be used with a split model", m.Name)
+		}
+	}
+	return m.validateResources()
+}
+
+// llamaChatTemplates are the built-in chat templates of the llama.cpp server
+// image (llama-server --help lists them). An unknown name only shows up as
+// a crash-looping server, so it is checked here.
+var llamaChatTemplates = []string{
+	"chatglm3", "chatglm4", "chatml", "command-r", "deepseek", "deepseek2",
+	"deepseek3", "exaone3", "falcon3", "gemma", "gigachat", "glmedge",
+	"granite", "llama2", "llama2-sys", "llama2-sys-bos", "llama2-sys-strip",
+	"llama3", "megrez", "minicpm", "mistral-v1", "mistral-v3",
+	"mistral-v3-tekken", "mistral-v7", "monarch", "openchat", "orion",
+	"phi3", "phi4", "rwkv-world", "vicuna", "vicuna-orca", "zephyr",
+}
+
+// checkChatTemplate accepts "" (use the GGUF's own template) or one of
+// llamaChatTemplates; for a family name like "mistral" it suggests the
+// versioned templates.
+func checkChatTemplate(name string) error {
+	if name == "" {
+		return nil
+	}
+	var similar []string
+	for _, t := range llamaChatTemplates {
+		if t == name {
+			return nil
+		}
+		if strings.HasPrefix(t, name) {
+			similar = append(similar, t)
+		}
+	}
+	if len(similar) > 0 {
+		return fmt.Errorf("unknown chat template %q; did you mean %s?", name, strings.Join(similar, ", "))
+	}
+	return fmt.Errorf("unknown chat template %q (have: %s)", name, strings.Join(llamaChatTemplates, ", "))
+}
+
+// shardPattern matches the "-00001-of-00003.gguf" suffix llama.cpp's
+// gguf-split gives each shard of a split model.
+var shardPattern = regexp.MustCompile(`-(\d{5})-of-(\d{5})\.gguf$`)
+
+// expandShards works out the shards of a split model and points URL at the
+// first one. They come from urls: or a comma-separated --model-url, or
+// from a single shard's URL: "-0000k-of-0000N.gguf" expands to all N.
+// A model in one file ends up with URL set and URLs empty.
+func (m *modelSpec) expandShards() error {
+	if m.URL != "" && len(m.URLs) > 0 {
+		return fmt.Errorf("model %q: set url or urls, not both", m.Name)
+	}
+	if len(m.URLs) == 0 && strings.Contains(m.URL, ",") {
+		for _, u := range strings.Split(m.URL, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				m.URLs = append(m.URLs, u)
+			}
+		}
+	}
+	if len(m.URLs) == 0 && m.URL != "" {
+		path, query, hasQuery := strings.Cut(m.URL, "?")
+		if loc := shardPattern.FindStringSubmatchIndex(path); loc != nil {
+			total := path[loc[4]:loc[5]]
+			n, _ := strconv.Atoi(total)
+			for i := 1; i <= n; i++ {
+				u := path[:loc[0]] + fmt.Sprintf("-%05d-of-%s.gguf", i, total)
+				if hasQuery {
+					u += "?" + query
+				}
+				m.URLs = append(m.URLs, u)
+			}
+		}
+	}
+	if len(m.URLs) > 0 {
+		m.URL = m.URLs[0]
+	}
+	if len(m.URLs) == 1 {
+		m.URLs = nil
+	}
+	return nil
+}
+
+// modelFiles names the files under /models the model is stored as, given
+// base ("model", or set-model's per-source name): base.gguf, or for a split
+// model base-00001-of-0000N.gguf and so on, the names llama.cpp expects
+// when it is pointed at the first shard.
+func (m modelSpec) modelFiles(base string) []string {
+	if len(m.URLs) == 0 {
+		return []string{base + ".gguf"}
+	}
+	var files []string
+	for i := range m.URLs {
+		files = append(files, fmt.Sprintf("%s-%05d-of-%05d.gguf", base, i+1, len(m.URLs)))
+	}
+	return files
+}
+
+// validateResources checks the CPU/memory limits and PVC size parse.
+func (m modelSpec) validateResources() error {
+	if m.Storage == "" {
+		return fmt.Errorf("model %q: storage (--model-storage-size) is required", m.Name)
+	}
+	for _, q := range []string{m.CPU, m.Memory, m.Storage} {
+		if q == "" {
+			continue
+		}
+		if _, err := resource.ParseQuantity(q); err != nil {
+			return fmt.Errorf("model %q: %q: %v", m.Name, q, err)
+		}
+	}
+	return nil
+}
+
+// serverOptions are the settings shared by every model server in one run.
+type serverOptions struct {
+	SystemPrompt    string        // Stored in the ConfigMap for clients
+	GPULayers       int           // LLAMA_ARG_N_GPU_LAYERS when a model has GPUs
+	GPURuntimeClass string        // RuntimeClass for GPU pods ("" = node default)
+	HFTokenSecret   string        // Secret whose "token" key authorizes downloads ("" = anonymous)
+	ORASImage       string        // Image for pulling OCI model artifacts
+	OCIPullSecret   string        // dockerconfigjson Secret for the OCI registry ("" = anonymous)
+	OCIPlainHTTP    bool          // Talk plain HTTP to the OCI registry
+	Downloader      string        // curl (one stream) or aria2 (segmented) for model URLs
+	Aria2Image      string        // Image with aria2c for --downloader=aria2
+	Aria2Split      int           // Segments per file
+	Aria2Conns      int           // Connections per server
+	Aria2MinSplit   string        // Smallest segment, e.g. 20M
+	VLLMImage       string        // Image for --backend=vllm
+	TGIImage        string        // Image for --backend=tgi
+	OllamaImage     string        // Image for --backend=ollama (server and pull Job)
+	ToolsImage      string        // llama.cpp image with llama-quantize (quantize command)
+	LlamaImage      string        // llama.cpp server image ("" = official; set by --rpc-image, --build-from-source or --cpu-variant)
+	RPCWorkers      int           // llama.cpp rpc-server pods the server offloads layers to (0 = none)
+	RPCWorkerCPU    string        // Their CPU limit ("" = none)
+	RPCWorkerMemory string        // Their memory request and limit ("" = none)
+	DraftMax        int           // LLAMA_ARG_DRAFT_MAX for draft models (0 = server default)
+	Parallel        int           // LLAMA_ARG_N_PARALLEL slots (0 = server default); each gets ctx/Parallel tokens
+	NPredict        int           // LLAMA_ARG_N_PREDICT: tokens a request may generate at most (0 = unlimited)
+	ContBatching    bool          // Continuous batching (LLAMA_ARG_CONT_BATCHING / LLAMA_ARG_NO_CONT_BATCHING)
+	BatchSize       int           // LLAMA_ARG_BATCH logical batch size (0 = server default)
+	CacheTypeK      string        // KV cache K type, LLAMA_ARG_CACHE_TYPE_K (f16 = server default)
+	CacheTypeV      string        // KV cache V type, LLAMA_ARG_CACHE_TYPE_V (quantized needs FlashAttn)
+	FlashAttn       bool          // LLAMA_ARG_FLASH_ATTN
+	KVOffload       bool          // Keep the KV cache on the GPU (LLAMA_ARG_NO_KV_OFFLOAD when false)
+	Replicas        int           // Server replicas (the HPA minimum when HPAMax > 0)
+	HPAMax          int           // HorizontalPodAutoscaler maximum (0 = no HPA)
+	HPACPUTarget    int           // HPA target CPU utilization, percent of the CPU limit
+	ModelVolume     string        // rwo (shared PVC), rwx (shared PVC) or per-replica (emptyDir)
+	ScaleToZero     string        // KEDA scale-to-zero: "" (off), http or prometheus
+	ScaleIdle       time.Duration // Idle time before KEDA scales to zero
+	KEDANamespace   string        // Where the KEDA HTTP add-on's interceptor runs
+	PrometheusURL   string        // Prometheus for --scale-to-zero=prometheus
+	PrometheusQuery string        // Request-rate query ("" = the router's per-route rate)
+	StorageClass    string        // StorageClass of the models PVC ("" = cluster default)
+	IntegritySched  string        // Cron schedule of the GGUF integrity CronJob ("" = none)
+	ModelHostPath   string        // Node directory backing the models PVC ("" = StorageClass)
+	HealthProbe     string        // llama.cpp readiness: http (/health) or tcp (old images)
+	InferenceProbe  bool          // The startup probe generates one token
+	PromptCache     bool          // Persist the server's slots (KV cache) on the models PVC
+	PromptCacheSize string        // Cap of /models/prompt-cache (oldest files removed)
+	PromptCacheSave time.Duration // How often the sidecar saves the slots
+	CacheTTL        time.Duration // Response cache TTL in the proxy sidecar (0 = no cache)
+	CacheMaxEntries int           // Responses the cache keeps at most
+	SidecarImage    string        // Python image running the proxy sidecar
+	CurlImage       string        // Image with sh and curl for the download/check containers
+	RateLimit       float64       // Requests per second per client (0 = unlimited)
+	RateLimitMode   string        // router (HAProxy annotations) or sidecar
+	UsagePVC        string        // PVC the proxy sidecar appends usage records to ("" = none)
+	UsageStorage    string        // Its size
+	Metrics         bool          // Serve Prometheus metrics on /metrics
+	ServiceMonitor  bool          // Create a ServiceMonitor scraping them
+	Observability   bool          // PodMonitor plus Grafana dashboard ConfigMap instead
+	DashboardNS     string        // Namespace of the dashboard ConfigMap
+	TLS             string        // "" (plain HTTP Ingress) or edge (TLS-terminating Route)
+	TLSInsecure     string        // Route insecureEdgeTerminationPolicy: Redirect, Allow or None
+	TLSCert         string        // PEM certificate from --tls-secret ("" = router's default)
+	TLSKey          string        // PEM key from --tls-secret
+	APIKeySecret    string        // Secret whose "api-key" key clients must send ("" = no auth)
+	ServerEnv       []string      // --server-env NAME=VALUE: extra server env, replacing ours of the same name
+	ServerArgs      []string      // --server-arg: extra server command-line arguments
+	Canary          string        // Service sharing the Route's traffic ("" = none; canary command)
+	CanaryWeight    int           // Percent of requests the Canary gets (100 while promoting)
+
+	// Node placement (--node-selector, --tolerations) for the server pods
+	// and the Jobs mounting the models PVC.
+	NodeSelector map[string]string
+	Tolerations  []corev1.Toleration
+}
+
+// modelStack is one model's set of objects: they all share ObjName, and the
+// Ingress (or, with --tls, the Route) serves the model at Scheme://Host.
+type modelStack struct {
+	Model   modelSpec
+	ObjName string
+	Host    string
+	Scheme  string // http, or https with --tls
+}
+
+// endpoint is the model's OpenAI chat completions URL.
+func (st modelStack) endpoint() string {
+	return st.Scheme + "://" + st.Host + "/v1/chat/completions"
+}
+
 // ---------- main entrypoint ----------
 func main() {
 	// -------------------------------
@@ -145,10 +1143,146 @@ func main() {
 	kubeconfig := flag.String("kubeconfig", filepath.Join(os.Getenv("HOME"), ".kube", "config"), "Path to kubeconfig")
 
 	// Model configuration.
-	modelURL := flag.String("model-url", "", "Direct URL to a GGUF model file (required)")
+	modelURL := flag.String("model-url", "", "Direct URL to a GGUF model file (required unless --models-file or --model-oci-ref)")
+	modelOCIRef := flag.String("model-oci-ref", "", "OCI artifact holding the GGUF, e.g. registry.internal/models/tinyllama:q4 (pulled with oras)")
+	modelFromPVC := flag.String("model-from-pvc", "", "Existing PVC (same namespace) to copy the GGUF from with a Job instead of downloading")
+	modelFromPVCPath := flag.String("model-from-pvc-path", "model.gguf", "Path of the GGUF inside --model-from-pvc")
 	modelName := flag.String("model-name", "local-gguf", "Logical model name used by clients")
+	modelSHA256 := flag.String("model-sha256", "", "Expected SHA256 of the GGUF file; verified after download and on every start")
 	ctxLen := flag.Int("ctx", 2048, "Context window tokens for llama.cpp")
 	nThreads := flag.Int("threads", 4, "CPU threads for llama.cpp")
+	cpuLimit := flag.String("cpu-limit", "", "CPU limit for the server container (none if empty)")
+	memoryLimit := flag.String("memory-limit", "", "Memory limit for the server container (none if empty)")
+	fitCtx := flag.String("fit-ctx", "warn", "llama.cpp: when --ctx's KV cache won't fit --memory-limit next to the weights: warn, adjust (lower ctx to fit) or off")
+	draftModelURL := flag.String("draft-model-url", "", "Direct URL to a small GGUF from the same model family, for speculative decoding")
+	draftMax := flag.Int("draft-max", 0, "Tokens the draft model proposes per step (0 = llama.cpp default)")
+	mmprojURL := flag.String("mmproj-url", "", "Direct URL to the multimodal projector GGUF of a vision model (enables image input)")
+	var loraURLs stringList
+	flag.Var(&loraURLs, "lora-url", "Direct URL to a GGUF LoRA adapter for the model (repeatable)")
+	var serverEnv, serverArgs stringList
+	flag.Var(&serverEnv, "server-env", "Extra server environment variable NAME=VALUE, e.g. LLAMA_ARG_DEFRAG_THOLD=0.1 (repeatable; replaces the deployer's own)")
+	flag.Var(&serverArgs, "server-arg", "Extra server command-line argument, e.g. --no-warmup (repeatable; one word each)")
+	chatTemplate := flag.String("chat-template", "", "Built-in llama.cpp chat template to use instead of the GGUF's, e.g. chatml, llama3 or mistral-v3")
+
+	// Client connection bundle, written once every model is verified.
+	bundleFile := flag.String("bundle-file", "", "Write the endpoint's client settings to this file (0600; one per model with --models-file)")
+	bundleFormat := flag.String("bundle-format", "dotenv", "--bundle-file format: dotenv (OPENAI_* variables) or json")
+	bundleNamespace := flag.String("bundle-namespace", "", "Also put the client settings in a Secret <name>-client in this (consumer) namespace")
+	bundleKeyRef := flag.Bool("bundle-key-ref", false, "--bundle-file names the API key's Secret instead of holding the key")
+
+	// Several models at once: one Deployment/Service/Ingress per entry.
+	preset := flag.String("preset", "", "Known model to deploy ("+presetNames()+"); sets URL, ctx, threads and memory unless given explicitly, and verifies the download against its SHA256")
+	modelsFilePath := flag.String("models-file", "", "YAML/JSON file listing models (name, url, ctx, threads, cpu, memory, gpu) to deploy side by side")
+
+	// Endpoint authentication. The key lives in the <name>-api-key Secret;
+	// an empty --api-key reuses the one there or generates a new one.
+	apiKey := flag.String("api-key", "", "API key clients must send as \"Authorization: Bearer\" (empty = reuse or generate; stored in the <name>-api-key Secret)")
+	noAuth := flag.Bool("no-auth", false, "Expose the endpoint without an API key (ollama has no key support)")
+
+	// Hugging Face access token for gated models (pick one).
+	hfToken := flag.String("hf-token", "", "Hugging Face token for gated models (stored in the <name>-hf-token Secret)")
+	hfTokenSecret := flag.String("hf-token-secret", "", "Existing Secret with the Hugging Face token under key \"token\"")
+
+	// OCI registry access for --model-oci-ref.
+	orasImage := flag.String("oras-image", "ghcr.io/oras-project/oras:v1.2.0", "Image with oras used to pull OCI model artifacts")
+	ociPullSecret := flag.String("oci-pull-secret", "", "kubernetes.io/dockerconfigjson Secret with registry credentials for --model-oci-ref")
+	ociPlainHTTP := flag.Bool("oci-plain-http", false, "Pull OCI model artifacts over plain HTTP (insecure in-cluster registries)")
+
+	// Segmented downloads: several connections per file cut first-deploy
+	// time for multi-GB models on fast links.
+	downloader := flag.String("downloader", "curl", "Tool downloading model URLs: curl (one stream) or aria2 (segmented, parallel)")
+	aria2Image := flag.String("aria2-image", "", "--downloader=aria2 (required): image with sh and aria2c (curl, if present, sizes files and resolves gated redirects). It gets HF_TOKEN, so use one you trust, ideally pinned by digest")
+	aria2Split := flag.Int("aria2-split", 8, "--downloader=aria2: segments each file is downloaded in")
+	aria2Conns := flag.Int("aria2-connections", 8, "--downloader=aria2: connections per server (1-16)")
+	aria2MinSplit := flag.String("aria2-min-split-size", "20M", "--downloader=aria2: smallest segment (1M-1024M)")
+
+	// Serving stack. vllm and tgi serve Hugging Face repos (not GGUF) on GPUs.
+	backend := flag.String("backend", "llamacpp", "Server to deploy: llamacpp, vllm, ollama or tgi (OpenAI API either way)")
+	hfModel := flag.String("hf-model", "", "Hugging Face repo id for --backend=vllm/tgi, e.g. Qwen/Qwen2.5-0.5B-Instruct")
+	vllmImage := flag.String("vllm-image", "docker.io/vllm/vllm-openai:v0.6.3", "vLLM OpenAI server image")
+	tgiImage := flag.String("tgi-image", "ghcr.io/huggingface/text-generation-inference:2.4.0", "Text Generation Inference image")
+	tgiQuantize := flag.String("tgi-quantize", "", "TGI --quantize method (e.g. awq, gptq, eetq, bitsandbytes-nf4); empty = none")
+	ollamaModel := flag.String("ollama-model", "", "Ollama library model for --backend=ollama, e.g. llama3.2:1b (served as --model-name)")
+	ollamaImage := flag.String("ollama-image", "docker.io/ollama/ollama:0.3.14", "Ollama server image")
+
+	// GPU mode (0 = CPU-only inference).
+	gpus := flag.Int("gpu", 0, "Number of NVIDIA GPUs to request; >0 switches to the CUDA server image")
+	gpuLayers := flag.Int("gpu-layers", 999, "Layers to offload to the GPU when --gpu > 0 (999 = all)")
+
+	// llama.cpp request batching.
+	parallel := flag.Int("parallel", 0, "llama.cpp: parallel decoding slots (0 = server default); the context is split between them")
+	contBatching := flag.Bool("cont-batching", true, "llama.cpp: continuous batching (new requests join a running batch)")
+	batchSize := flag.Int("batch-size", 0, "llama.cpp: logical batch size for prompt processing (0 = server default)")
+	nPredict := flag.Int("n-predict", 0, "llama.cpp: most tokens one request may generate, also capping clients' max_tokens (0 = unlimited); checked after deploying")
+
+	// llama.cpp KV cache: quantizing it fits longer contexts into less memory.
+	cacheTypeK := flag.String("cache-type-k", "f16", "llama.cpp: KV cache type for K, e.g. f16 or q8_0")
+	cacheTypeV := flag.String("cache-type-v", "f16", "llama.cpp: KV cache type for V, e.g. f16 or q8_0 (quantized turns on --flash-attn)")
+	flashAttn := flag.Bool("flash-attn", false, "llama.cpp: use flash attention")
+	kvOffload := flag.Bool("kv-offload", true, "llama.cpp: with --gpu, keep the KV cache in GPU memory")
+	gpuRuntimeClass := flag.String("gpu-runtime-class", "nvidia", "RuntimeClass for GPU pods (empty to use the node default)")
+
+	// Node placement, e.g. onto a GPU pool. Applies to the server pods
+	// (so also their fetch initContainers) and to every Job mounting the
+	// models PVC, which on multi-node clusters must attach where they run.
+	nodeSelector := flag.String("node-selector", "", "Comma-separated node labels the pods must match, e.g. nvidia.com/gpu.present=true")
+	tolerations := flag.String("tolerations", "", "Comma-separated taints the pods tolerate, as key[=value][:effect], e.g. nvidia.com/gpu:NoSchedule")
+
+	// Models PVC. Most 7B+ GGUFs don't fit the 5Gi default.
+	storageSize := flag.String("model-storage-size", "5Gi", "Size of the models PVC (must exceed the GGUF's size)")
+	storageClass := flag.String("model-storage-class", "", "StorageClass for the models PVC (empty = cluster default)")
+	modelHostPath := flag.String("model-hostpath", "", "Back the models PVC with this directory on the node (DIR/<model-name>, single-node CRC) instead of the StorageClass")
+	integritySchedule := flag.String("integrity-schedule", "", "Cron schedule (e.g. @weekly) of a CronJob re-hashing the GGUF on the PVC; a mismatch raises a Warning Event and fails the server's liveness probe (empty = off)")
+
+	// Scaling. Several replicas need a model volume they can all use.
+	replicas := flag.Int("replicas", 1, "Server replicas per model (minimum replicas with --hpa-max)")
+	hpaMax := flag.Int("hpa-max", 0, "Create a HorizontalPodAutoscaler scaling up to this many replicas (0 = none; needs --cpu-limit)")
+	hpaCPUTarget := flag.Int("hpa-cpu-target", 80, "HPA target CPU utilization in percent of --cpu-limit")
+	modelVolume := flag.String("model-volume", "rwo", "Model storage: rwo (ReadWriteOnce PVC), rwx (ReadWriteMany PVC shared by replicas) or per-replica (each pod downloads into an emptyDir)")
+
+	// Scale to zero with KEDA (the operator must already be installed).
+	scaleToZero := flag.String("scale-to-zero", "", "Let KEDA scale idle servers to zero: http (HTTP add-on wakes them on a request) or prometheus (router request rate); empty = off")
+	scaleIdle := flag.Duration("scale-to-zero-idle", 10*time.Minute, "Idle time before scaling to zero")
+	kedaNamespace := flag.String("keda-namespace", "keda", "Namespace of the KEDA HTTP add-on (its interceptor proxies the Ingress)")
+	prometheusURL := flag.String("keda-prometheus-url", "", "Prometheus URL KEDA queries for --scale-to-zero=prometheus")
+	prometheusQuery := flag.String("keda-prometheus-query", "", "Request-rate query for --scale-to-zero=prometheus (default: the router's rate for the model's route)")
+
+	// Prompt cache: llama.cpp's saved slots, so a restarted server doesn't
+	// process long shared prompts again.
+	promptCache := flag.Bool("prompt-cache", false, "llama.cpp: keep the slots' KV cache (processed prompts) on the models PVC across restarts")
+	promptCacheSize := flag.String("prompt-cache-size", "1Gi", "--prompt-cache: size cap of /models/prompt-cache (count it in --model-storage-size)")
+	promptCacheSave := flag.Duration("prompt-cache-interval", 5*time.Minute, "--prompt-cache: how often the slots are saved (and once more when the pod stops)")
+
+	// Response cache sidecar for demos sending the same prompts over and over.
+	cacheTTL := flag.Duration("cache-ttl", 0, "Cache responses to identical non-streamed requests this long in a sidecar (0 = no cache)")
+	cacheMaxEntries := flag.Int("cache-max-entries", 1000, "Responses the proxy sidecar caches at most (oldest evicted first)")
+	sidecarImage := flag.String("sidecar-image", "registry.access.redhat.com/ubi9/python-311:latest", "Python image running the cache/rate-limit sidecar")
+
+	// Rate limiting, so one client can't saturate a shared CPU-only server.
+	rateLimit := flag.Float64("rate-limit", 0, "Requests per second each client IP may send (0 = unlimited)")
+	rateLimitMode := flag.String("rate-limit-mode", "router", "How --rate-limit is enforced: router (OpenShift HAProxy annotations, connections dropped) or sidecar (proxy in the pod answering 429)")
+
+	// Usage accounting: per-request records for chargeback, read back with
+	// the usage command.
+	usageLog := flag.Bool("usage-log", false, "Record each request's tokens and latency (JSON lines) on the <name>-usage-pvc PVC, via the proxy sidecar (ReadWriteMany unless --model-volume=rwo)")
+	usageStorage := flag.String("usage-storage", "1Gi", "Size of the usage PVC")
+
+	// Readiness for llama.cpp: /health reports whether the model is loaded.
+	inferenceProbe := flag.Bool("inference-probe", false, "llama.cpp: the startup probe generates one token, so a model that loads but can't run inference never turns Ready")
+	healthProbe := flag.String("health-probe", "http", "llama.cpp probes: http (/health, Ready once the model is loaded) or tcp (images without /health)")
+
+	// Prometheus metrics (prompt/token throughput, queue depth). vLLM and
+	// TGI always serve them; llama.cpp needs them switched on.
+	metrics := flag.Bool("metrics", true, "Serve Prometheus metrics on /metrics (llama.cpp --metrics)")
+	serviceMonitor := flag.Bool("service-monitor", false, "Create a ServiceMonitor for the metrics (needs user workload monitoring)")
+	observability := flag.Bool("observability", false, "Create a PodMonitor for the llama.cpp metrics plus a Grafana dashboard ConfigMap (needs user workload monitoring)")
+	dashboardNS := flag.String("dashboard-namespace", "", "--observability: namespace of the dashboard ConfigMap (default --namespace; openshift-config-managed for the console)")
+
+	// TLS at the router. Tokens and prompts shouldn't cross the network in
+	// the clear; edge termination serves the endpoint over HTTPS.
+	tlsMode := flag.String("tls", "", "Terminate TLS at the router: edge (serves a Route instead of the Ingress); empty = plain HTTP")
+	tlsSecret := flag.String("tls-secret", "", "kubernetes.io/tls Secret with the certificate for --tls (empty = the router's default certificate)")
+	tlsInsecure := flag.String("tls-insecure-policy", "Redirect", "What --tls does with plain HTTP requests: Redirect, Allow or None")
 
 	// System prompt for the verification request (optional).
 	systemPrompt := flag.String("system", "You are a helpful local model.", "System prompt for verification chat")
@@ -156,379 +1290,7525 @@ func main() {
 	// Timeouts/TLS for the final verification HTTP request.
 	timeout := flag.Duration("timeout", 10*time.Minute, "Overall timeout for the setup")
 	insecureTLS := flag.Bool("insecure", true, "Allow insecure TLS (handy for local CRC)")
+	followDownload := flag.Bool("follow-download", true, "Stream the fetch-model initContainer's progress while waiting for readiness")
+	verifyStream := flag.Bool("verify-stream", false, "Verify with stream:true and require the reply to arrive as server-sent events")
+	verifyStreamChunks := flag.Int("verify-stream-min-chunks", 3, "Content chunks --verify-stream requires before [DONE]")
+	verifyParallel := flag.Bool("verify-parallel", false, "Also send --parallel requests at once and check they are decoded together")
+	verifyJSONSchema := flag.String("verify-json-schema", "", "JSON schema file: also verify a response_format-constrained reply parses and matches it")
+	verifyPrompt := flag.String("verify-prompt", "", "Also ask this question at temperature 0, e.g. \"What is the capital of France?\"")
+	verifyExpect := flag.String("verify-expect-regex", "", "Regular expression the answer to --verify-prompt must match, e.g. (?i)paris")
 
-	// Parse flags from CLI.
-	flag.Parse()
+	// benchmark: load-test already deployed models (same --name/--models-file).
+	benchRequests := flag.Int("bench-requests", 20, "benchmark: number of chat requests per model")
+	benchConcurrency := flag.Int("bench-concurrency", 4, "benchmark: requests in flight at once")
+	benchMaxTokens := flag.Int("bench-max-tokens", 128, "benchmark: max_tokens per request")
+	benchPrompt := flag.String("bench-prompt", "Write a short paragraph about high-performance computing.", "benchmark: user prompt")
+	benchFormat := flag.String("bench-format", "markdown", "benchmark: report format, markdown or json")
+	benchOutput := flag.String("bench-output", "", "benchmark: write the report to this file instead of stdout")
 
-	// Derive a default host like: <name>.<namespace>.apps-crc.testing
-	if *host == "" {
-		*host = fmt.Sprintf("%s.%s.apps-crc.testing", *name, *ns)
-	}
-	// We require a direct, curl'able GGUF URL (no login prompts/cookies).
-	if *modelURL == "" {
-		fatal("--model-url is required (a direct link to a .gguf file)")
-	}
+	// usage: summarize the --usage-log records.
+	usageBy := flag.String("usage-by", "key", "usage: group by key (API key hash), client (IP), model or day")
+	usageSince := flag.Duration("usage-since", 0, "usage: only count requests this recent, e.g. 168h (0 = all)")
+	usageFormat := flag.String("usage-format", "markdown", "usage: report format, markdown, json or jsonl (the raw records)")
+	usageOutput := flag.String("usage-output", "", "usage: write the report to this file instead of stdout")
 
-	// Create a context that automatically cancels after --timeout.
-	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
-	defer cancel()
+	// batch: offline completions over a prompts file.
+	promptsFile := flag.String("prompts-file", "", "batch: JSONL prompts, a local file (up to ~900KiB) or pvc://<claim>/<path>")
+	batchOutput := flag.String("batch-output", "", "batch: where results go, pvc://<claim>/<dir>/ (default pvc://<name>-batch-results/; created if missing)")
+	batchConcurrency := flag.Int("batch-concurrency", 4, "batch: requests in flight at once")
+	batchMaxTokens := flag.Int("batch-max-tokens", 256, "batch: max_tokens for prompts that don't set it")
+	batchStorage := flag.String("batch-storage", "1Gi", "batch: size of the output PVC when it is created")
 
-	// ---------------------
-	// Build Kubernetes client
-	// ---------------------
-	// Load kubeconfig exactly like kubectl does.
-	cfg, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
-	must(err, "load kubeconfig")
-	// Build the typed clientset (CoreV1, AppsV1, etc.).
-	cs, err := kubernetes.NewForConfig(cfg)
-	must(err, "create clientset")
+	// set-model: rotate a deployed llama.cpp model in place (--model-url,
+	// --model-name and --model-sha256 describe the new one).
+	keepOldModels := flag.Bool("keep-old-models", false, "set-model: keep the previous GGUF files instead of pruning them")
 
-	// -----------------------
-	// Ensure Namespace exists
-	// -----------------------
-	fmt.Printf("Ensuring namespace %q exists...\n", *ns)
-	must(ensureNamespace(ctx, cs, *ns), "ensure namespace")
+	// quantize: deploy from a full-precision GGUF converted in the cluster.
+	sourceURL := flag.String("source-url", "", "quantize: direct URL to the F16/BF16 GGUF to quantize")
+	var quants stringList
+	flag.Var(&quants, "quant", "quantize: llama-quantize type, e.g. Q4_K_M, Q5_K_M or Q8_0 (default Q4_K_M); compare: give it twice")
+	toolsImage := flag.String("tools-image", "ghcr.io/ggerganov/llama.cpp:full", "quantize: llama.cpp image with llama-quantize")
 
-	// -------------------------------
-	// Create/Update the ConfigMap
-	// -------------------------------
-	// A ConfigMap stores non-secret key/value config. We'll use it to:
-	// - pass the model URL to the initContainer
-	// - pass model parameters (ctx, threads, name, system prompt) to llama.cpp
-	cmName := *name + "-config"
-	cm := &corev1.ConfigMap{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      cmName,
-			Namespace: *ns,
-		},
-		Data: map[string]string{
-			"MODEL_URL":     *modelURL,
-			"MODEL_NAME":    *modelName,
-			"SYSTEM_PROMPT": *systemPrompt,
-			"CTX_LEN":       fmt.Sprintf("%d", *ctxLen),
-			"N_THREADS":     fmt.Sprintf("%d", *nThreads),
-		},
-	}
-	fmt.Println("Creating/updating ConfigMap...")
-	must(upsertConfigMap(ctx, cs, cm), "upsert configmap")
-
-	// -----------------------------------------
-	// Create/Update a PVC for persistent /models
-	// -----------------------------------------
-	// We use a 5Gi PVC so the downloaded model survives pod restarts.
-	// On CRC, a default StorageClass usually exists and will bind this PVC.
-	pvcName := *name + "-models-pvc"
-	pvc := &corev1.PersistentVolumeClaim{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      pvcName,
-			Namespace: *ns,
-		},
-		Spec: corev1.PersistentVolumeClaimSpec{
-			AccessModes: []corev1.PersistentVolumeAccessMode{
-				corev1.ReadWriteOnce, // good for single-node CRC
-			},
-			Resources: corev1.ResourceRequirements{
-				Requests: corev1.ResourceList{
-					corev1.ResourceStorage: resource.MustParse("5Gi"),
-				},
-			},
-		},
-	}
-	fmt.Println("Creating/updating PVC (persistent /models)...")
-	must(upsertPVC(ctx, cs, pvc), "upsert pvc")
+	// Build llama-server in the cluster instead of pulling the official image.
+	buildFromSource := flag.Bool("build-from-source", false, "Build the llama.cpp server image with an OpenShift BuildConfig and deploy that")
+	llamaCppGit := flag.String("llama-cpp-git", "https://github.com/ggerganov/llama.cpp.git", "--build-from-source: llama.cpp repository (e.g. an internal mirror)")
+	llamaCppRef := flag.String("llama-cpp-ref", "", "--build-from-source: tag or branch to build, e.g. b4000")
+	cmakeFlags := flag.String("cmake-flags", "", "--build-from-source: extra CMake flags, e.g. \"-DGGML_AVX512=OFF -DGGML_BLAS=ON -DGGML_BLAS_VENDOR=OpenBLAS\"")
 
-	// ------------------------------------------------------------------
-	// Build the Deployment: initContainer (download) + llama.cpp server
-	// ------------------------------------------------------------------
-	labels := map[string]string{"app": *name}
+	// Experimental: spread a llama.cpp model over several pods (RPC backend).
+	rpcWorkers := flag.Int("rpc-workers", 0, "Experimental: llama.cpp rpc-server pods the server offloads the model's layers to (0 = none)")
+	rpcImage := flag.String("rpc-image", "", "--rpc-workers: llama.cpp image built with -DGGML_RPC=ON (entrypoint llama-server, /app/rpc-server), unless --build-from-source")
+	rpcWorkerCPU := flag.String("rpc-worker-cpu", "", "--rpc-workers: CPU limit of each worker (none if empty)")
+	rpcWorkerMemory := flag.String("rpc-worker-memory", "", "--rpc-workers: memory request and limit of each worker, e.g. 4Gi (none if empty)")
+
+	// Which CPU architecture the pods run on, and its images.
+	arch := flag.String("arch", "auto", "CPU architecture of the nodes to run on: auto (the nodes', if they agree), amd64 or arm64")
+	curlImage := flag.String("curl-image", "curlimages/curl:8.10.1", "Image with sh and curl for the model download and check containers (multi-arch)")
+
+	// Which llama.cpp CPU build the nodes can run.
+	cpuVariant := flag.String("cpu-variant", "", "llama.cpp server image variant for CPU models: auto (detect from the nodes), avx512, avx2, noavx or arm64 (default: the official image, which needs AVX2 on x86)")
+	cpuVariantImages := flag.String("cpu-variant-images", "", "Images for --cpu-variant, as variant=image,... (default: the official multi-arch image for avx512, avx2 and arm64; none for noavx)")
+
+	// upload-model: deploy a GGUF from this machine (air-gapped clusters).
+	uploadFile := flag.String("file", "", "upload-model: local GGUF to stream into the models PVC")
+
+	// gateway: one OpenAI endpoint routing to already deployed models.
+	gatewayImage := flag.String("gateway-image", "registry.access.redhat.com/ubi9/python-311:latest", "gateway: Python image running the proxy")
+	gatewayHost := flag.String("gateway-host", "", "gateway: hostname (default <name>-gateway.<namespace>.apps-crc.testing)")
+
+	// compare: whether the slower quantization stays deployed.
+	keepBoth := flag.Bool("keep-both", false, "compare: keep both quantizations deployed instead of removing the slower one")
+
+	// canary: share of the main Route's requests the new model gets.
+	canaryWeight := flag.Int("weight", 10, "canary: percent of requests sent to the canary (1-99)")
+
+	// An optional command name may precede the flags; plain flags mean "deploy".
+	command := "deploy"
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	// Parse flags from CLI.
+	flag.Parse()
+
+	switch command {
+	case "deploy":
+	case "set-model":
+		if *modelsFilePath != "" || *modelURL == "" {
+			fatal("set-model rotates one model: give --model-url (and --model-name), not --models-file")
+		}
+	case "quantize", "compare":
+		if *modelsFilePath != "" || *sourceURL == "" {
+			fatal("%s deploys one model: give --source-url (and --quant, --model-name), not --models-file", command)
+		}
+		if *modelURL != "" || *modelOCIRef != "" || *modelFromPVC != "" || *preset != "" {
+			fatal("%s takes its model from --source-url; drop --model-url/--model-oci-ref/--model-from-pvc/--preset", command)
+		}
+		if *modelSHA256 != "" {
+			fatal("--model-sha256 checks a downloaded file; %s makes the served GGUF in the cluster", command)
+		}
+		if *backend != "llamacpp" {
+			fatal("%s produces a GGUF for --backend=llamacpp", command)
+		}
+		if len(quants) == 0 && command == "quantize" {
+			quants = stringList{"Q4_K_M"}
+		}
+		if command == "quantize" && len(quants) != 1 {
+			fatal("quantize makes one --quant; compare two with the compare command")
+		}
+		if command == "compare" && (len(quants) != 2 || strings.EqualFold(quants[0], quants[1])) {
+			fatal("compare needs two different --quant types, e.g. --quant=Q4_K_M --quant=Q5_K_M")
+		}
+		if command == "compare" && (*benchRequests < 1 || *benchConcurrency < 1 || *benchMaxTokens < 1) {
+			fatal("--bench-requests, --bench-concurrency and --bench-max-tokens must be >= 1")
+		}
+	case "upload-model":
+		if *modelsFilePath != "" || *uploadFile == "" {
+			fatal("upload-model deploys one model: give --file (and --model-name), not --models-file")
+		}
+		if *modelURL != "" || *modelOCIRef != "" || *modelFromPVC != "" || *preset != "" {
+			fatal("upload-model takes its model from --file; drop --model-url/--model-oci-ref/--model-from-pvc/--preset")
+		}
+		if *backend != "llamacpp" {
+			fatal("upload-model serves a GGUF with --backend=llamacpp")
+		}
+		// Each pod would need its own upload.
+		if *modelVolume == "per-replica" {
+			fatal("upload-model fills the models PVC; --model-volume=per-replica has none")
+		}
+		must(checkLocalGGUF(*uploadFile), "--file")
+	case "swap":
+		if *modelsFilePath != "" {
+			fatal("swap upgrades one model (--name); --models-file isn't supported")
+		}
+		// Both would keep scaling the Deployment swap just scaled down.
+		if *scaleToZero != "" {
+			fatal("swap scales Deployments itself; drop --scale-to-zero")
+		}
+	case "canary", "promote", "abort":
+		if *modelsFilePath != "" {
+			fatal("%s works on one model (--name); --models-file isn't supported", command)
+		}
+		if command == "canary" && (*canaryWeight < 1 || *canaryWeight > 99) {
+			fatal("--weight must be between 1 and 99, got %d", *canaryWeight)
+		}
+		// The interceptor routes by host, and the canary has its own.
+		if *scaleToZero == "http" {
+			fatal("%s splits traffic in the Route, which --scale-to-zero=http hands to the KEDA interceptor", command)
+		}
+	case "gateway":
+	case "benchmark":
+		if *benchRequests < 1 || *benchConcurrency < 1 || *benchMaxTokens < 1 {
+			fatal("--bench-requests, --bench-concurrency and --bench-max-tokens must be >= 1")
+		}
+		if *benchFormat != "markdown" && *benchFormat != "json" {
+			fatal("--bench-format must be markdown or json, got %q", *benchFormat)
+		}
+	case "usage":
+		if *usageBy != "key" && *usageBy != "client" && *usageBy != "model" && *usageBy != "day" {
+			fatal("--usage-by must be key, client, model or day, got %q", *usageBy)
+		}
+		if *usageFormat != "markdown" && *usageFormat != "json" && *usageFormat != "jsonl" {
+			fatal("--usage-format must be markdown, json or jsonl, got %q", *usageFormat)
+		}
+		if *usageSince < 0 {
+			fatal("--usage-since must be >= 0")
+		}
+	case "batch":
+		if *promptsFile == "" {
+			fatal("batch needs --prompts-file (a local JSONL file or pvc://<claim>/<path>)")
+		}
+		if *batchConcurrency < 1 || *batchMaxTokens < 1 {
+			fatal("--batch-concurrency and --batch-max-tokens must be >= 1")
+		}
+		if *batchOutput == "" {
+			*batchOutput = "pvc://" + *name + "-batch-results/"
+		}
+		if _, _, err := parsePVCPath(*batchOutput); err != nil {
+			fatal("--batch-output: %v", err)
+		}
+		if _, err := resource.ParseQuantity(*batchStorage); err != nil {
+			fatal("invalid --batch-storage %q: %v", *batchStorage, err)
+		}
+	default:
+		fatal("unknown command %q (deploy, set-model, swap, quantize, compare, upload-model, canary, promote, abort, gateway, benchmark, usage or batch)", command)
+	}
+
+	// The flags double as defaults for every entry in --models-file.
+	defaults := modelSpec{
+		Name:         *modelName,
+		URL:          *modelURL,
+		OCIRef:       *modelOCIRef,
+		FromPVC:      *modelFromPVC,
+		DraftURL:     *draftModelURL,
+		ChatTemplate: *chatTemplate,
+		LoRAURLs:     loraURLs,
+		MMProjURL:    *mmprojURL,
+		Ctx:          *ctxLen,
+		Threads:      *nThreads,
+		CPU:          *cpuLimit,
+		Memory:       *memoryLimit,
+		GPU:          *gpus,
+		SHA256:       *modelSHA256,
+		Storage:      *storageSize,
+
+		FromPVCPath: *modelFromPVCPath,
+		Backend:     *backend,
+		HFModel:     *hfModel,
+		OllamaModel: *ollamaModel,
+		Quantize:    *tgiQuantize,
+	}
+	if command == "upload-model" {
+		defaults.LocalFile = *uploadFile
+	}
+	if command == "quantize" || command == "compare" {
+		defaults.SourceURL, defaults.Quant = *sourceURL, quants[0]
+	}
+	// vLLM and TGI have no CPU mode worth deploying; default to one GPU.
+	if (defaults.Backend == "vllm" || defaults.Backend == "tgi") && defaults.GPU == 0 {
+		defaults.GPU = 1
+	}
+
+	// A preset replaces the flag defaults, but not flags given explicitly.
+	if *preset != "" {
+		explicit := map[string]bool{}
+		flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+		if !explicit["model-name"] {
+			defaults.Name = ""
+		}
+		if !explicit["ctx"] {
+			defaults.Ctx = 0
+		}
+		if !explicit["threads"] {
+			defaults.Threads = 0
+		}
+		if !explicit["model-storage-size"] {
+			defaults.Storage = ""
+		}
+		must(defaults.applyPreset(*preset), "--preset")
+		if defaults.Storage == "" {
+			defaults.Storage = *storageSize
+		}
+	}
+
+	// Work out which model stacks to deploy. A single model keeps the
+	// historical names (<name>, <name>-config, ...); with a models file each
+	// model gets <name>-<model> objects and its own host.
+	var stacks []modelStack
+	if *modelsFilePath != "" {
+		if *host != "" {
+			fatal("--host applies to a single model; with --models-file each model gets <name>-<model>.<ns>.apps-crc.testing")
+		}
+		// A draft model only works with models sharing its vocabulary.
+		if *draftModelURL != "" {
+			fatal("--draft-model-url applies to a single model; set draft_url per entry in --models-file")
+		}
+		// Likewise, a template is only right for some models.
+		if *chatTemplate != "" {
+			fatal("--chat-template applies to a single model; set chat_template per entry in --models-file")
+		}
+		// And so are adapters, which are trained against one base model.
+		if len(loraURLs) > 0 {
+			fatal("--lora-url applies to a single model; set lora_urls per entry in --models-file")
+		}
+		if *mmprojURL != "" {
+			fatal("--mmproj-url applies to a single model; set mmproj_url per entry in --models-file")
+		}
+		models, err := readModelsFile(*modelsFilePath, defaults)
+		must(err, "read models file")
+		for _, m := range models {
+			objName := *name + "-" + m.Name
+			stacks = append(stacks, modelStack{
+				Model:   m,
+				ObjName: objName,
+				Host:    fmt.Sprintf("%s.%s.apps-crc.testing", objName, *ns),
+			})
+		}
+	} else {
+		// Derive a default host like: <name>.<namespace>.apps-crc.testing
+		if *host == "" {
+			*host = fmt.Sprintf("%s.%s.apps-crc.testing", *name, *ns)
+		}
+		// We require a direct, curl'able GGUF URL (no login prompts/cookies)
+		// or an OCI reference; validate() below checks for exactly one.
+		stacks = append(stacks, modelStack{Model: defaults, ObjName: *name, Host: *host})
+	}
+	// compare deploys the model once per quantization, side by side.
+	if command == "compare" {
+		stacks = nil
+		for _, q := range quants {
+			st := modelStack{Model: defaults, ObjName: *name + "-" + strings.ReplaceAll(strings.ToLower(q), "_", "-")}
+			st.Model.Quant = q
+			st.Host = fmt.Sprintf("%s.%s.apps-crc.testing", st.ObjName, *ns)
+			stacks = append(stacks, st)
+		}
+	}
+	// benchmark, gateway, abort, usage and batch only need names and hosts;
+	// the sources are already deployed.
+	for i := range stacks {
+		stacks[i].Model.SHA256 = strings.ToLower(stacks[i].Model.SHA256)
+		if command != "benchmark" && command != "gateway" && command != "abort" && command != "usage" && command != "batch" {
+			must(stacks[i].Model.expandShards(), "invalid model settings")
+			must(stacks[i].Model.validate(), "invalid model settings")
+		}
+	}
+
+	if *hfToken != "" && *hfTokenSecret != "" {
+		fatal("use either --hf-token or --hf-token-secret, not both")
+	}
+
+	if *parallel < 0 || *batchSize < 0 || *nPredict < 0 {
+		fatal("--parallel, --batch-size and --n-predict must be >= 0")
+	}
+	if *fitCtx != "warn" && *fitCtx != "adjust" && *fitCtx != "off" {
+		fatal("--fit-ctx must be warn, adjust or off, got %q", *fitCtx)
+	}
+	for _, t := range []string{*cacheTypeK, *cacheTypeV} {
+		if _, ok := kvCacheTypeBytes[t]; !ok {
+			fatal("unknown KV cache type %q (have: %s)", t, strings.Join(kvCacheTypeNames(), ", "))
+		}
+	}
+	// llama.cpp only supports a quantized V cache with flash attention.
+	if *cacheTypeV != "f16" && *cacheTypeV != "f32" && *cacheTypeV != "bf16" && !*flashAttn {
+		fmt.Printf("Note: --cache-type-v=%s needs flash attention; turning on --flash-attn.\n", *cacheTypeV)
+		*flashAttn = true
+	}
+	if *verifyParallel && *parallel < 2 {
+		fatal("--verify-parallel needs --parallel=2 or more")
+	}
+	// Every slot gets an equal share of the context window.
+	if *parallel > 1 && command != "benchmark" && command != "usage" && command != "batch" {
+		for _, st := range stacks {
+			if st.Model.Backend == "llamacpp" {
+				fmt.Printf("Note: model %q: %d slots share ctx=%d, so each request gets up to %d tokens of context.\n",
+					st.Model.Name, *parallel, st.Model.Ctx, st.Model.Ctx / *parallel)
+			}
+		}
+	}
+
+	// Expected-answer check: a model with the wrong chat template or a
+	// broken quantization still says hello, but rarely answers correctly.
+	var expectRegex *regexp.Regexp
+	if *verifyExpect != "" {
+		if *verifyPrompt == "" {
+			fatal("--verify-expect-regex needs --verify-prompt")
+		}
+		var err error
+		expectRegex, err = regexp.Compile(*verifyExpect)
+		must(err, "--verify-expect-regex")
+	}
+
+	// Structured-output check: load the schema now so a typo fails fast.
+	var jsonSchema json.RawMessage
+	if *verifyJSONSchema != "" {
+		data, err := os.ReadFile(*verifyJSONSchema)
+		must(err, "read --verify-json-schema")
+		var probe map[string]any
+		if err := json.Unmarshal(data, &probe); err != nil {
+			fatal("--verify-json-schema: %s is not a JSON object: %v", *verifyJSONSchema, err)
+		}
+		jsonSchema = data
+		for _, st := range stacks {
+			// The Ollama release we deploy only knows {"type":"json_object"}.
+			if st.Model.Backend == "ollama" {
+				fatal("model %q: --verify-json-schema isn't supported with the ollama backend", st.Model.Name)
+			}
+		}
+	}
+
+	switch *modelVolume {
+	case "rwo", "rwx", "per-replica":
+	default:
+		fatal("--model-volume must be rwo, rwx or per-replica, got %q", *modelVolume)
+	}
+	if *replicas < 1 {
+		fatal("--replicas must be >= 1")
+	}
+	if *hpaMax != 0 && (*hpaMax < *replicas || *hpaCPUTarget < 1) {
+		fatal("--hpa-max must be >= --replicas and --hpa-cpu-target >= 1")
+	}
+	switch *tlsMode {
+	case "", "edge":
+	default:
+		fatal("--tls must be edge (or empty for plain HTTP), got %q", *tlsMode)
+	}
+	switch *tlsInsecure {
+	case "Redirect", "Allow", "None":
+	default:
+		fatal("--tls-insecure-policy must be Redirect, Allow or None, got %q", *tlsInsecure)
+	}
+	if *tlsSecret != "" && *tlsMode == "" {
+		fatal("--tls-secret needs --tls=edge")
+	}
+	for i := range stacks {
+		stacks[i].Scheme = "http"
+		if *tlsMode != "" {
+			stacks[i].Scheme = "https"
+		}
+	}
+
+	switch *scaleToZero {
+	case "", "http":
+	case "prometheus":
+		if *prometheusURL == "" {
+			fatal("--scale-to-zero=prometheus needs --keda-prometheus-url")
+		}
+	default:
+		fatal("--scale-to-zero must be http or prometheus, got %q", *scaleToZero)
+	}
+	for _, st := range stacks {
+		if !*noAuth && st.Model.Backend == "ollama" {
+			fatal("model %q: ollama can't check an API key; pass --no-auth to expose it unauthenticated", st.Model.Name)
+		}
+		// The pull Job talks to the server directly, so it must be up.
+		if *scaleToZero != "" && st.Model.Backend == "ollama" {
+			fatal("model %q: --scale-to-zero doesn't work with the ollama backend", st.Model.Name)
+		}
+		// The HPA measures utilization against the request, which defaults
+		// to the limit; without one there is nothing to measure against.
+		// (With KEDA, --hpa-max is only the replica ceiling.)
+		if *hpaMax > 0 && *scaleToZero == "" && st.Model.CPU == "" {
+			fatal("model %q: --hpa-max needs a CPU limit (--cpu-limit or cpu:)", st.Model.Name)
+		}
+		// Both put the model into the PVC once, outside the server pods.
+		if st.Model.DraftURL != "" && st.Model.Backend != "llamacpp" {
+			fatal("model %q: draft models (speculative decoding) need --backend=llamacpp", st.Model.Name)
+		}
+		if *modelVolume == "per-replica" && (st.Model.FromPVC != "" || st.Model.SourceURL != "" || st.Model.Backend == "ollama") {
+			fatal("model %q: --model-volume=per-replica doesn't work with from_pvc, quantize or the ollama backend", st.Model.Name)
+		}
+		// A re-download is the cure, so only downloaded GGUFs are checked.
+		if *integritySchedule != "" && (st.Model.URL == "" || st.Model.Backend != "llamacpp") {
+			fmt.Printf("Note: model %q: --integrity-schedule only checks GGUFs downloaded from a URL; skipping it.\n", st.Model.Name)
+		}
+	}
+	if *integritySchedule != "" {
+		if *modelVolume == "per-replica" {
+			fatal("--integrity-schedule checks the models PVC; --model-volume=per-replica has none")
+		}
+		if !strings.HasPrefix(*integritySchedule, "@") && len(strings.Fields(*integritySchedule)) != 5 {
+			fatal("--integrity-schedule must be a cron schedule like \"0 3 * * 0\" or @weekly, got %q", *integritySchedule)
+		}
+	}
+	if *promptCache {
+		if _, err := resource.ParseQuantity(*promptCacheSize); err != nil {
+			fatal("invalid --prompt-cache-size %q: %v", *promptCacheSize, err)
+		}
+		if *promptCacheSave < time.Minute {
+			fatal("--prompt-cache-interval must be at least 1m")
+		}
+		for _, st := range stacks {
+			if st.Model.Backend != "llamacpp" {
+				fatal("model %q: --prompt-cache saves llama.cpp slots; it needs --backend=llamacpp", st.Model.Name)
+			}
+		}
+		if *modelVolume == "per-replica" {
+			fmt.Println("Note: with --model-volume=per-replica the prompt cache only survives container restarts, not new pods.")
+		}
+	}
+	if *cacheTTL < 0 || *cacheMaxEntries < 1 {
+		fatal("--cache-ttl must be >= 0 and --cache-max-entries >= 1")
+	}
+	if *rateLimit < 0 {
+		fatal("--rate-limit must be >= 0")
+	}
+	if *rateLimitMode != "router" && *rateLimitMode != "sidecar" {
+		fatal("--rate-limit-mode must be router or sidecar, got %q", *rateLimitMode)
+	}
+	if *downloader != "curl" && *downloader != "aria2" {
+		fatal("--downloader must be curl or aria2, got %q", *downloader)
+	}
+	if *downloader == "aria2" && *aria2Image == "" {
+		// No default: a third-party image would be handed HF_TOKEN.
+		fatal("--downloader=aria2 needs --aria2-image (an image you trust with HF_TOKEN, ideally pinned by digest)")
+	}
+	if *aria2Split < 1 || *aria2Conns < 1 || *aria2Conns > 16 {
+		fatal("--aria2-split must be >= 1 and --aria2-connections between 1 and 16")
+	}
+	if !regexp.MustCompile(`^[0-9]+[KM]$`).MatchString(*aria2MinSplit) {
+		fatal("--aria2-min-split-size must be like 20M, got %q", *aria2MinSplit)
+	}
+	if _, err := resource.ParseQuantity(*usageStorage); err != nil {
+		fatal("invalid --usage-storage %q: %v", *usageStorage, err)
+	}
+	if *buildFromSource {
+		if *llamaCppRef == "" {
+			fatal("--build-from-source needs --llama-cpp-ref (a tag or branch, e.g. b4000)")
+		}
+		// The build is CPU only; GPUs use the official CUDA image.
+		for _, st := range stacks {
+			if st.Model.Backend != "llamacpp" || st.Model.GPU > 0 {
+				fatal("model %q: --build-from-source builds the CPU llama.cpp server; it needs --backend=llamacpp and no --gpu", st.Model.Name)
+			}
+		}
+	}
+	if *rpcWorkers < 0 {
+		fatal("--rpc-workers must be >= 0")
+	}
+	if *rpcWorkers > 0 {
+		// The workers serve one server at a time.
+		if *replicas > 1 || *hpaMax > 0 || *scaleToZero != "" {
+			fatal("--rpc-workers needs a single server replica (no --replicas, --hpa-max or --scale-to-zero)")
+		}
+		for _, st := range stacks {
+			if st.Model.Backend != "llamacpp" || st.Model.GPU > 0 {
+				fatal("model %q: --rpc-workers needs --backend=llamacpp and no --gpu", st.Model.Name)
+			}
+		}
+		switch {
+		case *rpcImage != "" && *buildFromSource:
+			fatal("pass either --rpc-image or --build-from-source, not both")
+		case *rpcImage == "" && !*buildFromSource:
+			fatal("--rpc-workers needs an image built with -DGGML_RPC=ON: --rpc-image, or --build-from-source")
+		case *buildFromSource && !strings.Contains(*cmakeFlags, "GGML_RPC=ON"):
+			*cmakeFlags = strings.TrimSpace(*cmakeFlags + " -DGGML_RPC=ON")
+		}
+		for _, q := range []string{*rpcWorkerCPU, *rpcWorkerMemory} {
+			if _, err := resource.ParseQuantity(q); q != "" && err != nil {
+				fatal("invalid --rpc-worker-cpu/--rpc-worker-memory %q: %v", q, err)
+			}
+		}
+		fmt.Println("Note: --rpc-workers is experimental; every token's activations cross the network, so expect it to be slow.")
+	}
+	for _, kv := range serverEnv {
+		k, _, ok := strings.Cut(kv, "=")
+		if errs := validation.IsEnvVarName(k); !ok || len(errs) > 0 {
+			fatal("--server-env %q must be NAME=VALUE with a valid variable name", kv)
+		}
+	}
+	// Ollama's image takes "serve" as its argument.
+	for _, st := range stacks {
+		if len(serverArgs) > 0 && st.Model.Backend == "ollama" {
+			fatal("model %q: --server-arg doesn't work with the ollama backend (use --server-env)", st.Model.Name)
+		}
+	}
+	if *bundleFormat != "dotenv" && *bundleFormat != "json" {
+		fatal("--bundle-format must be dotenv or json, got %q", *bundleFormat)
+	}
+	if *bundleNamespace != "" {
+		if errs := validation.IsDNS1123Label(*bundleNamespace); len(errs) > 0 {
+			fatal("invalid --bundle-namespace %q: %s", *bundleNamespace, strings.Join(errs, "; "))
+		}
+	}
+	if _, ok := cpuVariantRank[*cpuVariant]; !ok && *cpuVariant != "" && *cpuVariant != "auto" && *cpuVariant != "arm64" {
+		fatal("--cpu-variant must be auto, avx512, avx2, noavx or arm64, got %q", *cpuVariant)
+	}
+	variantImages, err := parseCPUVariantImages(*cpuVariantImages)
+	must(err, "--cpu-variant-images")
+	if *arch != "auto" && *arch != "amd64" && *arch != "arm64" {
+		fatal("--arch must be auto, amd64 or arm64, got %q", *arch)
+	}
+	if *modelHostPath != "" {
+		if !filepath.IsAbs(*modelHostPath) {
+			fatal("--model-hostpath must be an absolute path on the node, got %q", *modelHostPath)
+		}
+		// The directory is on one node; nothing is provisioned.
+		if *modelVolume != "rwo" || *storageClass != "" {
+			fatal("--model-hostpath replaces the StorageClass and needs --model-volume=rwo")
+		}
+	}
+	if *modelVolume == "rwo" && (*replicas > 1 || *hpaMax > 1) {
+		fmt.Println("Note: the models PVC (and --usage-log's) is ReadWriteOnce, so all replicas must run on one node (fine on CRC);")
+		fmt.Println("      use --model-volume=rwx or per-replica on multi-node clusters.")
+	}
+
+	opts := serverOptions{
+		SystemPrompt:    *systemPrompt,
+		GPULayers:       *gpuLayers,
+		GPURuntimeClass: *gpuRuntimeClass,
+		HFTokenSecret:   *hfTokenSecret,
+		ORASImage:       *orasImage,
+		Downloader:      *downloader,
+		Aria2Image:      *aria2Image,
+		Aria2Split:      *aria2Split,
+		Aria2Conns:      *aria2Conns,
+		Aria2MinSplit:   *aria2MinSplit,
+		OCIPullSecret:   *ociPullSecret,
+		OCIPlainHTTP:    *ociPlainHTTP,
+		VLLMImage:       *vllmImage,
+		TGIImage:        *tgiImage,
+		OllamaImage:     *ollamaImage,
+		ToolsImage:      *toolsImage,
+		LlamaImage:      *rpcImage,
+		RPCWorkers:      *rpcWorkers,
+		ServerEnv:       serverEnv,
+		ServerArgs:      serverArgs,
+		RPCWorkerCPU:    *rpcWorkerCPU,
+		RPCWorkerMemory: *rpcWorkerMemory,
+		DraftMax:        *draftMax,
+		Parallel:        *parallel,
+		NPredict:        *nPredict,
+		ContBatching:    *contBatching,
+		BatchSize:       *batchSize,
+		CacheTypeK:      *cacheTypeK,
+		CacheTypeV:      *cacheTypeV,
+		FlashAttn:       *flashAttn,
+		KVOffload:       *kvOffload,
+		Replicas:        *replicas,
+		HPAMax:          *hpaMax,
+		HPACPUTarget:    *hpaCPUTarget,
+		ModelVolume:     *modelVolume,
+		ScaleToZero:     *scaleToZero,
+		ScaleIdle:       *scaleIdle,
+		KEDANamespace:   *kedaNamespace,
+		PrometheusURL:   *prometheusURL,
+		PrometheusQuery: *prometheusQuery,
+		TLS:             *tlsMode,
+		TLSInsecure:     *tlsInsecure,
+		StorageClass:    *storageClass,
+		ModelHostPath:   *modelHostPath,
+		IntegritySched:  *integritySchedule,
+		CacheTTL:        *cacheTTL,
+		CacheMaxEntries: *cacheMaxEntries,
+		PromptCache:     *promptCache,
+		PromptCacheSize: *promptCacheSize,
+		PromptCacheSave: *promptCacheSave,
+		SidecarImage:    *sidecarImage,
+		CurlImage:       *curlImage,
+		RateLimit:       *rateLimit,
+		RateLimitMode:   *rateLimitMode,
+		UsageStorage:    *usageStorage,
+		HealthProbe:     *healthProbe,
+		InferenceProbe:  *inferenceProbe,
+		Metrics:         *metrics,
+		ServiceMonitor:  *serviceMonitor,
+		Observability:   *observability,
+		DashboardNS:     *dashboardNS,
+	}
+	if opts.DashboardNS == "" {
+		opts.DashboardNS = *ns
+	}
+	if *healthProbe != "http" && *healthProbe != "tcp" {
+		fatal("--health-probe must be http or tcp, got %q", *healthProbe)
+	}
+	if *serviceMonitor && !*metrics {
+		fatal("--service-monitor needs --metrics")
+	}
+	if *observability {
+		if !*metrics {
+			fatal("--observability needs --metrics")
+		}
+		// Both would scrape the same pods.
+		if *serviceMonitor {
+			fatal("use either --service-monitor or --observability, not both")
+		}
+		for _, st := range stacks {
+			if st.Model.Backend != "llamacpp" {
+				fmt.Printf("Note: model %q: --observability covers llama.cpp's metrics; skipping it.\n", st.Model.Name)
+			}
+		}
+	}
+	sel, err := parseNodeSelector(*nodeSelector)
+	must(err, "--node-selector")
+	tols, err := parseTolerations(*tolerations)
+	must(err, "--tolerations")
+	opts.NodeSelector, opts.Tolerations = sel, tols
+	if *usageLog {
+		opts.UsagePVC = *name + "-usage-pvc"
+	}
+	if *hfToken != "" {
+		opts.HFTokenSecret = *name + "-hf-token"
+	}
+	if !*noAuth {
+		opts.APIKeySecret = *name + "-api-key"
+	}
+
+	// Create a context that automatically cancels after --timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	// ---------------------
+	// Build Kubernetes client
+	// ---------------------
+	// Load kubeconfig exactly like kubectl does.
+	cfg, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	must(err, "load kubeconfig")
+	// Build the typed clientset (CoreV1, AppsV1, etc.).
+	cs, err := kubernetes.NewForConfig(cfg)
+	must(err, "create clientset")
+	// The dynamic client handles KEDA's custom resources.
+	dyn, err := dynamic.NewForConfig(cfg)
+	must(err, "create dynamic client")
+
+	// http.Client with a reasonable timeout. For local CRC with self-signed certs,
+	// you might set InsecureSkipVerify if switching to HTTPS.
+	httpClient := &http.Client{Timeout: 120 * time.Second}
+	if *insecureTLS {
+		httpClient.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // acceptable for local dev only
+		}
+	}
+
+	if command == "benchmark" {
+		key := *apiKey
+		if key == "" && opts.APIKeySecret != "" {
+			sec, err := cs.CoreV1().Secrets(*ns).Get(ctx, opts.APIKeySecret, metav1.GetOptions{})
+			must(err, "read API key Secret (or pass --api-key / --no-auth)")
+			key = string(sec.Data["api-key"])
+		}
+		bopts := benchOptions{
+			Requests:    *benchRequests,
+			Concurrency: *benchConcurrency,
+			MaxTokens:   *benchMaxTokens,
+			Prompt:      *benchPrompt,
+			APIKey:      key,
+		}
+		var results []benchResult
+		for _, st := range stacks {
+			fmt.Fprintf(os.Stderr, "Benchmarking %s (%d requests, %d at a time)...\n", st.endpoint(), bopts.Requests, bopts.Concurrency)
+			results = append(results, runBenchmark(ctx, httpClient, st, bopts))
+		}
+		must(writeBenchReport(results, *benchFormat, *benchOutput), "write benchmark report")
+		return
+	}
+
+	if command == "usage" {
+		fmt.Fprintf(os.Stderr, "Reading usage records from PVC %s-usage-pvc...\n", *name)
+		records, err := readUsage(ctx, cs, *ns, *name, *usageSince, opts)
+		must(err, "read usage records")
+		must(writeUsageReport(records, *usageBy, *usageFormat, *usageOutput), "write usage report")
+		return
+	}
+
+	if command == "batch" {
+		bopts := batchOptions{
+			Prompts:     *promptsFile,
+			Output:      *batchOutput,
+			Concurrency: *batchConcurrency,
+			MaxTokens:   *batchMaxTokens,
+			Storage:     *batchStorage,
+		}
+		for _, st := range stacks {
+			must(runBatch(ctx, cs, *ns, *name, st, bopts, opts), "batch over %q", st.Model.Name)
+		}
+		fmt.Println("Done.")
+		return
+	}
+
+	// -----------------------
+	// Ensure Namespace exists
+	// -----------------------
+	fmt.Printf("Ensuring namespace %q exists...\n", *ns)
+	must(ensureNamespace(ctx, cs, *ns), "ensure namespace")
+
+	// -------------------------------
+	// Hugging Face token Secret (optional)
+	// -------------------------------
+	// Shared by all models of this run. Only the Secret's name is printed.
+	if *hfToken != "" {
+		fmt.Printf("Creating/updating Secret %q (Hugging Face token)...\n", opts.HFTokenSecret)
+		must(upsertSecret(ctx, cs, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      opts.HFTokenSecret,
+				Namespace: *ns,
+				Labels:    map[string]string{"app": *name},
+			},
+			Type:       corev1.SecretTypeOpaque,
+			StringData: map[string]string{"token": *hfToken},
+		}), "upsert hf token secret")
+	}
+
+	// -------------------------------
+	// Preset checksums
+	// -------------------------------
+	// A preset's GGUF is never downloaded unverified: without a pinned
+	// SHA256 (or --model-sha256) it is checked against the hash Hugging
+	// Face lists for the file.
+	for i := range stacks {
+		m := &stacks[i].Model
+		if m.Preset == "" || m.SHA256 != "" || m.URL != modelPresets[m.Preset].URL || command == "gateway" || command == "abort" {
+			continue
+		}
+		sum, err := hubSHA256(ctx, httpClient, m.URL, *hfToken)
+		if err != nil {
+			fatal("preset %q has no pinned SHA256 and Hugging Face didn't list one (%v); pass --model-sha256 (or sha256:)", m.Preset, err)
+		}
+		fmt.Printf("Model %q: verifying against Hugging Face's SHA256 %s\n", m.Name, sum)
+		m.SHA256 = sum
+	}
+
+	// -------------------------------
+	// Check the models fit their PVCs
+	// -------------------------------
+	// A too-small PVC only shows up as a failed download much later. (Only
+	// URLs can be checked up front; OCI and PVC sources are sized elsewhere.
+	// set-model checks against the existing PVC itself.)
+	for _, st := range stacks {
+		if st.Model.LocalFile != "" {
+			info, err := os.Stat(st.Model.LocalFile)
+			must(err, "--file")
+			if pvcSize := resource.MustParse(st.Model.Storage); info.Size() >= pvcSize.Value() {
+				fatal("model %q needs %s but its PVC is only %s; raise --model-storage-size",
+					st.Model.Name, resource.NewQuantity(info.Size(), resource.BinarySI), st.Model.Storage)
+			}
+			continue
+		}
+		if (st.Model.URL == "" && st.Model.SourceURL == "") || command == "set-model" || command == "gateway" || command == "abort" {
+			continue
+		}
+		m := st.Model
+		if m.SourceURL != "" {
+			m.URL = m.SourceURL
+		}
+		size, err := modelSize(ctx, httpClient, m, *hfToken)
+		if err != nil {
+			fmt.Printf("Note: couldn't check the size of model %q (%v); make sure it fits in %s\n", st.Model.Name, err, st.Model.Storage)
+			continue
+		}
+		// While quantizing, the output (about half an F16 source at
+		// Q8_0, less below that) sits next to the source.
+		if st.Model.SourceURL != "" {
+			size += size / 2
+		}
+		for _, extra := range append([]string{st.Model.DraftURL, st.Model.MMProjURL}, st.Model.LoRAURLs...) {
+			if extra == "" {
+				continue
+			}
+			if n, err := remoteSize(ctx, httpClient, extra, *hfToken); err == nil {
+				size += n
+			}
+		}
+		pvcSize := resource.MustParse(st.Model.Storage)
+		if size >= pvcSize.Value() {
+			fatal("model %q needs %s but its PVC is only %s; raise --model-storage-size (or storage:)",
+				st.Model.Name, resource.NewQuantity(size, resource.BinarySI), st.Model.Storage)
+		}
+	}
+
+	// -------------------------------
+	// Memory estimate (llama.cpp)
+	// -------------------------------
+	// Weights plus KV cache, read from the GGUF header, so an OOM-killed
+	// server can be told apart from a misconfigured one before deploying.
+	// (Oversized contexts are what gets servers OOM-killed most.)
+	for i := range stacks {
+		m := &stacks[i].Model
+		if m.Backend == "llamacpp" && (m.URL != "" || m.LocalFile != "") && command != "gateway" && command != "abort" {
+			printMemoryEstimate(ctx, httpClient, m, opts, *hfToken, *fitCtx)
+		}
+	}
+
+	// -------------------------------
+	// TLS certificate (optional)
+	// -------------------------------
+	// Routes carry the PEM inline; copy it out of the Secret once.
+	if *tlsSecret != "" {
+		sec, err := cs.CoreV1().Secrets(*ns).Get(ctx, *tlsSecret, metav1.GetOptions{})
+		must(err, "read --tls-secret")
+		opts.TLSCert, opts.TLSKey = string(sec.Data[corev1.TLSCertKey]), string(sec.Data[corev1.TLSPrivateKeyKey])
+		if opts.TLSCert == "" || opts.TLSKey == "" {
+			fatal("Secret %q has no %s/%s (create it with: oc create secret tls ...)", *tlsSecret, corev1.TLSCertKey, corev1.TLSPrivateKeyKey)
+		}
+	}
+
+	// -------------------------------
+	// CPU architecture (--arch)
+	// -------------------------------
+	// Pinned through the node selector, so every pod and Job lands on it
+	// and pulls that architecture's build of the (multi-arch) images.
+	if command != "abort" {
+		if a := opts.NodeSelector[archLabel]; a != "" && *arch != "auto" && a != *arch {
+			fatal("--arch=%s contradicts --node-selector=%s=%s", *arch, archLabel, a)
+		}
+		a := *arch
+		if a == "auto" {
+			a, err = detectArch(ctx, cs, opts)
+			must(err, "detect the nodes' architecture (or pass --arch)")
+		}
+		if a != "" {
+			if opts.NodeSelector == nil {
+				opts.NodeSelector = map[string]string{}
+			}
+			opts.NodeSelector[archLabel] = a
+			fmt.Printf("Architecture: %s\n", a)
+		}
+		if a == "arm64" {
+			must(checkArm64(stacks, *cpuVariant), "--arch=arm64")
+		}
+	}
+
+	// -------------------------------
+	// llama.cpp server image (--build-from-source)
+	// -------------------------------
+	// Built once per ref and flags; later runs reuse the tagged image.
+	if *buildFromSource && command != "gateway" && command != "abort" {
+		src := sourceBuild{Git: *llamaCppGit, Ref: *llamaCppRef, CMakeFlags: *cmakeFlags}
+		opts.LlamaImage, err = buildLlamaServerImage(ctx, dyn, *ns, *name, src)
+		must(err, "build llama.cpp %s", *llamaCppRef)
+		fmt.Printf("Serving with %s\n", opts.LlamaImage)
+	}
+
+	// -------------------------------
+	// llama.cpp server image variant (--cpu-variant)
+	// -------------------------------
+	// One that every node the CPU servers may land on can run. Detecting
+	// it takes a Job per node without NFD labels, so only on request.
+	cpuModels := false
+	for _, st := range stacks {
+		cpuModels = cpuModels || (st.Model.Backend == "llamacpp" && st.Model.GPU == 0)
+	}
+	if *cpuVariant != "" && cpuModels && opts.LlamaImage == "" && command != "gateway" && command != "abort" {
+		variant := *cpuVariant
+		if variant == "auto" && opts.NodeSelector[archLabel] == "arm64" {
+			variant = "arm64" // No feature levels to tell apart.
+		}
+		if variant == "auto" {
+			variant, err = detectCPUVariant(ctx, cs, *ns, *name, opts)
+			must(err, "detect the nodes' CPU features (or pass --cpu-variant)")
+		}
+		opts.LlamaImage = variantImages[variant]
+		if opts.LlamaImage == "" {
+			fatal("no llama.cpp image for --cpu-variant=%s; give one with --cpu-variant-images=%s=IMAGE, or build it with\n"+
+				"  --build-from-source --llama-cpp-ref=<tag> --cmake-flags=\"-DGGML_NATIVE=OFF -DGGML_AVX2=OFF -DGGML_AVX512=OFF -DGGML_FMA=OFF -DGGML_F16C=OFF\"",
+				variant, variant)
+		}
+		fmt.Printf("CPU variant %s: serving with %s\n", variant, opts.LlamaImage)
+	}
+
+	// -------------------------------
+	// API key Secret
+	// -------------------------------
+	// Shared by all models of this run. The key itself is never printed;
+	// verification reads it back from here.
+	key := ""
+	if opts.APIKeySecret != "" {
+		fmt.Printf("Ensuring Secret %q (API key)...\n", opts.APIKeySecret)
+		key, err = ensureAPIKeySecret(ctx, cs, *ns, opts.APIKeySecret, *name, *apiKey)
+		must(err, "ensure api key secret")
+	}
+
+	vopts := verifyOptions{
+		SystemPrompt:   *systemPrompt,
+		FollowDownload: *followDownload,
+		ColdStart:      *scaleToZero != "",
+		APIKey:         key,
+		Stream:         *verifyStream,
+		MinChunks:      *verifyStreamChunks,
+		JSONSchema:     jsonSchema,
+		Prompt:         *verifyPrompt,
+		ExpectRegex:    expectRegex,
+	}
+	if *verifyParallel {
+		vopts.Parallel = *parallel
+	}
+	vopts.NPredict = *nPredict
+
+	if command == "gateway" {
+		host := *gatewayHost
+		if host == "" {
+			host = fmt.Sprintf("%s-gateway.%s.apps-crc.testing", *name, *ns)
+		}
+		must(deployGateway(ctx, cs, dyn, *ns, *name, host, *gatewayImage, stacks, opts), "deploy gateway")
+		gw := modelStack{ObjName: *name + "-gateway", Host: host, Scheme: stacks[0].Scheme}
+		fmt.Printf("Waiting for Deployment %s...\n", gw.ObjName)
+		must(waitForDeploymentReady(ctx, cs, *ns, gw.ObjName), "gateway not ready")
+		must(waitForEndpoints(ctx, cs, *ns, gw.ObjName), "gateway has no endpoints")
+		// Clients address models by name through the gateway, whatever
+		// the backend calls them.
+		for _, st := range stacks {
+			_, maxTokens := chatModel(st.Model)
+			fmt.Printf("Verifying %q through %s...\n", st.Model.Name, gw.endpoint())
+			reply, err := verifyChat(ctx, httpClient, gw.endpoint(), st.Model.Name, *systemPrompt, key, maxTokens)
+			must(err, "chat with %q through the gateway", st.Model.Name)
+			fmt.Printf("✅ %s replied: %q\n", st.Model.Name, reply)
+		}
+		fmt.Printf("Gateway: %s://%s/v1 (models: GET /v1/models)\n", gw.Scheme, host)
+		fmt.Println("Done.")
+		return
+	}
+
+	if command == "swap" {
+		svcClient := cs.CoreV1().Services(*ns)
+		svc, err := svcClient.Get(ctx, *name, metav1.GetOptions{})
+		must(err, "read Service %s (deploy it first)", *name)
+		// The main Service's selector says which Deployment is live.
+		live := svc.Spec.Selector["app"]
+		next := stacks[0]
+		next.ObjName = *name + "-green"
+		if live == next.ObjName {
+			next.ObjName = *name + "-blue"
+		}
+		next.Host = fmt.Sprintf("%s.%s.apps-crc.testing", next.ObjName, *ns)
+		fmt.Printf("Live Deployment is %s; bringing up %s with %q...\n", live, next.ObjName, next.Model.Name)
+		must(applyModelStack(ctx, cs, dyn, *ns, next, opts), "deploy %s", next.ObjName)
+		reply, err := waitAndVerify(ctx, cs, httpClient, *ns, next, vopts)
+		must(err, "verify %s (still serving %s; fix and re-run swap)", next.ObjName, live)
+		fmt.Printf("✅ Chat OK. Assistant replied: %q\n", reply)
+
+		fmt.Printf("Pointing Service %s at %s...\n", *name, next.ObjName)
+		svc.Spec.Selector = map[string]string{"app": next.ObjName}
+		_, err = svcClient.Update(ctx, svc, metav1.UpdateOptions{})
+		must(err, "update Service %s", *name)
+		fmt.Printf("Scaling %s to zero (its model stays on its PVC)...\n", live)
+		dep, err := cs.AppsV1().Deployments(*ns).Get(ctx, live, metav1.GetOptions{})
+		must(err, "read Deployment %s", live)
+		dep.Spec.Replicas = int32p(0)
+		_, err = cs.AppsV1().Deployments(*ns).Update(ctx, dep, metav1.UpdateOptions{})
+		must(err, "scale down %s", live)
+		// The main Service's Ingress (or Route) and ServiceMonitor serve
+		// the new pods from now on.
+		must(deleteExposure(ctx, cs, dyn, *ns, next.ObjName), "remove temporary Service %s", next.ObjName)
+		fmt.Printf("%s://%s now serves %q.\n", stacks[0].Scheme, stacks[0].Host, next.Model.Name)
+		fmt.Println("Done.")
+		return
+	}
+
+	// The canary is a full stack of its own next to the main one, which
+	// shares its Route with it.
+	if command == "canary" || command == "promote" || command == "abort" {
+		main, canary := stacks[0], stacks[0]
+		canary.ObjName = *name + "-canary"
+		canary.Host = fmt.Sprintf("%s-canary.%s.apps-crc.testing", *name, *ns)
+		split := opts
+		split.Canary, split.CanaryWeight = canary.ObjName, *canaryWeight
+		switch command {
+		case "canary":
+			must(applyModelStack(ctx, cs, dyn, *ns, canary, opts), "deploy canary %q", canary.Model.Name)
+			reply, err := waitAndVerify(ctx, cs, httpClient, *ns, canary, vopts)
+			must(err, "verify canary %q (no traffic was sent to it; remove it with abort)", canary.Model.Name)
+			fmt.Printf("✅ Canary chat OK. Assistant replied: %q\n", reply)
+			must(exposeStack(ctx, cs, dyn, *ns, main, split), "send traffic to the canary")
+			fmt.Printf("%s://%s now sends %d%% of requests to %q (alone at %s); promote or abort it when done.\n",
+				main.Scheme, main.Host, *canaryWeight, canary.Model.Name, canary.endpoint())
+		case "promote":
+			// The canary serves everything while the main stack switches
+			// models, and until the main stack has been verified.
+			split.CanaryWeight = 100
+			must(exposeStack(ctx, cs, dyn, *ns, main, split), "send all traffic to the canary")
+			must(applyModelStack(ctx, cs, dyn, *ns, main, split), "deploy %q to %s", main.Model.Name, main.ObjName)
+			fmt.Printf("Waiting for Deployment %s to roll out...\n", main.ObjName)
+			must(waitForRollout(ctx, cs, *ns, main.ObjName), "rollout of %s", main.ObjName)
+			// Verify the main stack through its Service while the Route
+			// still sends everything to the canary.
+			base, err := ocphelpers.ForwardService(cfg, *ns, main.ObjName, "http")
+			must(err, "proxy to Service %s", main.ObjName)
+			direct := main
+			direct.Scheme, direct.Host = "http", strings.TrimPrefix(base, "http://")
+			fmt.Printf("Verifying %s through its Service (API server service proxy at %s)...\n", main.ObjName, base)
+			reply, err := waitAndVerify(ctx, cs, httpClient, *ns, direct, vopts)
+			if err != nil {
+				fatal("verify %q: %v (all traffic stays on the canary; re-run promote or abort)", main.Model.Name, err)
+			}
+			fmt.Printf("✅ Chat OK. Assistant replied: %q\n", reply)
+			must(exposeStack(ctx, cs, dyn, *ns, main, opts), "send traffic back to %s", main.ObjName)
+			model, maxTokens := chatModel(main.Model)
+			if _, err := verifyChat(ctx, httpClient, main.endpoint(), model, *systemPrompt, key, maxTokens); err != nil {
+				must(exposeStack(ctx, cs, dyn, *ns, main, split), "send all traffic to the canary")
+				fatal("chat through %s: %v (all traffic is back on the canary; re-run promote or abort)", main.endpoint(), err)
+			}
+			fmt.Printf("Removing canary %s...\n", canary.ObjName)
+			must(deleteModelStack(ctx, cs, dyn, *ns, canary.ObjName, opts), "remove canary")
+		case "abort":
+			must(exposeStack(ctx, cs, dyn, *ns, main, opts), "send all traffic to %s", main.ObjName)
+			fmt.Printf("Removing canary %s...\n", canary.ObjName)
+			must(deleteModelStack(ctx, cs, dyn, *ns, canary.ObjName, opts), "remove canary")
+		}
+		fmt.Println("Done.")
+		return
+	}
+
+	if command == "set-model" {
+		st := stacks[0]
+		files, err := setModel(ctx, cs, httpClient, *ns, st, opts, *hfToken)
+		must(err, "set model")
+		reply, err := waitAndVerify(ctx, cs, httpClient, *ns, st, vopts)
+		must(err, "verify %q (old GGUF files were kept; roll back with set-model)", st.Model.Name)
+		fmt.Printf("✅ Chat OK. Assistant replied: %q\n", reply)
+		if !*keepOldModels && opts.ModelHostPath != "" {
+			// Other namespaces may be serving them from the same directory.
+			fmt.Println("Note: not pruning the previous GGUF files; --model-hostpath directories may be shared.")
+		} else if !*keepOldModels {
+			fmt.Println("Pruning previous GGUF files...")
+			must(runJob(ctx, cs, buildPruneModelsJob(*ns, st, files, opts)), "prune old models")
+		}
+		fmt.Println("Done.")
+		return
+	}
+
+	// ------------------------------------------------------------
+	// Apply every model's objects first, so downloads run in parallel
+	// ------------------------------------------------------------
+	for _, st := range stacks {
+		if len(stacks) > 1 {
+			fmt.Printf("\n== Model %q (%s) ==\n", st.Model.Name, st.ObjName)
+		}
+		must(applyModelStack(ctx, cs, dyn, *ns, st, opts), "deploy model %q", st.Model.Name)
+	}
+
+	// -------------------------
+	// Wait for readiness and verify each model
+	// -------------------------
+	// One model failing shouldn't hide the state of the others, so collect
+	// results and report them together.
+	results := make([]string, len(stacks))
+	failed := 0
+	for i, st := range stacks {
+		reply, err := waitAndVerify(ctx, cs, httpClient, *ns, st, vopts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: model %q: %v\n", st.Model.Name, err)
+			results[i] = "FAILED: " + err.Error()
+			failed++
+			continue
+		}
+		fmt.Printf("✅ Chat OK. Assistant replied: %q\n", reply)
+		results[i] = "OK"
+	}
+
+	// -------------------------
+	// Summary
+	// -------------------------
+	if len(stacks) > 1 {
+		fmt.Println("\nSummary:")
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "MODEL\tENDPOINT\tSTATUS")
+		for i, st := range stacks {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", st.Model.Name, st.endpoint(), results[i])
+		}
+		w.Flush()
+	}
+	if failed > 0 {
+		fatal("%d of %d model(s) failed verification", failed, len(stacks))
+	}
+
+	// A plain deploy took the main Service back from swap's colours, which
+	// would otherwise keep their pods and PVCs.
+	if command == "deploy" && len(stacks) == 1 && stacks[0].ObjName == *name {
+		for _, colour := range []string{*name + "-green", *name + "-blue"} {
+			_, err := cs.AppsV1().Deployments(*ns).Get(ctx, colour, metav1.GetOptions{})
+			if kerrors.IsNotFound(err) {
+				continue
+			}
+			must(err, "read Deployment %s", colour)
+			fmt.Printf("Removing %s, left from an earlier swap...\n", colour)
+			must(deleteModelStack(ctx, cs, dyn, *ns, colour, opts), "remove %s", colour)
+		}
+	}
+
+	// -------------------------
+	// compare: report, keep the faster quantization
+	// -------------------------
+	if command == "compare" {
+		bopts := benchOptions{
+			Requests:    *benchRequests,
+			Concurrency: *benchConcurrency,
+			MaxTokens:   *benchMaxTokens,
+			Prompt:      *benchPrompt,
+			APIKey:      key,
+		}
+		winner, loser, err := compareQuants(ctx, dyn, httpClient, *ns, stacks, bopts)
+		must(err, "compare %s and %s", quants[0], quants[1])
+		if *keepBoth {
+			fmt.Printf("Both stay deployed; %s was faster.\n", winner.Model.Quant)
+		} else {
+			fmt.Printf("Removing the slower %s (%s)...\n", loser.Model.Quant, loser.ObjName)
+			must(deleteModelStack(ctx, cs, dyn, *ns, loser.ObjName, opts), "remove %s", loser.ObjName)
+			stacks = []modelStack{winner}
+		}
+		fmt.Printf("%s serves %q quantized to %s.\n", winner.endpoint(), winner.Model.Name, winner.Model.Quant)
+	}
+	if opts.APIKeySecret != "" {
+		fmt.Printf("API key: Secret %s/%s, key \"api-key\" (send it as \"Authorization: Bearer <key>\")\n", *ns, opts.APIKeySecret)
+	}
+
+	// -------------------------
+	// Client bundle (optional)
+	// -------------------------
+	if *bundleFile != "" || *bundleNamespace != "" {
+		ca := ""
+		if opts.TLS != "" {
+			ca, err = routerCA(ctx, cs, *ns, *tlsSecret)
+			if err != nil {
+				fmt.Printf("Note: no CA certificate in the bundle (%v); clients must already trust the router's.\n", err)
+			}
+		}
+		caBundle := ""
+		if ca != "" {
+			caBundle, err = withSystemRoots(ca)
+			if err != nil {
+				fmt.Printf("Note: %v; SSL_CERT_FILE will trust the router's CA only.\n", err)
+				caBundle = ca
+			}
+		}
+		for _, st := range stacks {
+			b := buildClientBundle(*ns, st, opts, key, ca)
+			b.CABundle = caBundle
+			if *bundleFile != "" {
+				path := *bundleFile
+				if len(stacks) > 1 {
+					ext := filepath.Ext(path)
+					path = strings.TrimSuffix(path, ext) + "-" + st.Model.Name + ext
+				}
+				must(writeClientBundle(path, *bundleFormat, b, *bundleKeyRef), "write client bundle")
+				fmt.Printf("Client settings for %q: %s\n", st.Model.Name, path)
+			}
+			if *bundleNamespace != "" {
+				sec := clientBundleSecret(*bundleNamespace, st, b)
+				must(upsertSecret(ctx, cs, sec), "create Secret %s/%s", sec.Namespace, sec.Name)
+				fmt.Printf("Client settings for %q: Secret %s/%s (oc set env ... --from=secret/%s)\n", st.Model.Name, sec.Namespace, sec.Name, sec.Name)
+			}
+		}
+	}
+	fmt.Println("Done.")
+}
+
+// applyModelStack creates/updates one model's ConfigMap, PVC, Deployment,
+// Service and Ingress.
+func applyModelStack(ctx context.Context, cs *kubernetes.Clientset, dyn dynamic.Interface, ns string, st modelStack, opts serverOptions) error {
+	fmt.Println("Creating/updating ConfigMap...")
+	if err := upsertConfigMap(ctx, cs, buildConfigMap(ns, st, opts)); err != nil {
+		return fmt.Errorf("upsert configmap: %w", err)
+	}
+	if opts.UsagePVC != "" {
+		fmt.Printf("Creating/updating PVC %s (usage records)...\n", opts.UsagePVC)
+		if err := upsertPVC(ctx, cs, buildUsagePVC(ns, opts)); err != nil {
+			return fmt.Errorf("upsert usage pvc: %w", err)
+		}
+	}
+	if opts.ModelVolume != "per-replica" {
+		if opts.ModelHostPath != "" {
+			pv := buildHostPathPV(ns, st, opts)
+			fmt.Printf("Ensuring PersistentVolume %s (hostPath %s)...\n", pv.Name, pv.Spec.HostPath.Path)
+			if err := ensureHostPathPV(ctx, cs, pv); err != nil {
+				return fmt.Errorf("hostpath pv: %w", err)
+			}
+		}
+		fmt.Println("Creating/updating PVC (persistent /models)...")
+		pvc := buildModelPVC(ns, st, opts)
+		if err := upsertPVC(ctx, cs, pvc); err != nil {
+			return fmt.Errorf("upsert pvc: %w", err)
+		}
+		// A bound PVC keeps its volume, so switching storage needs a new one.
+		if pvc.Spec.VolumeName != "" {
+			existing, err := cs.CoreV1().PersistentVolumeClaims(ns).Get(ctx, pvc.Name, metav1.GetOptions{})
+			if err != nil {
+				return err
+			}
+			if existing.Spec.VolumeName != pvc.Spec.VolumeName {
+				return fmt.Errorf("PVC %s is bound to %s, not %s; delete the Deployment and PVC to switch to --model-hostpath",
+					pvc.Name, existing.Spec.VolumeName, pvc.Spec.VolumeName)
+			}
+		}
+	}
+	if st.Model.FromPVC != "" {
+		fmt.Printf("Copying model from PVC %q (%s)...\n", st.Model.FromPVC, st.Model.FromPVCPath)
+		if err := runJob(ctx, cs, buildCloneModelJob(ns, st, opts)); err != nil {
+			return fmt.Errorf("clone model: %w", err)
+		}
+	}
+	if st.Model.LocalFile != "" {
+		fmt.Printf("Uploading %s into the models PVC...\n", st.Model.LocalFile)
+		if err := uploadModel(ctx, cs, ns, st, opts); err != nil {
+			return fmt.Errorf("upload model: %w", err)
+		}
+	}
+	if st.Model.SourceURL != "" {
+		fmt.Printf("Downloading %s and quantizing it to %s (this can take a while)...\n", st.Model.SourceURL, st.Model.Quant)
+		if err := runJob(ctx, cs, buildQuantizeJob(ns, st, opts)); err != nil {
+			return fmt.Errorf("quantize model: %w", err)
+		}
+	}
+	// The server can't start without its RPC workers.
+	if opts.RPCWorkers > 0 {
+		fmt.Printf("Creating/updating %d RPC workers (StatefulSet %s-rpc)...\n", opts.RPCWorkers, st.ObjName)
+		if err := applyRPCWorkers(ctx, cs, ns, st, opts); err != nil {
+			return fmt.Errorf("rpc workers: %w", err)
+		}
+	} else if err := deleteRPCWorkers(ctx, cs, ns, st.ObjName); err != nil {
+		return fmt.Errorf("delete rpc workers: %w", err)
+	}
+	fmt.Println("Creating/updating Deployment (with initContainer and FSGroup)...")
+	if err := upsertDeployment(ctx, cs, buildDeployment(ns, st, opts)); err != nil {
+		return fmt.Errorf("upsert deployment: %w", err)
+	}
+	fmt.Println("Creating/updating Service...")
+	if err := upsertService(ctx, cs, buildService(ns, st, opts)); err != nil {
+		return fmt.Errorf("upsert service: %w", err)
+	}
+	// Ollama has no /metrics endpoint to scrape.
+	if opts.ServiceMonitor && st.Model.Backend != "ollama" {
+		fmt.Println("Creating/updating ServiceMonitor...")
+		if err := upsertServiceMonitor(ctx, dyn, buildServiceMonitor(ns, st, opts)); err != nil {
+			return fmt.Errorf("upsert servicemonitor (is user workload monitoring enabled?): %w", err)
+		}
+	}
+	if opts.Observability && st.Model.Backend == "llamacpp" {
+		fmt.Printf("Creating/updating PodMonitor and dashboard ConfigMap %s/%s-dashboard...\n", opts.DashboardNS, st.ObjName)
+		if err := ocphelpers.UpsertCustomObject(ctx, dyn, podMonitorGVR, buildPodMonitor(ns, st, opts)); err != nil {
+			return fmt.Errorf("upsert podmonitor (is user workload monitoring enabled?): %w", err)
+		}
+		if err := upsertConfigMap(ctx, cs, buildDashboardConfigMap(ns, st, opts)); err != nil {
+			return fmt.Errorf("upsert dashboard configmap: %w", err)
+		}
+	}
+	if opts.ScaleToZero == "http" {
+		fmt.Println("Creating/updating Service for the KEDA HTTP interceptor...")
+		if err := upsertService(ctx, cs, buildInterceptorService(ns, st, opts)); err != nil {
+			return fmt.Errorf("upsert interceptor service: %w", err)
+		}
+	}
+	if err := exposeStack(ctx, cs, dyn, ns, st, opts); err != nil {
+		return err
+	}
+	// KEDA and the HTTP add-on each own their scaler; keep only the chosen
+	// one, and only remove one an earlier run created.
+	for _, kind := range []string{"http", "prometheus"} {
+		scaler := kedaScalers[kind].Resource
+		if kind == opts.ScaleToZero {
+			fmt.Printf("Creating/updating KEDA %s scaler (0-%d replicas, idle %s)...\n", kind, maxReplicas(opts), opts.ScaleIdle)
+			if err := upsertKEDAScaler(ctx, dyn, kind, buildKEDAScaler(ns, st, opts)); err != nil {
+				return fmt.Errorf("upsert keda scaler: %w", err)
+			}
+			if err := markCreated(ctx, cs, ns, st.ObjName, scaler, true); err != nil {
+				return fmt.Errorf("record keda scaler: %w", err)
+			}
+			continue
+		}
+		created, err := wasCreated(ctx, cs, ns, st.ObjName, scaler)
+		if err != nil {
+			return err
+		}
+		if !created {
+			continue
+		}
+		if err := deleteKEDAScaler(ctx, dyn, ns, st.ObjName, kind); err != nil {
+			return fmt.Errorf("delete keda scaler: %w", err)
+		}
+		if err := markCreated(ctx, cs, ns, st.ObjName, scaler, false); err != nil {
+			return fmt.Errorf("record keda scaler: %w", err)
+		}
+	}
+	if opts.HPAMax > 0 && opts.ScaleToZero == "" {
+		fmt.Printf("Creating/updating HorizontalPodAutoscaler (%d-%d replicas, %d%% CPU)...\n", opts.Replicas, opts.HPAMax, opts.HPACPUTarget)
+		if err := upsertHPA(ctx, cs, buildHPA(ns, st, opts)); err != nil {
+			return fmt.Errorf("upsert hpa: %w", err)
+		}
+	} else if err := deleteHPA(ctx, cs, ns, st.ObjName); err != nil {
+		// Dropping --hpa-max hands the replica count back to --replicas.
+		return fmt.Errorf("delete hpa: %w", err)
+	}
+	if integrityChecked(st, opts) {
+		fmt.Printf("Creating/updating integrity CronJob (%s)...\n", opts.IntegritySched)
+		if err := applyIntegrityCheck(ctx, cs, ns, st, opts); err != nil {
+			return fmt.Errorf("integrity cronjob: %w", err)
+		}
+	} else if err := deleteIntegrityCheck(ctx, cs, ns, st.ObjName); err != nil {
+		return fmt.Errorf("delete integrity cronjob: %w", err)
+	}
+	if st.Model.Backend == "ollama" {
+		fmt.Printf("Pulling %s into Ollama (Job waits for the server first)...\n", st.Model.OllamaModel)
+		if err := runJob(ctx, cs, buildOllamaPullJob(ns, st, opts)); err != nil {
+			return fmt.Errorf("ollama pull: %w", err)
+		}
+	}
+	return nil
+}
+
+// exposeStack creates/updates the Ingress serving st.Host or, with --tls or
+// a canary, a Route. Generated Routes can't be told how to treat plain HTTP
+// or split traffic, so those use a Route of our own; only one of the two
+// may claim the host.
+func exposeStack(ctx context.Context, cs *kubernetes.Clientset, dyn dynamic.Interface, ns string, st modelStack, opts serverOptions) error {
+	if opts.TLS == "" && opts.Canary == "" {
+		fmt.Println("Creating/updating Ingress...")
+		if err := upsertIngress(ctx, cs, buildIngress(ns, st, opts)); err != nil {
+			return fmt.Errorf("upsert ingress: %w", err)
+		}
+		// Only a Route an earlier --tls or canary run created is ours to remove.
+		created, err := wasCreated(ctx, cs, ns, st.ObjName, routeGVR.Resource)
+		if err != nil || !created {
+			return err
+		}
+		if err := deleteRoute(ctx, dyn, ns, st.ObjName); err != nil {
+			return fmt.Errorf("delete route: %w", err)
+		}
+		return markCreated(ctx, cs, ns, st.ObjName, routeGVR.Resource, false)
+	}
+	if opts.Canary != "" {
+		fmt.Printf("Creating/updating Route (%d%% to %s, %d%% to %s)...\n", 100-opts.CanaryWeight, st.ObjName, opts.CanaryWeight, opts.Canary)
+	} else {
+		fmt.Printf("Creating/updating Route (TLS %s, insecure traffic: %s)...\n", opts.TLS, opts.TLSInsecure)
+	}
+	if err := upsertRoute(ctx, dyn, buildRoute(ns, st, opts)); err != nil {
+		return fmt.Errorf("upsert route: %w", err)
+	}
+	if err := markCreated(ctx, cs, ns, st.ObjName, routeGVR.Resource, true); err != nil {
+		return fmt.Errorf("record route: %w", err)
+	}
+	if err := deleteIngress(ctx, cs, ns, st.ObjName); err != nil {
+		return fmt.Errorf("delete ingress: %w", err)
+	}
+	return nil
+}
+
+// waitAndVerify waits for one model's Deployment and Service, then sends a
+// real chat request through its Ingress and returns the assistant's reply.
+func waitAndVerify(ctx context.Context, cs *kubernetes.Clientset, httpClient *http.Client, ns string, st modelStack, vopts verifyOptions) (string, error) {
+	reply, err := waitAndChat(ctx, cs, httpClient, ns, st, vopts)
+	if err != nil {
+		return "", err
+	}
+	if vopts.APIKey != "" {
+		fmt.Println("Verifying a request without the API key is refused...")
+		if err := verifyAuthRequired(ctx, httpClient, st); err != nil {
+			return "", fmt.Errorf("API key: %w", err)
+		}
+		fmt.Println("Unauthenticated request refused (401).")
+	}
+	if vopts.Prompt != "" {
+		fmt.Printf("Asking %q (temperature 0, --verify-prompt)...\n", vopts.Prompt)
+		answer, err := verifyChatAnswer(ctx, httpClient, st, vopts)
+		if err != nil {
+			return "", fmt.Errorf("expected answer: %w", err)
+		}
+		fmt.Printf("Answer OK: %q\n", answer)
+	}
+	if vopts.JSONSchema != nil {
+		fmt.Println("Verifying structured output (response_format with --verify-json-schema)...")
+		out, err := verifyChatJSONSchema(ctx, httpClient, st, vopts)
+		if err != nil {
+			return "", fmt.Errorf("structured output: %w", err)
+		}
+		fmt.Printf("Structured output OK: %s\n", out)
+	}
+	if st.Model.MMProjURL != "" {
+		fmt.Println("Verifying image input (asking the model to describe a test image)...")
+		out, err := verifyChatVision(ctx, httpClient, st, vopts)
+		if err != nil {
+			return "", fmt.Errorf("vision: %w", err)
+		}
+		fmt.Printf("Vision OK. Assistant described the image as: %q\n", out)
+	}
+	if vopts.Parallel > 1 {
+		fmt.Printf("Verifying %d requests are decoded in parallel (--verify-parallel)...\n", vopts.Parallel)
+		if err := verifyParallelSlots(ctx, httpClient, st, vopts); err != nil {
+			return "", fmt.Errorf("parallel slots: %w", err)
+		}
+	}
+	if st.Model.Backend == "tgi" {
+		fmt.Println("Verifying TGI's token limits...")
+		if err := verifyTGILimits(ctx, httpClient, st, vopts); err != nil {
+			return "", fmt.Errorf("token limits: %w", err)
+		}
+	}
+	if vopts.NPredict > 0 && st.Model.Backend == "llamacpp" {
+		fmt.Printf("Verifying generation stops at %d tokens (--n-predict)...\n", vopts.NPredict)
+		if err := verifyNPredict(ctx, httpClient, st, vopts); err != nil {
+			return "", fmt.Errorf("token limit: %w", err)
+		}
+	}
+	return reply, nil
+}
+
+// verifyAuthRequired sends a chat request without the API key, which the
+// server must answer with 401; anything else means it isn't checking keys.
+func verifyAuthRequired(ctx context.Context, httpClient *http.Client, st modelStack) error {
+	model, _ := chatModel(st.Model)
+	req, err := newChatRequest(ctx, st.endpoint(), "", chatReq{
+		Model:     model,
+		Messages:  []chatMessage{{Role: "user", Content: "Hello"}},
+		MaxTokens: 1,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("verification HTTP error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("request without a key got %d, want 401\n%s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// verifyTGILimits checks TGI's /info reports the prompt and total token
+// limits it was started with (ctx-1 and ctx), not ones it worked out.
+func verifyTGILimits(ctx context.Context, httpClient *http.Client, st modelStack, vopts verifyOptions) error {
+	url := st.Scheme + "://" + st.Host + "/info"
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	if vopts.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+vopts.APIKey)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("verification HTTP error: %w", err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("non-2xx from %s: %d\n%s", url, resp.StatusCode, string(raw))
+	}
+	var info struct {
+		MaxInputTokens int `json:"max_input_tokens"`
+		MaxTotalTokens int `json:"max_total_tokens"`
+	}
+	if err := json.Unmarshal(raw, &info); err != nil {
+		return fmt.Errorf("could not parse %s: %v\n%s", url, err, string(raw))
+	}
+	if info.MaxInputTokens != st.Model.Ctx-1 || info.MaxTotalTokens != st.Model.Ctx {
+		return fmt.Errorf("max_input_tokens=%d max_total_tokens=%d, want %d and %d",
+			info.MaxInputTokens, info.MaxTotalTokens, st.Model.Ctx-1, st.Model.Ctx)
+	}
+	fmt.Printf("Token limits OK: %d prompt, %d total.\n", info.MaxInputTokens, info.MaxTotalTokens)
+	return nil
+}
+
+// verifyNPredict asks /v1/completions for a long answer with max_tokens
+// well above vopts.NPredict, which the server must cut to NPredict tokens.
+// The reply's usage counts them; without one, /tokenize does.
+func verifyNPredict(ctx context.Context, httpClient *http.Client, st modelStack, vopts verifyOptions) error {
+	base := st.Scheme + "://" + st.Host
+	model, _ := chatModel(st.Model)
+	zero := 0.0
+	var out struct {
+		Choices []struct {
+			Text         string `json:"text"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+		Usage *struct {
+			CompletionTokens int `json:"completion_tokens"`
+		} `json:"usage"`
+	}
+	err := postJSON(ctx, httpClient, base+"/v1/completions", vopts.APIKey, map[string]any{
+		"model":       model,
+		"prompt":      "Count from 1 to 5000, separated by commas: 1, 2, 3,",
+		"max_tokens":  vopts.NPredict * 4,
+		"temperature": &zero,
+	}, &out)
+	if err != nil {
+		return err
+	}
+	if len(out.Choices) == 0 {
+		return fmt.Errorf("no choices in the completion")
+	}
+	n, how := 0, "usage"
+	if out.Usage != nil {
+		n = out.Usage.CompletionTokens
+	} else {
+		var tok struct {
+			Tokens []json.RawMessage `json:"tokens"`
+		}
+		if err := postJSON(ctx, httpClient, base+"/tokenize", vopts.APIKey, map[string]any{"content": out.Choices[0].Text}, &tok); err != nil {
+			return fmt.Errorf("count the reply's tokens: %w", err)
+		}
+		n, how = len(tok.Tokens), "/tokenize"
+	}
+	if n > vopts.NPredict {
+		return fmt.Errorf("asked for %d tokens, got %d (by %s); the server doesn't apply --n-predict=%d (is LLAMA_ARG_N_PREDICT overridden?)",
+			vopts.NPredict*4, n, how, vopts.NPredict)
+	}
+	fmt.Printf("Token limit OK: asked for %d tokens, got %d (by %s, finish_reason %q)\n", vopts.NPredict*4, n, how, out.Choices[0].FinishReason)
+	return nil
+}
+
+// verifyParallelSlots streams vopts.Parallel requests at once. With that
+// many slots they are decoded together, so every request's first token
+// arrives before any of them finishes; requests queued for a free slot only
+// start once an earlier one is done.
+func verifyParallelSlots(ctx context.Context, httpClient *http.Client, st modelStack, vopts verifyOptions) error {
+	type timing struct {
+		first, done time.Duration
+		err         error
+	}
+	model, _ := chatModel(st.Model)
+	results := make([]timing, vopts.Parallel)
+	done := make(chan struct{})
+	start := time.Now()
+	for i := range results {
+		go func(r *timing) {
+			_, r.err = streamChat(ctx, httpClient, st.endpoint(), vopts.APIKey, chatReq{
+				Model:     model,
+				MaxTokens: 64,
+				Messages:  []chatMessage{{Role: "user", Content: "Count from one to twenty in words."}},
+			}, func(string) {
+				if r.first == 0 {
+					r.first = time.Since(start)
+				}
+			})
+			r.done = time.Since(start)
+			done <- struct{}{}
+		}(&results[i])
+	}
+	for range results {
+		<-done
+	}
+
+	lastFirst, firstDone := time.Duration(0), time.Duration(1<<62)
+	for i, r := range results {
+		if r.err != nil {
+			return fmt.Errorf("request %d: %w", i+1, r.err)
+		}
+		if r.first == 0 {
+			return fmt.Errorf("request %d: no content streamed", i+1)
+		}
+		lastFirst, firstDone = max(lastFirst, r.first), min(firstDone, r.done)
+	}
+	if lastFirst >= firstDone {
+		return fmt.Errorf("a request only started (first token after %s) once another had finished (after %s); are requests queued instead of using %d slots?",
+			lastFirst.Round(time.Millisecond), firstDone.Round(time.Millisecond), vopts.Parallel)
+	}
+	fmt.Printf("Parallel OK: all %d requests started within %s, before the first finished at %s\n",
+		vopts.Parallel, lastFirst.Round(time.Millisecond), firstDone.Round(time.Millisecond))
+	return nil
+}
+
+// waitAndChat waits for st's server and sends the verification chat.
+func waitAndChat(ctx context.Context, cs *kubernetes.Clientset, httpClient *http.Client, ns string, st modelStack, vopts verifyOptions) (string, error) {
+	if vopts.ColdStart {
+		return verifyColdStart(ctx, httpClient, st, vopts)
+	}
+	fmt.Printf("Waiting for Deployment %s to have at least 1 ready replica (first run may take time for download)...\n", st.ObjName)
+	// Show the download's progress meanwhile, so a slow multi-GB download
+	// can be told apart from a hung deployment.
+	logCtx, stopLogs := context.WithCancel(ctx)
+	if vopts.FollowDownload {
+		go followFetchLogs(logCtx, cs, ns, st.ObjName)
+	}
+	err := waitForDeploymentReady(ctx, cs, ns, st.ObjName)
+	stopLogs()
+	if err != nil {
+		return "", fmt.Errorf("deployment not ready in time: %w", err)
+	}
+
+	fmt.Println("Waiting for Service to have endpoints (pod IPs behind the Service)...")
+	if err := waitForEndpoints(ctx, cs, ns, st.ObjName); err != nil {
+		return "", fmt.Errorf("service has no endpoints: %w", err)
+	}
+
+	// -------------------------
+	// Verify via OpenAI-style /v1/chat/completions
+	// -------------------------
+	url := st.endpoint()
+	fmt.Printf("Probing: %s\n", url)
+	return vopts.chat(ctx, httpClient, st)
+}
+
+// followFetchLogs prints the fetch-model initContainer's log while it runs,
+// following it across restarts (a resumed download is a new container).
+// curl redraws its progress meter with carriage returns; those updates are
+// printed at most every 5 seconds so the deployer's output stays readable.
+func followFetchLogs(ctx context.Context, cs *kubernetes.Clientset, ns, name string) {
+	streamed := map[string]bool{} // pod/restartCount already followed
+	for ctx.Err() == nil {
+		pods, err := cs.CoreV1().Pods(ns).List(ctx, metav1.ListOptions{LabelSelector: "app=" + name})
+		if err == nil {
+			for _, pod := range pods.Items {
+				for _, c := range pod.Status.InitContainerStatuses {
+					key := fmt.Sprintf("%s/%d", pod.Name, c.RestartCount)
+					if c.Name != "fetch-model" || c.State.Running == nil || streamed[key] {
+						continue
+					}
+					streamed[key] = true
+					streamContainerLog(ctx, cs, ns, pod.Name, c.Name)
+				}
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// streamContainerLog copies one container's log to stdout, prefixed, until
+// the container exits or ctx is cancelled.
+func streamContainerLog(ctx context.Context, cs *kubernetes.Clientset, ns, pod, container string) {
+	rc, err := cs.CoreV1().Pods(ns).GetLogs(pod, &corev1.PodLogOptions{Container: container, Follow: true}).Stream(ctx)
+	if err != nil {
+		return
+	}
+	defer rc.Close()
+
+	prefix := "  [" + container + "] "
+	var lastProgress time.Time
+	scanner := bufio.NewScanner(rc)
+	scanner.Split(scanLinesOrCR)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		// Progress meter rows start with a percentage; throttle those.
+		if line[0] >= '0' && line[0] <= '9' {
+			if time.Since(lastProgress) < 5*time.Second {
+				continue
+			}
+			lastProgress = time.Now()
+		}
+		fmt.Println(prefix + line)
+	}
+}
+
+// scanLinesOrCR is bufio.ScanLines that also splits on a bare '\r'.
+func scanLinesOrCR(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	for i, b := range data {
+		if b == '\n' || b == '\r' {
+			return i + 1, data[:i], nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// chatModel is the model name and reply cap for the verification request.
+func chatModel(m modelSpec) (string, int) {
+	if m.Backend == "tgi" {
+		// TGI serves one model and expects "tgi" as its name; without
+		// max_tokens it would generate up to the whole context.
+		return "tgi", 64
+	}
+	return m.Name, 0
+}
+
+// verifyColdStart verifies a model that KEDA may have scaled to zero. There
+// may be no replica to wait for, so keep sending the chat request (which is
+// what wakes it) until one answers. The first wake-up includes the model
+// download, and the interceptor or router gives up on a request long before
+// that, so errors here are expected for a while.
+func verifyColdStart(ctx context.Context, httpClient *http.Client, st modelStack, vopts verifyOptions) (string, error) {
+	fmt.Printf("Scale-to-zero: probing %s until a replica wakes up (first start includes the download)...\n", st.endpoint())
+	for {
+		reply, err := vopts.chat(ctx, httpClient, st)
+		if err == nil {
+			return reply, nil
+		}
+		fmt.Printf("  not answering yet: %s\n", strings.SplitN(err.Error(), "\n", 2)[0])
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("no answer before the timeout: %w", err)
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// chat sends the verification request to st, streamed or not per vopts.
+func (vopts verifyOptions) chat(ctx context.Context, httpClient *http.Client, st modelStack) (string, error) {
+	model, maxTokens := chatModel(st.Model)
+	if vopts.Stream {
+		return verifyChatStream(ctx, httpClient, st.endpoint(), model, vopts.SystemPrompt, vopts.APIKey, maxTokens, vopts.MinChunks)
+	}
+	return verifyChat(ctx, httpClient, st.endpoint(), model, vopts.SystemPrompt, vopts.APIKey, maxTokens)
+}
+
+// verifyOptions controls the post-deploy wait and checks.
+type verifyOptions struct {
+	SystemPrompt   string // System prompt for the verification chat
+	FollowDownload bool   // Stream fetch-model progress while waiting
+	ColdStart      bool   // Scaled to zero: retry the chat until a replica wakes up
+	APIKey         string // Sent as a bearer token ("" = none)
+	Stream         bool   // Verify the streaming (SSE) path instead
+	MinChunks      int    // Content chunks a streamed reply must have
+	// Prompt, if set, is asked at temperature 0, and the answer must match
+	// ExpectRegex (when set).
+	Prompt      string
+	ExpectRegex *regexp.Regexp
+	// JSONSchema, if set, is checked with a response_format request too.
+	JSONSchema json.RawMessage
+	// Parallel > 1 also checks that many concurrent requests are decoded
+	// together (--verify-parallel).
+	Parallel int
+	// NPredict > 0 checks llama.cpp stops a request asking for more at
+	// that many tokens (--n-predict).
+	NPredict int
+}
+
+// verifyChat POSTs a short conversation to url and returns the first choice.
+// apiKey is sent as a bearer token unless empty; maxTokens caps the reply
+// (0 = server default).
+func verifyChat(ctx context.Context, httpClient *http.Client, url, model, systemPrompt, apiKey string, maxTokens int) (string, error) {
+	return postChat(ctx, httpClient, url, apiKey, chatReq{
+		Model:     model,
+		Stream:    false,
+		MaxTokens: maxTokens,
+		Messages: []chatMessage{
+			{Role: "system", Content: systemPrompt},
+			{Role: "user", Content: "Say hello in one short sentence."},
+		},
+	})
+}
+
+// verifyChatAnswer asks st vopts.Prompt greedily (temperature 0, so the
+// answer doesn't vary between runs) and checks it against
+// vopts.ExpectRegex. It returns the answer.
+func verifyChatAnswer(ctx context.Context, httpClient *http.Client, st modelStack, vopts verifyOptions) (string, error) {
+	model, maxTokens := chatModel(st.Model)
+	// A checkable answer is short; don't let a rambling model run on.
+	if maxTokens == 0 {
+		maxTokens = 128
+	}
+	zero := 0.0
+	answer, err := postChat(ctx, httpClient, st.endpoint(), vopts.APIKey, chatReq{
+		Model:       model,
+		MaxTokens:   maxTokens,
+		Temperature: &zero,
+		Messages: []chatMessage{
+			{Role: "system", Content: vopts.SystemPrompt},
+			{Role: "user", Content: vopts.Prompt},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	if vopts.ExpectRegex != nil && !vopts.ExpectRegex.MatchString(answer) {
+		return "", fmt.Errorf("answer %q doesn't match %s (wrong chat template or a broken model?)", answer, vopts.ExpectRegex)
+	}
+	return answer, nil
+}
+
+// postChat POSTs body to url and returns the first choice's content.
+func postChat(ctx context.Context, httpClient *http.Client, url, apiKey string, reqBody chatReq) (string, error) {
+	req, err := newChatRequest(ctx, url, apiKey, reqBody)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("verification HTTP error: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		// Include the body for debugging if not 2xx.
+		return "", fmt.Errorf("non-2xx from chat endpoint: %d\n%s", resp.StatusCode, string(body))
+	}
+
+	// Parse minimal response to confirm the model answered.
+	var parsed chatResp
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("could not parse response JSON: %v\nRaw response: %s", err, string(body))
+	}
+	if len(parsed.Choices) == 0 {
+		return "", fmt.Errorf("no choices in response\nRaw response: %s", string(body))
+	}
+	return parsed.Choices[0].Message.Content, nil
+}
+
+// postJSON POSTs body to url (any of the server's JSON endpoints) and
+// decodes the reply into out.
+func postJSON(ctx context.Context, httpClient *http.Client, url, apiKey string, body, out any) error {
+	req, err := newChatRequest(ctx, url, apiKey, body)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("verification HTTP error: %w", err)
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("non-2xx from %s: %d\n%s", url, resp.StatusCode, string(raw))
+	}
+	if err := json.Unmarshal(raw, out); err != nil {
+		return fmt.Errorf("could not parse response JSON: %v\nRaw response: %s", err, string(raw))
+	}
+	return nil
+}
+
+// verifyChatJSONSchema asks st for JSON constrained by vopts.JSONSchema and
+// checks the reply parses and matches the schema (see checkJSONSchema for
+// the keywords checked). It returns the reply.
+func verifyChatJSONSchema(ctx context.Context, httpClient *http.Client, st modelStack, vopts verifyOptions) (string, error) {
+	model, _ := chatModel(st.Model)
+	format := &responseFormat{
+		Type:       "json_schema",
+		JSONSchema: &jsonSchemaSpec{Name: "verification", Schema: vopts.JSONSchema, Strict: true},
+	}
+	if st.Model.Backend == "tgi" {
+		format = &responseFormat{Type: "json_object", Value: vopts.JSONSchema}
+	}
+	req, err := newChatRequest(ctx, st.endpoint(), vopts.APIKey, chatReq{
+		Model:          model,
+		MaxTokens:      512, // a bound for servers that would fill the context
+		ResponseFormat: format,
+		Messages: []chatMessage{
+			{Role: "system", Content: vopts.SystemPrompt},
+			{Role: "user", Content: "Reply with a JSON object matching this JSON schema, and nothing else:\n" + string(vopts.JSONSchema)},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("verification HTTP error: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("non-2xx from chat endpoint: %d\n%s", resp.StatusCode, string(body))
+	}
+	var parsed chatResp
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("could not parse response JSON: %v\nRaw response: %s", err, string(body))
+	}
+	if len(parsed.Choices) == 0 {
+		return "", fmt.Errorf("no choices in response\nRaw response: %s", string(body))
+	}
+
+	content := strings.TrimSpace(parsed.Choices[0].Message.Content)
+	var value any
+	if err := json.Unmarshal([]byte(content), &value); err != nil {
+		return "", fmt.Errorf("reply is not JSON (was the constraint ignored?): %v\nReply: %s", err, content)
+	}
+	var schema any
+	if err := json.Unmarshal(vopts.JSONSchema, &schema); err != nil {
+		return "", err
+	}
+	if err := checkJSONSchema(schema, value, "$"); err != nil {
+		return "", fmt.Errorf("reply doesn't match the schema: %v\nReply: %s", err, content)
+	}
+	return content, nil
+}
+
+// visionReq is a chat request whose user message mixes text and an image
+// (OpenAI's content parts), for vision models.
+type visionReq struct {
+	Model     string          `json:"model"`
+	Messages  []visionMessage `json:"messages"`
+	MaxTokens int             `json:"max_tokens,omitempty"`
+}
+type visionMessage struct {
+	Role    string        `json:"role"`
+	Content []contentPart `json:"content"`
+}
+type contentPart struct {
+	Type     string    `json:"type"` // "text" or "image_url"
+	Text     string    `json:"text,omitempty"`
+	ImageURL *imageURL `json:"image_url,omitempty"`
+}
+type imageURL struct {
+	URL string `json:"url"`
+}
+
+// testImageDataURL is a small PNG (a red square on white) as a data: URL,
+// so the vision check needs nothing from outside the cluster.
+func testImageDataURL() string {
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for y := 0; y < 64; y++ {
+		for x := 0; x < 64; x++ {
+			c := color.RGBA{255, 255, 255, 255}
+			if x >= 16 && x < 48 && y >= 16 && y < 48 {
+				c = color.RGBA{220, 20, 20, 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+	var buf strings.Builder
+	enc := base64.NewEncoder(base64.StdEncoding, &buf)
+	png.Encode(enc, img)
+	enc.Close()
+	return "data:image/png;base64," + buf.String()
+}
+
+// verifyChatVision sends the test image with a request to describe it and
+// returns the description. Servers without a projector reject the image or
+// answer empty, which is what this catches; what the model says isn't
+// judged.
+func verifyChatVision(ctx context.Context, httpClient *http.Client, st modelStack, vopts verifyOptions) (string, error) {
+	model, _ := chatModel(st.Model)
+	req, err := newChatRequest(ctx, st.endpoint(), vopts.APIKey, visionReq{
+		Model:     model,
+		MaxTokens: 64,
+		Messages: []visionMessage{{
+			Role: "user",
+			Content: []contentPart{
+				{Type: "text", Text: "Describe this image in one short sentence."},
+				{Type: "image_url", ImageURL: &imageURL{URL: testImageDataURL()}},
+			},
+		}},
+	})
+	if err != nil {
+		return "", err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("verification HTTP error: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return "", fmt.Errorf("non-2xx from chat endpoint: %d\n%s", resp.StatusCode, string(body))
+	}
+	var parsed chatResp
+	if err := json.Unmarshal(body, &parsed); err != nil {
+		return "", fmt.Errorf("could not parse response JSON: %v\nRaw response: %s", err, string(body))
+	}
+	if len(parsed.Choices) == 0 || strings.TrimSpace(parsed.Choices[0].Message.Content) == "" {
+		return "", fmt.Errorf("empty reply to an image\nRaw response: %s", string(body))
+	}
+	return strings.TrimSpace(parsed.Choices[0].Message.Content), nil
+}
+
+// checkJSONSchema validates v (decoded by encoding/json) against schema.
+// It covers the keywords structured-output schemas use: type, enum, const,
+// properties, required, additionalProperties, items, min/maxItems,
+// min/maxLength, pattern, minimum/maximum, anyOf and allOf. Others, such
+// as $ref, are not checked.
+func checkJSONSchema(schema, v any, path string) error {
+	s, ok := schema.(map[string]any)
+	if !ok {
+		return nil // true/false schemas and the like: nothing to check
+	}
+	if t, ok := s["type"]; ok {
+		types := []any{t}
+		if list, ok := t.([]any); ok {
+			types = list
+		}
+		matched := false
+		for _, t := range types {
+			if name, _ := t.(string); jsonTypeMatches(name, v) {
+				matched = true
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: want type %v, got %s", path, t, jsonTypeName(v))
+		}
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, v) {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, v, enum)
+		}
+	}
+	if c, ok := s["const"]; ok && !jsonEqual(c, v) {
+		return fmt.Errorf("%s: want %v, got %v", path, c, v)
+	}
+	if all, ok := s["allOf"].([]any); ok {
+		for _, sub := range all {
+			if err := checkJSONSchema(sub, v, path); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		var errs []string
+		for _, sub := range anyOf {
+			err := checkJSONSchema(sub, v, path)
+			if err == nil {
+				errs = nil
+				break
+			}
+			errs = append(errs, err.Error())
+		}
+		if errs != nil {
+			return fmt.Errorf("%s: matches none of anyOf (%s)", path, strings.Join(errs, "; "))
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		if req, ok := s["required"].([]any); ok {
+			for _, r := range req {
+				if name, _ := r.(string); name != "" {
+					if _, ok := val[name]; !ok {
+						return fmt.Errorf("%s: missing required property %q", path, name)
+					}
+				}
+			}
+		}
+		props, _ := s["properties"].(map[string]any)
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys) // report the first problem deterministically
+		for _, k := range keys {
+			if sub, ok := props[k]; ok {
+				if err := checkJSONSchema(sub, val[k], path+"."+k); err != nil {
+					return err
+				}
+				continue
+			}
+			switch extra := s["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					return fmt.Errorf("%s: unexpected property %q", path, k)
+				}
+			case map[string]any:
+				if err := checkJSONSchema(extra, val[k], path+"."+k); err != nil {
+					return err
+				}
+			}
+		}
+	case []any:
+		if n, ok := s["minItems"].(float64); ok && float64(len(val)) < n {
+			return fmt.Errorf("%s: %d items, want at least %v", path, len(val), n)
+		}
+		if n, ok := s["maxItems"].(float64); ok && float64(len(val)) > n {
+			return fmt.Errorf("%s: %d items, want at most %v", path, len(val), n)
+		}
+		if items, ok := s["items"]; ok {
+			for i, item := range val {
+				if err := checkJSONSchema(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		length := float64(len([]rune(val)))
+		if n, ok := s["minLength"].(float64); ok && length < n {
+			return fmt.Errorf("%s: %q is shorter than %v", path, val, n)
+		}
+		if n, ok := s["maxLength"].(float64); ok && length > n {
+			return fmt.Errorf("%s: %q is longer than %v", path, val, n)
+		}
+		if p, ok := s["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fmt.Errorf("%s: bad pattern %q in schema: %v", path, p, err)
+			}
+			if !re.MatchString(val) {
+				return fmt.Errorf("%s: %q doesn't match %q", path, val, p)
+			}
+		}
+	case float64:
+		if n, ok := s["minimum"].(float64); ok && val < n {
+			return fmt.Errorf("%s: %v is below the minimum %v", path, val, n)
+		}
+		if n, ok := s["maximum"].(float64); ok && val > n {
+			return fmt.Errorf("%s: %v is above the maximum %v", path, val, n)
+		}
+	}
+	return nil
+}
+
+// jsonTypeMatches reports whether v has the JSON schema type name.
+func jsonTypeMatches(name string, v any) bool {
+	if name == "integer" {
+		n, ok := v.(float64)
+		return ok && n == float64(int64(n))
+	}
+	return name == jsonTypeName(v)
+}
+
+// jsonTypeName is the JSON schema type of a value decoded by encoding/json.
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// jsonEqual compares two decoded JSON values.
+func jsonEqual(a, b any) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return string(x) == string(y)
+}
+
+// -----------------------------
+// Memory estimate
+// -----------------------------
+
+// kvCacheTypeBytes is the size per element of each KV cache type llama.cpp
+// accepts (block-quantized types include their per-block scales).
+var kvCacheTypeBytes = map[string]float64{
+	"f32":    4,
+	"f16":    2,
+	"bf16":   2,
+	"q8_0":   34.0 / 32,
+	"q5_1":   24.0 / 32,
+	"q5_0":   22.0 / 32,
+	"q4_1":   20.0 / 32,
+	"q4_0":   18.0 / 32,
+	"iq4_nl": 18.0 / 32,
+}
+
+// kvCacheTypeNames lists kvCacheTypeBytes' keys for messages.
+func kvCacheTypeNames() []string {
+	var names []string
+	for t := range kvCacheTypeBytes {
+		names = append(names, t)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ggufParams are the hyperparameters the KV cache size depends on.
+type ggufParams struct {
+	Arch     string
+	Layers   uint64 // <arch>.block_count
+	HeadsKV  uint64 // <arch>.attention.head_count_kv (GQA), else head_count
+	KeyLen   uint64 // <arch>.attention.key_length, else embedding_length/head_count
+	ValLen   uint64 // <arch>.attention.value_length, likewise
+	TrainCtx uint64 // <arch>.context_length (0 if missing)
+}
+
+// computeHeadroom is the share of the memory limit --fit-ctx leaves for
+// llama.cpp's compute buffers and the process itself, on top of
+// computeReserve; both are rough, erring on the safe side.
+const (
+	computeHeadroom = 0.10
+	computeReserve  = 256 << 20
+)
+
+// printMemoryEstimate prints m's expected memory use: the weights (the
+// download or local file size) plus the KV cache for its full context.
+// When that doesn't fit its memory limit it warns, or with fit "adjust"
+// lowers m.Ctx to the largest context that does (in steps of 256 tokens,
+// and at most the context the model was trained with).
+func printMemoryEstimate(ctx context.Context, httpClient *http.Client, m *modelSpec, opts serverOptions, token, fit string) {
+	var p ggufParams
+	var weights int64
+	var err error
+	if m.LocalFile != "" {
+		p, err = readLocalGGUFParams(m.LocalFile)
+		if fi, statErr := os.Stat(m.LocalFile); statErr == nil {
+			weights = fi.Size()
+		}
+	} else {
+		p, err = readGGUFParams(ctx, httpClient, m.URL, token)
+		weights, _ = modelSize(ctx, httpClient, *m, token)
+	}
+	if err != nil {
+		fmt.Printf("Note: no memory estimate for model %q (couldn't read its GGUF header: %v)\n", m.Name, err)
+		return
+	}
+	kTypeBytes, vTypeBytes := kvCacheTypeBytes[opts.CacheTypeK], kvCacheTypeBytes[opts.CacheTypeV]
+	perToken := float64(p.Layers*p.HeadsKV) * (float64(p.KeyLen)*kTypeBytes + float64(p.ValLen)*vTypeBytes)
+	kv := int64(float64(m.Ctx) * perToken)
+	q := func(n int64) string {
+		if n >= 1<<30 {
+			return fmt.Sprintf("%.1fGi", float64(n)/(1<<30))
+		}
+		return fmt.Sprintf("%.0fMi", float64(n)/(1<<20))
+	}
+	fmt.Printf("Memory estimate for %q (%s, %d layers): weights %s + KV cache %s (ctx %d, K %s, V %s) = %s, plus compute buffers\n",
+		m.Name, p.Arch, p.Layers, q(weights), q(kv), m.Ctx, opts.CacheTypeK, opts.CacheTypeV, q(weights+kv))
+	// With GPUs the weights and (unless --kv-offload=false) the cache
+	// live in GPU memory, not under the container's limit.
+	if m.Memory == "" || m.GPU > 0 || fit == "off" {
+		return
+	}
+	limit := resource.MustParse(m.Memory)
+	budget := int64(float64(limit.Value())*(1-computeHeadroom)) - computeReserve - weights
+	maxCtx := 0
+	if budget > 0 {
+		maxCtx = int(float64(budget)/perToken) / 256 * 256
+	}
+	if m.Ctx <= maxCtx {
+		return
+	}
+	if p.TrainCtx > 0 && maxCtx > int(p.TrainCtx) {
+		maxCtx = int(p.TrainCtx)
+	}
+	switch {
+	case maxCtx < 512 && fit == "adjust":
+		fatal("model %q: its weights (%s) leave too little of the %s memory limit for any useful context; raise --memory-limit (or memory:)",
+			m.Name, q(weights), m.Memory)
+	case maxCtx < 512:
+		fmt.Printf("WARNING: model %q's weights (%s) leave too little of its %s memory limit for any useful context; expect OOM kills. Raise the limit.\n",
+			m.Name, q(weights), m.Memory)
+	case fit == "adjust":
+		fmt.Printf("Lowering model %q's ctx from %d to %d (KV cache %s) to fit its memory limit of %s.\n",
+			m.Name, m.Ctx, maxCtx, q(int64(float64(maxCtx)*perToken)), m.Memory)
+		m.Ctx = maxCtx
+	default:
+		fmt.Printf("WARNING: ctx %d is too large for model %q's memory limit of %s; expect OOM kills. About %d fits: pass --ctx=%d or --fit-ctx=adjust, quantize the KV cache (--cache-type-k/v=q8_0) or raise the limit.\n",
+			m.Ctx, m.Name, m.Memory, maxCtx, maxCtx)
+	}
+}
+
+// readLocalGGUFParams is readGGUFParams for upload-model's local file.
+func readLocalGGUFParams(path string) (ggufParams, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return ggufParams{}, err
+	}
+	defer f.Close()
+	return parseGGUFParams(bufio.NewReader(io.LimitReader(f, 64<<20)))
+}
+
+// readGGUFParams reads the start of the GGUF at url (a split model's first
+// shard has the metadata too) and returns the KV cache hyperparameters.
+// Converters write the architecture's keys before the tokenizer's (whose
+// vocabulary can be several MiB), so reading stops at the first
+// "tokenizer." key; usually only a few KiB are fetched.
+func readGGUFParams(ctx context.Context, httpClient *http.Client, url, token string) (ggufParams, error) {
+	var p ggufParams
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // closes the download once we have what we need
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return p, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return p, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return p, fmt.Errorf("GET %s", resp.Status)
+	}
+	return parseGGUFParams(bufio.NewReader(io.LimitReader(resp.Body, 64<<20)))
+}
+
+// parseGGUFParams reads the GGUF header and metadata from r up to the
+// tokenizer's keys.
+func parseGGUFParams(r *bufio.Reader) (ggufParams, error) {
+	var p ggufParams
+	var header struct {
+		Magic   [4]byte
+		Version uint32
+		Tensors uint64
+		KVs     uint64
+	}
+	if err := binary.Read(r, binary.LittleEndian, &header); err != nil {
+		return p, err
+	}
+	if string(header.Magic[:]) != "GGUF" {
+		return p, fmt.Errorf("not a GGUF file")
+	}
+	if header.Version < 2 {
+		return p, fmt.Errorf("GGUF version %d is too old", header.Version)
+	}
+
+	ints := map[string]uint64{}
+	for i := uint64(0); i < header.KVs; i++ {
+		key, err := ggufString(r)
+		if err != nil {
+			return p, err
+		}
+		if strings.HasPrefix(key, "tokenizer.") && p.Arch != "" {
+			break
+		}
+		var typ uint32
+		if err := binary.Read(r, binary.LittleEndian, &typ); err != nil {
+			return p, err
+		}
+		if typ == ggufTypeString && key == "general.architecture" {
+			if p.Arch, err = ggufString(r); err != nil {
+				return p, err
+			}
+			continue
+		}
+		n, err := ggufValue(r, typ)
+		if err != nil {
+			return p, fmt.Errorf("%s: %w", key, err)
+		}
+		if n >= 0 {
+			ints[key] = uint64(n)
+		}
+	}
+
+	a := p.Arch + "."
+	p.Layers = ints[a+"block_count"]
+	heads, embd := ints[a+"attention.head_count"], ints[a+"embedding_length"]
+	if p.Arch == "" || p.Layers == 0 || heads == 0 || embd == 0 {
+		return p, fmt.Errorf("missing architecture, block_count, embedding_length or head_count")
+	}
+	p.HeadsKV = heads
+	if n, ok := ints[a+"attention.head_count_kv"]; ok && n > 0 {
+		p.HeadsKV = n
+	}
+	p.KeyLen, p.ValLen = embd/heads, embd/heads
+	if n, ok := ints[a+"attention.key_length"]; ok && n > 0 {
+		p.KeyLen = n
+	}
+	if n, ok := ints[a+"attention.value_length"]; ok && n > 0 {
+		p.ValLen = n
+	}
+	p.TrainCtx = ints[a+"context_length"]
+	return p, nil
+}
+
+// GGUF metadata value types (gguf_type in ggml).
+const (
+	ggufTypeUint8   = 0
+	ggufTypeInt8    = 1
+	ggufTypeUint16  = 2
+	ggufTypeInt16   = 3
+	ggufTypeUint32  = 4
+	ggufTypeInt32   = 5
+	ggufTypeFloat32 = 6
+	ggufTypeBool    = 7
+	ggufTypeString  = 8
+	ggufTypeArray   = 9
+	ggufTypeUint64  = 10
+	ggufTypeInt64   = 11
+	ggufTypeFloat64 = 12
+)
+
+// ggufString reads a GGUF string: a uint64 length, then the bytes.
+func ggufString(r *bufio.Reader) (string, error) {
+	var n uint64
+	if err := binary.Read(r, binary.LittleEndian, &n); err != nil {
+		return "", err
+	}
+	if n > 1<<20 {
+		return "", fmt.Errorf("string of %d bytes", n)
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	return string(b), err
+}
+
+// ggufValue reads one value of type typ and returns it if it is an
+// integer, or -1 for anything else (which is skipped).
+func ggufValue(r *bufio.Reader, typ uint32) (int64, error) {
+	size := map[uint32]int{
+		ggufTypeUint8: 1, ggufTypeInt8: 1, ggufTypeBool: 1,
+		ggufTypeUint16: 2, ggufTypeInt16: 2,
+		ggufTypeUint32: 4, ggufTypeInt32: 4, ggufTypeFloat32: 4,
+		ggufTypeUint64: 8, ggufTypeInt64: 8, ggufTypeFloat64: 8,
+	}
+	switch typ {
+	case ggufTypeString:
+		_, err := ggufString(r)
+		return -1, err
+	case ggufTypeArray:
+		var elem uint32
+		var count uint64
+		if err := binary.Read(r, binary.LittleEndian, &elem); err != nil {
+			return -1, err
+		}
+		if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+			return -1, err
+		}
+		if n, ok := size[elem]; ok {
+			_, err := r.Discard(int(count) * n)
+			return -1, err
+		}
+		for j := uint64(0); j < count; j++ {
+			if _, err := ggufValue(r, elem); err != nil {
+				return -1, err
+			}
+		}
+		return -1, nil
+	}
+	n, ok := size[typ]
+	if !ok {
+		return -1, fmt.Errorf("unknown GGUF value type %d", typ)
+	}
+	b := make([]byte, 8)
+	if _, err := io.ReadFull(r, b[:n]); err != nil {
+		return -1, err
+	}
+	switch typ {
+	case ggufTypeUint8, ggufTypeUint16, ggufTypeUint32, ggufTypeUint64:
+		return int64(binary.LittleEndian.Uint64(b)), nil
+	case ggufTypeInt8:
+		return int64(int8(b[0])), nil
+	case ggufTypeInt16:
+		return int64(int16(binary.LittleEndian.Uint16(b))), nil
+	case ggufTypeInt32:
+		return int64(int32(binary.LittleEndian.Uint32(b))), nil
+	case ggufTypeInt64:
+		return int64(binary.LittleEndian.Uint64(b)), nil
+	}
+	return -1, nil // floats and bools
+}
+
+// remoteSize HEADs url (following redirects, as the download does) and
+// returns its Content-Length. token, if set, is sent as a bearer token.
+func remoteSize(ctx context.Context, httpClient *http.Client, url, token string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return 0, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return 0, fmt.Errorf("HEAD %s", resp.Status)
+	}
+	if resp.ContentLength < 0 {
+		return 0, fmt.Errorf("no Content-Length")
+	}
+	return resp.ContentLength, nil
+}
+
+// hubSHA256 is the SHA256 Hugging Face lists for the LFS file behind a
+// resolve/ URL: the Hub answers a HEAD with a redirect to its CDN and
+// the LFS object id, which is the file's SHA256, in X-Linked-Etag.
+func hubSHA256(ctx context.Context, httpClient *http.Client, url, token string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", url, nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	noRedirect := *httpClient
+	noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err := noRedirect.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return "", fmt.Errorf("HEAD %s", resp.Status)
+	}
+	sum := strings.ToLower(strings.Trim(strings.TrimPrefix(resp.Header.Get("X-Linked-Etag"), "W/"), `"`))
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != 64 {
+		return "", fmt.Errorf("no SHA256 in X-Linked-Etag")
+	}
+	return sum, nil
+}
+
+// modelSize is the download size of m: its file, or all of its shards.
+func modelSize(ctx context.Context, httpClient *http.Client, m modelSpec, token string) (int64, error) {
+	urls := m.URLs
+	if len(urls) == 0 {
+		urls = []string{m.URL}
+	}
+	var total int64
+	for _, u := range urls {
+		size, err := remoteSize(ctx, httpClient, u, token)
+		if err != nil {
+			return 0, err
+		}
+		total += size
+	}
+	return total, nil
+}
+
+// newChatRequest builds the POST of body to url, with apiKey as a bearer
+// token unless empty.
+func newChatRequest(ctx context.Context, url, apiKey string, body any) (*http.Request, error) {
+	bts, _ := json.Marshal(body)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(string(bts)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+	return req, nil
+}
+
+// verifyChatStream is verifyChat with stream:true. It reads the server-sent
+// events as they arrive and requires at least minChunks content chunks and
+// the closing [DONE]: a buffering proxy or a router timeout can break
+// streaming while plain requests still work. When the chunks arrive matters
+// too, so the times of the first and last one are printed.
+func verifyChatStream(ctx context.Context, httpClient *http.Client, url, model, systemPrompt, apiKey string, maxTokens, minChunks int) (string, error) {
+	var reply strings.Builder
+	var first, last time.Duration
+	chunks := 0
+	start := time.Now()
+	_, err := streamChat(ctx, httpClient, url, apiKey, chatReq{
+		Model:     model,
+		MaxTokens: maxTokens,
+		Messages: []chatMessage{
+			{Role: "system", Content: systemPrompt},
+			{Role: "user", Content: "Count from one to ten in words."},
+		},
+	}, func(content string) {
+		chunks++
+		if chunks == 1 {
+			first = time.Since(start)
+		}
+		last = time.Since(start)
+		reply.WriteString(content)
+	})
+	if err != nil {
+		return "", err
+	}
+	if chunks < minChunks {
+		return "", fmt.Errorf("only %d content chunks before [DONE], want at least %d (is something buffering the response?)", chunks, minChunks)
+	}
+	fmt.Printf("Streaming OK: %d chunks, first after %s, last after %s\n", chunks, first.Round(time.Millisecond), last.Round(time.Millisecond))
+	return reply.String(), nil
+}
+
+// streamChat POSTs body with stream:true and calls onDelta for each piece of
+// content as it arrives. It fails unless the reply is an event stream that
+// ends with [DONE], and returns the completion tokens the server reported
+// (0 if it didn't).
+func streamChat(ctx context.Context, httpClient *http.Client, url, apiKey string, body chatReq, onDelta func(content string)) (int, error) {
+	body.Stream = true
+	req, err := newChatRequest(ctx, url, apiKey, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("verification HTTP error: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		b, _ := io.ReadAll(resp.Body)
+		return 0, fmt.Errorf("non-2xx from chat endpoint: %d\n%s", resp.StatusCode, string(b))
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+		return 0, fmt.Errorf("expected a text/event-stream reply, got %q", ct)
+	}
+
+	deltas, usage := 0, 0
+	sc := bufio.NewScanner(resp.Body)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		// Blank lines separate events; other fields (event:, id:, comments)
+		// don't matter here.
+		data, ok := strings.CutPrefix(sc.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			return usage, nil
+		}
+		var chunk chatChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return 0, fmt.Errorf("could not parse stream chunk: %v\nRaw chunk: %s", err, data)
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage.CompletionTokens
+		}
+		for _, c := range chunk.Choices {
+			if c.Delta.Content != "" {
+				deltas++
+				onDelta(c.Delta.Content)
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return 0, fmt.Errorf("stream broke after %d chunks: %w", deltas, err)
+	}
+	return 0, fmt.Errorf("stream ended after %d chunks without [DONE] (router timeout?)", deltas)
+}
+
+// -----------------------------
+// Object builders (one model stack)
+// -----------------------------
+
+// buildConfigMap stores non-secret key/value config. We'll use it to:
+// - pass the model URL to the initContainer
+// - pass model parameters (ctx, threads, name, system prompt) to llama.cpp
+func buildConfigMap(ns string, st modelStack, opts serverOptions) *corev1.ConfigMap {
+	cm := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName + "-config",
+			Namespace: ns,
+			Labels:    map[string]string{"app": st.ObjName},
+		},
+		Data: map[string]string{
+			"MODEL_URL":     st.Model.URL,
+			"MODEL_URLS":    strings.Join(st.Model.URLs, " "),
+			"DRAFT_URL":     st.Model.DraftURL,
+			"MMPROJ_URL":    st.Model.MMProjURL,
+			"CHAT_TEMPLATE": st.Model.ChatTemplate,
+			"MODEL_OCI_REF": st.Model.OCIRef,
+			"HF_MODEL":      st.Model.HFModel,
+			"OLLAMA_MODEL":  st.Model.OllamaModel,
+			"MODEL_NAME":    st.Model.Name,
+			"SYSTEM_PROMPT": opts.SystemPrompt,
+			"CTX_LEN":       fmt.Sprintf("%d", st.Model.Ctx),
+			"N_THREADS":     fmt.Sprintf("%d", st.Model.Threads),
+			"MODEL_SHA256":  st.Model.SHA256,
+			// File under /models the server loads (a split model's first
+			// shard); set-model rotates it.
+			"MODEL_FILE": st.Model.modelFiles("model")[0],
+		},
+	}
+	// Mounted into the proxy and prompt cache sidecars.
+	if opts.proxySidecar() {
+		cm.Data["proxy.py"] = proxySidecarScript
+	}
+	if opts.PromptCache {
+		cm.Data["prompt-cache.py"] = promptCacheScript
+	}
+	return cm
+}
+
+// buildModelPVC: a PVC (5Gi unless --model-storage-size/storage: says
+// otherwise) so the downloaded model survives pod restarts. On CRC, a
+// default StorageClass usually exists and will bind this PVC;
+// --model-storage-class picks another.
+// --model-volume=rwx asks for ReadWriteMany so replicas on several nodes
+// can share it (the StorageClass must support that, e.g. NFS or CephFS).
+func buildModelPVC(ns string, st modelStack, opts serverOptions) *corev1.PersistentVolumeClaim {
+	accessMode := corev1.ReadWriteOnce // good for single-node CRC
+	if opts.ModelVolume == "rwx" {
+		accessMode = corev1.ReadWriteMany
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName + "-models-pvc",
+			Namespace: ns,
+			Labels:    map[string]string{"app": st.ObjName},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{accessMode},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: resource.MustParse(st.Model.Storage),
+				},
+			},
+		},
+	}
+	if opts.StorageClass != "" {
+		pvc.Spec.StorageClassName = &opts.StorageClass
+	}
+	// Bind to our hostPath PV only; "" keeps the default StorageClass out.
+	if opts.ModelHostPath != "" {
+		noClass := ""
+		pvc.Spec.StorageClassName = &noClass
+		pvc.Spec.VolumeName = hostPathPVName(ns, st.ObjName)
+	}
+	return pvc
+}
+
+// hostPathPVName names a model's hostPath PV. PVs are cluster-scoped, so
+// the namespace is part of the name.
+func hostPathPVName(ns, objName string) string {
+	return ns + "-" + objName + "-models"
+}
+
+// buildUsagePVC is where --usage-log's records go. Every model of a run
+// (and its swap and canary Deployments) shares it; each pod writes its
+// own files, so only the access mode has to allow that. It is
+// ReadWriteOnce only next to an RWO models PVC, which keeps the pods on
+// one node anyway; with rwx or per-replica they may spread out, and every
+// replica mounts it.
+func buildUsagePVC(ns string, opts serverOptions) *corev1.PersistentVolumeClaim {
+	accessMode := corev1.ReadWriteMany
+	if opts.ModelVolume == "rwo" {
+		accessMode = corev1.ReadWriteOnce
+	}
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: opts.UsagePVC, Namespace: ns},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{accessMode},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: resource.MustParse(opts.UsageStorage),
+				},
+			},
+		},
+	}
+	if opts.StorageClass != "" {
+		pvc.Spec.StorageClassName = &opts.StorageClass
+	}
+	return pvc
+}
+
+// buildHostPathPV: a PersistentVolume on the node's
+// <--model-hostpath>/<model name>, pre-bound to the model's PVC. PVs bind
+// one claim each, so every namespace gets its own PV on the same
+// directory. The directory must already exist (kubelet would create it
+// root-owned, unwritable for the pods' random UID), and Retain keeps the
+// files when the PVC goes.
+func buildHostPathPV(ns string, st modelStack, opts serverOptions) *corev1.PersistentVolume {
+	hostPathType := corev1.HostPathDirectory
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   hostPathPVName(ns, st.ObjName),
+			Labels: map[string]string{"app": st.ObjName},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: resource.MustParse(st.Model.Storage),
+			},
+			AccessModes:                   []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce},
+			PersistentVolumeReclaimPolicy: corev1.PersistentVolumeReclaimRetain,
+			ClaimRef: &corev1.ObjectReference{
+				Kind:      "PersistentVolumeClaim",
+				Namespace: ns,
+				Name:      st.ObjName + "-models-pvc",
+			},
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: filepath.Join(opts.ModelHostPath, st.Model.Name),
+					Type: &hostPathType,
+				},
+			},
+		},
+	}
+}
+
+// fetchModelScript runs in the "fetch-model" initContainer. It:
+//   - creates /models
+//   - ensures it's writable (0775) for fsGroup/random UID
+//   - downloads into $MODEL_FILE.part (MODEL_FILE defaults to model.gguf;
+//     set-model uses a new name per model), resuming a partial file left by an
+//     interrupted attempt (curl -C -), sending the Hugging Face token (if any)
+//     as a header; with DOWNLOADER=aria2, aria2c fetches it in segments over
+//     several connections instead (see useDownloader)
+//   - checks the size against the server's Content-Length and, with
+//     MODEL_SHA256 set, the checksum; a bad file is deleted and re-fetched,
+//     up to 3 times
+//   - renames the checked file into place, so $MODEL_FILE is only ever a
+//     complete download (an existing one is re-checked the same way)
+//   - first deletes the files the integrity CronJob flagged as corrupt
+//   - for a split model (MODEL_URLS lists the shards), does all of the
+//     above per shard, storing them as <name>-0000k-of-0000N.gguf next to
+//     $MODEL_FILE (the first shard), which is how llama.cpp finds the rest
+//   - shows a listing on success
+const fetchModelScript = `set -euo pipefail
+mkdir -p /models
+chmod 0775 /models || true
+
+# fetch (below) downloads URL into MODEL, via PART.
+URL="${MODEL_URL}"
+MODEL="/models/${MODEL_FILE:-model.gguf}"
+
+# remote_size prints the Content-Length of the final redirect target, or
+# nothing if the server doesn't say (or can't be reached).
+remote_size() {
+  curl -sIL --max-time 30 "$@" "$URL" 2>/dev/null | tr -d '\r' |
+    awk 'tolower($1) == "content-length:" { n = $2 } END { print n }' || true
+}
+
+size_of() {
+  if [ -f "$1" ]; then wc -c < "$1" | tr -d ' '; else echo 0; fi
+}
+
+# check succeeds if the file has the expected size (when known) and matches
+# MODEL_SHA256 (when configured).
+check() {
+  if [ -n "$EXPECTED_SIZE" ] && [ "$(size_of "$1")" != "$EXPECTED_SIZE" ]; then
+    echo "Size mismatch: expected $EXPECTED_SIZE bytes, got $(size_of "$1")"
+    return 1
+  fi
+  [ -z "${MODEL_SHA256:-}" ] && return 0
+  echo "Verifying SHA256 of $1 ..."
+  actual=$(sha256sum "$1" | cut -d' ' -f1)
+  if [ "$actual" != "${MODEL_SHA256}" ]; then
+    echo "SHA256 mismatch: expected ${MODEL_SHA256}, got $actual"
+    return 1
+  fi
+  echo "SHA256 OK"
+}
+
+# aria2_download is download for DOWNLOADER=aria2: ARIA2_SPLIT segments
+# over up to ARIA2_CONNECTIONS connections. aria2 notes finished segments
+# in $PART.aria2 and resumes from it; the file itself may already have its
+# full size with holes in it.
+aria2_download() {
+  url="$URL"
+  hdr=""
+  if [ -n "${HF_TOKEN:-}" ]; then
+    # aria2 would send the token on to the CDN too; follow the redirect
+    # here instead and fetch the signed URL it ends at without it.
+    if command -v curl >/dev/null 2>&1; then
+      url=$(curl -sIL -o /dev/null -w '%{url_effective}' --max-time 30 "$@" "$URL") || url="$URL"
+    else
+      hdr="Authorization: Bearer ${HF_TOKEN}"
+    fi
+  fi
+  aria2c --continue=true --allow-overwrite=true --auto-file-renaming=false \
+         --split="${ARIA2_SPLIT}" --max-connection-per-server="${ARIA2_CONNECTIONS}" \
+         --min-split-size="${ARIA2_MIN_SPLIT_SIZE}" \
+         --max-tries=5 --retry-wait=3 --timeout=30 --lowest-speed-limit=1K \
+         --file-allocation=none --console-log-level=warn \
+         --show-console-readout=false --summary-interval=10 \
+         ${hdr:+"--header=$hdr"} \
+         --dir="$(dirname "$PART")" --out="$(basename "$PART")" "$url" || {
+    echo "Download interrupted at $(size_of "$PART") bytes; will resume on restart"
+    exit 1
+  }
+  echo "Download complete: $(ls -lh "$PART")"
+}
+
+download() {
+  have=$(size_of "$PART")
+  if [ -n "$EXPECTED_SIZE" ] && [ "$have" -ge "$EXPECTED_SIZE" ] && [ ! -e "$PART.aria2" ]; then
+    echo "Partial file already has $have bytes; not downloading more"
+    return 0
+  fi
+  if [ "$have" -gt 0 ]; then
+    echo "Resuming download of $URL at byte $have ..."
+  else
+    echo "Downloading model from $URL ..."
+  fi
+  if [ "${DOWNLOADER:-curl}" = aria2 ]; then
+    aria2_download "$@"
+    return
+  fi
+  # curl flags:
+  # -L: follow redirects
+  # -C -: continue from the end of the partial file
+  # --fail: treat HTTP 4xx/5xx as errors
+  # --show-error: print error messages on failure
+  # --retry/--retry-delay/--retry-max-time: resilience to transient failures
+  # --speed-time/--speed-limit: abort if too slow (e.g., hung connection)
+  # On failure the partial file is kept; the initContainer is restarted
+  # and picks up where this attempt stopped.
+  curl -L -C - --fail --show-error \
+       --retry 5 --retry-delay 3 --retry-max-time 180 \
+       --speed-time 30 --speed-limit 1024 \
+       "$@" -o "$PART" "$URL" || {
+    echo "Download interrupted at $(size_of "$PART") bytes; will resume on restart"
+    exit 1
+  }
+  echo "Download complete: $(ls -lh "$PART")"
+}
+
+# Gated models: pass the token as a header. curl drops it when a redirect
+# leaves the host (e.g. to the CDN), which is what we want.
+if [ -n "${HF_TOKEN:-}" ]; then
+  echo "Using Hugging Face token from Secret"
+  set -- -H "Authorization: Bearer ${HF_TOKEN}"
+fi
+
+fetch() {
+  # PART_SUFFIX keeps replicas sharing an RWX volume out of each other's way.
+  PART="$MODEL.part${PART_SUFFIX:-}"
+  EXPECTED_SIZE=$(remote_size "$@")
+
+  if [ -s "$MODEL" ] && check "$MODEL"; then
+    echo "Model already present: $(ls -lh "$MODEL")"
+    return 0
+  fi
+  # A model.gguf that fails the checks is either corrupt or a truncated
+  # download from an older version of this script; start over.
+  rm -f "$MODEL"
+  attempt=1
+  while :; do
+    download "$@"
+    if check "$PART"; then
+      mv -f "$PART" "$MODEL"
+      rm -f "$MODEL.sha256" # the integrity check's reference, if any
+      return 0
+    fi
+    rm -f "$PART" "$PART.aria2"
+    if [ "$attempt" -ge 3 ]; then
+      echo "Giving up after $attempt downloads that failed verification"
+      exit 1
+    fi
+    attempt=$((attempt + 1))
+  done
+}
+
+# Files the integrity CronJob (--integrity-schedule) found corrupt are
+# downloaded again.
+if [ -e "$MODEL.corrupt" ]; then
+  for f in $(cat "$MODEL.corrupt"); do
+    echo "Integrity check flagged $f; downloading it again"
+    rm -f "/models/$f" "/models/$f.sha256"
+  done
+  rm -f "$MODEL.corrupt"
+fi
+
+if [ -n "${MODEL_URLS:-}" ]; then
+  total=$(echo "$MODEL_URLS" | wc -w | tr -d ' ')
+  prefix="${MODEL%-00001-of-*.gguf}"
+  i=1
+  for URL in $MODEL_URLS; do
+    MODEL=$(printf '%s-%05d-of-%05d.gguf' "$prefix" "$i" "$total")
+    echo "Shard $i of $total"
+    fetch "$@"
+    i=$((i + 1))
+  done
+else
+  fetch "$@"
+fi
+ls -l /models
+`
+
+// verifySHA256Func is the shell function the non-curl fetch scripts use to
+// check a file against MODEL_SHA256 (a no-op when it is empty).
+const verifySHA256Func = `
+verify() {
+  [ -z "${MODEL_SHA256:-}" ] && return 0
+  echo "Verifying SHA256 of $1 ..."
+  actual=$(sha256sum "$1" | cut -d' ' -f1)
+  if [ "$actual" != "${MODEL_SHA256}" ]; then
+    echo "SHA256 mismatch: expected ${MODEL_SHA256}, got $actual"
+    return 1
+  fi
+  echo "SHA256 OK"
+}
+`
+
+// checkModelScript replaces fetchModelScript for --model-from-pvc and the
+// quantize and upload-model commands: the clone or quantize Job or the
+// upload has already put model.gguf in place, so only check it.
+const checkModelScript = `set -euo pipefail
+MODEL=/models/model.gguf
+` + verifySHA256Func + `
+if [ ! -s "$MODEL" ]; then
+  echo "No model at $MODEL; did the clone or quantize Job (or the upload) run?"
+  exit 1
+fi
+verify "$MODEL"
+ls -l /models
+`
+
+// uploadScript is the upload-model helper pod's server (Python standard
+// library only, so any Python 3 image will do).
+const uploadScript = `# Upload endpoint of the upload-model command, reached through the API
+# server's pod proxy. GET /upload?file=F answers {"bytes": n, "sha256": h}
+# for an existing /models/F ({} if there is none); PUT /upload?file=F&sha256=H
+# streams the body (plain or chunked) into F.part, hashing it on the way,
+# and renames it into place if the hash is H.
+import hashlib
+import json
+import os
+import urllib.parse
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+MODELS = "/models"
+
+
+class Upload(BaseHTTPRequestHandler):
+    protocol_version = "HTTP/1.1"
+
+    def reply(self, status, obj):
+        body = json.dumps(obj).encode()
+        self.send_response(status)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def query(self):
+        q = urllib.parse.parse_qs(urllib.parse.urlsplit(self.path).query)
+        name = os.path.basename(q.get("file", ["model.gguf"])[0])
+        return os.path.join(MODELS, name), q.get("sha256", [""])[0]
+
+    def do_GET(self):
+        path, _ = self.query()
+        if not os.path.exists(path):
+            return self.reply(200, {})
+        h, n = hashlib.sha256(), 0
+        with open(path, "rb") as f:
+            for b in iter(lambda: f.read(1 << 20), b""):
+                h.update(b)
+                n += len(b)
+        self.reply(200, {"bytes": n, "sha256": h.hexdigest()})
+
+    def body(self):
+        if self.headers.get("Transfer-Encoding", "").lower() == "chunked":
+            while True:
+                size = int(self.rfile.readline().split(b";")[0].strip(), 16)
+                if size == 0:
+                    while self.rfile.readline() not in (b"\r\n", b"\n", b""):
+                        pass
+                    return
+                yield from self.read(size)
+                self.rfile.readline()
+        else:
+            yield from self.read(int(self.headers.get("Content-Length") or 0))
+
+    def read(self, left):
+        while left:
+            b = self.rfile.read(min(left, 1 << 20))
+            if not b:
+                raise EOFError("upload cut short")
+            left -= len(b)
+            yield b
+
+    def do_PUT(self):
+        path, expected = self.query()
+        part = path + ".part"
+        h, n = hashlib.sha256(), 0
+        try:
+            with open(part, "wb") as f:
+                for b in self.body():
+                    f.write(b)
+                    h.update(b)
+                    n += len(b)
+        except (EOFError, ValueError, OSError) as e:
+            self.close_connection = True
+            return self.reply(400, {"error": str(e)})
+        print("Received %d bytes, sha256 %s" % (n, h.hexdigest()), flush=True)
+        if expected and h.hexdigest() != expected:
+            os.remove(part)
+            return self.reply(422, {"error": "sha256 mismatch: expected %s, got %s" % (expected, h.hexdigest())})
+        os.replace(part, path)
+        # References the integrity CronJob kept for the old file.
+        for stale in (path + ".sha256", path + ".corrupt"):
+            if os.path.exists(stale):
+                os.remove(stale)
+        self.reply(200, {"bytes": n, "sha256": h.hexdigest()})
+
+
+if __name__ == "__main__":
+    ThreadingHTTPServer(("0.0.0.0", 8000), Upload).serve_forever()
+`
+
+// checkLocalGGUF makes sure path is a GGUF before anything is created.
+func checkLocalGGUF(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != "GGUF" {
+		return fmt.Errorf("%s is not a GGUF file", path)
+	}
+	return nil
+}
+
+// buildUploadPod runs uploadScript on the models PVC, preferably next to
+// the server pods (an RWO volume can only be shared on their node).
+func buildUploadPod(ns string, st modelStack, opts serverOptions) *corev1.Pod {
+	var fsGroup int64 = 65532 // same group as the server pod, see buildDeployment
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName + "-upload",
+			Namespace: ns,
+			// No "app" label here: the Service must not select this pod.
+			Labels: map[string]string{"job": "upload-model"},
+		},
+		Spec: corev1.PodSpec{
+			RestartPolicy:   corev1.RestartPolicyNever,
+			SecurityContext: &corev1.PodSecurityContext{FSGroup: &fsGroup},
+			Affinity: &corev1.Affinity{
+				PodAffinity: &corev1.PodAffinity{
+					PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+						{
+							Weight: 100,
+							PodAffinityTerm: corev1.PodAffinityTerm{
+								LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": st.ObjName}},
+								TopologyKey:   "kubernetes.io/hostname",
+							},
+						},
+					},
+				},
+			},
+			Containers: []corev1.Container{
+				{
+					Name:    "upload",
+					Image:   opts.SidecarImage,
+					Command: []string{"python3", "-u", "-c", uploadScript},
+					Ports:   []corev1.ContainerPort{{Name: "upload", ContainerPort: 8000}},
+					ReadinessProbe: &corev1.Probe{
+						ProbeHandler: corev1.ProbeHandler{
+							TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8000)},
+						},
+						PeriodSeconds: 2,
+					},
+					SecurityContext: &corev1.SecurityContext{
+						RunAsNonRoot:             boolp(true),
+						AllowPrivilegeEscalation: boolp(false),
+					},
+					VolumeMounts: []corev1.VolumeMount{
+						{Name: "model-store", MountPath: "/models"},
+					},
+				},
+			},
+			Volumes: []corev1.Volume{
+				{
+					Name: "model-store",
+					VolumeSource: corev1.VolumeSource{
+						PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: st.ObjName + "-models-pvc"},
+					},
+				},
+			},
+		},
+	}
+	placePod(&pod.Spec, opts)
+	return pod
+}
+
+// progressReader prints how much of an upload has been read, at most
+// every 5 seconds.
+type progressReader struct {
+	r           io.Reader
+	read, total int64
+	last        time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.read += int64(n)
+	if time.Since(p.last) >= 5*time.Second || (err == io.EOF && p.read == p.total) {
+		p.last = time.Now()
+		fmt.Printf("  [upload] %d / %d MiB (%.0f%%)\n", p.read>>20, p.total>>20, 100*float64(p.read)/float64(max(p.total, 1)))
+	}
+	return n, err
+}
+
+// uploadModel streams st.Model.LocalFile into the models PVC as
+// model.gguf through buildUploadPod, reached via the API server's pod
+// proxy: only the Kubernetes API has to be reachable, so this works when
+// the cluster can't download anything. A file with the same SHA256
+// already there isn't sent again.
+func uploadModel(ctx context.Context, cs *kubernetes.Clientset, ns string, st modelStack, opts serverOptions) error {
+	f, err := os.Open(st.Model.LocalFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Hashing %s (%d MiB)...\n", st.Model.LocalFile, info.Size()>>20)
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	if st.Model.SHA256 != "" && sum != st.Model.SHA256 {
+		return fmt.Errorf("SHA256 mismatch: --model-sha256 is %s, %s has %s", st.Model.SHA256, st.Model.LocalFile, sum)
+	}
+
+	pods := cs.CoreV1().Pods(ns)
+	pod := buildUploadPod(ns, st, opts)
+	if err := pods.Delete(ctx, pod.Name, metav1.DeleteOptions{}); err != nil && !kerrors.IsNotFound(err) {
+		return err
+	}
+	err = waitutil.PollImmediateUntilWithContext(ctx, 2*time.Second, func(ctx context.Context) (bool, error) {
+		_, err := pods.Get(ctx, pod.Name, metav1.GetOptions{})
+		return kerrors.IsNotFound(err), nil
+	})
+	if err != nil {
+		return fmt.Errorf("old pod %s not deleted: %w", pod.Name, err)
+	}
+	if _, err := pods.Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	defer pods.Delete(context.Background(), pod.Name, metav1.DeleteOptions{})
+	err = waitutil.PollImmediateUntilWithContext(ctx, 2*time.Second, func(ctx context.Context) (bool, error) {
+		p, err := pods.Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		if p.Status.Phase == corev1.PodFailed {
+			return false, fmt.Errorf("upload pod failed (see: oc logs %s -n %s)", pod.Name, ns)
+		}
+		for _, c := range p.Status.Conditions {
+			if c.Type == corev1.PodReady && c.Status == corev1.ConditionTrue {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("upload pod not ready: %w", err)
+	}
+
+	proxy := func(verb string) *rest.Request {
+		return cs.CoreV1().RESTClient().Verb(verb).Namespace(ns).Resource("pods").
+			Name(pod.Name+":8000").SubResource("proxy").Suffix("upload").Param("file", "model.gguf")
+	}
+	var got struct {
+		Bytes  int64  `json:"bytes"`
+		SHA256 string `json:"sha256"`
+	}
+	raw, err := proxy("GET").DoRaw(ctx)
+	if err != nil {
+		return fmt.Errorf("query upload pod: %w", err)
+	}
+	if err := json.Unmarshal(raw, &got); err != nil {
+		return fmt.Errorf("query upload pod: %w", err)
+	}
+	if got.SHA256 == sum {
+		fmt.Println("The PVC already has this model; not uploading it again.")
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	body := &progressReader{r: f, total: info.Size(), last: time.Now()}
+	raw, err = proxy("PUT").Param("sha256", sum).Body(body).DoRaw(ctx)
+	if err != nil {
+		return fmt.Errorf("upload (a large file needs a long enough --timeout): %w: %s", err, raw)
+	}
+	if err := json.Unmarshal(raw, &got); err != nil || got.SHA256 != sum {
+		return fmt.Errorf("upload pod answered %s", raw)
+	}
+	fmt.Printf("Uploaded %d bytes, SHA256 %s\n", got.Bytes, got.SHA256)
+	return nil
+}
+
+// cloneModelScript runs in the clone Job: it copies the source PVC's GGUF
+// next to model.gguf and renames it into place, skipping the copy when a
+// file of the same size is already there.
+const cloneModelScript = `set -euo pipefail
+SRC="/source/${SOURCE_PATH}"
+MODEL=/models/model.gguf
+if [ ! -s "$SRC" ]; then
+  echo "No GGUF at ${SOURCE_PATH} in the source PVC:"
+  ls -l /source
+  exit 1
+fi
+if [ -s "$MODEL" ] && [ "$(wc -c < "$MODEL")" = "$(wc -c < "$SRC")" ]; then
+  echo "Model already cloned: $(ls -lh "$MODEL")"
+  exit 0
+fi
+chmod 0775 /models || true
+echo "Copying $(ls -lh "$SRC") ..."
+cp "$SRC" "$MODEL.part"
+mv -f "$MODEL.part" "$MODEL"
+echo "Clone complete: $(ls -lh "$MODEL")"
+`
+
+// buildCloneModelJob copies the GGUF from st.Model.FromPVC into the model's
+// own PVC. Both are mounted in one pod, so on multi-node clusters ReadWriteOnce
+// volumes must be attachable to the same node (--node-selector helps).
+func buildCloneModelJob(ns string, st modelStack, opts serverOptions) *batchv1.Job {
+	var fsGroup int64 = 65532 // same group as the server pod, see buildDeployment
+	labels := map[string]string{"app": st.ObjName, "job": "clone-model"}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName + "-clone-model",
+			Namespace: ns,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: int32p(2),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy:   corev1.RestartPolicyNever,
+					SecurityContext: &corev1.PodSecurityContext{FSGroup: &fsGroup},
+					Containers: []corev1.Container{
+						{
+							Name:    "clone",
+							Image:   opts.CurlImage, // any small image with sh/cp will do
+							Command: []string{"sh", "-c", cloneModelScript},
+							Env:     []corev1.EnvVar{{Name: "SOURCE_PATH", Value: st.Model.FromPVCPath}},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "source", MountPath: "/source", ReadOnly: true},
+								{Name: "model-store", MountPath: "/models"},
+							},
+							SecurityContext: &corev1.SecurityContext{
+								RunAsNonRoot:             boolp(true),
+								AllowPrivilegeEscalation: boolp(false),
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "source",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: st.Model.FromPVC, ReadOnly: true},
+							},
+						},
+						{
+							Name: "model-store",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: st.ObjName + "-models-pvc"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	placePod(&job.Spec.Template.Spec, opts)
+	return job
+}
+
+// quantizeModelScript runs in the quantize Job after its fetch-model init
+// container has downloaded the source to $SOURCE_FILE: llama-quantize writes
+// model.gguf.part, which is renamed into place, and the source is deleted
+// to free the PVC. A stamp file records what model.gguf was made from, so
+// re-running with the same source and type does nothing.
+const quantizeModelScript = `set -eu
+SRC="/models/${SOURCE_FILE}"
+MODEL=/models/model.gguf
+STAMP=/models/.quantized-from
+if [ -s "$MODEL" ] && [ "$(cat "$STAMP" 2>/dev/null)" = "${QUANT} ${SOURCE_URL}" ]; then
+  echo "Already quantized: $(ls -lh "$MODEL")"
+  exit 0
+fi
+QUANTIZE=$(command -v llama-quantize || echo /app/llama-quantize)
+echo "Quantizing $(ls -lh "$SRC") to ${QUANT} ..."
+"$QUANTIZE" "$SRC" "$MODEL.part" "${QUANT}" "${N_THREADS}"
+mv -f "$MODEL.part" "$MODEL"
+echo "${QUANT} ${SOURCE_URL}" > "$STAMP"
+rm -f "$SRC"
+ls -l /models
+`
+
+// quantizeSkipScript goes in front of fetchModelScript in the quantize Job,
+// so the source isn't downloaded again once model.gguf has been made from it.
+const quantizeSkipScript = `if [ -s /models/model.gguf ] && [ "$(cat /models/.quantized-from 2>/dev/null)" = "${QUANT} ${MODEL_URL}" ]; then
+  echo "model.gguf is already ${QUANT} of ${MODEL_URL}; not downloading it"
+  exit 0
+fi
+`
+
+// buildQuantizeJob downloads st.Model.SourceURL into the models PVC (the
+// fetch-model Job's container, run as an init container) and quantizes it
+// to model.gguf with the llama.cpp tools image.
+func buildQuantizeJob(ns string, st modelStack, opts serverOptions) *batchv1.Job {
+	const sourceFile = "source.gguf"
+	src := st
+	src.Model.URL, src.Model.URLs, src.Model.SHA256 = st.Model.SourceURL, nil, ""
+	job := buildFetchModelJob(ns, src, sourceFile, opts)
+	job.Name = st.ObjName + "-quantize"
+	job.Labels["job"] = "quantize"
+	job.Spec.Template.Labels = map[string]string{"job": "quantize"}
+	job.Spec.BackoffLimit = int32p(1)
+
+	pod := &job.Spec.Template.Spec
+	fetch := pod.Containers[0]
+	fetch.Args = []string{quantizeSkipScript + fetchModelScript}
+	fetch.Env = append(fetch.Env, corev1.EnvVar{Name: "QUANT", Value: st.Model.Quant})
+	pod.InitContainers = []corev1.Container{fetch}
+	pod.Containers = []corev1.Container{
+		{
+			Name:    "quantize",
+			Image:   opts.ToolsImage,
+			Command: []string{"sh", "-c"},
+			Args:    []string{quantizeModelScript},
+			Env: []corev1.EnvVar{
+				{Name: "SOURCE_URL", Value: st.Model.SourceURL},
+				{Name: "SOURCE_FILE", Value: sourceFile},
+				{Name: "QUANT", Value: st.Model.Quant},
+				{Name: "N_THREADS", Value: fmt.Sprintf("%d", st.Model.Threads)},
+			},
+			SecurityContext: fetch.SecurityContext,
+			VolumeMounts:    fetch.VolumeMounts,
+		},
+	}
+	return job
+}
+
+// fetchOCIModelScript replaces fetchModelScript for --model-oci-ref: oras
+// pulls the artifact (its layer digests are verified by oras itself), and
+// the first .gguf in it becomes model.gguf after the optional SHA256 check.
+const fetchOCIModelScript = `set -euo pipefail
+mkdir -p /models
+chmod 0775 /models || true
+
+MODEL=/models/model.gguf
+PULL="/models/.oci-pull${PART_SUFFIX:-}"
+` + verifySHA256Func + `
+if [ -s "$MODEL" ] && verify "$MODEL"; then
+  echo "Model already present: $(ls -lh "$MODEL")"
+else
+  rm -rf "$MODEL" "$PULL"
+  set --
+  if [ -f /etc/oras/config.json ]; then
+    set -- "$@" --registry-config /etc/oras/config.json
+  fi
+  if [ "${ORAS_PLAIN_HTTP:-}" = "true" ]; then
+    set -- "$@" --plain-http
+  fi
+  echo "Pulling OCI artifact ${MODEL_OCI_REF} ..."
+  oras pull "$@" -o "$PULL" "${MODEL_OCI_REF}"
+  gguf=$(find "$PULL" -type f -name '*.gguf' | sort | head -n 1)
+  if [ -z "$gguf" ]; then
+    echo "No .gguf file in ${MODEL_OCI_REF}:"
+    ls -lR "$PULL"
+    exit 1
+  fi
+  verify "$gguf"
+  mv -f "$gguf" "$MODEL"
+  rm -rf "$PULL"
+  echo "Pull complete: $(ls -lh "$MODEL")"
+fi
+ls -l /models
+`
+
+// useOCISource switches the fetch-model initContainer to oras, with the
+// registry credentials (if any) mounted where fetchOCIModelScript looks.
+func useOCISource(spec *corev1.PodSpec, cmName string, opts serverOptions) {
+	fetch := &spec.InitContainers[0]
+	fetch.Image = opts.ORASImage
+	fetch.Args = []string{fetchOCIModelScript}
+	fetch.Env = append(fetch.Env,
+		corev1.EnvVar{Name: "MODEL_OCI_REF", ValueFrom: cfgKey(cmName, "MODEL_OCI_REF")},
+		corev1.EnvVar{Name: "ORAS_PLAIN_HTTP", Value: fmt.Sprintf("%t", opts.OCIPlainHTTP)},
+		// oras keeps its own state under $HOME; the random UID has none.
+		corev1.EnvVar{Name: "HOME", Value: "/tmp"},
+	)
+	if opts.OCIPullSecret == "" {
+		return
+	}
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: "oci-auth",
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: opts.OCIPullSecret,
+				Items:      []corev1.KeyToPath{{Key: corev1.DockerConfigJsonKey, Path: "config.json"}},
+			},
+		},
+	})
+	fetch.VolumeMounts = append(fetch.VolumeMounts, corev1.VolumeMount{Name: "oci-auth", MountPath: "/etc/oras", ReadOnly: true})
+}
+
+// llamaAPIKeyEnv is the variable llama-server reads --api-key from (unlike
+// most of its options, it has no LLAMA_ARG_ prefix).
+const llamaAPIKeyEnv = "LLAMA_API_KEY"
+
+// buildDeployment builds the model's server Deployment for its backend and
+// applies the replica count and model volume strategy, which all share.
+func buildDeployment(ns string, st modelStack, opts serverOptions) *appsv1.Deployment {
+	var dep *appsv1.Deployment
+	switch st.Model.Backend {
+	case "vllm":
+		dep = buildVLLMDeployment(ns, st, opts)
+	case "ollama":
+		dep = buildOllamaDeployment(ns, st, opts)
+	case "tgi":
+		dep = buildTGIDeployment(ns, st, opts)
+	default:
+		dep = buildLlamaCppDeployment(ns, st, opts)
+	}
+
+	// Each server reads its API key from a different variable.
+	if opts.APIKeySecret != "" {
+		keyEnv := map[string]string{
+			"llamacpp": llamaAPIKeyEnv,
+			"vllm":     "VLLM_API_KEY",
+			"tgi":      "API_KEY",
+		}[st.Model.Backend]
+		server := &dep.Spec.Template.Spec.Containers[0]
+		server.Env = append(server.Env, corev1.EnvVar{
+			Name: keyEnv,
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: opts.APIKeySecret},
+					Key:                  "api-key",
+				},
+			},
+		})
+	}
+
+	// --server-env/--server-arg last, so they win.
+	server := &dep.Spec.Template.Spec.Containers[0]
+	for _, kv := range opts.ServerEnv {
+		k, v, _ := strings.Cut(kv, "=")
+		e := corev1.EnvVar{Name: k, Value: v}
+		replaced := false
+		for i := range server.Env {
+			if server.Env[i].Name == e.Name {
+				server.Env[i], replaced = e, true
+			}
+		}
+		if !replaced {
+			server.Env = append(server.Env, e)
+		}
+	}
+	server.Args = append(server.Args, opts.ServerArgs...)
+
+	// With an HPA (ours or KEDA's) the replica count is its business;
+	// upsertDeployment keeps the current one when Replicas is nil.
+	dep.Spec.Replicas = int32p(int32(opts.Replicas))
+	if opts.HPAMax > 0 || opts.ScaleToZero != "" {
+		dep.Spec.Replicas = nil
+	}
+
+	spec := &dep.Spec.Template.Spec
+	placePod(spec, opts)
+	for i := range spec.InitContainers {
+		useDownloader(&spec.InitContainers[i], opts)
+	}
+	if opts.proxySidecar() {
+		addProxySidecar(spec, st, opts)
+	}
+	switch opts.ModelVolume {
+	case "per-replica":
+		// Every pod downloads its own copy; nothing is shared or kept.
+		for i := range spec.Volumes {
+			if spec.Volumes[i].Name == "model-store" {
+				size := resource.MustParse(st.Model.Storage)
+				spec.Volumes[i].VolumeSource = corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{SizeLimit: &size},
+				}
+			}
+		}
+	case "rwx":
+		// Replicas starting together would all resume into the same
+		// partial file; give each pod its own (the winner's rename is atomic).
+		for i := range spec.InitContainers {
+			c := &spec.InitContainers[i]
+			c.Env = append(c.Env,
+				corev1.EnvVar{Name: "POD_NAME", ValueFrom: &corev1.EnvVarSource{
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"},
+				}},
+				corev1.EnvVar{Name: "PART_SUFFIX", Value: ".$(POD_NAME)"},
+			)
+		}
+	}
+	return dep
+}
+
+// buildLlamaCppDeployment: initContainer (download) + llama.cpp server.
+func buildLlamaCppDeployment(ns string, st modelStack, opts serverOptions) *appsv1.Deployment {
+	labels := map[string]string{"app": st.ObjName}
+	cmName := st.ObjName + "-config"
+	pvcName := st.ObjName + "-models-pvc"
 	modelVolName := "model-store"
 	modelMountPath := "/models"
 
-	// IMPORTANT OpenShift detail:
-	// - OpenShift uses a *random non-root UID* under the restricted SCC.
-	// - Mounted volumes need to be writable by that UID. Setting an FSGroup
-	//   at the Pod level makes the volume group-writable appropriately.
-	var fsGroup int64 = 65532 // a typical non-privileged group id
+	// IMPORTANT OpenShift detail:
+	// - OpenShift uses a *random non-root UID* under the restricted SCC.
+	// - Mounted volumes need to be writable by that UID. Setting an FSGroup
+	//   at the Pod level makes the volume group-writable appropriately.
+	var fsGroup int64 = 65532 // a typical non-privileged group id
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName,
+			Namespace: ns,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: int32p(1),
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					// Pod-level security context to handle volume perms under restricted SCC
+					SecurityContext: &corev1.PodSecurityContext{
+						FSGroup: &fsGroup,
+						// FSGroupChangeOnRootMismatch reduces unnecessary recursive chown on every mount
+						FSGroupChangePolicy: func() *corev1.PodFSGroupChangePolicy {
+							v := corev1.FSGroupChangeOnRootMismatch
+							return &v
+						}(),
+					},
+
+					// -------- initContainer: fetch the model into /models --------
+					InitContainers: []corev1.Container{
+						{
+							Name:    "fetch-model",
+							Image:   opts.CurlImage, // small image with curl
+							Command: []string{"sh", "-lc"},
+							Args: []string{
+								fetchModelScript,
+							},
+							Env: []corev1.EnvVar{
+								{Name: "MODEL_URL", ValueFrom: cfgKey(cmName, "MODEL_URL")},
+								{Name: "MODEL_URLS", ValueFrom: cfgKey(cmName, "MODEL_URLS")},
+								{Name: "MODEL_SHA256", ValueFrom: cfgKey(cmName, "MODEL_SHA256")},
+								{Name: "MODEL_FILE", ValueFrom: cfgKey(cmName, "MODEL_FILE")},
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: modelVolName, MountPath: modelMountPath},
+							},
+							SecurityContext: &corev1.SecurityContext{
+								RunAsNonRoot:             boolp(true),
+								AllowPrivilegeEscalation: boolp(false),
+							},
+						},
+					},
+
+					// -------- main container: llama.cpp server (OpenAI-compatible) --------
+					Containers: []corev1.Container{
+						{
+							Name: "llama-server",
+							// Official server image (or our build of it, same entrypoint).
+							// We do NOT override command/entrypoint.
+							// We'll configure it entirely via LLAMA_ARG_* environment vars below.
+							Image: llamaImage(opts),
+
+							// Expose HTTP port 8080 (the image listens here with --api).
+							Ports: []corev1.ContainerPort{
+								{Name: "http", ContainerPort: 8080},
+							},
+
+							// Startup/Readiness:
+							// /health answers 503 until the model is loaded, so the pod
+							// only turns Ready once it can serve. Loading a large model
+							// can take minutes: the startupProbe allows up to 15 before
+							// the other probes start. --health-probe=tcp swaps in TCP
+							// checks for old builds without /health; --inference-probe
+							// a one-token completion for the startup check.
+							StartupProbe: &corev1.Probe{
+								ProbeHandler:     llamaStartupProbe(opts),
+								TimeoutSeconds:   30,
+								PeriodSeconds:    10,
+								FailureThreshold: 90,
+							},
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler:  llamaHealthProbe(opts.HealthProbe),
+								PeriodSeconds: 5,
+							},
+							// Liveness: a busy server may answer /health slowly; only
+							// restart it if the port stops accepting connections (or,
+							// with --integrity-schedule, the model turns out corrupt).
+							LivenessProbe: &corev1.Probe{
+								ProbeHandler:        llamaLivenessProbe(st, opts),
+								InitialDelaySeconds: 15,
+								PeriodSeconds:       10,
+							},
+
+							SecurityContext: &corev1.SecurityContext{
+								RunAsNonRoot:             boolp(true),
+								AllowPrivilegeEscalation: boolp(false),
+							},
+
+							// Mount the /models PVC so the server can read model.gguf
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: modelVolName, MountPath: modelMountPath},
+							},
+
+							// ENV VARS: the server image reads LLAMA_ARG_* to form its arguments.
+							// This avoids hardcoding a binary path and keeps compatibility.
+							Env: []corev1.EnvVar{
+								// Model path (MODEL_FILE is model.gguf unless set-model
+								// rotated it; $(VAR) is expanded by Kubernetes):
+								{Name: "MODEL_FILE", ValueFrom: cfgKey(cmName, "MODEL_FILE")},
+								{Name: "LLAMA_ARG_MODEL", Value: "/models/$(MODEL_FILE)"},
+								// Context length (tokens):
+								{Name: "LLAMA_ARG_CTX_SIZE", ValueFrom: cfgKey(cmName, "CTX_LEN")},
+								// Threads:
+								{Name: "LLAMA_ARG_THREADS", ValueFrom: cfgKey(cmName, "N_THREADS")},
+								// Bind host/port:
+								{Name: "LLAMA_ARG_HOST", Value: "0.0.0.0"},
+								{Name: "LLAMA_ARG_PORT", Value: "8080"},
+								// Enable OpenAI-compatible API:
+								{Name: "LLAMA_ARG_API", Value: "1"},
+
+								// Optional metadata your clients can use:
+								{Name: "MODEL_NAME", ValueFrom: cfgKey(cmName, "MODEL_NAME")},
+								{Name: "SYSTEM_PROMPT", ValueFrom: cfgKey(cmName, "SYSTEM_PROMPT")},
+							},
+						},
+					},
+
+					// Volumes section: attach the PVC as "model-store" -> /models
+					Volumes: []corev1.Volume{
+						{
+							Name: modelVolName,
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: pvcName,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	// Optional CPU/memory limits (per model in --models-file).
+	server := &dep.Spec.Template.Spec.Containers[0]
+	if st.Model.CPU != "" || st.Model.Memory != "" {
+		server.Resources.Limits = corev1.ResourceList{}
+	}
+	if st.Model.CPU != "" {
+		server.Resources.Limits[corev1.ResourceCPU] = resource.MustParse(st.Model.CPU)
+	}
+	if st.Model.Memory != "" {
+		server.Resources.Limits[corev1.ResourceMemory] = resource.MustParse(st.Model.Memory)
+	}
+
+	// Prometheus /metrics (the server's --metrics flag).
+	if opts.Metrics {
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_ENDPOINT_METRICS", Value: "1"})
+	}
+
+	// Request batching: slots, continuous batching (on by default in
+	// current servers; set explicitly either way) and the batch size.
+	if opts.Parallel > 0 {
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_N_PARALLEL", Value: fmt.Sprintf("%d", opts.Parallel)})
+	}
+	if opts.ContBatching {
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_CONT_BATCHING", Value: "1"})
+	} else {
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_NO_CONT_BATCHING", Value: "1"})
+	}
+	if opts.BatchSize > 0 {
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_BATCH", Value: fmt.Sprintf("%d", opts.BatchSize)})
+	}
+	// The server's default for requests without max_tokens, and a cap on
+	// those asking for more.
+	if opts.NPredict > 0 {
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_N_PREDICT", Value: fmt.Sprintf("%d", opts.NPredict)})
+	}
+
+	// KV cache: type (f16 unless quantized), flash attention (needed for a
+	// quantized V cache) and, on GPUs, whether it stays in GPU memory.
+	if opts.CacheTypeK != "" && opts.CacheTypeK != "f16" {
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_CACHE_TYPE_K", Value: opts.CacheTypeK})
+	}
+	if opts.CacheTypeV != "" && opts.CacheTypeV != "f16" {
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_CACHE_TYPE_V", Value: opts.CacheTypeV})
+	}
+	if opts.FlashAttn {
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_FLASH_ATTN", Value: "1"})
+	}
+	if st.Model.GPU > 0 && !opts.KVOffload {
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_NO_KV_OFFLOAD", Value: "1"})
+	}
+
+	// Chat template override; otherwise the server uses the GGUF's own.
+	if st.Model.ChatTemplate != "" {
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_CHAT_TEMPLATE", ValueFrom: cfgKey(cmName, "CHAT_TEMPLATE")})
+	}
+
+	// GPU mode: swap in the CUDA build of the server, request the GPUs,
+	// offload layers to them, and let the pod onto tainted GPU nodes.
+	if st.Model.GPU > 0 {
+		enableGPU(&dep.Spec.Template.Spec, st.Model.GPU, opts.GPULayers, opts.GPURuntimeClass)
+	}
+	// Persistent prompt cache: the server saves and restores slots in
+	// promptCacheDir when asked (by the sidecar, and by preStop here).
+	if opts.PromptCache {
+		addPromptCache(&dep.Spec.Template.Spec, st, opts)
+	}
+	// Distributed: every layer goes to the RPC workers. They hold one
+	// server's tensors at a time, so the old pod goes before the new one.
+	if opts.RPCWorkers > 0 {
+		server.Env = append(server.Env,
+			corev1.EnvVar{Name: "LLAMA_ARG_RPC", Value: strings.Join(rpcWorkerAddrs(ns, st, opts), ",")},
+			corev1.EnvVar{Name: "LLAMA_ARG_N_GPU_LAYERS", Value: fmt.Sprintf("%d", opts.GPULayers)})
+		dep.Spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+	}
+	// OCI artifacts are pulled with oras instead of curl.
+	if st.Model.OCIRef != "" {
+		useOCISource(&dep.Spec.Template.Spec, cmName, opts)
+	}
+	// Models cloned from another PVC, quantized by a Job or uploaded are
+	// already in place; just check them.
+	if st.Model.FromPVC != "" || st.Model.SourceURL != "" || st.Model.LocalFile != "" {
+		dep.Spec.Template.Spec.InitContainers[0].Args = []string{checkModelScript}
+	}
+
+	// Speculative decoding: a second initContainer fetches the draft model
+	// with the same script (into draftModelFile), and the server proposes
+	// tokens with it. On GPUs the draft is offloaded like the main model.
+	if st.Model.DraftURL != "" {
+		spec := &dep.Spec.Template.Spec
+		spec.InitContainers = append(spec.InitContainers, fetchFileContainer("fetch-draft-model", draftModelFile, opts.CurlImage,
+			corev1.EnvVar{Name: "MODEL_URL", ValueFrom: cfgKey(cmName, "DRAFT_URL")}))
+		server := &spec.Containers[0]
+		server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_MODEL_DRAFT", Value: modelMountPath + "/" + draftModelFile})
+		if opts.DraftMax > 0 {
+			server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_DRAFT_MAX", Value: fmt.Sprintf("%d", opts.DraftMax)})
+		}
+		if st.Model.GPU > 0 {
+			server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_N_GPU_LAYERS_DRAFT", Value: fmt.Sprintf("%d", opts.GPULayers)})
+		}
+	}
+
+	// Vision models: fetch the projector, and the server accepts images.
+	if st.Model.MMProjURL != "" {
+		spec := &dep.Spec.Template.Spec
+		spec.InitContainers = append(spec.InitContainers, fetchFileContainer("fetch-mmproj", mmprojFile, opts.CurlImage,
+			corev1.EnvVar{Name: "MODEL_URL", ValueFrom: cfgKey(cmName, "MMPROJ_URL")}))
+		spec.Containers[0].Env = append(spec.Containers[0].Env, corev1.EnvVar{Name: "LLAMA_ARG_MMPROJ", Value: modelMountPath + "/" + mmprojFile})
+	}
+
+	// LoRA adapters: one initContainer each, then a --lora argument each.
+	// (The server has no environment variable for them; Args are appended
+	// to the image's entrypoint, so the command stays the image's own.)
+	for i, url := range st.Model.LoRAURLs {
+		spec := &dep.Spec.Template.Spec
+		file := loraFile(url)
+		spec.InitContainers = append(spec.InitContainers, fetchFileContainer(fmt.Sprintf("fetch-lora-%d", i), file, opts.CurlImage,
+			corev1.EnvVar{Name: "MODEL_URL", Value: url}))
+		spec.Containers[0].Args = append(spec.Containers[0].Args, "--lora", modelMountPath+"/"+file)
+	}
+
+	// Gated models: expose the token to the download steps only.
+	if opts.HFTokenSecret != "" {
+		for i := range dep.Spec.Template.Spec.InitContainers {
+			fetch := &dep.Spec.Template.Spec.InitContainers[i]
+			fetch.Env = append(fetch.Env, corev1.EnvVar{
+				Name: "HF_TOKEN",
+				ValueFrom: &corev1.EnvVarSource{
+					SecretKeyRef: &corev1.SecretKeySelector{
+						LocalObjectReference: corev1.LocalObjectReference{Name: opts.HFTokenSecret},
+						Key:                  "token",
+					},
+				},
+			})
+		}
+	}
+	return dep
+}
+
+// draftModelFile and mmprojFile are where the draft model and the
+// multimodal projector are stored under /models.
+const (
+	draftModelFile = "draft.gguf"
+	mmprojFile     = "mmproj.gguf"
+)
+
+// loraFile names a LoRA adapter under /models after its URL, so adding or
+// reordering adapters never mixes up their files.
+func loraFile(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return "lora-" + hex.EncodeToString(sum[:6]) + ".gguf"
+}
+
+// useDownloader switches a container running fetchModelScript to
+// --downloader=aria2: the aria2 image, and the segment settings. Others
+// are left alone.
+func useDownloader(c *corev1.Container, opts serverOptions) {
+	if opts.Downloader != "aria2" || len(c.Args) != 1 || !strings.HasSuffix(c.Args[0], fetchModelScript) {
+		return
+	}
+	c.Image = opts.Aria2Image
+	c.Env = append(c.Env,
+		corev1.EnvVar{Name: "DOWNLOADER", Value: "aria2"},
+		corev1.EnvVar{Name: "ARIA2_SPLIT", Value: strconv.Itoa(opts.Aria2Split)},
+		corev1.EnvVar{Name: "ARIA2_CONNECTIONS", Value: strconv.Itoa(opts.Aria2Conns)},
+		corev1.EnvVar{Name: "ARIA2_MIN_SPLIT_SIZE", Value: opts.Aria2MinSplit},
+	)
+}
+
+// fetchFileContainer is an extra initContainer that downloads one more
+// file (draft model, LoRA adapter) into /models with fetchModelScript;
+// urlEnv supplies its MODEL_URL.
+func fetchFileContainer(name, file, image string, urlEnv corev1.EnvVar) corev1.Container {
+	return corev1.Container{
+		Name:    name,
+		Image:   image,
+		Command: []string{"sh", "-lc"},
+		Args:    []string{fetchModelScript},
+		Env: []corev1.EnvVar{
+			urlEnv,
+			{Name: "MODEL_FILE", Value: file},
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "model-store", MountPath: "/models"},
+		},
+		SecurityContext: &corev1.SecurityContext{
+			RunAsNonRoot:             boolp(true),
+			AllowPrivilegeEscalation: boolp(false),
+		},
+	}
+}
+
+// llamaHealthProbe checks llama.cpp's /health (200 once the model is
+// loaded, 503 before), or just the port with mode "tcp".
+func llamaHealthProbe(mode string) corev1.ProbeHandler {
+	if mode == "tcp" {
+		return corev1.ProbeHandler{
+			TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8080)},
+		}
+	}
+	return corev1.ProbeHandler{
+		HTTPGet: &corev1.HTTPGetAction{Path: "/health", Port: intstr.FromInt(8080)},
+	}
+}
+
+// llamaStartupProbe is llamaHealthProbe or, with --inference-probe, a
+// one-token completion (curl is in the official images): /completion
+// answers 503 while loading and 500 when inference fails, and the reply
+// must carry the generated content.
+func llamaStartupProbe(opts serverOptions) corev1.ProbeHandler {
+	if !opts.InferenceProbe {
+		return llamaHealthProbe(opts.HealthProbe)
+	}
+	return corev1.ProbeHandler{
+		Exec: &corev1.ExecAction{Command: []string{"sh", "-c",
+			`curl -sf --max-time 25 -H "Authorization: Bearer ${` + llamaAPIKeyEnv + `:-}" -H "Content-Type: application/json" ` +
+				`-d '{"prompt":"Hello","n_predict":1,"cache_prompt":false}' http://127.0.0.1:8080/completion | grep -q '"content"'`}},
+	}
+}
+
+// llamaLivenessProbe is a TCP check of the server's port. When the
+// integrity CronJob watches the model it also fails while its corruption
+// marker exists, with curl (in the official images) checking the port.
+func llamaLivenessProbe(st modelStack, opts serverOptions) corev1.ProbeHandler {
+	if !integrityChecked(st, opts) {
+		return corev1.ProbeHandler{
+			TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8080)},
+		}
+	}
+	return corev1.ProbeHandler{
+		Exec: &corev1.ExecAction{Command: []string{"sh", "-c",
+			`test ! -e "/models/$MODEL_FILE.corrupt" && curl -so /dev/null --max-time 5 http://127.0.0.1:8080/health`}},
+	}
+}
+
+// buildService (ClusterIP): internal stable address for other pods (and a
+// target for Ingress). With --metrics, the usual prometheus.io annotations
+// advertise /metrics on the same port for annotation-based scrapers.
+func buildService(ns string, st modelStack, opts serverOptions) *corev1.Service {
+	labels := map[string]string{"app": st.ObjName}
+	// The proxy sidecar fronts the server, /metrics included.
+	port := 8080
+	if opts.proxySidecar() {
+		port = proxyPort
+	}
+	var annotations map[string]string
+	if opts.Metrics && st.Model.Backend != "ollama" {
+		annotations = map[string]string{
+			"prometheus.io/scrape": "true",
+			"prometheus.io/path":   "/metrics",
+			"prometheus.io/port":   strconv.Itoa(port),
+		}
+	}
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        st.ObjName,
+			Namespace:   ns,
+			Labels:      labels,
+			Annotations: annotations,
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: labels,
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromInt(port)},
+			},
+			Type: corev1.ServiceTypeClusterIP,
+		},
+	}
+}
+
+// buildIngress: on CRC, OpenShift's router will expose this Ingress externally.
+// With --scale-to-zero=http it points at the KEDA interceptor instead, which
+// holds requests while it wakes the server up.
+func buildIngress(ns string, st modelStack, opts serverOptions) *netv1.Ingress {
+	labels := map[string]string{"app": st.ObjName}
+	pathType := netv1.PathTypePrefix
+	backend := netv1.IngressServiceBackend{
+		Name: st.ObjName,
+		Port: netv1.ServiceBackendPort{Name: "http"},
+	}
+	if opts.ScaleToZero == "http" {
+		backend = netv1.IngressServiceBackend{
+			Name: st.ObjName + "-interceptor",
+			Port: netv1.ServiceBackendPort{Number: 8080},
+		}
+	}
+	return &netv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        st.ObjName,
+			Namespace:   ns,
+			Labels:      labels,
+			Annotations: routerAnnotations(opts),
+		},
+		Spec: netv1.IngressSpec{
+			Rules: []netv1.IngressRule{
+				{
+					Host: st.Host,
+					IngressRuleValue: netv1.IngressRuleValue{
+						HTTP: &netv1.HTTPIngressRuleValue{
+							Paths: []netv1.HTTPIngressPath{
+								{
+									Path:     "/",
+									PathType: &pathType,
+									Backend:  netv1.IngressBackend{Service: &backend},
+								},
+							},
+						},
+					},
+				},
+			},
+			// TLS is handled by buildRoute (--tls).
+		},
+	}
+}
+
+// rateLimitAnnotation enables the OpenShift router's per-client limits;
+// its sub-keys set them.
+const rateLimitAnnotation = "haproxy.router.openshift.io/rate-limit-connections"
+
+// routerAnnotations are the Ingress's and Route's HAProxy settings: a
+// generous timeout to accommodate model startup/first token times and,
+// with --rate-limit-mode=router, the request rate limit. The router counts
+// HTTP requests per client IP over 3 seconds, and drops the connection of
+// a client over the limit.
+func routerAnnotations(opts serverOptions) map[string]string {
+	annotations := map[string]string{"haproxy.router.openshift.io/timeout": "180s"}
+	if opts.RateLimit > 0 && opts.RateLimitMode == "router" {
+		annotations[rateLimitAnnotation] = "true"
+		annotations[rateLimitAnnotation+".rate-http"] = strconv.Itoa(int(math.Ceil(opts.RateLimit * 3)))
+	}
+	return annotations
+}
+
+// serviceMonitorGVR is the Prometheus Operator's ServiceMonitor resource.
+var serviceMonitorGVR = schema.GroupVersionResource{Group: "monitoring.coreos.com", Version: "v1", Resource: "servicemonitors"}
+
+// buildServiceMonitor has Prometheus scrape the model Service's /metrics.
+// With an API key the scrape sends it too (llama.cpp guards /metrics).
+func buildServiceMonitor(ns string, st modelStack, opts serverOptions) *unstructured.Unstructured {
+	endpoint := map[string]interface{}{
+		"port":     "http",
+		"path":     "/metrics",
+		"interval": "30s",
+	}
+	if opts.APIKeySecret != "" {
+		endpoint["bearerTokenSecret"] = map[string]interface{}{
+			"name": opts.APIKeySecret,
+			"key":  "api-key",
+		}
+	}
+	sm := &unstructured.Unstructured{}
+	sm.SetAPIVersion("monitoring.coreos.com/v1")
+	sm.SetKind("ServiceMonitor")
+	sm.SetName(st.ObjName)
+	sm.SetNamespace(ns)
+	sm.SetLabels(map[string]string{"app": st.ObjName})
+	sm.Object["spec"] = map[string]interface{}{
+		"selector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{"app": st.ObjName},
+		},
+		"endpoints": []interface{}{endpoint},
+	}
+	return sm
+}
+
+// podMonitorGVR is the Prometheus Operator's PodMonitor (--observability).
+var podMonitorGVR = schema.GroupVersionResource{Group: "monitoring.coreos.com", Version: "v1", Resource: "podmonitors"}
+
+// buildPodMonitor scrapes every server pod directly (through the proxy
+// sidecar when there is one, which adds its own counters), so per-pod
+// numbers survive the Service's load balancing. Its job label is
+// "<namespace>/<name>", which the dashboard selects on.
+func buildPodMonitor(ns string, st modelStack, opts serverOptions) *unstructured.Unstructured {
+	port := "http"
+	if opts.proxySidecar() {
+		port = "proxy"
+	}
+	endpoint := map[string]interface{}{
+		"port":     port,
+		"path":     "/metrics",
+		"interval": "15s",
+	}
+	if opts.APIKeySecret != "" {
+		endpoint["bearerTokenSecret"] = map[string]interface{}{
+			"name": opts.APIKeySecret,
+			"key":  "api-key",
+		}
+	}
+	pm := &unstructured.Unstructured{}
+	pm.SetAPIVersion("monitoring.coreos.com/v1")
+	pm.SetKind("PodMonitor")
+	pm.SetName(st.ObjName)
+	pm.SetNamespace(ns)
+	pm.SetLabels(map[string]string{"app": st.ObjName})
+	pm.Object["spec"] = map[string]interface{}{
+		"selector": map[string]interface{}{
+			"matchLabels": map[string]interface{}{"app": st.ObjName},
+		},
+		"podMetricsEndpoints": []interface{}{endpoint},
+	}
+	return pm
+}
+
+// buildDashboardConfigMap holds a Grafana dashboard of st's llama.cpp
+// metrics, labelled for both the OpenShift console (which reads them from
+// openshift-config-managed) and Grafana's dashboard sidecar.
+func buildDashboardConfigMap(ns string, st modelStack, opts serverOptions) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName + "-dashboard",
+			Namespace: opts.DashboardNS,
+			Labels: map[string]string{
+				"app":                            st.ObjName,
+				"console.openshift.io/dashboard": "true",
+				"grafana_dashboard":              "1",
+			},
+		},
+		Data: map[string]string{st.ObjName + ".json": llamaDashboard(ns, st)},
+	}
+}
+
+// llamaDashboard is the Grafana dashboard JSON. llama.cpp has no request
+// latency histogram, so latency is shown per token, from its time and
+// token counters: prompt processing (time to first token grows with it)
+// and generation.
+func llamaDashboard(ns string, st modelStack) string {
+	sel := fmt.Sprintf(`{job="%s/%s"}`, ns, st.ObjName)
+	type target struct{ expr, legend string }
+	panel := func(i int, title, unit string, targets ...target) map[string]interface{} {
+		var ts []interface{}
+		for j, t := range targets {
+			ts = append(ts, map[string]interface{}{
+				"expr":         t.expr,
+				"legendFormat": t.legend,
+				"refId":        string(rune('A' + j)),
+			})
+		}
+		return map[string]interface{}{
+			"id":         i + 1,
+			"type":       "timeseries",
+			"title":      title,
+			"datasource": map[string]interface{}{"type": "prometheus", "uid": "${datasource}"},
+			"gridPos":    map[string]interface{}{"x": (i % 2) * 12, "y": (i / 2) * 8, "w": 12, "h": 8},
+			"fieldConfig": map[string]interface{}{
+				"defaults":  map[string]interface{}{"unit": unit},
+				"overrides": []interface{}{},
+			},
+			"targets": ts,
+		}
+	}
+	rate := func(metric string) string { return fmt.Sprintf("rate(llamacpp:%s%s[5m])", metric, sel) }
+	panels := []interface{}{
+		panel(0, "Generated tokens/s", "short",
+			target{"sum(" + rate("tokens_predicted_total") + ")", "total"},
+			target{"sum by (pod) (" + rate("tokens_predicted_total") + ")", "{{pod}}"}),
+		panel(1, "Prompt tokens/s", "short",
+			target{"sum(" + rate("prompt_tokens_total") + ")", "total"},
+			target{"sum by (pod) (" + rate("prompt_tokens_total") + ")", "{{pod}}"}),
+		panel(2, "Slots: busy and queued requests", "short",
+			target{"sum by (pod) (llamacpp:requests_processing" + sel + ")", "busy {{pod}}"},
+			target{"sum by (pod) (llamacpp:requests_deferred" + sel + ")", "queued {{pod}}"}),
+		panel(3, "KV cache usage", "percentunit",
+			target{"max by (pod) (llamacpp:kv_cache_usage_ratio" + sel + ")", "{{pod}}"}),
+		panel(4, "Latency per generated token", "s",
+			target{"sum(" + rate("tokens_predicted_seconds_total") + ") / sum(" + rate("tokens_predicted_total") + ")", "generation"}),
+		panel(5, "Latency per prompt token", "s",
+			target{"sum(" + rate("prompt_seconds_total") + ") / sum(" + rate("prompt_tokens_total") + ")", "prompt processing"}),
+	}
+	dashboard := map[string]interface{}{
+		"title":         fmt.Sprintf("llama.cpp / %s / %s", ns, st.ObjName),
+		"uid":           fmt.Sprintf("%x", sha256.Sum256([]byte(ns+"/"+st.ObjName)))[:12],
+		"tags":          []interface{}{"llama.cpp", "llm"},
+		"schemaVersion": 39,
+		"refresh":       "30s",
+		"time":          map[string]interface{}{"from": "now-1h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []interface{}{
+				map[string]interface{}{"name": "datasource", "type": "datasource", "query": "prometheus"},
+			},
+		},
+		"panels": panels,
+	}
+	out, _ := json.MarshalIndent(dashboard, "", "  ")
+	return string(out)
+}
+
+// routeGVR is the OpenShift Route resource (not in client-go's typed clients).
+var routeGVR = schema.GroupVersionResource{Group: "route.openshift.io", Version: "v1", Resource: "routes"}
+
+// buildRoute serves the model over HTTPS with edge termination: the router
+// holds the certificate (from --tls-secret, else its default wildcard one)
+// and talks plain HTTP to the Service. It targets the same backend as
+// buildIngress would, less the canary's share of the requests when there
+// is one (then without --tls it serves plain HTTP).
+func buildRoute(ns string, st modelStack, opts serverOptions) *unstructured.Unstructured {
+	service := st.ObjName
+	if opts.ScaleToZero == "http" {
+		service = st.ObjName + "-interceptor"
+	}
+	tls := map[string]interface{}{
+		"termination":                   opts.TLS,
+		"insecureEdgeTerminationPolicy": opts.TLSInsecure,
+	}
+	if opts.TLSCert != "" {
+		tls["certificate"] = opts.TLSCert
+		tls["key"] = opts.TLSKey
+	}
+	route := &unstructured.Unstructured{}
+	route.SetAPIVersion("route.openshift.io/v1")
+	route.SetKind("Route")
+	route.SetName(st.ObjName)
+	route.SetNamespace(ns)
+	route.SetLabels(map[string]string{"app": st.ObjName})
+	route.SetAnnotations(routerAnnotations(opts))
+	spec := map[string]interface{}{
+		"host": st.Host,
+		"to": map[string]interface{}{
+			"kind":   "Service",
+			"name":   service,
+			"weight": int64(100 - opts.CanaryWeight),
+		},
+		"port": map[string]interface{}{"targetPort": "http"},
+	}
+	if opts.TLS != "" {
+		spec["tls"] = tls
+	}
+	if opts.Canary != "" {
+		spec["alternateBackends"] = []interface{}{
+			map[string]interface{}{
+				"kind":   "Service",
+				"name":   opts.Canary,
+				"weight": int64(opts.CanaryWeight),
+			},
+		}
+	}
+	route.Object["spec"] = spec
+	return route
+}
+
+// -----------------------------
+// Alternative backends
+// -----------------------------
+
+// buildVLLMDeployment runs the vLLM OpenAI-compatible server instead of
+// llama.cpp, serving the Hugging Face repo under the logical model name.
+func buildVLLMDeployment(ns string, st modelStack, opts serverOptions) *appsv1.Deployment {
+	return buildHFServerDeployment(ns, st, corev1.Container{
+		Name:  "vllm-server",
+		Image: opts.VLLMImage,
+		Args: []string{
+			"--model", st.Model.HFModel,
+			// Clients keep using the logical model name.
+			"--served-model-name", st.Model.Name,
+			"--port", "8080",
+			"--max-model-len", fmt.Sprintf("%d", st.Model.Ctx),
+			"--tensor-parallel-size", fmt.Sprintf("%d", st.Model.GPU),
+		},
+	}, opts)
+}
+
+// buildTGIDeployment runs Hugging Face Text Generation Inference, sharded
+// across the model's GPUs and optionally quantized. TGI serves exactly one
+// model and ignores the request's model name (see waitAndVerify).
+func buildTGIDeployment(ns string, st modelStack, opts serverOptions) *appsv1.Deployment {
+	args := []string{
+		"--model-id", st.Model.HFModel,
+		"--port", "8080",
+		"--num-shard", fmt.Sprintf("%d", st.Model.GPU),
+		// TGI sizes its prompt limit from the GPU memory unless told; keep
+		// it inside the context, leaving at least one token to generate.
+		"--max-input-tokens", fmt.Sprintf("%d", st.Model.Ctx-1),
+		"--max-total-tokens", fmt.Sprintf("%d", st.Model.Ctx),
+	}
+	if st.Model.Quantize != "" {
+		args = append(args, "--quantize", st.Model.Quantize)
+	}
+	return buildHFServerDeployment(ns, st, corev1.Container{
+		Name:  "tgi-server",
+		Image: opts.TGIImage,
+		Args:  args,
+	}, opts)
+}
+
+// buildHFServerDeployment wraps a GPU server container that downloads a
+// Hugging Face repo itself (vLLM, TGI). It listens on the llama.cpp port,
+// so the Service, Ingress and chat verification are shared. The Hugging
+// Face cache lives on the models PVC so restarts don't re-download.
+func buildHFServerDeployment(ns string, st modelStack, server corev1.Container, opts serverOptions) *appsv1.Deployment {
+	labels := map[string]string{"app": st.ObjName}
+	var fsGroup int64 = 65532 // see buildDeployment
+
+	server.Env = []corev1.EnvVar{
+		{Name: "HF_HOME", Value: "/models/hf-cache"},
+		// TGI reads the hub cache location from its own variable.
+		{Name: "HUGGINGFACE_HUB_CACHE", Value: "/models/hf-cache/hub"},
+		// The random UID has no home directory; the servers and torch cache there.
+		{Name: "HOME", Value: "/tmp"},
+	}
+	if opts.HFTokenSecret != "" {
+		server.Env = append(server.Env, corev1.EnvVar{
+			Name: "HF_TOKEN",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: opts.HFTokenSecret},
+					Key:                  "token",
+				},
+			},
+		})
+	}
+
+	// /health answers once the weights are loaded; the first start also
+	// downloads them, so allow up to 30 minutes before liveness takes over.
+	health := corev1.ProbeHandler{
+		HTTPGet: &corev1.HTTPGetAction{Path: "/health", Port: intstr.FromInt(8080)},
+	}
+	server.Ports = []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}}
+	server.StartupProbe = &corev1.Probe{ProbeHandler: health, PeriodSeconds: 10, FailureThreshold: 180}
+	server.ReadinessProbe = &corev1.Probe{ProbeHandler: health, PeriodSeconds: 5}
+	server.LivenessProbe = &corev1.Probe{ProbeHandler: health, PeriodSeconds: 10}
+	server.SecurityContext = &corev1.SecurityContext{
+		RunAsNonRoot:             boolp(true),
+		AllowPrivilegeEscalation: boolp(false),
+	}
+	server.VolumeMounts = []corev1.VolumeMount{
+		{Name: "model-store", MountPath: "/models"},
+		// PyTorch/NCCL need more shared memory than the 64Mi default.
+		{Name: "dshm", MountPath: "/dev/shm"},
+	}
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName,
+			Namespace: ns,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: int32p(1),
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					SecurityContext: &corev1.PodSecurityContext{FSGroup: &fsGroup},
+					Containers:      []corev1.Container{server},
+					Volumes: []corev1.Volume{
+						{
+							Name: "model-store",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: st.ObjName + "-models-pvc",
+								},
+							},
+						},
+						{
+							Name: "dshm",
+							VolumeSource: corev1.VolumeSource{
+								EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	limits := &dep.Spec.Template.Spec.Containers[0].Resources
+	if st.Model.CPU != "" || st.Model.Memory != "" {
+		limits.Limits = corev1.ResourceList{}
+	}
+	if st.Model.CPU != "" {
+		limits.Limits[corev1.ResourceCPU] = resource.MustParse(st.Model.CPU)
+	}
+	if st.Model.Memory != "" {
+		limits.Limits[corev1.ResourceMemory] = resource.MustParse(st.Model.Memory)
+	}
+	addGPUs(&dep.Spec.Template.Spec, st.Model.GPU, opts.GPURuntimeClass)
+	return dep
+}
+
+// buildOllamaDeployment runs the Ollama server on the llama.cpp port. Its
+// model store (OLLAMA_MODELS) is on the models PVC; models are added by
+// buildOllamaPullJob, not at startup, so the pod is ready almost at once.
+func buildOllamaDeployment(ns string, st modelStack, opts serverOptions) *appsv1.Deployment {
+	labels := map[string]string{"app": st.ObjName}
+	var fsGroup int64 = 65532 // see buildDeployment
+
+	dep := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName,
+			Namespace: ns,
+			Labels:    labels,
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: int32p(1),
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					SecurityContext: &corev1.PodSecurityContext{FSGroup: &fsGroup},
+					Containers: []corev1.Container{
+						{
+							Name:  "ollama-server",
+							Image: opts.OllamaImage,
+							// The image's entrypoint is "ollama" and its default
+							// command "serve"; only the environment changes.
+							Ports: []corev1.ContainerPort{
+								{Name: "http", ContainerPort: 8080},
+							},
+							Env: []corev1.EnvVar{
+								{Name: "OLLAMA_HOST", Value: "0.0.0.0:8080"},
+								{Name: "OLLAMA_MODELS", Value: "/models/ollama"},
+								// Keep the served model loaded between requests.
+								{Name: "OLLAMA_KEEP_ALIVE", Value: "-1"},
+								// The random UID has no home; ollama keeps its key there.
+								{Name: "HOME", Value: "/tmp"},
+							},
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									HTTPGet: &corev1.HTTPGetAction{Path: "/", Port: intstr.FromInt(8080)},
+								},
+								PeriodSeconds: 5,
+							},
+							LivenessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8080)},
+								},
+								InitialDelaySeconds: 10,
+								PeriodSeconds:       10,
+							},
+							SecurityContext: &corev1.SecurityContext{
+								RunAsNonRoot:             boolp(true),
+								AllowPrivilegeEscalation: boolp(false),
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "model-store", MountPath: "/models"},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "model-store",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+									ClaimName: st.ObjName + "-models-pvc",
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	server := &dep.Spec.Template.Spec.Containers[0]
+	if st.Model.CPU != "" || st.Model.Memory != "" {
+		server.Resources.Limits = corev1.ResourceList{}
+	}
+	if st.Model.CPU != "" {
+		server.Resources.Limits[corev1.ResourceCPU] = resource.MustParse(st.Model.CPU)
+	}
+	if st.Model.Memory != "" {
+		server.Resources.Limits[corev1.ResourceMemory] = resource.MustParse(st.Model.Memory)
+	}
+	// The ollama image bundles the CUDA runtime; it just needs the GPUs.
+	if st.Model.GPU > 0 {
+		addGPUs(&dep.Spec.Template.Spec, st.Model.GPU, opts.GPURuntimeClass)
+	}
+	return dep
+}
+
+// ollamaPullScript waits for the server, has it pull OLLAMA_MODEL, and then
+// copies it to MODEL_NAME so clients (and verifyChat) use the logical name
+// like with the other backends. The ollama CLI talks to OLLAMA_HOST.
+const ollamaPullScript = `set -eu
+i=0
+until ollama list >/dev/null 2>&1; do
+  i=$((i+1))
+  if [ "$i" -ge 120 ]; then
+    echo "Ollama server at ${OLLAMA_HOST} not reachable" >&2
+    exit 1
+  fi
+  sleep 5
+done
+ollama pull "${OLLAMA_MODEL}"
+ollama cp "${OLLAMA_MODEL}" "${MODEL_NAME}"
+ollama list
+`
+
+// buildOllamaPullJob pulls the model through the running server's API
+// (so only the server mounts the RWO models PVC).
+func buildOllamaPullJob(ns string, st modelStack, opts serverOptions) *batchv1.Job {
+	cmName := st.ObjName + "-config"
+	labels := map[string]string{"app": st.ObjName, "job": "ollama-pull"}
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName + "-ollama-pull",
+			Namespace: ns,
+			Labels:    labels,
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: int32p(2),
+			Template: corev1.PodTemplateSpec{
+				// No "app" label here: the Service must not select this pod.
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"job": "ollama-pull"}},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:    "pull",
+							Image:   opts.OllamaImage,
+							Command: []string{"sh", "-c", ollamaPullScript},
+							Env: []corev1.EnvVar{
+								{Name: "OLLAMA_HOST", Value: "http://" + st.ObjName + ":80"},
+								{Name: "OLLAMA_MODEL", ValueFrom: cfgKey(cmName, "OLLAMA_MODEL")},
+								{Name: "MODEL_NAME", ValueFrom: cfgKey(cmName, "MODEL_NAME")},
+								{Name: "HOME", Value: "/tmp"},
+							},
+							SecurityContext: &corev1.SecurityContext{
+								RunAsNonRoot:             boolp(true),
+								AllowPrivilegeEscalation: boolp(false),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// buildHPA scales the model's Deployment between --replicas and --hpa-max
+// on CPU utilization (llama.cpp is CPU-bound without GPUs).
+func buildHPA(ns string, st modelStack, opts serverOptions) *autoscalingv2.HorizontalPodAutoscaler {
+	target := int32(opts.HPACPUTarget)
+	return &autoscalingv2.HorizontalPodAutoscaler{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName,
+			Namespace: ns,
+			Labels:    map[string]string{"app": st.ObjName},
+		},
+		Spec: autoscalingv2.HorizontalPodAutoscalerSpec{
+			ScaleTargetRef: autoscalingv2.CrossVersionObjectReference{
+				APIVersion: "apps/v1",
+				Kind:       "Deployment",
+				Name:       st.ObjName,
+			},
+			MinReplicas: int32p(int32(opts.Replicas)),
+			MaxReplicas: int32(opts.HPAMax),
+			Metrics: []autoscalingv2.MetricSpec{
+				{
+					Type: autoscalingv2.ResourceMetricSourceType,
+					Resource: &autoscalingv2.ResourceMetricSource{
+						Name: corev1.ResourceCPU,
+						Target: autoscalingv2.MetricTarget{
+							Type:               autoscalingv2.UtilizationMetricType,
+							AverageUtilization: &target,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// -----------------------------
+// KEDA scale-to-zero
+// -----------------------------
+
+// kedaScalers maps --scale-to-zero modes to the KEDA resource they create.
+var kedaScalers = map[string]schema.GroupVersionResource{
+	"http":       {Group: "http.keda.sh", Version: "v1alpha1", Resource: "httpscaledobjects"},
+	"prometheus": {Group: "keda.sh", Version: "v1alpha1", Resource: "scaledobjects"},
+}
+
+// maxReplicas is the scaler's ceiling: --hpa-max if given, else --replicas.
+func maxReplicas(opts serverOptions) int {
+	if opts.HPAMax > opts.Replicas {
+		return opts.HPAMax
+	}
+	return opts.Replicas
+}
+
+// buildInterceptorService gives the Ingress a same-namespace name for the
+// HTTP add-on's interceptor (Ingress backends can't cross namespaces). The
+// interceptor routes by Host header to the model's own Service.
+func buildInterceptorService(ns string, st modelStack, opts serverOptions) *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName + "-interceptor",
+			Namespace: ns,
+			Labels:    map[string]string{"app": st.ObjName},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:         corev1.ServiceTypeExternalName,
+			ExternalName: fmt.Sprintf("keda-add-ons-http-interceptor-proxy.%s.svc.cluster.local", opts.KEDANamespace),
+			Ports:        []corev1.ServicePort{{Name: "http", Port: 8080}},
+		},
+	}
+}
+
+// buildKEDAScaler returns an HTTPScaledObject (http mode) or a ScaledObject
+// with a Prometheus trigger on the router's request rate (prometheus mode).
+// Either scales the model's Deployment between zero and maxReplicas.
+func buildKEDAScaler(ns string, st modelStack, opts serverOptions) *unstructured.Unstructured {
+	gvr := kedaScalers[opts.ScaleToZero]
+	idle := int64(opts.ScaleIdle.Seconds())
+	obj := &unstructured.Unstructured{}
+	var spec map[string]interface{}
+	switch opts.ScaleToZero {
+	case "http":
+		obj.SetKind("HTTPScaledObject")
+		spec = map[string]interface{}{
+			"hosts": []interface{}{st.Host},
+			"scaleTargetRef": map[string]interface{}{
+				"apiVersion": "apps/v1",
+				"kind":       "Deployment",
+				"name":       st.ObjName,
+				"service":    st.ObjName,
+				"port":       int64(80),
+			},
+			"replicas": map[string]interface{}{
+				"min": int64(0),
+				"max": int64(maxReplicas(opts)),
+			},
+			"scaledownPeriod": idle,
+		}
+	case "prometheus":
+		obj.SetKind("ScaledObject")
+		query := opts.PrometheusQuery
+		if query == "" {
+			// Routes generated from an Ingress are named <ingress>-<suffix>;
+			// the --tls Route is named after the model's objects.
+			query = fmt.Sprintf(`sum(rate(haproxy_backend_http_responses_total{exported_namespace=%q,route=~"%s(-.*)?"}[2m]))`, ns, st.ObjName)
+		}
+		spec = map[string]interface{}{
+			"scaleTargetRef":  map[string]interface{}{"name": st.ObjName},
+			"minReplicaCount": int64(0),
+			"maxReplicaCount": int64(maxReplicas(opts)),
+			"cooldownPeriod":  idle,
+			"triggers": []interface{}{
+				map[string]interface{}{
+					"type": "prometheus",
+					"metadata": map[string]interface{}{
+						"serverAddress": opts.PrometheusURL,
+						"query":         query,
+						// One replica per request/second; any traffic wakes it.
+						"threshold":           "1",
+						"activationThreshold": "0",
+					},
+				},
+			},
+		}
+	}
+	obj.SetAPIVersion(gvr.GroupVersion().String())
+	obj.SetName(st.ObjName)
+	obj.SetNamespace(ns)
+	obj.SetLabels(map[string]string{"app": st.ObjName})
+	obj.Object["spec"] = spec
+	return obj
+}
+
+// upsertKEDAScaler creates or updates the scaler for a --scale-to-zero mode.
+func upsertKEDAScaler(ctx context.Context, dyn dynamic.Interface, mode string, obj *unstructured.Unstructured) error {
+	client := dyn.Resource(kedaScalers[mode]).Namespace(obj.GetNamespace())
+	existing, err := client.Get(ctx, obj.GetName(), metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		// Also what a missing CRD looks like.
+		if _, err = client.Create(ctx, obj, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("%w (are KEDA and, for http, its HTTP add-on installed?)", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	existing.Object["spec"] = obj.Object["spec"]
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// deleteKEDAScaler removes a scaler left over from an earlier run. Without
+// KEDA installed the resource doesn't exist at all, which is also fine.
+func deleteKEDAScaler(ctx context.Context, dyn dynamic.Interface, ns, name, mode string) error {
+	err := dyn.Resource(kedaScalers[mode]).Namespace(ns).Delete(ctx, name, metav1.DeleteOptions{})
+	if nothingToDelete(err) {
+		return nil
+	}
+	return err
+}
+
+// nothingToDelete reports whether a Delete error means there is nothing
+// (we may) remove: the object or its CRD is missing, or we lack the rights
+// to the kind, which an object we created would have needed too.
+func nothingToDelete(err error) bool {
+	return kerrors.IsNotFound(err) || meta.IsNoMatchError(err) || kerrors.IsForbidden(err)
+}
+
+// createdAnnotation lists, on a model's Deployment, the optional resources
+// (KEDA scalers, Route) this tool created for it, so later runs only remove
+// those rather than whatever shares the name.
+const createdAnnotation = "llama-chat/created"
+
+// wasCreated reports whether res is in the Deployment's createdAnnotation.
+func wasCreated(ctx context.Context, cs *kubernetes.Clientset, ns, name, res string) (bool, error) {
+	dep, err := cs.AppsV1().Deployments(ns).Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, r := range strings.Split(dep.Annotations[createdAnnotation], ",") {
+		if r == res {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// markCreated adds res to (or removes it from) the Deployment's
+// createdAnnotation with a merge patch, which doesn't race the controller.
+func markCreated(ctx context.Context, cs *kubernetes.Clientset, ns, name, res string, created bool) error {
+	client := cs.AppsV1().Deployments(ns)
+	dep, err := client.Get(ctx, name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	set := map[string]bool{}
+	for _, r := range strings.Split(dep.Annotations[createdAnnotation], ",") {
+		if r != "" {
+			set[r] = true
+		}
+	}
+	if set[res] == created {
+		return nil
+	}
+	if created {
+		set[res] = true
+	} else {
+		delete(set, res)
+	}
+	var list []string
+	for r := range set {
+		list = append(list, r)
+	}
+	sort.Strings(list)
+	var value any // null removes the annotation
+	if len(list) > 0 {
+		value = strings.Join(list, ",")
+	}
+	patch, err := json.Marshal(map[string]any{
+		"metadata": map[string]any{"annotations": map[string]any{createdAnnotation: value}},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// -----------------------------
+// set-model command
+// -----------------------------
+
+// setModel swaps a running llama.cpp deployment to st.Model without
+// recreating it: a Job downloads the new GGUF next to the current one under
+// its own name, then the ConfigMap points MODEL_FILE at it and the
+// Deployment rolls. It returns the new file names (several for a split
+// model); the old files stay until the caller has verified the new model.
+func setModel(ctx context.Context, cs *kubernetes.Clientset, httpClient *http.Client, ns string, st modelStack, opts serverOptions, hfToken string) ([]string, error) {
+	cmClient := cs.CoreV1().ConfigMaps(ns)
+	cm, err := cmClient.Get(ctx, st.ObjName+"-config", metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("%w (deploy %q first)", err, st.ObjName)
+	}
+	// OCI and PVC-cloned models are re-fetched by their own init scripts,
+	// which only know model.gguf.
+	if cm.Data["MODEL_URL"] == "" {
+		return nil, fmt.Errorf("%s wasn't deployed from a --model-url; redeploy it instead", st.ObjName)
+	}
+	pvc, err := cs.CoreV1().PersistentVolumeClaims(ns).Get(ctx, st.ObjName+"-models-pvc", metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("%w (set-model needs the models PVC, not --model-volume=per-replica)", err)
+	}
+	// Old and new model share the PVC until the old one is pruned.
+	if size, err := modelSize(ctx, httpClient, st.Model, hfToken); err == nil {
+		capacity := pvc.Status.Capacity[corev1.ResourceStorage]
+		if size >= capacity.Value() {
+			return nil, fmt.Errorf("the new model is %s but the PVC holds %s", resource.NewQuantity(size, resource.BinarySI), capacity.String())
+		}
+		fmt.Printf("New model is %s; the PVC holds %s (the old model stays until the new one is verified).\n",
+			resource.NewQuantity(size, resource.BinarySI), capacity.String())
+	}
+
+	// Name the file after its source so re-running set-model resumes or
+	// reuses the same download.
+	sum := sha256.Sum256([]byte(st.Model.URL))
+	files := st.Model.modelFiles("model-" + hex.EncodeToString(sum[:6]))
+	file := files[0]
+	fmt.Printf("Downloading %s into %s...\n", st.Model.URL, file)
+	if err := runJob(ctx, cs, buildFetchModelJob(ns, st, file, opts)); err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+
+	fmt.Printf("Pointing ConfigMap %s at %s...\n", cm.Name, file)
+	cm.Data["MODEL_URL"] = st.Model.URL
+	cm.Data["MODEL_URLS"] = strings.Join(st.Model.URLs, " ")
+	cm.Data["MODEL_NAME"] = st.Model.Name
+	cm.Data["MODEL_SHA256"] = st.Model.SHA256
+	cm.Data["MODEL_FILE"] = file
+	if _, err := cmClient.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return nil, fmt.Errorf("update configmap: %w", err)
+	}
+
+	// Pods read the ConfigMap only at start, so change the pod template
+	// to roll them.
+	fmt.Printf("Rolling Deployment %s...\n", st.ObjName)
+	depClient := cs.AppsV1().Deployments(ns)
+	dep, err := depClient.Get(ctx, st.ObjName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if dep.Spec.Template.Annotations == nil {
+		dep.Spec.Template.Annotations = map[string]string{}
+	}
+	dep.Spec.Template.Annotations["llama-chat/model-file"] = file
+	if _, err := depClient.Update(ctx, dep, metav1.UpdateOptions{}); err != nil {
+		return nil, fmt.Errorf("update deployment: %w", err)
+	}
+	if err := waitForRollout(ctx, cs, ns, st.ObjName); err != nil {
+		return nil, fmt.Errorf("rollout: %w", err)
+	}
+	return files, nil
+}
+
+// buildFetchModelJob runs fetchModelScript in a Job, downloading st.Model
+// into file on the models PVC while the server keeps using its current one.
+// An RWO volume can only be used from one node, so the Job prefers the
+// server pods' node (and is placed like them).
+func buildFetchModelJob(ns string, st modelStack, file string, opts serverOptions) *batchv1.Job {
+	var fsGroup int64 = 65532 // same group as the server pod, see buildDeployment
+	env := []corev1.EnvVar{
+		{Name: "MODEL_URL", Value: st.Model.URL},
+		{Name: "MODEL_URLS", Value: strings.Join(st.Model.URLs, " ")},
+		{Name: "MODEL_SHA256", Value: st.Model.SHA256},
+		{Name: "MODEL_FILE", Value: file},
+	}
+	if opts.HFTokenSecret != "" {
+		env = append(env, corev1.EnvVar{
+			Name: "HF_TOKEN",
+			ValueFrom: &corev1.EnvVarSource{
+				SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: opts.HFTokenSecret},
+					Key:                  "token",
+				},
+			},
+		})
+	}
+	labels := map[string]string{"job": "fetch-model"}
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName + "-fetch-model",
+			Namespace: ns,
+			Labels:    map[string]string{"app": st.ObjName, "job": "fetch-model"},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: int32p(3),
+			Template: corev1.PodTemplateSpec{
+				// No "app" label here: the Service must not select this pod.
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					RestartPolicy:   corev1.RestartPolicyNever,
+					SecurityContext: &corev1.PodSecurityContext{FSGroup: &fsGroup},
+					Affinity: &corev1.Affinity{
+						PodAffinity: &corev1.PodAffinity{
+							PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+								{
+									Weight: 100,
+									PodAffinityTerm: corev1.PodAffinityTerm{
+										LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": st.ObjName}},
+										TopologyKey:   "kubernetes.io/hostname",
+									},
+								},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:    "fetch-model",
+							Image:   opts.CurlImage,
+							Command: []string{"sh", "-c"},
+							Args:    []string{fetchModelScript},
+							Env:     env,
+							SecurityContext: &corev1.SecurityContext{
+								RunAsNonRoot:             boolp(true),
+								AllowPrivilegeEscalation: boolp(false),
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "model-store", MountPath: "/models"},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "model-store",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: st.ObjName + "-models-pvc"},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	useDownloader(&job.Spec.Template.Spec.Containers[0], opts)
+	placePod(&job.Spec.Template.Spec, opts)
+	return job
+}
+
+// pruneModelsScript deletes every model GGUF (and partial download) in
+// /models except the files listed in $KEEP (space-separated). Draft models,
+// projectors and LoRA adapters aren't model*.gguf, so they stay.
+const pruneModelsScript = `set -eu
+for f in /models/model*.gguf /models/model*.gguf.part*; do
+  [ -e "$f" ] || continue
+  case " ${KEEP} " in *" ${f#/models/} "*) continue ;; esac
+  echo "Removing $f"
+  rm -f "$f"
+done
+ls -l /models
+`
+
+// buildPruneModelsJob removes the models set-model replaced, keeping files.
+func buildPruneModelsJob(ns string, st modelStack, files []string, opts serverOptions) *batchv1.Job {
+	job := buildFetchModelJob(ns, st, files[0], opts)
+	job.Name = st.ObjName + "-prune-models"
+	job.Labels["job"] = "prune-models"
+	job.Spec.Template.Labels = map[string]string{"job": "prune-models"}
+	c := &job.Spec.Template.Spec.Containers[0]
+	c.Name = "prune-models"
+	c.Args = []string{pruneModelsScript}
+	c.Env = []corev1.EnvVar{{Name: "KEEP", Value: strings.Join(files, " ")}}
+	return job
+}
+
+// -----------------------------
+// Distributed inference (--rpc-workers, experimental)
+// -----------------------------
+
+// rpcPort is where rpc-server listens.
+const rpcPort = 50052
+
+// rpcWorkerAddrs lists the workers' stable StatefulSet names for the
+// server's LLAMA_ARG_RPC.
+func rpcWorkerAddrs(ns string, st modelStack, opts serverOptions) []string {
+	name := st.ObjName + "-rpc"
+	addrs := make([]string, opts.RPCWorkers)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("%s-%d.%s.%s.svc:%d", name, i, name, ns, rpcPort)
+	}
+	return addrs
+}
+
+// buildRPCWorkers runs rpc-server from the server's image in a
+// StatefulSet, so each worker keeps its DNS name, preferably one per node
+// (the point is pooling their memory).
+func buildRPCWorkers(ns string, st modelStack, opts serverOptions) *appsv1.StatefulSet {
+	name := st.ObjName + "-rpc"
+	labels := map[string]string{"app": name}
+	sts := &appsv1.StatefulSet{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, Labels: labels},
+		Spec: appsv1.StatefulSetSpec{
+			Replicas:    int32p(int32(opts.RPCWorkers)),
+			ServiceName: name,
+			// The server needs all of them; start them together.
+			PodManagementPolicy: appsv1.ParallelPodManagement,
+			Selector:            &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				Spec: corev1.PodSpec{
+					Affinity: &corev1.Affinity{
+						PodAntiAffinity: &corev1.PodAntiAffinity{
+							PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+								{
+									Weight: 100,
+									PodAffinityTerm: corev1.PodAffinityTerm{
+										LabelSelector: &metav1.LabelSelector{MatchLabels: labels},
+										TopologyKey:   "kubernetes.io/hostname",
+									},
+								},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:    "rpc-server",
+							Image:   llamaImage(opts),
+							Command: []string{"/app/rpc-server"},
+							Args:    []string{"-H", "0.0.0.0", "-p", fmt.Sprintf("%d", rpcPort)},
+							Ports:   []corev1.ContainerPort{{Name: "rpc", ContainerPort: rpcPort}},
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler: corev1.ProbeHandler{
+									TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromString("rpc")},
+								},
+								PeriodSeconds: 5,
+							},
+							SecurityContext: &corev1.SecurityContext{
+								RunAsNonRoot:             boolp(true),
+								AllowPrivilegeEscalation: boolp(false),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	worker := &sts.Spec.Template.Spec.Containers[0]
+	if opts.RPCWorkerCPU != "" || opts.RPCWorkerMemory != "" {
+		worker.Resources.Limits = corev1.ResourceList{}
+	}
+	if opts.RPCWorkerCPU != "" {
+		worker.Resources.Limits[corev1.ResourceCPU] = resource.MustParse(opts.RPCWorkerCPU)
+	}
+	if opts.RPCWorkerMemory != "" {
+		// Requested too, so the scheduler spreads them by memory.
+		worker.Resources.Limits[corev1.ResourceMemory] = resource.MustParse(opts.RPCWorkerMemory)
+		worker.Resources.Requests = corev1.ResourceList{corev1.ResourceMemory: resource.MustParse(opts.RPCWorkerMemory)}
+	}
+	placePod(&sts.Spec.Template.Spec, opts)
+	return sts
+}
+
+// buildRPCService is the StatefulSet's headless Service (per-pod DNS).
+func buildRPCService(ns string, st modelStack) *corev1.Service {
+	name := st.ObjName + "-rpc"
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, Labels: map[string]string{"app": name}},
+		Spec: corev1.ServiceSpec{
+			ClusterIP: corev1.ClusterIPNone,
+			Selector:  map[string]string{"app": name},
+			Ports:     []corev1.ServicePort{{Name: "rpc", Port: rpcPort, TargetPort: intstr.FromString("rpc")}},
+		},
+	}
+}
+
+// buildRPCNetworkPolicy lets only the model's server pods reach the
+// workers: rpc-server has no authentication and runs whatever it is sent.
+func buildRPCNetworkPolicy(ns string, st modelStack) *netv1.NetworkPolicy {
+	name := st.ObjName + "-rpc"
+	port := intstr.FromInt(rpcPort)
+	return &netv1.NetworkPolicy{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: ns, Labels: map[string]string{"app": name}},
+		Spec: netv1.NetworkPolicySpec{
+			PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+			PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeIngress},
+			Ingress: []netv1.NetworkPolicyIngressRule{
+				{
+					From: []netv1.NetworkPolicyPeer{
+						{PodSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": st.ObjName}}},
+					},
+					Ports: []netv1.NetworkPolicyPort{{Port: &port}},
+				},
+			},
+		},
+	}
+}
+
+// applyRPCWorkers creates/updates the workers, their Service and
+// NetworkPolicy, and waits until all of them accept connections.
+func applyRPCWorkers(ctx context.Context, cs *kubernetes.Clientset, ns string, st modelStack, opts serverOptions) error {
+	if err := upsertNetworkPolicy(ctx, cs, buildRPCNetworkPolicy(ns, st)); err != nil {
+		return fmt.Errorf("upsert networkpolicy: %w", err)
+	}
+	if err := upsertService(ctx, cs, buildRPCService(ns, st)); err != nil {
+		return fmt.Errorf("upsert service: %w", err)
+	}
+	sts := buildRPCWorkers(ns, st, opts)
+	if err := upsertStatefulSet(ctx, cs, sts); err != nil {
+		return fmt.Errorf("upsert statefulset: %w", err)
+	}
+	fmt.Printf("Waiting for %d RPC workers to be Ready...\n", opts.RPCWorkers)
+	return waitutil.PollImmediateUntilWithContext(ctx, 3*time.Second, func(ctx context.Context) (bool, error) {
+		s, err := cs.AppsV1().StatefulSets(ns).Get(ctx, sts.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return s.Status.ObservedGeneration >= s.Generation && s.Status.UpdatedReplicas == int32(opts.RPCWorkers) &&
+			s.Status.ReadyReplicas == int32(opts.RPCWorkers), nil
+	})
+}
+
+// deleteRPCWorkers removes the workers left over from a run with
+// --rpc-workers.
+func deleteRPCWorkers(ctx context.Context, cs *kubernetes.Clientset, ns, name string) error {
+	name += "-rpc"
+	deletes := []func() error{
+		func() error { return cs.AppsV1().StatefulSets(ns).Delete(ctx, name, metav1.DeleteOptions{}) },
+		func() error { return cs.CoreV1().Services(ns).Delete(ctx, name, metav1.DeleteOptions{}) },
+		func() error { return cs.NetworkingV1().NetworkPolicies(ns).Delete(ctx, name, metav1.DeleteOptions{}) },
+	}
+	for _, del := range deletes {
+		if err := del(); err != nil && !kerrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// -----------------------------
+// llama.cpp built from source (--build-from-source)
+// -----------------------------
+
+// llamaServerDockerfile builds llama-server statically linked against
+// ggml and copies it into a slim runtime image with the same entrypoint
+// as the official :server image, so the LLAMA_ARG_* env works unchanged.
+// With -DGGML_RPC=ON it also builds rpc-server (--rpc-workers).
+// The OpenBLAS runtime is always installed; it only matters when
+// CMAKE_FLAGS turn BLAS on.
+const llamaServerDockerfile = `FROM docker.io/library/ubuntu:22.04 AS build
+ARG LLAMA_CPP_GIT
+ARG LLAMA_CPP_REF
+ARG CMAKE_FLAGS
+RUN apt-get update && apt-get install -y --no-install-recommends \
+      build-essential cmake git ca-certificates libcurl4-openssl-dev libopenblas-dev pkg-config \
+ && rm -rf /var/lib/apt/lists/*
+RUN git clone --depth 1 --branch "$LLAMA_CPP_REF" "$LLAMA_CPP_GIT" /src
+WORKDIR /src
+RUN cmake -B build -DBUILD_SHARED_LIBS=OFF $CMAKE_FLAGS \
+ && cmake --build build --config Release --target llama-server -j"$(nproc)" \
+ && if grep -q '^GGML_RPC:BOOL=ON' build/CMakeCache.txt; then \
+      cmake --build build --config Release --target rpc-server -j"$(nproc)"; fi
+
+FROM docker.io/library/ubuntu:22.04
+RUN apt-get update && apt-get install -y --no-install-recommends \
+      libgomp1 libcurl4 libopenblas0 curl ca-certificates \
+ && rm -rf /var/lib/apt/lists/*
+COPY --from=build /src/build/bin/ /app/
+ENV LLAMA_ARG_HOST=0.0.0.0
+EXPOSE 8080
+ENTRYPOINT ["/app/llama-server"]
+`
+
+// sourceBuild is what --build-from-source builds.
+type sourceBuild struct {
+	Git        string // Repository URL
+	Ref        string // Tag or branch (git clone --branch)
+	CMakeFlags string // Extra CMake flags
+}
+
+// tag names the image: the ref plus a hash of the repository and flags,
+// so a different configuration is a different image and the same one is
+// only built once.
+func (b sourceBuild) tag() string {
+	ref := regexp.MustCompile(`[^A-Za-z0-9_.-]+`).ReplaceAllString(b.Ref, "-")
+	if len(ref) > 100 {
+		ref = ref[:100]
+	}
+	sum := sha256.Sum256([]byte(b.Git + "\x00" + strings.Join(strings.Fields(b.CMakeFlags), " ")))
+	return fmt.Sprintf("%s-%x", ref, sum[:4])
+}
+
+// llamaImage is the llama.cpp server image a CPU pod runs (enableGPU
+// switches GPU pods to the CUDA one).
+func llamaImage(opts serverOptions) string {
+	if opts.LlamaImage != "" {
+		return opts.LlamaImage
+	}
+	return "ghcr.io/ggerganov/llama.cpp:server"
+}
+
+// buildLlamaServerImage makes sure <name>-llama-server:<tag> exists in
+// the namespace's ImageStream, running the BuildConfig and waiting for
+// it when it doesn't, and returns the image's digest reference in the
+// internal registry (so a rebuild rolls the Deployment).
+func buildLlamaServerImage(ctx context.Context, dyn dynamic.Interface, ns, name string, b sourceBuild) (string, error) {
+	buildArg := func(name, value string) interface{} {
+		return map[string]interface{}{"name": name, "value": value}
+	}
+	return ocphelpers.BuildImage(ctx, dyn, ns, ocphelpers.ImageBuild{
+		Name:   name + "-llama-server",
+		Tag:    b.tag(),
+		What:   "llama.cpp " + b.Ref,
+		Labels: map[string]string{"app": name},
+		Source: map[string]interface{}{"type": "Dockerfile", "dockerfile": llamaServerDockerfile},
+		Strategy: map[string]interface{}{
+			"buildArgs": []interface{}{
+				buildArg("LLAMA_CPP_GIT", b.Git),
+				buildArg("LLAMA_CPP_REF", b.Ref),
+				buildArg("CMAKE_FLAGS", b.CMakeFlags),
+			},
+		},
+	})
+}
+
+// -----------------------------
+// llama.cpp server image variant (--cpu-variant)
+// -----------------------------
+
+// cpuVariantRank orders the x86 variants, least capable first; each runs
+// on any CPU a higher one does.
+var cpuVariantRank = map[string]int{"noavx": 0, "avx2": 1, "avx512": 2}
+
+// parseCPUVariantImages parses --cpu-variant-images over the defaults.
+// The official :server image is multi-arch, and on x86 needs AVX2; there
+// is no official build without it.
+func parseCPUVariantImages(s string) (map[string]string, error) {
+	images := map[string]string{
+		"avx512": "ghcr.io/ggerganov/llama.cpp:server",
+		"avx2":   "ghcr.io/ggerganov/llama.cpp:server",
+		"arm64":  "ghcr.io/ggerganov/llama.cpp:server",
+		"noavx":  "",
+	}
+	if s == "" {
+		return images, nil
+	}
+	for _, kv := range strings.Split(s, ",") {
+		variant, image, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if _, known := images[variant]; !ok || !known || image == "" {
+			return nil, fmt.Errorf("%q isn't variant=image with variant avx512, avx2, noavx or arm64", kv)
+		}
+		images[variant] = image
+	}
+	return images, nil
+}
+
+// cpuVariantOf names the variant a CPU of this architecture (as in
+// GOARCH) and these /proc/cpuinfo flags (lower case) runs.
+func cpuVariantOf(arch string, flags map[string]bool) (string, error) {
+	switch {
+	case arch == "arm64":
+		return "arm64", nil
+	case arch != "amd64":
+		return "", fmt.Errorf("no llama.cpp image variant for %s CPUs; use --build-from-source or --cpu-variant", arch)
+	case flags["avx512f"]:
+		return "avx512", nil
+	case flags["avx2"]:
+		return "avx2", nil
+	}
+	return "noavx", nil
+}
+
+// nodeCPUVariant reads the variant off Node Feature Discovery's
+// cpu-cpuid labels; ok is false when an x86 node has none.
+func nodeCPUVariant(node *corev1.Node) (variant string, ok bool, err error) {
+	const prefix = "feature.node.kubernetes.io/cpu-cpuid."
+	flags := map[string]bool{}
+	for k, v := range node.Labels {
+		if strings.HasPrefix(k, prefix) && v == "true" {
+			flags[strings.ToLower(strings.TrimPrefix(k, prefix))] = true
+		}
+	}
+	arch := node.Status.NodeInfo.Architecture
+	if len(flags) == 0 && arch == "amd64" {
+		return "", false, nil
+	}
+	variant, err = cpuVariantOf(arch, flags)
+	return variant, true, err
+}
+
+// cpuDetectScript prints what cpuVariantFromLog needs. curl's image is
+// Alpine, so uname and grep are busybox.
+const cpuDetectScript = `echo "arch=$(uname -m)"; grep -m1 '^flags' /proc/cpuinfo || true`
+
+// cpuVariantFromLog parses cpuDetectScript's output.
+func cpuVariantFromLog(log string) (string, error) {
+	arch, flags := "", map[string]bool{}
+	for _, line := range strings.Split(log, "\n") {
+		if m, ok := strings.CutPrefix(line, "arch="); ok {
+			arch = map[string]string{"x86_64": "amd64", "aarch64": "arm64"}[strings.TrimSpace(m)]
+			if arch == "" {
+				arch = strings.TrimSpace(m)
+			}
+		} else if _, list, ok := strings.Cut(line, ":"); ok && strings.HasPrefix(line, "flags") {
+			for _, f := range strings.Fields(list) {
+				flags[f] = true
+			}
+		}
+	}
+	if arch == "" {
+		return "", fmt.Errorf("unexpected detection output %q", log)
+	}
+	return cpuVariantOf(arch, flags)
+}
+
+// buildCPUDetectJob runs cpuDetectScript on node, or where the server
+// pods would be scheduled when node is "".
+func buildCPUDetectJob(ns, name, node string, opts serverOptions) *batchv1.Job {
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-cpu-detect",
+			Namespace: ns,
+			Labels:    map[string]string{"app": name, "job": "cpu-detect"},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: int32p(1),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"job": "cpu-detect"}},
+				Spec: corev1.PodSpec{
+					RestartPolicy: corev1.RestartPolicyNever,
+					Containers: []corev1.Container{
+						{
+							Name:    "cpu-detect",
+							Image:   opts.CurlImage, // any small multi-arch image with sh and grep
+							Command: []string{"sh", "-c", cpuDetectScript},
+							SecurityContext: &corev1.SecurityContext{
+								RunAsNonRoot:             boolp(true),
+								AllowPrivilegeEscalation: boolp(false),
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	spec := &job.Spec.Template.Spec
+	if node != "" {
+		// Bound to the node, bypassing the scheduler; don't let a
+		// NoExecute taint evict it either.
+		spec.NodeName = node
+		spec.Tolerations = []corev1.Toleration{{Operator: corev1.TolerationOpExists}}
+	} else {
+		placePod(spec, opts)
+	}
+	return job
+}
+
+// archLabel is the node label with the CPU architecture (as in GOARCH).
+const archLabel = "kubernetes.io/arch"
+
+// detectArch returns the architecture of the Ready nodes the pods may be
+// scheduled on (--node-selector, --tolerations), if they all share one.
+// Without permission to list nodes it returns "" and the pods aren't
+// pinned.
+func detectArch(ctx context.Context, cs *kubernetes.Clientset, opts serverOptions) (string, error) {
+	if a := opts.NodeSelector[archLabel]; a != "" {
+		return a, nil
+	}
+	nodes, err := cs.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(opts.NodeSelector).String()})
+	if kerrors.IsForbidden(err) {
+		fmt.Println("Note: not allowed to list nodes; not pinning an architecture (see --arch).")
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	found := map[string]bool{}
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if node.Spec.Unschedulable || !nodeReady(node) || !toleratesTaints(node.Spec.Taints, opts.Tolerations) {
+			continue
+		}
+		found[node.Labels[archLabel]] = true
+	}
+	switch {
+	case len(found) == 0:
+		return "", fmt.Errorf("no Ready, schedulable node matches --node-selector/--tolerations")
+	case len(found) > 1:
+		return "", fmt.Errorf("the nodes mix architectures; pick one with --arch=amd64 (or arm64)")
+	}
+	for a := range found {
+		if a != "amd64" && a != "arm64" {
+			return "", fmt.Errorf("nodes of architecture %q aren't supported; only amd64 and arm64", a)
+		}
+		return a, nil
+	}
+	return "", nil
+}
+
+// checkArm64 rejects what has no arm64 build: the official CUDA server
+// image and the x86 CPU variants. vLLM and TGI images may lack one too;
+// that's only a note, as --vllm-image/--tgi-image may point at one.
+func checkArm64(stacks []modelStack, cpuVariant string) error {
+	if cpuVariant != "" && cpuVariant != "auto" && cpuVariant != "arm64" {
+		return fmt.Errorf("--cpu-variant=%s is an x86 build; use --cpu-variant=arm64 (or leave it unset)", cpuVariant)
+	}
+	for _, st := range stacks {
+		switch {
+		case st.Model.Backend == "llamacpp" && st.Model.GPU > 0:
+			return fmt.Errorf("model %q: the llama.cpp CUDA image is amd64 only; serve it on CPU (--gpu=0)", st.Model.Name)
+		case st.Model.Backend == "vllm" || st.Model.Backend == "tgi":
+			fmt.Printf("Note: model %q: make sure the %s image has an arm64 build.\n", st.Model.Name, st.Model.Backend)
+		}
+	}
+	return nil
+}
+
+// detectCPUVariant returns the least capable variant among the Ready
+// nodes the CPU server pods may be scheduled on (--node-selector,
+// --tolerations), so the image runs wherever they land. Nodes without
+// NFD labels run buildCPUDetectJob; without permission to list nodes, one
+// Job placed like the server pods decides.
+func detectCPUVariant(ctx context.Context, cs *kubernetes.Clientset, ns, name string, opts serverOptions) (string, error) {
+	detect := func(node string) (string, error) {
+		log, err := jobLog(ctx, cs, buildCPUDetectJob(ns, name, node, opts), "cpu-detect")
+		if err != nil {
+			return "", err
+		}
+		return cpuVariantFromLog(string(log))
+	}
+	nodes, err := cs.CoreV1().Nodes().List(ctx, metav1.ListOptions{LabelSelector: labels.SelectorFromSet(opts.NodeSelector).String()})
+	if kerrors.IsForbidden(err) {
+		fmt.Println("Note: not allowed to list nodes; detecting the CPU of one node the server may run on.")
+		variant, err := detect("")
+		if err == nil {
+			fmt.Printf("CPU variant of a schedulable node: %s\n", variant)
+		}
+		return variant, err
+	}
+	if err != nil {
+		return "", err
+	}
+	variant := ""
+	for i := range nodes.Items {
+		node := &nodes.Items[i]
+		if node.Spec.Unschedulable || !nodeReady(node) || !toleratesTaints(node.Spec.Taints, opts.Tolerations) {
+			continue
+		}
+		v, ok, err := nodeCPUVariant(node)
+		source := "NFD labels"
+		if err == nil && !ok {
+			v, err = detect(node.Name)
+			source = "/proc/cpuinfo"
+		}
+		if err != nil {
+			return "", fmt.Errorf("node %s: %w", node.Name, err)
+		}
+		fmt.Printf("Node %s: %s (%s)\n", node.Name, v, source)
+		switch {
+		case variant == "" || (v != "arm64" && cpuVariantRank[v] < cpuVariantRank[variant]):
+			variant = v
+		case (v == "arm64") != (variant == "arm64"):
+			return "", fmt.Errorf("the nodes mix arm64 and x86; pick one kind with --node-selector=kubernetes.io/arch=amd64 (or arm64)")
+		}
+	}
+	if variant == "" {
+		return "", fmt.Errorf("no Ready, schedulable node matches --node-selector/--tolerations")
+	}
+	return variant, nil
+}
+
+// nodeReady says whether the node's Ready condition is True.
+func nodeReady(node *corev1.Node) bool {
+	for _, c := range node.Status.Conditions {
+		if c.Type == corev1.NodeReady {
+			return c.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// toleratesTaints says whether pods with tols may be scheduled onto a
+// node with these taints (PreferNoSchedule ones don't keep them off).
+func toleratesTaints(taints []corev1.Taint, tols []corev1.Toleration) bool {
+	for i := range taints {
+		if taints[i].Effect == corev1.TaintEffectPreferNoSchedule {
+			continue
+		}
+		tolerated := false
+		for j := range tols {
+			tolerated = tolerated || tols[j].ToleratesTaint(&taints[i])
+		}
+		if !tolerated {
+			return false
+		}
+	}
+	return true
+}
+
+// -----------------------------
+// Model integrity CronJob (--integrity-schedule)
+// -----------------------------
+
+// integrityChecked says whether st gets the integrity CronJob: a
+// llama.cpp model downloaded from a URL (the fix is downloading it again)
+// onto a PVC.
+func integrityChecked(st modelStack, opts serverOptions) bool {
+	return opts.IntegritySched != "" && opts.ModelVolume != "per-replica" &&
+		st.Model.URL != "" && st.Model.Backend == "llamacpp"
+}
+
+// integrityScript re-hashes the served GGUF (every shard of a split
+// model). On a mismatch it leaves $MODEL.corrupt listing the bad files,
+// posts a Warning Event on the Deployment and fails.
+const integrityScript = `set -eu
+MODEL="/models/${MODEL_FILE}"
+case "$MODEL" in
+  *-00001-of-*.gguf) FILES=$(ls "${MODEL%-00001-of-*.gguf}"-*-of-*.gguf) ;;
+  *) FILES="$MODEL" ;;
+esac
+
+bad=""
+for f in $FILES; do
+  if [ ! -e "$f" ]; then
+    echo "$f not downloaded yet; skipping"
+    continue
+  fi
+  # --model-sha256 covers a single-file model; anything else is compared
+  # with the hash this check recorded the first time it saw the file.
+  expected=""
+  if [ "$FILES" = "$MODEL" ]; then
+    expected="${MODEL_SHA256:-}"
+  fi
+  if [ -z "$expected" ] && [ -s "$f.sha256" ]; then
+    expected=$(cat "$f.sha256")
+  fi
+  echo "Hashing $f ..."
+  actual=$(sha256sum "$f" | cut -d' ' -f1)
+  if [ -z "$expected" ]; then
+    echo "$actual" > "$f.sha256"
+    echo "Recorded $actual as the reference for later checks"
+  elif [ "$actual" = "$expected" ]; then
+    echo "SHA256 OK"
+  else
+    echo "SHA256 MISMATCH: expected $expected, got $actual"
+    bad="$bad ${f#/models/}"
+  fi
+done
+[ -z "$bad" ] && exit 0
+
+# The server's liveness probe fails while this marker exists, and the
+# fetch-model initContainer downloads the listed files again.
+echo "$bad" > "$MODEL.corrupt"
+SA=/var/run/secrets/kubernetes.io/serviceaccount
+now=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+curl -sS --fail --cacert "$SA/ca.crt" -H "Authorization: Bearer $(cat "$SA/token")" \
+  -H "Content-Type: application/json" -o /dev/null \
+  -X POST "https://kubernetes.default.svc/api/v1/namespaces/${NAMESPACE}/events" -d "{
+  \"metadata\": {\"generateName\": \"${DEPLOYMENT}-integrity-\"},
+  \"involvedObject\": {\"apiVersion\": \"apps/v1\", \"kind\": \"Deployment\", \"name\": \"${DEPLOYMENT}\", \"namespace\": \"${NAMESPACE}\"},
+  \"type\": \"Warning\", \"reason\": \"ModelCorrupted\",
+  \"message\": \"SHA256 mismatch on the models PVC:${bad}. Delete the pods to download it again.\",
+  \"source\": {\"component\": \"model-integrity\"},
+  \"firstTimestamp\": \"$now\", \"lastTimestamp\": \"$now\", \"count\": 1
+}" || echo "Could not post the Event"
+echo "Corrupt:${bad}"
+exit 1
+`
+
+// buildIntegrityCronJob runs integrityScript on the models PVC, preferably
+// next to the server pods (an RWO volume can only be shared on their node).
+func buildIntegrityCronJob(ns string, st modelStack, opts serverOptions) *batchv1.CronJob {
+	var fsGroup int64 = 65532 // same group as the server pod, see buildDeployment
+	cmName := st.ObjName + "-config"
+	labels := map[string]string{"app": st.ObjName, "job": "integrity"}
+	podSpec := corev1.PodSpec{
+		RestartPolicy:      corev1.RestartPolicyNever,
+		ServiceAccountName: st.ObjName + "-integrity",
+		SecurityContext:    &corev1.PodSecurityContext{FSGroup: &fsGroup},
+		Affinity: &corev1.Affinity{
+			PodAffinity: &corev1.PodAffinity{
+				PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+					{
+						Weight: 100,
+						PodAffinityTerm: corev1.PodAffinityTerm{
+							LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": st.ObjName}},
+							TopologyKey:   "kubernetes.io/hostname",
+						},
+					},
+				},
+			},
+		},
+		Containers: []corev1.Container{
+			{
+				Name:    "integrity",
+				Image:   opts.CurlImage, // sh, sha256sum and curl for the Event
+				Command: []string{"sh", "-c"},
+				Args:    []string{integrityScript},
+				Env: []corev1.EnvVar{
+					{Name: "MODEL_FILE", ValueFrom: cfgKey(cmName, "MODEL_FILE")},
+					{Name: "MODEL_SHA256", ValueFrom: cfgKey(cmName, "MODEL_SHA256")},
+					{Name: "NAMESPACE", Value: ns},
+					{Name: "DEPLOYMENT", Value: st.ObjName},
+				},
+				SecurityContext: &corev1.SecurityContext{
+					RunAsNonRoot:             boolp(true),
+					AllowPrivilegeEscalation: boolp(false),
+				},
+				VolumeMounts: []corev1.VolumeMount{
+					{Name: "model-store", MountPath: "/models"},
+				},
+			},
+		},
+		Volumes: []corev1.Volume{
+			{
+				Name: "model-store",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: st.ObjName + "-models-pvc"},
+				},
+			},
+		},
+	}
+	placePod(&podSpec, opts)
+	return &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      st.ObjName + "-integrity",
+			Namespace: ns,
+			Labels:    labels,
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:                   opts.IntegritySched,
+			ConcurrencyPolicy:          batchv1.ForbidConcurrent,
+			SuccessfulJobsHistoryLimit: int32p(1),
+			FailedJobsHistoryLimit:     int32p(3),
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					// Hashing again won't change the verdict.
+					BackoffLimit: int32p(0),
+					Template: corev1.PodTemplateSpec{
+						// No "app" label here: the Service must not select this pod.
+						ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"job": "integrity"}},
+						Spec:       podSpec,
+					},
+				},
+			},
+		},
+	}
+}
+
+// applyIntegrityCheck creates/updates the CronJob and the ServiceAccount
+// and Role that let it post Events.
+func applyIntegrityCheck(ctx context.Context, cs *kubernetes.Clientset, ns string, st modelStack, opts serverOptions) error {
+	name := st.ObjName + "-integrity"
+	labels := map[string]string{"app": st.ObjName}
+	meta := metav1.ObjectMeta{Name: name, Namespace: ns, Labels: labels}
+	sa := &corev1.ServiceAccount{ObjectMeta: meta}
+	if _, err := cs.CoreV1().ServiceAccounts(ns).Create(ctx, sa, metav1.CreateOptions{}); err != nil && !kerrors.IsAlreadyExists(err) {
+		return err
+	}
+	if err := upsertRole(ctx, cs, &rbacv1.Role{
+		ObjectMeta: meta,
+		Rules: []rbacv1.PolicyRule{
+			{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"create"}},
+		},
+	}); err != nil {
+		return err
+	}
+	if err := upsertRoleBinding(ctx, cs, &rbacv1.RoleBinding{
+		ObjectMeta: meta,
+		Subjects:   []rbacv1.Subject{{Kind: "ServiceAccount", Name: name, Namespace: ns}},
+		RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "Role", Name: name},
+	}); err != nil {
+		return err
+	}
+	return upsertCronJob(ctx, cs, buildIntegrityCronJob(ns, st, opts))
+}
+
+// deleteIntegrityCheck removes what applyIntegrityCheck created under
+// name, so dropping --integrity-schedule stops the checks.
+func deleteIntegrityCheck(ctx context.Context, cs *kubernetes.Clientset, ns, name string) error {
+	name += "-integrity"
+	propagation := metav1.DeletePropagationBackground
+	deletes := []func() error{
+		func() error {
+			return cs.BatchV1().CronJobs(ns).Delete(ctx, name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+		},
+		func() error { return cs.RbacV1().RoleBindings(ns).Delete(ctx, name, metav1.DeleteOptions{}) },
+		func() error { return cs.RbacV1().Roles(ns).Delete(ctx, name, metav1.DeleteOptions{}) },
+		func() error { return cs.CoreV1().ServiceAccounts(ns).Delete(ctx, name, metav1.DeleteOptions{}) },
+	}
+	for _, del := range deletes {
+		if err := del(); err != nil && !kerrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// -----------------------------
+// gateway command
+// -----------------------------
+
+// gatewayScript is the proxy the gateway Deployment runs (Python standard
+// library only, so any Python 3 image will do).
+const gatewayScript = `# OpenAI-compatible gateway: routes each request to a model's Service by
+# the "model" field of its JSON body. Routes come from routes.json:
+#   {"<model>": {"url": "http://<service>.<ns>.svc:80", "host": "...", "model": "..."}}
+# "host" overrides the Host header (the KEDA HTTP interceptor routes by it)
+# and "model" the name sent upstream (TGI wants "tgi"). Responses, including
+# server-sent event streams, are relayed as they arrive.
+import http.client
+import json
+import os
+import sys
+import urllib.parse
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+ROUTES = json.load(open(os.environ.get("ROUTES_FILE", "/etc/gateway/routes.json")))
+HOP_BY_HOP = {"connection", "keep-alive", "proxy-connection", "te", "trailer",
+              "transfer-encoding", "upgrade", "host", "content-length"}
+
+` + relayScript + `
+
+class Gateway(BaseHTTPRequestHandler):
+    protocol_version = "HTTP/1.1"
+
+    def reply(self, status, obj):
+        body = json.dumps(obj).encode()
+        self.send_response(status)
+        self.send_header("Content-Type", "application/json")
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def do_GET(self):
+        if self.path == "/healthz":
+            return self.reply(200, {"status": "ok"})
+        if self.path.rstrip("/") == "/v1/models":
+            return self.reply(200, {"object": "list", "data": [
+                {"id": m, "object": "model", "owned_by": "llama-chat"} for m in sorted(ROUTES)]})
+        self.reply(404, {"error": {"message": "not found: " + self.path}})
+
+    def do_POST(self):
+        body = self.rfile.read(int(self.headers.get("Content-Length") or 0))
+        try:
+            req = json.loads(body)
+            model = req.get("model")
+        except (ValueError, AttributeError):
+            return self.reply(400, {"error": {"message": "request body is not a JSON object"}})
+        route = ROUTES.get(model)
+        if route is None:
+            return self.reply(404, {"error": {"message": "unknown model %r (have: %s)" % (model, ", ".join(sorted(ROUTES)))}})
+        if route.get("model") and route["model"] != model:
+            req["model"] = route["model"]
+            body = json.dumps(req).encode()
+
+        url = urllib.parse.urlsplit(route["url"])
+        headers = {k: v for k, v in self.headers.items() if k.lower() not in HOP_BY_HOP}
+        headers["Host"] = route.get("host") or url.netloc
+        headers["Content-Length"] = str(len(body))
+        try:
+            conn = http.client.HTTPConnection(url.hostname, url.port or 80, timeout=600)
+            conn.request("POST", self.path, body, headers)
+            resp = conn.getresponse()
+        except OSError as e:
+            return self.reply(502, {"error": {"message": "model %r is unreachable: %s" % (model, e)}})
+
+        try:
+            relay(self, resp, [(k, v) for k, v in resp.getheaders() if k.lower() not in HOP_BY_HOP])
+        finally:
+            conn.close()
+
+    def log_message(self, fmt, *args):
+        sys.stdout.write("%s %s\n" % (self.address_string(), fmt % args))
+
+
+if __name__ == "__main__":
+    print("Routing models: " + ", ".join(sorted(ROUTES)), flush=True)
+    ThreadingHTTPServer(("0.0.0.0", int(os.environ.get("PORT", "8080"))), Gateway).serve_forever()
+`
+
+// relayScript is the response relay gatewayScript and proxySidecarScript
+// share: it re-sends the upstream body chunked, flushing every piece, so
+// server-sent event streams reach the client as they are generated.
+const relayScript = `
+def relay(handler, resp, headers, on_chunk=None):
+    """Sends resp to handler's client as it arrives, with these headers.
+    on_chunk, if given, sees every piece of the body."""
+    handler.send_response(resp.status)
+    for k, v in headers:
+        handler.send_header(k, v)
+    handler.send_header("Transfer-Encoding", "chunked")
+    handler.end_headers()
+    while True:
+        chunk = resp.read1(65536)
+        if not chunk:
+            break
+        handler.wfile.write(b"%x\r\n%s\r\n" % (len(chunk), chunk))
+        handler.wfile.flush()
+        if on_chunk:
+            on_chunk(chunk)
+    handler.wfile.write(b"0\r\n\r\n")
+`
+
+// gatewayRoute is one routes.json entry: where a model's requests go.
+type gatewayRoute struct {
+	URL   string `json:"url"`             // The model's Service
+	Host  string `json:"host,omitempty"`  // Host header, for the KEDA HTTP interceptor
+	Model string `json:"model,omitempty"` // Name the server expects, if not the client's
+}
+
+// deployGateway creates/updates the gateway's ConfigMap (script and
+// routes), Deployment, Service and Ingress or Route for stacks.
+func deployGateway(ctx context.Context, cs *kubernetes.Clientset, dyn dynamic.Interface, ns, name, host, image string, stacks []modelStack, opts serverOptions) error {
+	routes := map[string]gatewayRoute{}
+	for _, st := range stacks {
+		r := gatewayRoute{URL: fmt.Sprintf("http://%s.%s.svc:80", st.ObjName, ns)}
+		// The interceptor wakes scaled-to-zero models, and routes by host.
+		if opts.ScaleToZero == "http" {
+			r = gatewayRoute{URL: fmt.Sprintf("http://%s-interceptor.%s.svc:8080", st.ObjName, ns), Host: st.Host}
+		}
+		if model, _ := chatModel(st.Model); model != st.Model.Name {
+			r.Model = model
+		}
+		routes[st.Model.Name] = r
+	}
+	routesJSON, err := json.MarshalIndent(routes, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	gw := modelStack{ObjName: name + "-gateway", Host: host}
+	labels := map[string]string{"app": gw.ObjName}
+	fmt.Printf("Creating/updating ConfigMap %s-config (%d routes)...\n", gw.ObjName, len(routes))
+	err = upsertConfigMap(ctx, cs, &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: gw.ObjName + "-config", Namespace: ns, Labels: labels},
+		Data: map[string]string{
+			"gateway.py":  gatewayScript,
+			"routes.json": string(routesJSON),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("upsert configmap: %w", err)
+	}
+
+	fmt.Printf("Creating/updating Deployment %s...\n", gw.ObjName)
+	if err := upsertDeployment(ctx, cs, buildGatewayDeployment(ns, gw, image, routesJSON)); err != nil {
+		return fmt.Errorf("upsert deployment: %w", err)
+	}
+	// The gateway has no metrics or scaler of its own.
+	plain := serverOptions{TLS: opts.TLS, TLSInsecure: opts.TLSInsecure, TLSCert: opts.TLSCert, TLSKey: opts.TLSKey}
+	if opts.RateLimitMode == "router" {
+		plain.RateLimit, plain.RateLimitMode = opts.RateLimit, opts.RateLimitMode
+	}
+	fmt.Println("Creating/updating Service...")
+	if err := upsertService(ctx, cs, buildService(ns, gw, plain)); err != nil {
+		return fmt.Errorf("upsert service: %w", err)
+	}
+	return exposeStack(ctx, cs, dyn, ns, gw, plain)
+}
+
+// buildGatewayDeployment runs gatewayScript from its ConfigMap. The proxy
+// reads the routes at start, so their checksum is a pod annotation: new
+// routes roll the pods.
+func buildGatewayDeployment(ns string, gw modelStack, image string, routesJSON []byte) *appsv1.Deployment {
+	labels := map[string]string{"app": gw.ObjName}
+	sum := sha256.Sum256(routesJSON)
+	health := corev1.ProbeHandler{
+		HTTPGet: &corev1.HTTPGetAction{Path: "/healthz", Port: intstr.FromInt(8080)},
+	}
+	return &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: gw.ObjName, Namespace: ns, Labels: labels},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: int32p(1),
+			Selector: &metav1.LabelSelector{MatchLabels: labels},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels:      labels,
+					Annotations: map[string]string{"llama-chat/routes-sha256": hex.EncodeToString(sum[:])},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:    "gateway",
+							Image:   image,
+							Command: []string{"python3", "-u", "/etc/gateway/gateway.py"},
+							Ports:   []corev1.ContainerPort{{Name: "http", ContainerPort: 8080}},
+							Env:     []corev1.EnvVar{{Name: "ROUTES_FILE", Value: "/etc/gateway/routes.json"}},
+							ReadinessProbe: &corev1.Probe{
+								ProbeHandler:  health,
+								PeriodSeconds: 5,
+							},
+							LivenessProbe: &corev1.Probe{
+								ProbeHandler:        health,
+								InitialDelaySeconds: 10,
+								PeriodSeconds:       10,
+							},
+							Resources: corev1.ResourceRequirements{
+								Requests: corev1.ResourceList{
+									corev1.ResourceCPU:    resource.MustParse("50m"),
+									corev1.ResourceMemory: resource.MustParse("64Mi"),
+								},
+								Limits: corev1.ResourceList{
+									corev1.ResourceMemory: resource.MustParse("256Mi"),
+								},
+							},
+							SecurityContext: &corev1.SecurityContext{
+								RunAsNonRoot:             boolp(true),
+								AllowPrivilegeEscalation: boolp(false),
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "gateway", MountPath: "/etc/gateway", ReadOnly: true},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "gateway",
+							VolumeSource: corev1.VolumeSource{
+								ConfigMap: &corev1.ConfigMapVolumeSource{
+									LocalObjectReference: corev1.LocalObjectReference{Name: gw.ObjName + "-config"},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// -----------------------------
+// benchmark command
+// -----------------------------
+
+// benchOptions is the workload each model gets.
+type benchOptions struct {
+	Requests    int
+	Concurrency int
+	MaxTokens   int
+	Prompt      string
+	APIKey      string
+}
+
+// benchResult summarizes one model's run. Times are in milliseconds.
+type benchResult struct {
+	Model           string  `json:"model"`
+	Endpoint        string  `json:"endpoint"`
+	Requests        int     `json:"requests"`
+	Errors          int     `json:"errors"`
+	FirstError      string  `json:"first_error,omitempty"`
+	Concurrency     int     `json:"concurrency"`
+	WallSeconds     float64 `json:"wall_seconds"`
+	TotalTokens     int     `json:"total_tokens"`
+	TokensPerSec    float64 `json:"tokens_per_sec"`     // All completion tokens / wall time
+	DecodeTokPerSec float64 `json:"decode_tok_per_sec"` // Median per-request rate after the first token
+	TTFTP50         float64 `json:"ttft_p50_ms"`
+	TTFTP90         float64 `json:"ttft_p90_ms"`
+	TTFTP99         float64 `json:"ttft_p99_ms"`
+	LatencyP50      float64 `json:"latency_p50_ms"`
+	LatencyP90      float64 `json:"latency_p90_ms"`
+	LatencyP99      float64 `json:"latency_p99_ms"`
+}
+
+// runBenchmark sends the requests with bopts.Concurrency in flight, streamed
+// so time to first token can be measured. Tokens are the server's count when
+// it reports usage, else the number of streamed chunks (one token each on
+// llama.cpp and vLLM).
+func runBenchmark(ctx context.Context, httpClient *http.Client, st modelStack, bopts benchOptions) benchResult {
+	type sample struct {
+		ttft, latency time.Duration
+		tokens        int
+		err           error
+	}
+	model, _ := chatModel(st.Model)
+	samples := make([]sample, bopts.Requests)
+	jobs := make(chan int)
+	done := make(chan struct{})
+	for w := 0; w < bopts.Concurrency; w++ {
+		go func() {
+			for i := range jobs {
+				start := time.Now()
+				chunks := 0
+				var ttft time.Duration
+				usage, err := streamChat(ctx, httpClient, st.endpoint(), bopts.APIKey, chatReq{
+					Model:     model,
+					MaxTokens: bopts.MaxTokens,
+					Messages:  []chatMessage{{Role: "user", Content: bopts.Prompt}},
+				}, func(string) {
+					if chunks == 0 {
+						ttft = time.Since(start)
+					}
+					chunks++
+				})
+				if usage == 0 {
+					usage = chunks
+				}
+				samples[i] = sample{ttft: ttft, latency: time.Since(start), tokens: usage, err: err}
+			}
+			done <- struct{}{}
+		}()
+	}
+	start := time.Now()
+	for i := 0; i < bopts.Requests; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	for w := 0; w < bopts.Concurrency; w++ {
+		<-done
+	}
+	wall := time.Since(start)
+
+	res := benchResult{
+		Model:       st.Model.Name,
+		Endpoint:    st.endpoint(),
+		Requests:    bopts.Requests,
+		Concurrency: bopts.Concurrency,
+		WallSeconds: wall.Seconds(),
+	}
+	var ttfts, latencies, rates []float64
+	for _, s := range samples {
+		if s.err != nil {
+			if res.Errors == 0 {
+				res.FirstError = strings.SplitN(s.err.Error(), "\n", 2)[0]
+			}
+			res.Errors++
+			continue
+		}
+		res.TotalTokens += s.tokens
+		ttfts = append(ttfts, float64(s.ttft)/float64(time.Millisecond))
+		latencies = append(latencies, float64(s.latency)/float64(time.Millisecond))
+		if decode := s.latency - s.ttft; s.tokens > 1 && decode > 0 {
+			rates = append(rates, float64(s.tokens-1)/decode.Seconds())
+		}
+	}
+	res.TokensPerSec = float64(res.TotalTokens) / wall.Seconds()
+	res.DecodeTokPerSec = percentile(rates, 50)
+	res.TTFTP50, res.TTFTP90, res.TTFTP99 = percentile(ttfts, 50), percentile(ttfts, 90), percentile(ttfts, 99)
+	res.LatencyP50, res.LatencyP90, res.LatencyP99 = percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99)
+	return res
+}
+
+// percentile is the nearest-rank p-th percentile of xs (0 if empty).
+func percentile(xs []float64, p float64) float64 {
+	if len(xs) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), xs...)
+	sort.Float64s(sorted)
+	rank := int(p/100*float64(len(sorted))+0.5) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// writeBenchReport prints the results as JSON or a markdown table, to path
+// if given (else stdout).
+func writeBenchReport(results []benchResult, format, path string) error {
+	var b strings.Builder
+	if format == "json" {
+		out, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		b.Write(out)
+		b.WriteString("\n")
+	} else {
+		b.WriteString("| Model | Requests | Errors | Concurrency | Tokens/s | Decode tok/s (p50) | TTFT p50/p90/p99 (ms) | Latency p50/p90/p99 (ms) |\n")
+		b.WriteString("|---|---|---|---|---|---|---|---|\n")
+		for _, r := range results {
+			fmt.Fprintf(&b, "| %s | %d | %d | %d | %.1f | %.1f | %.0f / %.0f / %.0f | %.0f / %.0f / %.0f |\n",
+				r.Model, r.Requests, r.Errors, r.Concurrency, r.TokensPerSec, r.DecodeTokPerSec,
+				r.TTFTP50, r.TTFTP90, r.TTFTP99, r.LatencyP50, r.LatencyP90, r.LatencyP99)
+		}
+		for _, r := range results {
+			if r.FirstError != "" {
+				fmt.Fprintf(&b, "\n%s: first error: %s\n", r.Model, r.FirstError)
+			}
+		}
+	}
+	if path == "" {
+		_, err := os.Stdout.WriteString(b.String())
+		return err
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+	return nil
+}
+
+// -----------------------------
+// compare command
+// -----------------------------
+
+// comparePrompts are what both quantizations answer at temperature 0, after
+// --bench-prompt: a lower-bit one often starts to drift on facts and
+// arithmetic first.
+var comparePrompts = []string{
+	"What is 17 * 23? Answer with the number only.",
+	"Name the capital of Australia in one word.",
+	"List the first five prime numbers, comma-separated.",
+}
+
+// podMetricsGVR is the metrics API's pod usage (metrics-server, or
+// OpenShift's Prometheus adapter).
+var podMetricsGVR = schema.GroupVersionResource{Group: "metrics.k8s.io", Version: "v1beta1", Resource: "pods"}
+
+// serverMemory is the largest working set of the server container among
+// the stack's pods, or an error when the metrics API has none.
+func serverMemory(ctx context.Context, dyn dynamic.Interface, ns, objName string) (int64, error) {
+	list, err := dyn.Resource(podMetricsGVR).Namespace(ns).List(ctx, metav1.ListOptions{LabelSelector: "app=" + objName})
+	if err != nil {
+		return 0, err
+	}
+	var max int64
+	for _, pod := range list.Items {
+		containers, _, _ := unstructured.NestedSlice(pod.Object, "containers")
+		for _, c := range containers {
+			c, _ := c.(map[string]interface{})
+			mem, _, _ := unstructured.NestedString(c, "usage", "memory")
+			if q, err := resource.ParseQuantity(mem); err == nil && c["name"] != "proxy" && c["name"] != "prompt-cache" && q.Value() > max {
+				max = q.Value()
+			}
+		}
+	}
+	if max == 0 {
+		return 0, fmt.Errorf("no metrics for %s pods yet", objName)
+	}
+	return max, nil
+}
+
+// compareQuants benchmarks both stacks one after the other (so they don't
+// compete for CPU), reads their memory, collects their replies to
+// comparePrompts, prints the report and returns the faster stack first.
+// Fewer failed requests beat speed.
+func compareQuants(ctx context.Context, dyn dynamic.Interface, httpClient *http.Client, ns string, stacks []modelStack, bopts benchOptions) (modelStack, modelStack, error) {
+	a, b := stacks[0], stacks[1]
+	var res [2]benchResult
+	var mem [2]string
+	var replies [2][]string
+	prompts := append([]string{bopts.Prompt}, comparePrompts...)
+	for i, st := range []modelStack{a, b} {
+		fmt.Fprintf(os.Stderr, "Benchmarking %s (%d requests, %d at a time)...\n", st.Model.Quant, bopts.Requests, bopts.Concurrency)
+		res[i] = runBenchmark(ctx, httpClient, st, bopts)
+		res[i].Model = st.Model.Quant
+		mem[i] = "n/a"
+		if m, err := serverMemory(ctx, dyn, ns, st.ObjName); err == nil {
+			mem[i] = fmt.Sprintf("%.0f MiB", float64(m)/(1<<20))
+		} else {
+			fmt.Fprintf(os.Stderr, "Note: no memory figure for %s: %v\n", st.Model.Quant, err)
+		}
+		model, _ := chatModel(st.Model)
+		zero := 0.0
+		for _, p := range prompts {
+			var reply strings.Builder
+			_, err := streamChat(ctx, httpClient, st.endpoint(), bopts.APIKey, chatReq{
+				Model:       model,
+				MaxTokens:   bopts.MaxTokens,
+				Temperature: &zero,
+				Messages:    []chatMessage{{Role: "user", Content: p}},
+			}, func(s string) { reply.WriteString(s) })
+			if err != nil {
+				return a, b, fmt.Errorf("%s: %w", st.Model.Quant, err)
+			}
+			replies[i] = append(replies[i], strings.TrimSpace(reply.String()))
+		}
+	}
+	if res[1].Errors < res[0].Errors || (res[1].Errors == res[0].Errors && res[1].TokensPerSec > res[0].TokensPerSec) {
+		a, b = b, a
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "\n\t%s\t%s\n", res[0].Model, res[1].Model)
+	row := func(name, format string, v func(r benchResult) interface{}) {
+		fmt.Fprintf(w, "%s\t"+format+"\t"+format+"\n", name, v(res[0]), v(res[1]))
+	}
+	row("Errors", "%v", func(r benchResult) interface{} { return fmt.Sprintf("%d/%d", r.Errors, r.Requests) })
+	row("Tokens/s", "%.1f", func(r benchResult) interface{} { return r.TokensPerSec })
+	row("Decode tok/s (p50)", "%.1f", func(r benchResult) interface{} { return r.DecodeTokPerSec })
+	row("TTFT p50 (ms)", "%.0f", func(r benchResult) interface{} { return r.TTFTP50 })
+	row("Latency p90 (ms)", "%.0f", func(r benchResult) interface{} { return r.LatencyP90 })
+	fmt.Fprintf(w, "Memory\t%s\t%s\n", mem[0], mem[1])
+	w.Flush()
+
+	same := 0
+	for i, p := range prompts {
+		if replies[0][i] == replies[1][i] {
+			same++
+			continue
+		}
+		fmt.Printf("\nPrompt: %s\n  %s: %q\n  %s: %q\n", p, res[0].Model, truncate(replies[0][i], 200), res[1].Model, truncate(replies[1][i], 200))
+	}
+	fmt.Printf("\nIdentical replies at temperature 0: %d of %d prompts.\n", same, len(prompts))
+	fmt.Printf("Faster: %s.\n", a.Model.Quant)
+	return a, b, nil
+}
+
+// -----------------------------
+// usage command
+// -----------------------------
+
+// usageRecord is one line the proxy sidecar wrote (see proxySidecarScript).
+type usageRecord struct {
+	TS               time.Time `json:"ts"`
+	Model            string    `json:"model"`
+	Path             string    `json:"path"`
+	Client           string    `json:"client"`
+	Key              string    `json:"key"` // sha256 of the Authorization header, shortened
+	Stream           bool      `json:"stream"`
+	Status           int       `json:"status"`
+	Cache            string    `json:"cache"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	LatencyMS        float64   `json:"latency_ms"`
+}
+
+// usageRow totals one group's records. Cached answers are counted as
+// requests and tokens too, but cost the server nothing.
+type usageRow struct {
+	Group            string  `json:"group"`
+	Requests         int     `json:"requests"`
+	Errors           int     `json:"errors"`
+	CacheHits        int     `json:"cache_hits"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	LatencyP50       float64 `json:"latency_p50_ms"`
+	LatencyP95       float64 `json:"latency_p95_ms"`
+}
+
+// usageDumpScript prints the usage files from $SINCE (yyyymmdd) on,
+// gzipped and base64-encoded so a long history stays well inside the
+// container log the records are read back from.
+const usageDumpScript = `set -eu
+cd /var/usage
+for f in usage-*.jsonl; do
+  [ -e "$f" ] || continue
+  day=${f#usage-}
+  day=${day%%-*}
+  [ "$day" -ge "$SINCE" ] && cat "$f"
+done | gzip -c | base64
+`
+
+// buildUsageDumpJob mounts the usage PVC read-only, preferably next to the
+// server pods (an RWO volume can only be shared on their node).
+func buildUsageDumpJob(ns, name string, since time.Time, opts serverOptions) *batchv1.Job {
+	var fsGroup int64 = 65532 // same group as the server pod, see buildDeployment
+	job := &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name + "-usage-dump",
+			Namespace: ns,
+			Labels:    map[string]string{"app": name, "job": "usage-dump"},
+		},
+		Spec: batchv1.JobSpec{
+			BackoffLimit: int32p(1),
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"job": "usage-dump"}},
+				Spec: corev1.PodSpec{
+					RestartPolicy:   corev1.RestartPolicyNever,
+					SecurityContext: &corev1.PodSecurityContext{FSGroup: &fsGroup},
+					Affinity: &corev1.Affinity{
+						PodAffinity: &corev1.PodAffinity{
+							PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{
+								{
+									Weight: 100,
+									PodAffinityTerm: corev1.PodAffinityTerm{
+										LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": name}},
+										TopologyKey:   "kubernetes.io/hostname",
+									},
+								},
+							},
+						},
+					},
+					Containers: []corev1.Container{
+						{
+							Name:    "usage-dump",
+							Image:   opts.SidecarImage,
+							Command: []string{"sh", "-c"},
+							Args:    []string{usageDumpScript},
+							Env:     []corev1.EnvVar{{Name: "SINCE", Value: since.UTC().Format("20060102")}},
+							SecurityContext: &corev1.SecurityContext{
+								RunAsNonRoot:             boolp(true),
+								AllowPrivilegeEscalation: boolp(false),
+							},
+							VolumeMounts: []corev1.VolumeMount{
+								{Name: "usage", MountPath: "/var/usage", ReadOnly: true},
+							},
+						},
+					},
+					Volumes: []corev1.Volume{
+						{
+							Name: "usage",
+							VolumeSource: corev1.VolumeSource{
+								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: name + "-usage-pvc", ReadOnly: true},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	placePod(&job.Spec.Template.Spec, opts)
+	return job
+}
+
+// readUsage runs buildUsageDumpJob and decodes its log into records,
+// oldest first. since = 0 reads everything.
+func readUsage(ctx context.Context, cs *kubernetes.Clientset, ns, name string, since time.Duration, opts serverOptions) ([]usageRecord, error) {
+	if _, err := cs.CoreV1().PersistentVolumeClaims(ns).Get(ctx, name+"-usage-pvc", metav1.GetOptions{}); err != nil {
+		return nil, fmt.Errorf("%w (was the model deployed with --usage-log?)", err)
+	}
+	var cutoff time.Time
+	if since > 0 {
+		cutoff = time.Now().Add(-since)
+	}
+	raw, err := jobLog(ctx, cs, buildUsageDumpJob(ns, name, cutoff, opts), "usage-dump")
+	if err != nil {
+		return nil, err
+	}
+	gz, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(raw)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("decode job log: %w", err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(gz))
+	if err != nil {
+		return nil, fmt.Errorf("decode job log: %w", err)
+	}
+	var records []usageRecord
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var r usageRecord
+		// A pod killed mid-write leaves a partial last line; skip it.
+		if json.Unmarshal(scanner.Bytes(), &r) != nil || r.TS.Before(cutoff) {
+			continue
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].TS.Before(records[j].TS) })
+	return records, nil
+}
+
+// summarizeUsage totals records per --usage-by group, busiest (most
+// tokens) first.
+func summarizeUsage(records []usageRecord, by string) []usageRow {
+	rows := map[string]*usageRow{}
+	latencies := map[string][]float64{}
+	for _, r := range records {
+		var group string
+		switch by {
+		case "client":
+			group = r.Client
+		case "model":
+			group = r.Model
+		case "day":
+			group = r.TS.UTC().Format("2006-01-02")
+		default:
+			group = r.Key
+		}
+		if group == "" {
+			group = "(none)"
+		}
+		row := rows[group]
+		if row == nil {
+			row = &usageRow{Group: group}
+			rows[group] = row
+		}
+		row.Requests++
+		if r.Status >= 400 {
+			row.Errors++
+		}
+		if r.Cache == "HIT" {
+			row.CacheHits++
+		}
+		row.PromptTokens += r.PromptTokens
+		row.CompletionTokens += r.CompletionTokens
+		latencies[group] = append(latencies[group], r.LatencyMS)
+	}
+	var out []usageRow
+	for group, row := range rows {
+		row.LatencyP50 = percentile(latencies[group], 50)
+		row.LatencyP95 = percentile(latencies[group], 95)
+		out = append(out, *row)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		ti, tj := out[i].PromptTokens+out[i].CompletionTokens, out[j].PromptTokens+out[j].CompletionTokens
+		if ti != tj {
+			return ti > tj
+		}
+		return out[i].Group < out[j].Group
+	})
+	return out
+}
+
+// writeUsageReport prints the summary (or, as jsonl, the records
+// themselves) to stdout or path.
+func writeUsageReport(records []usageRecord, by, format, path string) error {
+	var b strings.Builder
+	switch format {
+	case "jsonl":
+		for _, r := range records {
+			line, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			b.Write(line)
+			b.WriteString("\n")
+		}
+	case "json":
+		out, err := json.MarshalIndent(summarizeUsage(records, by), "", "  ")
+		if err != nil {
+			return err
+		}
+		b.Write(out)
+		b.WriteString("\n")
+	default:
+		if len(records) > 0 {
+			fmt.Fprintf(&b, "Usage from %s to %s, by %s:\n\n",
+				records[0].TS.Format(time.RFC3339), records[len(records)-1].TS.Format(time.RFC3339), by)
+		}
+		fmt.Fprintf(&b, "| %s | Requests | Errors | Cache hits | Prompt tokens | Completion tokens | Latency p50/p95 (ms) |\n", strings.ToUpper(by[:1])+by[1:])
+		b.WriteString("|---|---|---|---|---|---|---|\n")
+		for _, r := range summarizeUsage(records, by) {
+			fmt.Fprintf(&b, "| %s | %d | %d | %d | %d | %d | %.0f / %.0f |\n",
+				r.Group, r.Requests, r.Errors, r.CacheHits, r.PromptTokens, r.CompletionTokens, r.LatencyP50, r.LatencyP95)
+		}
+	}
+	if path == "" {
+		_, err := os.Stdout.WriteString(b.String())
+		return err
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+	return nil
+}
+
+// -----------------------------
+// batch command
+// -----------------------------
+
+// batchOptions are the batch command's flags.
+type batchOptions struct {
+	Prompts     string // Local JSONL file or pvc://<claim>/<path>
+	Output      string // pvc://<claim>/<dir>
+	Concurrency int    // Requests in flight
+	MaxTokens   int    // Default max_tokens
+	Storage     string // Size of the output PVC if it is created
+}
+
+// batchScript sends every prompt in $PROMPTS to the model's Service,
+// $CONCURRENCY at a time, and writes one JSON line per prompt to $OUTPUT
+// in input order: the id, the reply (or error), finish_reason, usage and
+// latency. It writes $OUTPUT.partial as it goes and renames it when done.
+// Each input line is {"id": ..., "prompt": "..."} or {"id": ...,
+// "messages": [...]}, plus any other request fields (temperature, ...).
+const batchScript = `import json
+import os
+import sys
+import time
+import urllib.error
+import urllib.request
+from concurrent.futures import ThreadPoolExecutor
+
+URL = os.environ["ENDPOINT"] + "/v1/chat/completions"
+HEADERS = {"Content-Type": "application/json"}
+if os.environ.get("API_KEY"):
+    HEADERS["Authorization"] = "Bearer " + os.environ["API_KEY"]
+MAX_TOKENS = int(os.environ["MAX_TOKENS"])
+
+
+def complete(item):
+    i, line = item
+    out = {"id": line.get("id", i)}
+    body = {k: v for k, v in line.items() if k not in ("id", "prompt")}
+    if "messages" not in body:
+        body["messages"] = [{"role": "user", "content": line["prompt"]}]
+    body.setdefault("model", os.environ["MODEL"])
+    body.setdefault("max_tokens", MAX_TOKENS)
+    body["stream"] = False
+    req = urllib.request.Request(URL, json.dumps(body).encode(), HEADERS)
+    start = time.time()
+    for attempt in range(3):
+        try:
+            with urllib.request.urlopen(req, timeout=600) as resp:
+                reply = json.load(resp)
+            choice = reply["choices"][0]
+            out.update(response=choice["message"]["content"],
+                       finish_reason=choice.get("finish_reason"), usage=reply.get("usage"))
+            out.pop("error", None)
+            break
+        except urllib.error.HTTPError as e:
+            out["error"] = "HTTP %d: %s" % (e.code, e.read()[:500].decode(errors="replace"))
+            if e.code < 500 and e.code != 429:
+                break  # Retrying won't help.
+        except (OSError, ValueError, KeyError, IndexError, TypeError) as e:
+            out["error"] = "%s: %s" % (type(e).__name__, e)
+        time.sleep(2 ** attempt)
+    out["latency_ms"] = round((time.time() - start) * 1000)
+    return out
+
+
+with open(os.environ["PROMPTS"]) as f:
+    prompts = [json.loads(l) for l in f if l.strip()]
+os.makedirs(os.path.dirname(os.environ["OUTPUT"]), exist_ok=True)
+partial = os.environ["OUTPUT"] + ".partial"
+ok = failed = 0
+with open(partial, "w") as f, ThreadPoolExecutor(int(os.environ["CONCURRENCY"])) as pool:
+    for n, out in enumerate(pool.map(complete, enumerate(prompts)), 1):
+        f.write(json.dumps(out) + "\n")
+        f.flush()
+        if "error" in out:
+            failed += 1
+            print("prompt %s: %s" % (out["id"], out["error"]), flush=True)
+        else:
+            ok += 1
+        if n % 50 == 0:
+            print("%d/%d done" % (n, len(prompts)), flush=True)
+os.rename(partial, os.environ["OUTPUT"])
+print("batch: %d prompts, %d ok, %d failed -> %s" % (len(prompts), ok, failed, os.environ["OUTPUT"]), flush=True)
+sys.exit(1 if prompts and not ok else 0)
+`
+
+// parsePVCPath splits pvc://<claim>/<path> (the path may be empty).
+func parsePVCPath(s string) (claim, path string, err error) {
+	rest, ok := strings.CutPrefix(s, "pvc://")
+	if !ok {
+		return "", "", fmt.Errorf("%q isn't pvc://<claim>/<path>", s)
+	}
+	claim, path, _ = strings.Cut(rest, "/")
+	if errs := validation.IsDNS1123Subdomain(claim); len(errs) > 0 {
+		return "", "", fmt.Errorf("claim %q: %s", claim, strings.Join(errs, "; "))
+	}
+	path = strings.Trim(filepath.Clean("/"+path), "/")
+	return claim, path, nil
+}
+
+// readPrompts reads a local prompts file, checking each line is a JSON
+// object with a "prompt" string or a "messages" list, and returns it with
+// the number of prompts.
+func readPrompts(path string) ([]byte, int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	// A ConfigMap holds at most 1MiB, metadata included.
+	if len(data) > 900*1024 {
+		return nil, 0, fmt.Errorf("%s is %d bytes, too big for a ConfigMap; copy it into a PVC and pass pvc://<claim>/<path>", path, len(data))
+	}
+	n := 0
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var p struct {
+			Prompt   *string           `json:"prompt"`
+			Messages []json.RawMessage `json:"messages"`
+		}
+		if err := json.Unmarshal([]byte(line), &p); err != nil {
+			return nil, 0, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		if p.Prompt == nil && len(p.Messages) == 0 {
+			return nil, 0, fmt.Errorf("%s:%d: needs \"prompt\" or \"messages\"", path, i+1)
+		}
+		n++
+	}
+	if n == 0 {
+		return nil, 0, fmt.Errorf("%s has no prompts", path)
+	}
+	return data, n, nil
+}
 
-	dep := &appsv1.Deployment{
+// buildBatchJob runs batchScript against st's Service, reading prompts
+// from promptsVol (mounted at /prompts) and writing outFile under the
+// output PVC (mounted at /results, or /prompts when it is the same one).
+func buildBatchJob(ns, name string, st modelStack, promptsVol corev1.Volume, promptsFile, outClaim, outFile string, b batchOptions, opts serverOptions) *batchv1.Job {
+	var fsGroup int64 = 65532 // same group as the server pod, see buildDeployment
+	model, _ := chatModel(st.Model)
+	env := []corev1.EnvVar{
+		{Name: "ENDPOINT", Value: fmt.Sprintf("http://%s.%s.svc", st.ObjName, ns)},
+		{Name: "MODEL", Value: model},
+		{Name: "PROMPTS", Value: "/prompts/" + promptsFile},
+		{Name: "CONCURRENCY", Value: fmt.Sprintf("%d", b.Concurrency)},
+		{Name: "MAX_TOKENS", Value: fmt.Sprintf("%d", b.MaxTokens)},
+	}
+	if opts.APIKeySecret != "" {
+		env = append(env, corev1.EnvVar{Name: "API_KEY", ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: opts.APIKeySecret},
+				Key:                  "api-key",
+			},
+		}})
+	}
+	mounts := []corev1.VolumeMount{{Name: "prompts", MountPath: "/prompts", ReadOnly: true}}
+	volumes := []corev1.Volume{promptsVol}
+	out := "/results/" + outFile
+	if promptsVol.PersistentVolumeClaim != nil && promptsVol.PersistentVolumeClaim.ClaimName == outClaim {
+		// One PVC for both: mount it once, writable.
+		mounts[0].ReadOnly = false
+		out = "/prompts/" + outFile
+	} else {
+		mounts = append(mounts, corev1.VolumeMount{Name: "results", MountPath: "/results"})
+		volumes = append(volumes, corev1.Volume{
+			Name: "results",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: outClaim},
+			},
+		})
+	}
+	env = append(env, corev1.EnvVar{Name: "OUTPUT", Value: out})
+	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      *name,
-			Namespace: *ns,
-			Labels:    labels,
+			Name:      st.ObjName + "-batch",
+			Namespace: ns,
+			Labels:    map[string]string{"app": name, "job": "batch"},
 		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: int32p(1),
-			Selector: &metav1.LabelSelector{MatchLabels: labels},
+		Spec: batchv1.JobSpec{
+			// A retry would send every prompt again.
+			BackoffLimit: int32p(0),
 			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{Labels: labels},
+				ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"job": "batch"}},
 				Spec: corev1.PodSpec{
-					// Pod-level security context to handle volume perms under restricted SCC
-					SecurityContext: &corev1.PodSecurityContext{
-						FSGroup: &fsGroup,
-						// FSGroupChangeOnRootMismatch reduces unnecessary recursive chown on every mount
-						FSGroupChangePolicy: func() *corev1.PodFSGroupChangePolicy {
-							v := corev1.FSGroupChangeOnRootMismatch
-							return &v
-						}(),
-					},
-
-					// -------- initContainer: fetch the model into /models --------
-					InitContainers: []corev1.Container{
+					RestartPolicy:   corev1.RestartPolicyNever,
+					SecurityContext: &corev1.PodSecurityContext{FSGroup: &fsGroup},
+					Containers: []corev1.Container{
 						{
-							Name:  "fetch-model",
-							Image: "curlimages/curl:8.10.1", // small image with curl
-							Command: []string{"sh", "-lc"},
-							Args: []string{
-								// The script below:
-								// - creates /models
-								// - ensures it's writable (0775) for fsGroup/random UID
-								// - downloads model.gguf with retries if it's missing
-								// - shows a listing on success
-								`set -euo pipefail
-mkdir -p /models
-chmod 0775 /models || true
-
-if [ -s /models/model.gguf ]; then
-  echo "Model already present: $(ls -lh /models/model.gguf)"
-else
-  echo "Downloading model from ${MODEL_URL} ..."
-  # curl flags:
-  # -L: follow redirects
-  # --fail: treat HTTP 4xx/5xx as errors
-  # --show-error: print error messages on failure
-  # --retry/--retry-delay/--retry-max-time: resilience to transient failures
-  # --speed-time/--speed-limit: abort if too slow (e.g., hung connection)
-  curl -L --fail --show-error \
-       --retry 5 --retry-delay 3 --retry-max-time 180 \
-       --speed-time 30 --speed-limit 1024 \
-       -o /models/model.gguf "${MODEL_URL}"
-  echo "Download complete: $(ls -lh /models/model.gguf)"
-fi
-ls -l /models
-`,
-							},
-							Env: []corev1.EnvVar{
-								{Name: "MODEL_URL", ValueFrom: cfgKey(cmName, "MODEL_URL")},
-							},
-							VolumeMounts: []corev1.VolumeMount{
-								{Name: modelVolName, MountPath: modelMountPath},
-							},
+							Name:    "batch",
+							Image:   opts.SidecarImage,
+							Command: []string{"python3", "-c", batchScript},
+							Env:     env,
 							SecurityContext: &corev1.SecurityContext{
 								RunAsNonRoot:             boolp(true),
 								AllowPrivilegeEscalation: boolp(false),
 							},
+							VolumeMounts: mounts,
 						},
 					},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+	placePod(&job.Spec.Template.Spec, opts)
+	return job
+}
 
-					// -------- main container: llama.cpp server (OpenAI-compatible) --------
-					Containers: []corev1.Container{
-						{
-							Name:  "llama-server",
-							// Official server image. We do NOT override command/entrypoint.
-							// We'll configure it entirely via LLAMA_ARG_* environment vars below.
-							Image: "ghcr.io/ggerganov/llama.cpp:server",
+// runBatch runs the batch Job for one deployed model: the prompts come
+// from a ConfigMap (local file) or a PVC, and the results go to
+// <output dir>/<model>-<UTC time>.jsonl on the output PVC, which is
+// created when missing.
+func runBatch(ctx context.Context, cs *kubernetes.Clientset, ns, name string, st modelStack, b batchOptions, opts serverOptions) error {
+	if _, err := cs.CoreV1().Services(ns).Get(ctx, st.ObjName, metav1.GetOptions{}); err != nil {
+		return fmt.Errorf("%w (deploy the model first)", err)
+	}
+	var promptsVol corev1.Volume
+	promptsFile := "prompts.jsonl"
+	if strings.HasPrefix(b.Prompts, "pvc://") {
+		claim, path, err := parsePVCPath(b.Prompts)
+		if err != nil {
+			return fmt.Errorf("--prompts-file: %w", err)
+		}
+		promptsFile = path
+		promptsVol = corev1.Volume{Name: "prompts", VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+		}}
+	} else {
+		data, n, err := readPrompts(b.Prompts)
+		if err != nil {
+			return err
+		}
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: st.ObjName + "-batch-prompts", Namespace: ns, Labels: map[string]string{"app": name}},
+			Data:       map[string]string{promptsFile: string(data)},
+		}
+		fmt.Printf("Creating/updating ConfigMap %s (%d prompts)...\n", cm.Name, n)
+		if err := upsertConfigMap(ctx, cs, cm); err != nil {
+			return err
+		}
+		promptsVol = corev1.Volume{Name: "prompts", VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: cm.Name}},
+		}}
+	}
 
-							// Expose HTTP port 8080 (the image listens here with --api).
-							Ports: []corev1.ContainerPort{
-								{Name: "http", ContainerPort: 8080},
-							},
+	outClaim, outDir, _ := parsePVCPath(b.Output)
+	_, err := cs.CoreV1().PersistentVolumeClaims(ns).Get(ctx, outClaim, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		fmt.Printf("Creating PVC %s (%s) for the results...\n", outClaim, b.Storage)
+		pvc := buildUsagePVC(ns, opts)
+		pvc.Name = outClaim
+		pvc.Spec.Resources.Requests[corev1.ResourceStorage] = resource.MustParse(b.Storage)
+		_, err = cs.CoreV1().PersistentVolumeClaims(ns).Create(ctx, pvc, metav1.CreateOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("output PVC %s: %w", outClaim, err)
+	}
+	outFile := strings.TrimPrefix(fmt.Sprintf("%s/%s-%s.jsonl", outDir, st.Model.Name, time.Now().UTC().Format("20060102T150405Z")), "/")
 
-							// Liveness/Readiness:
-							// Not all builds expose a health path; TCP probes are the most tolerant.
-							ReadinessProbe: &corev1.Probe{
-								ProbeHandler: corev1.ProbeHandler{
-									TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8080)},
-								},
-								InitialDelaySeconds: 5,
-								PeriodSeconds:       5,
-							},
-							LivenessProbe: &corev1.Probe{
-								ProbeHandler: corev1.ProbeHandler{
-									TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(8080)},
-								},
-								InitialDelaySeconds: 15,
-								PeriodSeconds:       10,
-							},
+	job := buildBatchJob(ns, name, st, promptsVol, promptsFile, outClaim, outFile, b, opts)
+	fmt.Printf("Running %s against %s (%d at a time; follow it with: oc logs -f job/%s -n %s)...\n",
+		b.Prompts, st.ObjName, b.Concurrency, job.Name, ns)
+	log, err := jobLog(ctx, cs, job, "batch")
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.TrimSpace(string(log)), "\n")
+	fmt.Println(lines[len(lines)-1])
+	fmt.Printf("Results: pvc://%s/%s\n", outClaim, outFile)
+	return nil
+}
 
-							SecurityContext: &corev1.SecurityContext{
-								RunAsNonRoot:             boolp(true),
-								AllowPrivilegeEscalation: boolp(false),
-							},
+// -----------------------------
+// Client bundle (--bundle-file, --bundle-namespace)
+// -----------------------------
 
-							// Mount the /models PVC so the server can read model.gguf
-							VolumeMounts: []corev1.VolumeMount{
-								{Name: modelVolName, MountPath: modelMountPath},
-							},
+// clientBundle is what a client needs to call one model.
+type clientBundle struct {
+	BaseURL      string `json:"base_url"`
+	Model        string `json:"model"`
+	APIKey       string `json:"api_key,omitempty"`
+	APIKeySecret string `json:"api_key_secret,omitempty"` // <namespace>/<name>, key "api-key"
+	CACert       string `json:"ca_cert,omitempty"`        // PEM; only with --tls
+	CABundle     string `json:"-"`                        // The system roots plus CACert, for SSL_CERT_FILE
+}
 
-							// ENV VARS: the server image reads LLAMA_ARG_* to form its arguments.
-							// This avoids hardcoding a binary path and keeps compatibility.
-							Env: []corev1.EnvVar{
-								// Model path:
-								{Name: "LLAMA_ARG_MODEL", Value: "/models/model.gguf"},
-								// Context length (tokens):
-								{Name: "LLAMA_ARG_CTX_SIZE", ValueFrom: cfgKey(cmName, "CTX_LEN")},
-								// Threads:
-								{Name: "LLAMA_ARG_THREADS", ValueFrom: cfgKey(cmName, "N_THREADS")},
-								// Bind host/port:
-								{Name: "LLAMA_ARG_HOST", Value: "0.0.0.0"},
-								{Name: "LLAMA_ARG_PORT", Value: "8080"},
-								// Enable OpenAI-compatible API:
-								{Name: "LLAMA_ARG_API", Value: "1"},
+// buildClientBundle describes st's endpoint (key is "" with --no-auth).
+func buildClientBundle(ns string, st modelStack, opts serverOptions, key, ca string) clientBundle {
+	model, _ := chatModel(st.Model)
+	b := clientBundle{BaseURL: st.Scheme + "://" + st.Host + "/v1", Model: model, APIKey: key, CACert: ca}
+	if opts.APIKeySecret != "" {
+		b.APIKeySecret = ns + "/" + opts.APIKeySecret
+	}
+	return b
+}
 
-								// Optional metadata your clients can use:
-								{Name: "MODEL_NAME", ValueFrom: cfgKey(cmName, "MODEL_NAME")},
-								{Name: "SYSTEM_PROMPT", ValueFrom: cfgKey(cmName, "SYSTEM_PROMPT")},
-							},
-						},
-					},
+// routerCA finds the CA that signed the Route's certificate: ca.crt of
+// --tls-secret, else the ingress operator's CA for the default
+// certificate (which needs read access to openshift-config-managed).
+func routerCA(ctx context.Context, cs *kubernetes.Clientset, ns, tlsSecret string) (string, error) {
+	if tlsSecret != "" {
+		sec, err := cs.CoreV1().Secrets(ns).Get(ctx, tlsSecret, metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		if ca := string(sec.Data["ca.crt"]); ca != "" {
+			return ca, nil
+		}
+		return "", fmt.Errorf("Secret %s has no ca.crt", tlsSecret)
+	}
+	cm, err := cs.CoreV1().ConfigMaps("openshift-config-managed").Get(ctx, "default-ingress-cert", metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	return cm.Data["ca-bundle.crt"], nil
+}
 
-					// Volumes section: attach the PVC as "model-store" -> /models
-					Volumes: []corev1.Volume{
-						{
-							Name: modelVolName,
-							VolumeSource: corev1.VolumeSource{
-								PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-									ClaimName: pvcName,
-								},
-							},
-						},
-					},
-				},
-			},
-		},
+// systemCABundles are where Linux distributions and macOS keep the system
+// roots as one PEM file.
+var systemCABundles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // Fedora, RHEL
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Older RHEL
+	"/etc/ssl/ca-bundle.pem",                            // openSUSE
+	"/etc/ssl/cert.pem",                                 // macOS, Alpine
+}
+
+// withSystemRoots appends ca to this machine's CA bundle ($SSL_CERT_FILE,
+// else the system one). SSL_CERT_FILE replaces the roots a client trusts
+// rather than adding to them, so pointing it at the router's CA alone
+// would break every other HTTPS call the client makes.
+func withSystemRoots(ca string) (string, error) {
+	files := systemCABundles
+	if f := os.Getenv("SSL_CERT_FILE"); f != "" {
+		files = append([]string{f}, files...)
 	}
-	fmt.Println("Creating/updating Deployment (with initContainer and FSGroup)...")
-	must(upsertDeployment(ctx, cs, dep), "upsert deployment")
+	for _, f := range files {
+		if roots, err := os.ReadFile(f); err == nil {
+			return strings.TrimRight(string(roots), "\n") + "\n" + ca, nil
+		}
+	}
+	return "", fmt.Errorf("no system CA bundle found (tried %s)", strings.Join(files, ", "))
+}
 
-	// -------------------------
-	// Service (ClusterIP)
-	// -------------------------
-	// Internal stable address for other pods (and a target for Ingress).
-	svc := &corev1.Service{
+// writeClientBundle writes b to path as OPENAI_* variables (the names the
+// OpenAI SDKs read) or JSON. A dotenv file can't hold the PEM, so the CA
+// bundle goes next to it as <path>.ca.crt, named by SSL_CERT_FILE. With keyRef
+// the key stays in its Secret and only the Secret's name is written.
+func writeClientBundle(path, format string, b clientBundle, keyRef bool) error {
+	if keyRef {
+		b.APIKey = ""
+	} else {
+		b.APIKeySecret = ""
+	}
+	var data []byte
+	if format == "json" {
+		out, err := json.MarshalIndent(b, "", "  ")
+		if err != nil {
+			return err
+		}
+		data = append(out, '\n')
+	} else {
+		var sb strings.Builder
+		fmt.Fprintf(&sb, "OPENAI_BASE_URL=%s\nOPENAI_MODEL=%s\n", b.BaseURL, b.Model)
+		if b.APIKey != "" {
+			fmt.Fprintf(&sb, "OPENAI_API_KEY=%s\n", b.APIKey)
+		}
+		if b.APIKeySecret != "" {
+			secNS, secName, _ := strings.Cut(b.APIKeySecret, "/")
+			fmt.Fprintf(&sb, "# OPENAI_API_KEY=$(oc get secret %s -n %s -o jsonpath='{.data.api-key}' | base64 -d)\n", secName, secNS)
+			fmt.Fprintf(&sb, "OPENAI_API_KEY_SECRET=%s\n", b.APIKeySecret)
+		}
+		if b.CABundle != "" {
+			caPath := path + ".ca.crt"
+			if err := os.WriteFile(caPath, []byte(b.CABundle), 0o644); err != nil {
+				return err
+			}
+			abs, err := filepath.Abs(caPath)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(&sb, "SSL_CERT_FILE=%s\n", abs)
+		}
+		data = []byte(sb.String())
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// clientBundleSecret holds b in the consumer's namespace, one variable per
+// key (for "oc set env --from=secret/...") plus the CA as ca.crt, for
+// clients that add a CA, and as ca-bundle.crt with the system roots, to
+// mount and point SSL_CERT_FILE at.
+func clientBundleSecret(ns string, st modelStack, b clientBundle) *corev1.Secret {
+	data := map[string]string{"OPENAI_BASE_URL": b.BaseURL, "OPENAI_MODEL": b.Model}
+	if b.APIKey != "" {
+		data["OPENAI_API_KEY"] = b.APIKey
+	}
+	if b.CACert != "" {
+		data["ca.crt"] = b.CACert
+	}
+	if b.CABundle != "" {
+		data["ca-bundle.crt"] = b.CABundle
+	}
+	return &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      *name,
-			Namespace: *ns,
-			Labels:    labels,
+			Name:        st.ObjName + "-client",
+			Namespace:   ns,
+			Labels:      map[string]string{"app": st.ObjName},
+			Annotations: map[string]string{"llama-chat/endpoint": b.BaseURL},
 		},
-		Spec: corev1.ServiceSpec{
-			Selector: labels,
-			Ports: []corev1.ServicePort{
-				{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080)},
-			},
-			Type: corev1.ServiceTypeClusterIP,
+		Type:       corev1.SecretTypeOpaque,
+		StringData: data,
+	}
+}
+
+// -----------------------------
+// Helper functions (Kubernetes)
+// -----------------------------
+
+// promptCacheDir is where --prompt-cache keeps the slot files, on the
+// models volume.
+const promptCacheDir = "/models/prompt-cache"
+
+// promptCacheSlots is how many slots the preStop hook saves (the sidecar
+// asks the server): --parallel, else one.
+func promptCacheSlots(opts serverOptions) int {
+	if opts.Parallel > 0 {
+		return opts.Parallel
+	}
+	return 1
+}
+
+// addPromptCache points the server's --slot-save-path at promptCacheDir,
+// has it save its slots before stopping (given time to), and adds the
+// sidecar running promptCacheScript.
+func addPromptCache(spec *corev1.PodSpec, st modelStack, opts serverOptions) {
+	maxBytes := resource.MustParse(opts.PromptCacheSize)
+	server := &spec.Containers[0]
+	server.Args = append(server.Args, "--slot-save-path", promptCacheDir)
+	server.Env = append(server.Env, corev1.EnvVar{Name: "PROMPT_CACHE_SLOTS", Value: strconv.Itoa(promptCacheSlots(opts))})
+	server.Lifecycle = &corev1.Lifecycle{
+		PreStop: &corev1.LifecycleHandler{
+			Exec: &corev1.ExecAction{Command: []string{"sh", "-c", `mkdir -p ` + promptCacheDir + `
+failed=0
+for i in $(seq 0 $((PROMPT_CACHE_SLOTS - 1))); do
+  f="$MODEL_FILE.slot$i.bin"
+  code=$(curl -s -o /dev/null -w '%{http_code}' --max-time 50 -X POST -H "Authorization: Bearer ${` + llamaAPIKeyEnv + `:-}" -H "Content-Type: application/json" \
+    -d "{\"filename\":\"$f.$HOSTNAME.tmp\"}" "http://127.0.0.1:8080/slots/$i?action=save")
+  if [ "$code" = 200 ]; then
+    mv "` + promptCacheDir + `/$f.$HOSTNAME.tmp" "` + promptCacheDir + `/$f"
+  else
+    echo "saving slot $i failed: HTTP $code" >&2
+    rm -f "` + promptCacheDir + `/$f.$HOSTNAME.tmp"
+    failed=1
+  fi
+done
+exit $failed`}},
 		},
 	}
-	fmt.Println("Creating/updating Service...")
-	must(upsertService(ctx, cs, svc), "upsert service")
+	spec.TerminationGracePeriodSeconds = int64p(120)
 
-	// -------------------------
-	// Ingress (OpenShift router)
-	// -------------------------
-	// On CRC, OpenShift's router will expose this Ingress externally.
-	pathType := netv1.PathTypePrefix
-	ing := &netv1.Ingress{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      *name,
-			Namespace: *ns,
-			Labels:    labels,
-			Annotations: map[string]string{
-				// Generous timeout to accommodate model startup/first token times.
-				"haproxy.router.openshift.io/timeout": "180s",
+	env := []corev1.EnvVar{
+		{Name: "CACHE_DIR", Value: promptCacheDir},
+		{Name: "MODEL_FILE", ValueFrom: cfgKey(st.ObjName+"-config", "MODEL_FILE")},
+		{Name: "SLOTS", Value: strconv.Itoa(promptCacheSlots(opts))},
+		{Name: "INTERVAL_SECONDS", Value: strconv.Itoa(int(opts.PromptCacheSave.Seconds()))},
+		{Name: "MAX_BYTES", Value: strconv.FormatInt(maxBytes.Value(), 10)},
+	}
+	for _, e := range server.Env {
+		if e.Name == llamaAPIKeyEnv {
+			env = append(env, corev1.EnvVar{Name: "API_KEY", ValueFrom: e.ValueFrom})
+		}
+	}
+	spec.Containers = append(spec.Containers, corev1.Container{
+		Name:    "prompt-cache",
+		Image:   opts.SidecarImage,
+		Command: []string{"python3", "-u", "/etc/prompt-cache/prompt-cache.py"},
+		Env:     env,
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("10m"),
+				corev1.ResourceMemory: resource.MustParse("32Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("128Mi"),
 			},
 		},
-		Spec: netv1.IngressSpec{
-			Rules: []netv1.IngressRule{
-				{
-					Host: *host,
-					IngressRuleValue: netv1.IngressRuleValue{
-						HTTP: &netv1.HTTPIngressRuleValue{
-							Paths: []netv1.HTTPIngressPath{
-								{
-									Path:     "/",
-									PathType: &pathType,
-									Backend: netv1.IngressBackend{
-										Service: &netv1.IngressServiceBackend{
-											Name: *name,
-											Port: netv1.ServiceBackendPort{Name: "http"},
-										},
-									},
-								},
-							},
-						},
-					},
-				},
+		SecurityContext: &corev1.SecurityContext{
+			RunAsNonRoot:             boolp(true),
+			AllowPrivilegeEscalation: boolp(false),
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "prompt-cache", MountPath: "/etc/prompt-cache", ReadOnly: true},
+			{Name: "model-store", MountPath: "/models"},
+		},
+	})
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: "prompt-cache",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: st.ObjName + "-config"},
+				Items:                []corev1.KeyToPath{{Key: "prompt-cache.py", Path: "prompt-cache.py"}},
 			},
-			// For TLS you could add IngressTLS; HTTP is fine for local CRC tests.
 		},
-	}
-	fmt.Println("Creating/updating Ingress...")
-	must(upsertIngress(ctx, cs, ing), "upsert ingress")
+	})
+}
+
+// promptCacheScript is the --prompt-cache sidecar (Python standard
+// library only, like proxySidecarScript).
+const promptCacheScript = `# Keeps llama.cpp's slots (the KV cache of the prompts they processed) in
+# CACHE_DIR across restarts: once the server is up it restores every slot
+# saved for this model (MODEL_FILE), then saves them every
+# INTERVAL_SECONDS; the server's preStop hook saves them a last time.
+# Files are written under a temporary name and renamed, so replicas
+# sharing the volume never read a half-written one. Beyond MAX_BYTES the
+# oldest files (other models' first, being oldest) are removed.
+import glob
+import json
+import os
+import time
+import urllib.request
+
+DIR = os.environ["CACHE_DIR"]
+MODEL = os.environ["MODEL_FILE"]
+INTERVAL = int(os.environ["INTERVAL_SECONDS"])
+MAX_BYTES = int(os.environ["MAX_BYTES"])
+POD = os.environ.get("HOSTNAME", "pod")
+HEADERS = {"Content-Type": "application/json"}
+if os.environ.get("API_KEY"):
+    HEADERS["Authorization"] = "Bearer " + os.environ["API_KEY"]
+
+
+def call(path, body=None):
+    data = json.dumps(body).encode() if body is not None else None
+    req = urllib.request.Request("http://127.0.0.1:8080" + path, data, HEADERS)
+    with urllib.request.urlopen(req, timeout=300) as resp:
+        return json.load(resp)
+
+
+def slot_count():
+    try:
+        return len(call("/slots"))
+    except (OSError, ValueError, TypeError):
+        return int(os.environ["SLOTS"])  # /slots turned off
+
+
+def name(i):
+    return "%s.slot%d.bin" % (MODEL, i)
+
+
+def restore(slots):
+    for i in range(slots):
+        if not os.path.exists(os.path.join(DIR, name(i))):
+            continue
+        try:
+            call("/slots/%d?action=restore" % i, {"filename": name(i)})
+            print("restored slot %d from %s" % (i, name(i)))
+        except (OSError, ValueError) as e:
+            # E.g. saved by another server build; the next save replaces it.
+            print("restore slot %d: %s" % (i, e))
+
+
+def save(slots):
+    for i in range(slots):
+        tmp = "%s.%s.tmp" % (name(i), POD)
+        try:
+            call("/slots/%d?action=save" % i, {"filename": tmp})
+            os.replace(os.path.join(DIR, tmp), os.path.join(DIR, name(i)))
+        except (OSError, ValueError) as e:
+            print("save slot %d: %s" % (i, e))
+    prune()
+
+
+def prune():
+    now = time.time()
+    files = []
+    for f in glob.glob(os.path.join(DIR, "*")):
+        try:
+            st = os.stat(f)
+        except OSError:
+            continue  # Renamed or removed by another replica.
+        if f.endswith(".tmp") and now - st.st_mtime > 3600:
+            os.remove(f)  # Left by a pod that died mid-save.
+            continue
+        files.append((st.st_mtime, st.st_size, f))
+    total = sum(size for _, size, _ in files)
+    for _, size, f in sorted(files):
+        if total <= MAX_BYTES:
+            break
+        print("prompt cache over %d bytes; removing %s" % (MAX_BYTES, os.path.basename(f)))
+        os.remove(f)
+        total -= size
+
+
+os.makedirs(DIR, exist_ok=True)
+while True:
+    try:
+        if call("/health").get("status") == "ok":
+            break
+    except (OSError, ValueError):
+        pass
+    time.sleep(5)
+slots = slot_count()
+restore(slots)
+while True:
+    time.sleep(INTERVAL)
+    save(slots)
+`
+
+// proxySidecarScript is the sidecar for --cache-ttl, --usage-log and
+// --rate-limit-mode=sidecar (Python standard library only, so any Python 3
+// image will do).
+const proxySidecarScript = `# Proxy in front of the model server (same pod, UPSTREAM_PORT).
+#
+# With CACHE_TTL_SECONDS > 0, non-streamed POSTs to the completion and
+# embedding endpoints are cached by a hash of path, Authorization header and
+# body (so a cached answer is only served to a caller who could have asked
+# for it), oldest entries evicted beyond CACHE_MAX_ENTRIES. Only 200s are
+# cached; X-Cache says HIT or MISS.
+#
+# With RATE_LIMIT_RPS > 0, each client may POST that many requests per
+# second (bursts of up to one second's worth); more get a 429 with
+# Retry-After. The client is the last X-Forwarded-For address, which the
+# router sets (earlier ones come from the client and can be forged).
+#
+# With USAGE_DIR set, every completion and embedding request appends a
+# JSON line to USAGE_DIR/usage-<yyyymmdd>-<pod>.jsonl: time, client, a
+# hash of the API key, status, cache result, prompt and completion tokens
+# (the server's "usage", or llama.cpp's own counts) and latency.
+#
+# Everything else, streams included, is relayed as it arrives. The
+# server's /metrics gains llamachat_cache_* and llamachat_ratelimit_*
+# counters.
+import hashlib
+import http.client
+import json
+import math
+import os
+import socket
+import sys
+import threading
+import time
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+
+UPSTREAM_PORT = int(os.environ.get("UPSTREAM_PORT", "8080"))
+TTL = float(os.environ.get("CACHE_TTL_SECONDS", "300"))
+MAX_ENTRIES = int(os.environ.get("CACHE_MAX_ENTRIES", "1000"))
+RATE = float(os.environ.get("RATE_LIMIT_RPS", "0"))
+BURST = max(1.0, RATE)
+USAGE_DIR = os.environ.get("USAGE_DIR", "")
+MODEL_NAME = os.environ.get("MODEL_NAME", "")
+ACCOUNTED = CACHEABLE = {"/v1/chat/completions", "/v1/completions", "/v1/embeddings",
+             "/completion", "/embedding"}
+HOP_BY_HOP = {"connection", "keep-alive", "proxy-connection", "te", "trailer",
+              "transfer-encoding", "upgrade", "content-length"}
+
+lock = threading.Lock()
+cache = {}  # key -> (expires, status, headers, body), oldest first
+counts = {"hit": 0, "miss": 0, "bypass": 0}
+buckets = {}  # client -> (tokens, last refill)
+rejected = [0]
+
+
+def lookup(key):
+    with lock:
+        entry = cache.get(key)
+        if entry and entry[0] < time.time():
+            del cache[key]
+            entry = None
+        counts["hit" if entry else "miss"] += 1
+        return entry
+
+
+def store(key, entry):
+    with lock:
+        cache.pop(key, None)
+        cache[key] = entry
+        while len(cache) > MAX_ENTRIES:
+            del cache[next(iter(cache))]
+
+
+def wait_time(client):
+    """Takes a token from client's bucket; returns 0, or the seconds until
+    one is available (the request is rejected)."""
+    now = time.monotonic()
+    with lock:
+        if len(buckets) > 10000:
+            # Idle buckets are full again; forget them.
+            for c in [c for c, (_, last) in buckets.items() if now - last > BURST / RATE]:
+                del buckets[c]
+        tokens, last = buckets.get(client, (BURST, now))
+        tokens = min(BURST, tokens + (now - last) * RATE)
+        if tokens < 1:
+            buckets[client] = (tokens, now)
+            rejected[0] += 1
+            return (1 - tokens) / RATE
+        buckets[client] = (tokens - 1, now)
+        return 0
+
+
+def metrics():
+    with lock:
+        lines = [
+            "# HELP llamachat_cache_requests_total Requests seen by the response cache, by result.",
+            "# TYPE llamachat_cache_requests_total counter",
+        ] + ['llamachat_cache_requests_total{result="%s"} %d' % kv for kv in sorted(counts.items())] + [
+            "# HELP llamachat_cache_entries Responses currently cached.",
+            "# TYPE llamachat_cache_entries gauge",
+            "llamachat_cache_entries %d" % len(cache),
+            "# HELP llamachat_ratelimit_rejected_total Requests rejected with 429 by the rate limit.",
+            "# TYPE llamachat_ratelimit_rejected_total counter",
+            "llamachat_ratelimit_rejected_total %d" % rejected[0],
+        ]
+    return ("\n".join(lines) + "\n").encode()
+
+
+def token_counts(data, stream):
+    """(prompt, completion) tokens from a response body, or from the last
+    event of a stream that carries them."""
+    docs = []
+    if stream:
+        for line in reversed(data.split(b"\n")):
+            if line.startswith(b"data:") and (b'"usage"' in line or b'"tokens_predicted"' in line):
+                try:
+                    docs.append(json.loads(line[5:]))
+                except ValueError:
+                    pass
+    else:
+        try:
+            docs.append(json.loads(data))
+        except ValueError:
+            pass
+    for d in docs:
+        if not isinstance(d, dict):
+            continue
+        u = d.get("usage")
+        if isinstance(u, dict) and "prompt_tokens" in u:
+            return u.get("prompt_tokens") or 0, u.get("completion_tokens") or 0
+        if "tokens_predicted" in d:
+            return d.get("tokens_evaluated") or 0, d.get("tokens_predicted") or 0
+    return 0, 0
+
+
+class Usage:
+    """One accounted request; record() appends its line."""
+
+    def __init__(self, path, client, auth, body):
+        self.start = time.monotonic()
+        self.path, self.client = path, client
+        self.key = hashlib.sha256(auth.encode()).hexdigest()[:12] if auth else ""
+        try:
+            self.stream = bool(json.loads(body).get("stream"))
+        except (ValueError, AttributeError):
+            self.stream = False
+        self.seen = []
+
+    def add(self, chunk):
+        # Streams only need their last events; other bodies are kept whole.
+        self.seen.append(chunk)
+        if self.stream and len(self.seen) > 64:
+            del self.seen[:-64]
+
+    def record(self, status, data, cache_result):
+        prompt, completion = token_counts(data, self.stream) if status == 200 else (0, 0)
+        line = json.dumps({
+            "ts": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+            "model": MODEL_NAME, "path": self.path, "client": self.client,
+            "key": self.key, "stream": self.stream, "status": status,
+            "cache": cache_result or "", "prompt_tokens": prompt,
+            "completion_tokens": completion,
+            "latency_ms": round((time.monotonic() - self.start) * 1000),
+        })
+        name = "usage-%s-%s.jsonl" % (time.strftime("%Y%m%d", time.gmtime()), socket.gethostname())
+        try:
+            with lock, open(os.path.join(USAGE_DIR, name), "a") as f:
+                f.write(line + "\n")
+        except OSError as e:
+            print("usage log: %s" % e, file=sys.stderr, flush=True)
+
+
+def cache_key(path, auth, body):
+    # Streamed replies arrive piece by piece and aren't cached.
+    try:
+        if json.loads(body).get("stream"):
+            return None
+    except (ValueError, AttributeError):
+        return None
+    return hashlib.sha256(b"\0".join([path.encode(), auth.encode(), body])).hexdigest()
+
+` + relayScript + `
+
+class Proxy(BaseHTTPRequestHandler):
+    protocol_version = "HTTP/1.1"
 
-	// -------------------------
-	// Wait for readiness
-	// -------------------------
-	fmt.Println("Waiting for Deployment to have at least 1 ready replica (first run may take time for download)...")
-	must(waitForDeploymentReady(ctx, cs, *ns, *name), "deployment not ready in time")
+    def reply(self, status, headers, body, result):
+        self.send_response(status)
+        for k, v in headers:
+            self.send_header(k, v)
+        if result:
+            self.send_header("X-Cache", result)
+        self.send_header("Content-Length", str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
 
-	fmt.Println("Waiting for Service to have endpoints (pod IPs behind the Service)...")
-	must(waitForEndpoints(ctx, cs, *ns, *name), "service has no endpoints")
+    def do_GET(self):
+        self.proxy(b"")
 
-	// -------------------------
-	// Verify via OpenAI-style /v1/chat/completions
-	// -------------------------
-	url := "http://" + *host + "/v1/chat/completions"
-	fmt.Printf("Probing: %s\n", url)
+    def do_POST(self):
+        self.proxy(self.rfile.read(int(self.headers.get("Content-Length") or 0)))
 
-	reqBody := chatReq{
-		Model:  *modelName,
-		Stream: false,
-		Messages: []chatMessage{
-			{Role: "system", Content: *systemPrompt},
-			{Role: "user", Content: "Say hello in one short sentence."},
+    def proxy(self, body):
+        path = self.path.split("?")[0]
+        forwarded = self.headers.get("X-Forwarded-For", "").split(",")[-1].strip()
+        client = forwarded or self.client_address[0]
+        if RATE > 0 and self.command == "POST":
+            wait = wait_time(client)
+            if wait:
+                body = json.dumps({"error": {"message": "rate limit exceeded, retry later",
+                                             "type": "rate_limit_exceeded"}}).encode()
+                return self.reply(429, [("Content-Type", "application/json"),
+                                        ("Retry-After", str(math.ceil(wait)))], body, None)
+        usage = None
+        if USAGE_DIR and self.command == "POST" and path in ACCOUNTED:
+            usage = Usage(path, client, self.headers.get("Authorization", ""), body)
+        key = None
+        if TTL > 0 and self.command == "POST" and path in CACHEABLE:
+            key = cache_key(self.path, self.headers.get("Authorization", ""), body)
+        if key:
+            entry = lookup(key)
+            if entry:
+                if usage:
+                    usage.record(entry[1], entry[3], "HIT")
+                return self.reply(entry[1], entry[2], entry[3], "HIT")
+        else:
+            with lock:
+                counts["bypass"] += 1
+
+        headers = {k: v for k, v in self.headers.items() if k.lower() not in HOP_BY_HOP}
+        headers["Content-Length"] = str(len(body))
+        try:
+            conn = http.client.HTTPConnection("127.0.0.1", UPSTREAM_PORT, timeout=600)
+            conn.request(self.command, self.path, body, headers)
+            resp = conn.getresponse()
+        except OSError as e:
+            return self.reply(502, [("Content-Type", "text/plain")], ("server unreachable: %s\n" % e).encode(), None)
+        try:
+            out = [(k, v) for k, v in resp.getheaders() if k.lower() not in HOP_BY_HOP]
+            if key or path == "/metrics":
+                data = resp.read()
+                if key and resp.status == 200:
+                    store(key, (time.time() + TTL, resp.status, out, data))
+                if path == "/metrics" and resp.status == 200:
+                    data += metrics()
+                if usage:
+                    usage.record(resp.status, data, "MISS" if key else None)
+                return self.reply(resp.status, out, data, "MISS" if key else None)
+
+            relay(self, resp, out, usage.add if usage else None)
+            if usage:
+                usage.record(resp.status, b"".join(usage.seen), None)
+        finally:
+            conn.close()
+
+    def log_message(self, fmt, *args):
+        pass  # The server logs every request already.
+
+
+if __name__ == "__main__":
+    if TTL > 0:
+        print("Caching responses for %gs (up to %d)" % (TTL, MAX_ENTRIES), flush=True)
+    if RATE > 0:
+        print("Limiting each client to %g requests/s" % RATE, flush=True)
+    if USAGE_DIR:
+        print("Recording usage in %s" % USAGE_DIR, flush=True)
+    ThreadingHTTPServer(("0.0.0.0", int(os.environ.get("PORT", "8090"))), Proxy).serve_forever()
+`
+
+// proxyPort is where the proxy sidecar listens; the server stays on 8080.
+const proxyPort = 8090
+
+// proxySidecar says whether the pods get the proxy sidecar.
+func (opts serverOptions) proxySidecar() bool {
+	return opts.CacheTTL > 0 || opts.UsagePVC != "" || (opts.RateLimit > 0 && opts.RateLimitMode == "sidecar")
+}
+
+// addProxySidecar puts proxySidecarScript in front of the server container,
+// running from the model's ConfigMap.
+func addProxySidecar(spec *corev1.PodSpec, st modelStack, opts serverOptions) {
+	rate := 0.0
+	if opts.RateLimitMode == "sidecar" {
+		rate = opts.RateLimit
+	}
+	spec.Containers = append(spec.Containers, corev1.Container{
+		Name:    "proxy",
+		Image:   opts.SidecarImage,
+		Command: []string{"python3", "-u", "/etc/proxy/proxy.py"},
+		Ports:   []corev1.ContainerPort{{Name: "proxy", ContainerPort: proxyPort}},
+		Env: []corev1.EnvVar{
+			{Name: "PORT", Value: strconv.Itoa(proxyPort)},
+			{Name: "UPSTREAM_PORT", Value: "8080"},
+			{Name: "CACHE_TTL_SECONDS", Value: strconv.Itoa(int(opts.CacheTTL.Seconds()))},
+			{Name: "CACHE_MAX_ENTRIES", Value: strconv.Itoa(opts.CacheMaxEntries)},
+			{Name: "RATE_LIMIT_RPS", Value: strconv.FormatFloat(rate, 'g', -1, 64)},
+			{Name: "MODEL_NAME", Value: st.Model.Name},
+		},
+		ReadinessProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				TCPSocket: &corev1.TCPSocketAction{Port: intstr.FromInt(proxyPort)},
+			},
+			PeriodSeconds: 5,
+		},
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{
+				corev1.ResourceCPU:    resource.MustParse("50m"),
+				corev1.ResourceMemory: resource.MustParse("64Mi"),
+			},
+			Limits: corev1.ResourceList{
+				corev1.ResourceMemory: resource.MustParse("512Mi"),
+			},
 		},
+		SecurityContext: &corev1.SecurityContext{
+			RunAsNonRoot:             boolp(true),
+			AllowPrivilegeEscalation: boolp(false),
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{Name: "proxy", MountPath: "/etc/proxy", ReadOnly: true},
+		},
+	})
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: "proxy",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: st.ObjName + "-config"},
+				Items:                []corev1.KeyToPath{{Key: "proxy.py", Path: "proxy.py"}},
+			},
+		},
+	})
+	if opts.UsagePVC != "" {
+		c := &spec.Containers[len(spec.Containers)-1]
+		c.Env = append(c.Env, corev1.EnvVar{Name: "USAGE_DIR", Value: "/var/usage"})
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: "usage", MountPath: "/var/usage"})
+		spec.Volumes = append(spec.Volumes, corev1.Volume{
+			Name: "usage",
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: opts.UsagePVC},
+			},
+		})
 	}
-	bts, _ := json.Marshal(reqBody)
+}
 
-	// http.Client with a reasonable timeout. For local CRC with self-signed certs,
-	// you might set InsecureSkipVerify if switching to HTTPS.
-	httpClient := &http.Client{Timeout: 120 * time.Second}
-	if *insecureTLS {
-		httpClient.Transport = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // acceptable for local dev only
+// parseNodeSelector parses --node-selector: "key=value,key=value".
+func parseNodeSelector(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+	sel := map[string]string{}
+	for _, kv := range strings.Split(s, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(kv), "=")
+		if !ok {
+			return nil, fmt.Errorf("%q isn't key=value", kv)
+		}
+		if errs := validation.IsQualifiedName(k); len(errs) > 0 {
+			return nil, fmt.Errorf("label %q: %s", k, strings.Join(errs, "; "))
 		}
+		if errs := validation.IsValidLabelValue(v); len(errs) > 0 {
+			return nil, fmt.Errorf("label %s value %q: %s", k, v, strings.Join(errs, "; "))
+		}
+		sel[k] = v
 	}
+	return sel, nil
+}
 
-	req, _ := http.NewRequest("POST", url, strings.NewReader(string(bts)))
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := httpClient.Do(req)
-	must(err, "verification HTTP error")
-	defer resp.Body.Close()
-	body, _ := io.ReadAll(resp.Body)
-
-	if resp.StatusCode/100 != 2 {
-		// Print the body for debugging if not 2xx.
-		fatal("non-2xx from chat endpoint: %d\n%s", resp.StatusCode, string(body))
+// parseTolerations parses --tolerations, each entry like the taint it
+// tolerates in "oc adm taint": key[=value][:effect]. Without a value any
+// value matches; without an effect, any effect.
+func parseTolerations(s string) ([]corev1.Toleration, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var tols []corev1.Toleration
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		rest, effect, _ := strings.Cut(entry, ":")
+		key, value, hasValue := strings.Cut(rest, "=")
+		t := corev1.Toleration{Key: key, Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffect(effect)}
+		if hasValue {
+			t.Operator, t.Value = corev1.TolerationOpEqual, value
+		}
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return nil, fmt.Errorf("%q: key: %s", entry, strings.Join(errs, "; "))
+		}
+		switch t.Effect {
+		case "", corev1.TaintEffectNoSchedule, corev1.TaintEffectPreferNoSchedule, corev1.TaintEffectNoExecute:
+		default:
+			return nil, fmt.Errorf("%q: effect must be NoSchedule, PreferNoSchedule or NoExecute", entry)
+		}
+		tols = append(tols, t)
 	}
+	return tols, nil
+}
 
-	// Parse minimal response to confirm the model answered.
-	var parsed chatResp
-	if err := json.Unmarshal(body, &parsed); err != nil {
-		fmt.Println("Raw response:", string(body))
-		fatal("could not parse response JSON: %v", err)
+// placePod adds --node-selector and --tolerations to a pod spec, skipping
+// tolerations it already has (addGPUs adds the usual GPU one).
+func placePod(spec *corev1.PodSpec, opts serverOptions) {
+	for k, v := range opts.NodeSelector {
+		if spec.NodeSelector == nil {
+			spec.NodeSelector = map[string]string{}
+		}
+		spec.NodeSelector[k] = v
 	}
-	if len(parsed.Choices) == 0 {
-		fmt.Println("Raw response:", string(body))
-		fatal("no choices in response")
+	for _, t := range opts.Tolerations {
+		have := false
+		for i := range spec.Tolerations {
+			have = have || spec.Tolerations[i].MatchToleration(&t)
+		}
+		if !have {
+			spec.Tolerations = append(spec.Tolerations, t)
+		}
 	}
+}
 
-	fmt.Printf("✅ Chat OK. Assistant replied: %q\n", parsed.Choices[0].Message.Content)
-	fmt.Println("Done.")
+// enableGPU turns the CPU server pod spec into a GPU one:
+// - the ":server-cuda" image variant (same entrypoint and LLAMA_ARG_* env)
+// - an nvidia.com/gpu limit (extended resources only need limits)
+// - LLAMA_ARG_N_GPU_LAYERS so the model's layers actually run on the GPU
+// - the NVIDIA runtime class and a toleration for the usual GPU node taint
+func enableGPU(spec *corev1.PodSpec, gpus, layers int, runtimeClass string) {
+	server := &spec.Containers[0]
+	server.Image = "ghcr.io/ggerganov/llama.cpp:server-cuda"
+	server.Env = append(server.Env, corev1.EnvVar{Name: "LLAMA_ARG_N_GPU_LAYERS", Value: fmt.Sprintf("%d", layers)})
+	addGPUs(spec, gpus, runtimeClass)
 }
 
-// -----------------------------
-// Helper functions (Kubernetes)
-// -----------------------------
+// addGPUs requests gpus NVIDIA GPUs for the first container, next to any
+// CPU/memory limits, and lets the pod onto GPU nodes (any backend).
+func addGPUs(spec *corev1.PodSpec, gpus int, runtimeClass string) {
+	server := &spec.Containers[0]
+	if server.Resources.Limits == nil {
+		server.Resources.Limits = corev1.ResourceList{}
+	}
+	server.Resources.Limits["nvidia.com/gpu"] = *resource.NewQuantity(int64(gpus), resource.DecimalSI)
+
+	if runtimeClass != "" {
+		spec.RuntimeClassName = &runtimeClass
+	}
+	spec.Tolerations = append(spec.Tolerations, corev1.Toleration{
+		Key:      "nvidia.com/gpu",
+		Operator: corev1.TolerationOpExists,
+		Effect:   corev1.TaintEffectNoSchedule,
+	})
+}
 
 // ensureNamespace: create the Namespace if it doesn't exist.
 func ensureNamespace(ctx context.Context, cs *kubernetes.Clientset, ns string) error {
@@ -558,6 +8838,52 @@ func upsertConfigMap(ctx context.Context, cs *kubernetes.Clientset, cm *corev1.C
 	return err
 }
 
+// upsertSecret: create if missing, else replace the data.
+func upsertSecret(ctx context.Context, cs *kubernetes.Clientset, sec *corev1.Secret) error {
+	client := cs.CoreV1().Secrets(sec.Namespace)
+	existing, err := client.Get(ctx, sec.Name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(ctx, sec, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Data = nil
+	existing.StringData = sec.StringData
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// ensureAPIKeySecret stores key in the named Secret and returns it. An empty
+// key keeps the Secret's current one, so reruns don't lock clients out, or
+// generates a random one the first time.
+func ensureAPIKeySecret(ctx context.Context, cs *kubernetes.Clientset, ns, secretName, app, key string) (string, error) {
+	if key == "" {
+		existing, err := cs.CoreV1().Secrets(ns).Get(ctx, secretName, metav1.GetOptions{})
+		switch {
+		case err == nil && len(existing.Data["api-key"]) > 0:
+			return string(existing.Data["api-key"]), nil
+		case err != nil && !kerrors.IsNotFound(err):
+			return "", err
+		}
+		buf := make([]byte, 24)
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		key = hex.EncodeToString(buf)
+	}
+	return key, upsertSecret(ctx, cs, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: ns,
+			Labels:    map[string]string{"app": app},
+		},
+		Type:       corev1.SecretTypeOpaque,
+		StringData: map[string]string{"api-key": key},
+	})
+}
+
 // upsertPVC: create if missing, else update Requests/AccessModes.
 func upsertPVC(ctx context.Context, cs *kubernetes.Clientset, pvc *corev1.PersistentVolumeClaim) error {
 	client := cs.CoreV1().PersistentVolumeClaims(pvc.Namespace)
@@ -577,6 +8903,29 @@ func upsertPVC(ctx context.Context, cs *kubernetes.Clientset, pvc *corev1.Persis
 	return err
 }
 
+// ensureHostPathPV creates the PV if missing. Its source can't change, so
+// an existing one on another directory is an error; one released by a
+// deleted PVC is handed to the new one.
+func ensureHostPathPV(ctx context.Context, cs *kubernetes.Clientset, pv *corev1.PersistentVolume) error {
+	client := cs.CoreV1().PersistentVolumes()
+	existing, err := client.Get(ctx, pv.Name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(ctx, pv, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if existing.Spec.HostPath == nil || existing.Spec.HostPath.Path != pv.Spec.HostPath.Path {
+		return fmt.Errorf("PersistentVolume %s exists with another source; delete it to use %s", pv.Name, pv.Spec.HostPath.Path)
+	}
+	if existing.Status.Phase == corev1.VolumeReleased {
+		existing.Spec.ClaimRef = pv.Spec.ClaimRef
+		_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	}
+	return err
+}
+
 // upsertDeployment: create if missing, else replace the Spec.
 func upsertDeployment(ctx context.Context, cs *kubernetes.Clientset, d *appsv1.Deployment) error {
 	client := cs.AppsV1().Deployments(d.Namespace)
@@ -588,6 +8937,10 @@ func upsertDeployment(ctx context.Context, cs *kubernetes.Clientset, d *appsv1.D
 	if err != nil {
 		return err
 	}
+	if d.Spec.Replicas == nil {
+		// Scaled by an HPA: don't reset it to one replica on every run.
+		d.Spec.Replicas = existing.Spec.Replicas
+	}
 	existing.Spec = d.Spec
 	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
 	return err
@@ -608,6 +8961,12 @@ func upsertService(ctx context.Context, cs *kubernetes.Clientset, s *corev1.Serv
 	clusterIP := existing.Spec.ClusterIP
 	existing.Spec = s.Spec
 	existing.Spec.ClusterIP = clusterIP
+	if existing.Annotations == nil {
+		existing.Annotations = map[string]string{}
+	}
+	for k, v := range s.Annotations {
+		existing.Annotations[k] = v
+	}
 	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
 	return err
 }
@@ -627,6 +8986,12 @@ func upsertIngress(ctx context.Context, cs *kubernetes.Clientset, ing *netv1.Ing
 	if existing.Annotations == nil {
 		existing.Annotations = map[string]string{}
 	}
+	// Other annotations are merged, but a dropped --rate-limit must go.
+	for k := range existing.Annotations {
+		if _, keep := ing.Annotations[k]; strings.HasPrefix(k, rateLimitAnnotation) && !keep {
+			delete(existing.Annotations, k)
+		}
+	}
 	for k, v := range ing.Annotations {
 		existing.Annotations[k] = v
 	}
@@ -634,7 +8999,289 @@ func upsertIngress(ctx context.Context, cs *kubernetes.Clientset, ing *netv1.Ing
 	return err
 }
 
+// deleteIngress removes the Ingress when a Route serves the model instead.
+func deleteIngress(ctx context.Context, cs *kubernetes.Clientset, ns, name string) error {
+	err := cs.NetworkingV1().Ingresses(ns).Delete(ctx, name, metav1.DeleteOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+func upsertRoute(ctx context.Context, dyn dynamic.Interface, route *unstructured.Unstructured) error {
+	client := dyn.Resource(routeGVR).Namespace(route.GetNamespace())
+	existing, err := client.Get(ctx, route.GetName(), metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(ctx, route, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Object["spec"] = route.Object["spec"]
+	existing.SetAnnotations(route.GetAnnotations())
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+func upsertStatefulSet(ctx context.Context, cs *kubernetes.Clientset, s *appsv1.StatefulSet) error {
+	client := cs.AppsV1().StatefulSets(s.Namespace)
+	existing, err := client.Get(ctx, s.Name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(ctx, s, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	// The selector, serviceName and podManagementPolicy are immutable,
+	// but ours never change.
+	existing.Spec = s.Spec
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+func upsertNetworkPolicy(ctx context.Context, cs *kubernetes.Clientset, np *netv1.NetworkPolicy) error {
+	client := cs.NetworkingV1().NetworkPolicies(np.Namespace)
+	existing, err := client.Get(ctx, np.Name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(ctx, np, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Spec = np.Spec
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+func upsertServiceMonitor(ctx context.Context, dyn dynamic.Interface, sm *unstructured.Unstructured) error {
+	client := dyn.Resource(serviceMonitorGVR).Namespace(sm.GetNamespace())
+	existing, err := client.Get(ctx, sm.GetName(), metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(ctx, sm, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Object["spec"] = sm.Object["spec"]
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// deleteRoute removes a Route left over from a --tls run. Outside OpenShift
+// the resource doesn't exist at all, which is also fine.
+func deleteRoute(ctx context.Context, dyn dynamic.Interface, ns, name string) error {
+	err := dyn.Resource(routeGVR).Namespace(ns).Delete(ctx, name, metav1.DeleteOptions{})
+	if nothingToDelete(err) {
+		return nil
+	}
+	return err
+}
+
+func upsertHPA(ctx context.Context, cs *kubernetes.Clientset, hpa *autoscalingv2.HorizontalPodAutoscaler) error {
+	client := cs.AutoscalingV2().HorizontalPodAutoscalers(hpa.Namespace)
+	existing, err := client.Get(ctx, hpa.Name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(ctx, hpa, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Spec = hpa.Spec
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// upsertRole: create if missing, else replace its rules.
+func upsertRole(ctx context.Context, cs *kubernetes.Clientset, role *rbacv1.Role) error {
+	client := cs.RbacV1().Roles(role.Namespace)
+	existing, err := client.Get(ctx, role.Name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(ctx, role, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Rules = role.Rules
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// upsertRoleBinding: create if missing, else replace its subjects (the
+// role it refers to can't change).
+func upsertRoleBinding(ctx context.Context, cs *kubernetes.Clientset, rb *rbacv1.RoleBinding) error {
+	client := cs.RbacV1().RoleBindings(rb.Namespace)
+	existing, err := client.Get(ctx, rb.Name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(ctx, rb, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Subjects = rb.Subjects
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// upsertCronJob: create if missing, else update Spec.
+func upsertCronJob(ctx context.Context, cs *kubernetes.Clientset, cj *batchv1.CronJob) error {
+	client := cs.BatchV1().CronJobs(cj.Namespace)
+	existing, err := client.Get(ctx, cj.Name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(ctx, cj, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Spec = cj.Spec
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// deleteModelStack removes what applyModelStack created under name (the
+// canary's objects, including its PVC and, with --model-hostpath, its PV;
+// the files on the node stay). Objects that don't exist are fine.
+func deleteModelStack(ctx context.Context, cs *kubernetes.Clientset, dyn dynamic.Interface, ns, name string, opts serverOptions) error {
+	if err := deleteExposure(ctx, cs, dyn, ns, name); err != nil {
+		return err
+	}
+	deletes := []func() error{
+		func() error { return cs.AppsV1().Deployments(ns).Delete(ctx, name, metav1.DeleteOptions{}) },
+		func() error { return cs.CoreV1().ConfigMaps(ns).Delete(ctx, name+"-config", metav1.DeleteOptions{}) },
+		func() error {
+			return cs.CoreV1().PersistentVolumeClaims(ns).Delete(ctx, name+"-models-pvc", metav1.DeleteOptions{})
+		},
+		func() error {
+			if opts.ModelHostPath == "" {
+				return nil
+			}
+			return cs.CoreV1().PersistentVolumes().Delete(ctx, hostPathPVName(ns, name), metav1.DeleteOptions{})
+		},
+		func() error { return deleteHPA(ctx, cs, ns, name) },
+		func() error { return deleteKEDAScaler(ctx, dyn, ns, name, "prometheus") },
+		func() error { return deleteIntegrityCheck(ctx, cs, ns, name) },
+		func() error { return deleteRPCWorkers(ctx, cs, ns, name) },
+		func() error {
+			return dyn.Resource(podMonitorGVR).Namespace(ns).Delete(ctx, name, metav1.DeleteOptions{})
+		},
+		func() error {
+			return cs.CoreV1().ConfigMaps(opts.DashboardNS).Delete(ctx, name+"-dashboard", metav1.DeleteOptions{})
+		},
+	}
+	for _, del := range deletes {
+		if err := del(); err != nil && !kerrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteExposure removes the Service, ServiceMonitor and Ingress or Route
+// named name, leaving its Deployment running (swap's temporary Service).
+func deleteExposure(ctx context.Context, cs *kubernetes.Clientset, dyn dynamic.Interface, ns, name string) error {
+	deletes := []func() error{
+		func() error { return cs.CoreV1().Services(ns).Delete(ctx, name, metav1.DeleteOptions{}) },
+		func() error {
+			return dyn.Resource(serviceMonitorGVR).Namespace(ns).Delete(ctx, name, metav1.DeleteOptions{})
+		},
+		func() error { return deleteIngress(ctx, cs, ns, name) },
+		func() error { return deleteRoute(ctx, dyn, ns, name) },
+	}
+	for _, del := range deletes {
+		if err := del(); err != nil && !kerrors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteHPA removes a model's HPA left over from a run with --hpa-max.
+func deleteHPA(ctx context.Context, cs *kubernetes.Clientset, ns, name string) error {
+	err := cs.AutoscalingV2().HorizontalPodAutoscalers(ns).Delete(ctx, name, metav1.DeleteOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// jobLog runs job (see runJob) and returns the log of container in the pod
+// that succeeded.
+func jobLog(ctx context.Context, cs *kubernetes.Clientset, job *batchv1.Job, container string) ([]byte, error) {
+	if err := runJob(ctx, cs, job); err != nil {
+		return nil, err
+	}
+	pods, err := cs.CoreV1().Pods(job.Namespace).List(ctx, metav1.ListOptions{LabelSelector: "job-name=" + job.Name})
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == corev1.PodSucceeded {
+			return cs.CoreV1().Pods(job.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{Container: container}).DoRaw(ctx)
+		}
+	}
+	return nil, fmt.Errorf("no finished pod for job %s", job.Name)
+}
+
+// runJob: (re)create a Job and wait for it to succeed. Jobs are immutable, so
+// an old one with the same name is deleted first, along with its pods.
+func runJob(ctx context.Context, cs *kubernetes.Clientset, job *batchv1.Job) error {
+	client := cs.BatchV1().Jobs(job.Namespace)
+	propagation := metav1.DeletePropagationForeground
+	err := client.Delete(ctx, job.Name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil && !kerrors.IsNotFound(err) {
+		return err
+	}
+	// Foreground deletion keeps the Job around until its pods are gone.
+	err = waitutil.PollImmediateUntilWithContext(ctx, 2*time.Second, func(ctx context.Context) (bool, error) {
+		_, err := client.Get(ctx, job.Name, metav1.GetOptions{})
+		return kerrors.IsNotFound(err), nil
+	})
+	if err != nil {
+		return fmt.Errorf("old job %s not deleted: %w", job.Name, err)
+	}
+	if _, err := client.Create(ctx, job, metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	return waitutil.PollImmediateUntilWithContext(ctx, 3*time.Second, func(ctx context.Context) (bool, error) {
+		j, err := client.Get(ctx, job.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		for _, c := range j.Status.Conditions {
+			if c.Type == batchv1.JobFailed && c.Status == corev1.ConditionTrue {
+				return false, fmt.Errorf("job %s failed: %s (see: oc logs job/%s -n %s)", job.Name, c.Message, job.Name, job.Namespace)
+			}
+		}
+		return j.Status.Succeeded > 0, nil
+	})
+}
+
 // waitForDeploymentReady: poll until ReadyReplicas >= 1 or context times out.
+// waitForRollout waits until every replica runs the Deployment's current
+// template and the old ones are gone.
+func waitForRollout(ctx context.Context, cs *kubernetes.Clientset, ns, name string) error {
+	return waitutil.PollImmediateUntilWithContext(ctx, 3*time.Second, func(ctx context.Context) (bool, error) {
+		d, err := cs.AppsV1().Deployments(ns).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		want := int32(1)
+		if d.Spec.Replicas != nil {
+			want = *d.Spec.Replicas
+		}
+		s := d.Status
+		return s.ObservedGeneration >= d.Generation && s.UpdatedReplicas == want &&
+			s.Replicas == want && s.AvailableReplicas == want, nil
+	})
+}
+
 func waitForDeploymentReady(ctx context.Context, cs *kubernetes.Clientset, ns, name string) error {
 	return waitutil.PollImmediateUntilWithContext(ctx, 3*time.Second, func(ctx context.Context) (bool, error) {
 		d, err := cs.AppsV1().Deployments(ns).Get(ctx, name, metav1.GetOptions{})
@@ -673,4 +9320,3 @@ func fatal(msg string, args ...any) {
 	fmt.Fprintf(os.Stderr, "ERROR: "+msg+"\n", args...)
 	os.Exit(1)
 }
-
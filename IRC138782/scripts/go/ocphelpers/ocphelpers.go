@@ -0,0 +1,221 @@
+// --------------------------------------------------------------
+// ocphelpers.go
+//
+// OpenShift helpers shared by the setup programs next to this
+// directory (chat, llamacpp), which pull it in with a replace
+// directive in their go.mod:
+//   - BuildImage: a Docker-strategy build into the namespace's
+//     ImageStream (the equivalent of "oc new-build" plus "oc
+//     start-build"), reusing the tag when it was built before.
+//   - ForwardService: a Service's port on a local address, relayed
+//     through the API server's service proxy (not a pod port-forward).
+// --------------------------------------------------------------
+
+package ocphelpers
+
+// Standard library imports.
+import (
+	"context"           // Propagates timeouts/cancellation through API calls
+	"fmt"               // Printing/logging
+	"net"               // Listening on a local port for ForwardService
+	"net/http"          // Serving the proxied Service
+	"net/http/httputil" // ReverseProxy to the API server's service proxy
+	"net/url"           // Parsing the API server's address
+	"strings"           // Trimming paths, lower-casing build phases
+	"time"              // Polling interval for builds
+)
+
+// Kubernetes helper packages and client-go.
+import (
+	kerrors "k8s.io/apimachinery/pkg/api/errors"        // For IsNotFound checks
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"       // Object metadata types
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured" // The build API's objects
+	"k8s.io/apimachinery/pkg/runtime/schema"            // GroupVersionResource
+	"k8s.io/client-go/dynamic"                          // Client for the build and image APIs
+	"k8s.io/client-go/rest"                             // Transport to the API server
+)
+
+// -----------------------------
+// Image builds
+// -----------------------------
+
+// The OpenShift image and build APIs (not in client-go's typed clients).
+var (
+	ImageStreamGVR    = schema.GroupVersionResource{Group: "image.openshift.io", Version: "v1", Resource: "imagestreams"}
+	ImageStreamTagGVR = schema.GroupVersionResource{Group: "image.openshift.io", Version: "v1", Resource: "imagestreamtags"}
+	BuildConfigGVR    = schema.GroupVersionResource{Group: "build.openshift.io", Version: "v1", Resource: "buildconfigs"}
+	BuildGVR          = schema.GroupVersionResource{Group: "build.openshift.io", Version: "v1", Resource: "builds"}
+)
+
+// ImageBuild is one image BuildImage makes: a BuildConfig with the
+// Docker strategy, pushing to an ImageStream of the same name.
+type ImageBuild struct {
+	Name     string                 // ImageStream and BuildConfig
+	Tag      string                 // ImageStreamTag to push; an existing one is reused
+	What     string                 // What is being built, for the progress lines
+	Labels   map[string]string      // On the ImageStream and BuildConfig
+	Source   map[string]interface{} // The BuildConfig's spec.source
+	Strategy map[string]interface{} // Its spec.strategy.dockerStrategy (nil for none)
+}
+
+// BuildImage makes sure b.Name:b.Tag exists in the namespace's
+// ImageStream, running the BuildConfig and waiting for it when it
+// doesn't, and returns the image's digest reference in the internal
+// registry (so a rebuild rolls the Deployments using it).
+func BuildImage(ctx context.Context, dyn dynamic.Interface, ns string, b ImageBuild) (string, error) {
+	nameTag := b.Name + ":" + b.Tag
+	if ref, err := ImageStreamTagRef(ctx, dyn, ns, nameTag); err != nil || ref != "" {
+		if ref != "" {
+			fmt.Printf("Image %s already built; reusing it.\n", nameTag)
+		}
+		return ref, err
+	}
+
+	fmt.Printf("Creating/updating ImageStream and BuildConfig %s...\n", b.Name)
+	labels := map[string]interface{}{}
+	for k, v := range b.Labels {
+		labels[k] = v
+	}
+	is := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "image.openshift.io/v1",
+		"kind":       "ImageStream",
+		"metadata":   map[string]interface{}{"name": b.Name, "namespace": ns, "labels": labels},
+		"spec":       map[string]interface{}{"lookupPolicy": map[string]interface{}{"local": true}},
+	}}
+	if err := UpsertCustomObject(ctx, dyn, ImageStreamGVR, is); err != nil {
+		return "", fmt.Errorf("ImageStream: %w", err)
+	}
+	strategy := b.Strategy
+	if strategy == nil {
+		strategy = map[string]interface{}{}
+	}
+	bc := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "build.openshift.io/v1",
+		"kind":       "BuildConfig",
+		"metadata":   map[string]interface{}{"name": b.Name, "namespace": ns, "labels": labels},
+		"spec": map[string]interface{}{
+			"runPolicy": "Serial",
+			"source":    b.Source,
+			"strategy":  map[string]interface{}{"type": "Docker", "dockerStrategy": strategy},
+			"output": map[string]interface{}{
+				"to": map[string]interface{}{"kind": "ImageStreamTag", "name": nameTag},
+			},
+			// Started by BuildImage only.
+			"triggers": []interface{}{},
+		},
+	}}
+	if err := UpsertCustomObject(ctx, dyn, BuildConfigGVR, bc); err != nil {
+		return "", fmt.Errorf("BuildConfig: %w", err)
+	}
+
+	// The equivalent of "oc start-build".
+	req := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "build.openshift.io/v1",
+		"kind":       "BuildRequest",
+		"metadata":   map[string]interface{}{"name": b.Name},
+	}}
+	build, err := dyn.Resource(BuildConfigGVR).Namespace(ns).Create(ctx, req, metav1.CreateOptions{}, "instantiate")
+	if err != nil {
+		return "", fmt.Errorf("start build: %w", err)
+	}
+	fmt.Printf("Building %s (%s); follow it with: oc logs -f build/%s -n %s\n", b.What, nameTag, build.GetName(), ns)
+	lastPhase := ""
+	for {
+		build, err = dyn.Resource(BuildGVR).Namespace(ns).Get(ctx, build.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return "", err
+		}
+		phase, _, _ := unstructured.NestedString(build.Object, "status", "phase")
+		if phase != lastPhase {
+			fmt.Printf("Build %s: %s\n", build.GetName(), phase)
+			lastPhase = phase
+		}
+		switch phase {
+		case "Complete":
+			ref, err := ImageStreamTagRef(ctx, dyn, ns, nameTag)
+			if err == nil && ref == "" {
+				err = fmt.Errorf("build %s pushed no %s", build.GetName(), nameTag)
+			}
+			return ref, err
+		case "Failed", "Error", "Cancelled":
+			msg, _, _ := unstructured.NestedString(build.Object, "status", "message")
+			return "", fmt.Errorf("build %s %s: %s (see: oc logs build/%s -n %s)", build.GetName(), strings.ToLower(phase), msg, build.GetName(), ns)
+		}
+		select {
+		case <-ctx.Done():
+			return "", fmt.Errorf("build %s still %s: %w (raise --timeout; it keeps running)", build.GetName(), phase, ctx.Err())
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// ImageStreamTagRef returns the image behind an ImageStreamTag ("" when
+// it doesn't exist yet).
+func ImageStreamTagRef(ctx context.Context, dyn dynamic.Interface, ns, nameTag string) (string, error) {
+	ist, err := dyn.Resource(ImageStreamTagGVR).Namespace(ns).Get(ctx, nameTag, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	ref, _, _ := unstructured.NestedString(ist.Object, "image", "dockerImageReference")
+	return ref, nil
+}
+
+// UpsertCustomObject creates obj, or replaces the spec of the existing
+// one (metadata and status are left alone).
+func UpsertCustomObject(ctx context.Context, dyn dynamic.Interface, gvr schema.GroupVersionResource, obj *unstructured.Unstructured) error {
+	client := dyn.Resource(gvr).Namespace(obj.GetNamespace())
+	existing, err := client.Get(ctx, obj.GetName(), metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		_, err = client.Create(ctx, obj, metav1.CreateOptions{})
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	existing.Object["spec"] = obj.Object["spec"]
+	_, err = client.Update(ctx, existing, metav1.UpdateOptions{})
+	return err
+}
+
+// -----------------------------
+// Service proxy
+// -----------------------------
+
+// ForwardService serves a Service's port (by name) on a local address
+// and returns its base URL. Requests are relayed through the API server's
+// service proxy (.../services/<name>:<port>/proxy), so unlike a pod
+// port-forward it needs no SPDY and goes through the Service; WebSocket
+// upgrades pass through too. It lasts until the program exits.
+func ForwardService(cfg *rest.Config, ns, name, port string) (string, error) {
+	rt, err := rest.TransportFor(cfg)
+	if err != nil {
+		return "", err
+	}
+	apiServer, err := url.Parse(cfg.Host)
+	if err != nil {
+		return "", err
+	}
+	prefix := strings.TrimSuffix(apiServer.Path, "/") + fmt.Sprintf("/api/v1/namespaces/%s/services/%s:%s/proxy", ns, name, port)
+	proxy := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme, r.URL.Host = apiServer.Scheme, apiServer.Host
+			r.URL.Path = prefix + r.URL.Path
+			r.URL.RawPath = ""
+			r.Host = apiServer.Host
+		},
+		Transport: rt,
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		if err := http.Serve(ln, proxy); err != nil {
+			fmt.Printf("Warning: local proxy to service %s/%s stopped: %v\n", ns, name, err)
+		}
+	}()
+	return "http://" + ln.Addr().String(), nil
+}